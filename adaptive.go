@@ -0,0 +1,110 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// adaptiveStart is the number of goroutines adaptive downloads start with.
+	adaptiveStart = 2
+	// adaptiveInterval is how often the number of goroutines is adjusted.
+	adaptiveInterval = time.Second
+	// adaptiveChunks is how many chunks per goroutine adaptive downloads are split in,
+	// unless a chunk size is set.
+	adaptiveChunks = 4
+	// minAdaptiveChunkSize is the smallest chunk adaptive downloads are split in.
+	minAdaptiveChunkSize = 256 << 10
+)
+
+// workerLimit bounds the number of goroutines downloading chunks at once. The bound can be
+// changed while they run, goroutines over it stop once done with their current chunk.
+type workerLimit struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	active int
+}
+
+func newWorkerLimit(limit int) *workerLimit {
+	l := &workerLimit{limit: limit}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// acquire waits until the goroutine is allowed to download a chunk.
+func (l *workerLimit) acquire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.active >= l.limit {
+		l.cond.Wait()
+	}
+	l.active++
+}
+
+// release lets another goroutine download a chunk.
+func (l *workerLimit) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	l.cond.Broadcast()
+}
+
+// get returns the current bound.
+func (l *workerLimit) get() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// set changes the bound.
+func (l *workerLimit) set(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+	l.cond.Broadcast()
+}
+
+// adaptConcurrency adjusts the number of goroutines downloading chunks, up to max, based on the
+// throughput measured while the download goes on, until the context is done.
+func (d *download) adaptConcurrency(ctx context.Context, limit *workerLimit, max int) {
+	ticker := time.NewTicker(adaptiveInterval)
+	defer ticker.Stop()
+
+	last := atomic.LoadInt64(&d.transferred)
+	var lastRate float64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			current := atomic.LoadInt64(&d.transferred)
+			rate := float64(current-last) / adaptiveInterval.Seconds()
+			last = current
+
+			limit.set(nextConcurrency(limit.get(), max, rate, lastRate))
+			lastRate = rate
+		}
+	}
+}
+
+// nextConcurrency returns how many goroutines should download chunks, given how many do now
+// and the current and previous throughput. Connections are added as long as they make the
+// download notably faster, and removed when it gets notably slower, like when the server
+// starts throttling us.
+func nextConcurrency(current, max int, rate, lastRate float64) int {
+	switch {
+	case rate > lastRate*1.1 && current < max:
+		return current + 1
+	case rate < lastRate*0.9 && current > 1:
+		return current - 1
+	default:
+		return current
+	}
+}
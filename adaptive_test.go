@@ -0,0 +1,60 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestNextConcurrency(t *testing.T) {
+	tests := []struct {
+		current, max   int
+		rate, lastRate float64
+		expected       int
+	}{
+		{2, 8, 100, 0, 3},
+		{3, 8, 200, 100, 4},
+		{4, 8, 205, 200, 4},
+		{4, 8, 100, 200, 3},
+		{8, 8, 400, 200, 8},
+		{1, 8, 10, 200, 1},
+	}
+
+	for _, tt := range tests {
+		assert.Equals(t, tt.expected, nextConcurrency(tt.current, tt.max, tt.rate, tt.lastRate))
+	}
+}
+
+func TestWithAdaptiveConcurrency(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "./fixtures/test")
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "adaptive")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	gf := New(WithDestDir(destDir), WithConcurrency(8), WithAdaptiveConcurrency())
+	assert.Equals(t, 32, len(gf.planChunks(10485760, 8)))
+
+	file, err := gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	defer file.Close()
+
+	hasher := sha512.New()
+	_, err = io.Copy(hasher, file)
+	assert.Ok(t, err)
+	assert.Equals(t, "4ff6e159db38d46a665f26e9f82b98134238c0457cc82727a5258b7184773e4967068cc0eecf3928ecd079f3aea6e22aac024847c6d76c0329c4635c4b6ae327", fmt.Sprintf("%x", hasher.Sum(nil)))
+}
@@ -0,0 +1,163 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// azureAPIVersion is the version of the Blob service REST API requests are sent for.
+const azureAPIVersion = "2021-08-06"
+
+// AzureBlobHandler fetches blobs from Azure Blob Storage through azblob://container/blob URLs.
+// Requests are authorized with a shared access signature (SAS) token, taken from the query of
+// the URL, SASToken or AZURE_STORAGE_SAS_TOKEN, in that order, and sent anonymously, for public
+// containers, if there is none. Blobs are read in byte ranges, so downloads are resumed and
+// split in chunks, resumed chunks being requested only if the ETag of the blob did not change.
+// The MD5 digest of blobs, when set, is verified when WithServerChecksums is set. It is
+// registered for the azblob scheme by default.
+type AzureBlobHandler struct {
+	// Account is the storage account of the blobs. It is taken from AZURE_STORAGE_ACCOUNT if
+	// empty, and ignored if Endpoint is set.
+	Account string
+	// Endpoint is the URL of the Blob service, like the one of Azurite. It is
+	// https://<account>.blob.core.windows.net if empty.
+	Endpoint string
+	// SASToken is the shared access signature to authorize requests with.
+	SASToken string
+	// Client sends the requests. The client of the fetcher is used if nil, with its TLS
+	// settings, proxy and timeouts, or http.DefaultClient outside a fetcher.
+	Client *http.Client
+}
+
+func (h *AzureBlobHandler) Stat(ctx context.Context, rawURL string) (*ContentInfo, error) {
+	res, err := h.send(ctx, "HEAD", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, &statusError{code: res.StatusCode, status: res.Status}
+	}
+
+	info := &ContentInfo{
+		Size:   res.ContentLength,
+		Ranges: true,
+		ETag:   res.Header.Get("ETag"),
+	}
+	if modTime, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = modTime
+	}
+	for _, c := range serverChecksums(res.Header) {
+		if info.Checksums == nil {
+			info.Checksums = make(map[string]string)
+		}
+		info.Checksums[c.algorithm] = c.value
+	}
+	return info, nil
+}
+
+func (h *AzureBlobHandler) Open(ctx context.Context, rawURL string, offset, length int64) (io.ReadCloser, error) {
+	return h.OpenIfMatch(ctx, rawURL, offset, length, "")
+}
+
+func (h *AzureBlobHandler) OpenIfMatch(ctx context.Context, rawURL string, offset, length int64, etag string) (io.ReadCloser, error) {
+	header := http.Header{}
+	if rng := rangeHeader(offset, length); rng != "" {
+		header.Set("Range", rng)
+	}
+	if etag != "" {
+		header.Set("If-Match", etag)
+	}
+
+	res, err := h.send(ctx, "GET", rawURL, header)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case res.StatusCode == http.StatusPreconditionFailed:
+		res.Body.Close()
+		return nil, ErrContentChanged
+	// Servers may send the whole content when asked for a range of it from its beginning.
+	case res.StatusCode != http.StatusPartialContent && (offset > 0 || res.StatusCode != http.StatusOK):
+		res.Body.Close()
+		return nil, &statusError{code: res.StatusCode, status: res.Status}
+	}
+	return res.Body, nil
+}
+
+// send sends a request for the blob of the given URL.
+func (h *AzureBlobHandler) send(ctx context.Context, method, rawURL string, header http.Header) (*http.Response, error) {
+	blobURL, err := h.blobURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, blobURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("X-Ms-Version", azureAPIVersion)
+	req.Header.Set("X-Ms-Date", time.Now().UTC().Format(http.TimeFormat))
+
+	client := h.Client
+	if client == nil {
+		client = httpClientFrom(ctx)
+	}
+	return client.Do(req)
+}
+
+// blobURL returns the HTTPS URL of the blob of the given azblob:// URL, carrying its SAS token.
+func (h *AzureBlobHandler) blobURL(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	container, blob := u.Host, strings.TrimPrefix(u.Path, "/")
+	if container == "" || blob == "" {
+		return "", fmt.Errorf("invalid Azure Blob Storage URL, expected azblob://container/blob: %s", rawURL)
+	}
+
+	endpoint := h.Endpoint
+	if endpoint == "" {
+		account := h.Account
+		if account == "" {
+			account = os.Getenv("AZURE_STORAGE_ACCOUNT")
+		}
+		if account == "" {
+			return "", fmt.Errorf("unknown storage account of %s, set AZURE_STORAGE_ACCOUNT", rawURL)
+		}
+		endpoint = "https://" + account + ".blob.core.windows.net"
+	}
+
+	blobURL, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil {
+		return "", err
+	}
+	blobURL.Path += "/" + container + "/" + blob
+
+	sas := u.RawQuery
+	if sas == "" {
+		sas = h.SASToken
+	}
+	if sas == "" {
+		sas = os.Getenv("AZURE_STORAGE_SAS_TOKEN")
+	}
+	blobURL.RawQuery = strings.TrimPrefix(sas, "?")
+	return blobURL.String(), nil
+}
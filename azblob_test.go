@@ -0,0 +1,106 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+// newAzureServer serves the given blob as images/dir/disk.vhd of the account devstoreaccount1,
+// like Azurite, requiring the SAS token sig=secret and sending md5 as its Content-MD5.
+func newAzureServer(t *testing.T, data, md5 []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("sig") != "secret" || r.Header.Get("X-Ms-Version") == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Path != "/devstoreaccount1/images/dir/disk.vhd" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if match := r.Header.Get("If-Match"); match != "" && match != `"0x8D9"` {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		w.Header().Set("ETag", `"0x8D9"`)
+		if r.Method == "HEAD" {
+			w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(md5))
+		}
+		http.ServeContent(w, r, "", time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), bytes.NewReader(data))
+	}))
+}
+
+func TestAzureBlob(t *testing.T) {
+	destDir, err := ioutil.TempDir(os.TempDir(), "azblob")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64<<10)
+	sum := md5.Sum(data)
+	server := newAzureServer(t, data, sum[:])
+	defer server.Close()
+
+	handler := &AzureBlobHandler{Endpoint: server.URL + "/devstoreaccount1", SASToken: "?sv=2021-08-06&sig=secret"}
+	RegisterScheme("azblob", handler)
+	defer RegisterScheme("azblob", &AzureBlobHandler{})
+
+	var hooked int32
+	hook := func(r *http.Request) error {
+		atomic.AddInt32(&hooked, 1)
+		return nil
+	}
+	gf := New(WithDestDir(destDir), WithConcurrency(4), WithServerChecksums(), WithRequestHook(hook))
+	file, err := gf.Fetch("azblob://images/dir/disk.vhd", nil)
+	assert.Ok(t, err)
+	defer file.Close()
+	assert.Cond(t, atomic.LoadInt32(&hooked) > 0, "requests should go through the client of the fetcher")
+
+	got, err := ioutil.ReadAll(file)
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(data, got), "downloaded blob does not match")
+
+	// Resumed chunks are only read if the blob did not change.
+	_, err = handler.OpenIfMatch(context.Background(), "azblob://images/dir/disk.vhd", 10, -1, `"0x1"`)
+	assert.Equals(t, ErrContentChanged, err)
+
+	// SAS tokens in URLs take precedence.
+	_, err = handler.Stat(context.Background(), "azblob://images/dir/disk.vhd?sig=wrong")
+	assert.Cond(t, err != nil, "wrong SAS token should be rejected")
+
+	// Blobs not matching their MD5 digest are rejected.
+	corrupt := newAzureServer(t, data, make([]byte, md5.Size))
+	defer corrupt.Close()
+	RegisterScheme("azblob", &AzureBlobHandler{Endpoint: corrupt.URL + "/devstoreaccount1"})
+	_, err = New(WithDestDir(filepath.Join(destDir, "corrupt")), WithServerChecksums()).
+		Fetch("azblob://images/dir/disk.vhd?sig=secret", nil)
+	assert.Cond(t, err != nil, "blob not matching its MD5 digest should be rejected")
+}
+
+func TestAzureBlobURL(t *testing.T) {
+	t.Setenv("AZURE_STORAGE_ACCOUNT", "")
+	t.Setenv("AZURE_STORAGE_SAS_TOKEN", "")
+
+	_, err := (&AzureBlobHandler{}).blobURL("azblob://images/disk.vhd")
+	assert.Cond(t, err != nil, "blobs without storage account should be rejected")
+
+	t.Setenv("AZURE_STORAGE_ACCOUNT", "deploys")
+	t.Setenv("AZURE_STORAGE_SAS_TOKEN", "sv=2021-08-06&sig=abc")
+	blobURL, err := (&AzureBlobHandler{}).blobURL("azblob://images/2020 builds/disk.vhd")
+	assert.Ok(t, err)
+	assert.Equals(t, "https://deploys.blob.core.windows.net/images/2020%20builds/disk.vhd?sv=2021-08-06&sig=abc", blobURL)
+}
@@ -0,0 +1,36 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"io"
+	"sync"
+)
+
+// defaultBufferSize is the size of the buffers used to copy downloaded data, same as io.Copy's.
+const defaultBufferSize = 32 << 10
+
+// bufferPool reuses the buffers data is copied through, so goroutines downloading
+// chunks do not allocate a new one for each request.
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	p := &bufferPool{size: size}
+	p.pool.New = func() interface{} {
+		b := make([]byte, p.size)
+		return &b
+	}
+	return p
+}
+
+// copy copies from src to dst until EOF or an error, through a buffer of the pool.
+func (p *bufferPool) copy(dst io.Writer, src io.Reader) (int64, error) {
+	b := p.pool.Get().(*[]byte)
+	defer p.pool.Put(b)
+	return io.CopyBuffer(dst, src, *b)
+}
@@ -0,0 +1,60 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+// chunkedWriter records the size of each write it gets.
+type chunkedWriter struct {
+	buf    bytes.Buffer
+	writes []int
+}
+
+func (w *chunkedWriter) Write(b []byte) (int, error) {
+	w.writes = append(w.writes, len(b))
+	return w.buf.Write(b)
+}
+
+func TestBufferPool(t *testing.T) {
+	p := newBufferPool(4)
+	var w chunkedWriter
+	// Hides strings.Reader's WriteTo, so the buffer is used.
+	n, err := p.copy(&w, struct{ io.Reader }{strings.NewReader("0123456789")})
+	assert.Ok(t, err)
+	assert.Equals(t, int64(10), n)
+	assert.Equals(t, "0123456789", w.buf.String())
+	assert.Equals(t, []int{4, 4, 2}, w.writes)
+}
+
+func TestWithBufferSize(t *testing.T) {
+	ts := httptest.NewServer(http.FileServer(http.Dir("./fixtures")))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "buffer-size")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	gf := New(WithDestDir(destDir), WithConcurrency(4), WithBufferSize(1<<20))
+	assert.Equals(t, 1<<20, gf.buffers.size)
+
+	f, err := gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	defer f.Close()
+
+	fi, err := f.Stat()
+	assert.Ok(t, err)
+	assert.Equals(t, int64(10485760), fi.Size())
+}
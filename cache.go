@@ -0,0 +1,138 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cache stores what gofetch knows about downloaded URLs, to avoid downloading files again if they
+// did not change, and the content of files when the content-addressable cache is enabled. By default,
+// it is kept on disk, in ~/.gofetch, but it can be backed by anything else, like Redis or an object
+// store, to be shared by a fleet of machines. See WithCacheBackend. Implementations must be safe
+// for concurrent use.
+type Cache interface {
+	// Get returns the metadata of the given URL, or nil if there is none.
+	Get(url string) (*CacheEntry, error)
+	// Put stores the metadata of a URL, replacing any previous one.
+	Put(e *CacheEntry) error
+	// Delete removes a URL from the cache, along with its content if it is stored.
+	Delete(url string) error
+	// List returns the metadata of all the URLs in the cache.
+	List() ([]*CacheEntry, error)
+	// Clear removes everything from the cache.
+	Clear() error
+	// Usage reports the current size of the cache.
+	Usage() (CacheUsage, error)
+
+	// Stat reports whether the cache holds the content with the given digest, computed using
+	// the given hashing algorithm.
+	Stat(algorithm, sum string) (bool, error)
+	// Load writes the content with the given digest to the file at path, replacing it.
+	Load(algorithm, sum, path string) error
+	// Store adds the content of the file at path to the cache, given its digests keyed by
+	// hashing algorithm. They always include its SHA-256 digest.
+	Store(path string, digests map[string]string) error
+}
+
+// NotCachedError is returned in offline mode, when the requested file is not in the cache.
+type NotCachedError struct {
+	URL string
+}
+
+func (e *NotCachedError) Error() string {
+	return fmt.Sprintf("%s is not cached and gofetch is offline", e.URL)
+}
+
+// CacheValidation tells how files on disk are validated before being reused.
+type CacheValidation int
+
+const (
+	// CacheValidationNone only checks that files still have the size they had once downloaded. This is the default.
+	CacheValidationNone CacheValidation = iota
+	// CacheValidationQuick also checks that files were not modified since they were downloaded,
+	// using their modification time.
+	CacheValidationQuick
+	// CacheValidationFull hashes files to check that their content did not change since they were downloaded.
+	CacheValidationFull
+)
+
+// validCached tells whether a file on disk is still the one described by its cache entry.
+func (gf *Fetcher) validCached(path string, fi os.FileInfo, e *CacheEntry) bool {
+	switch gf.cacheValidation {
+	case CacheValidationQuick:
+		return fi.ModTime().Equal(e.ModTime)
+	case CacheValidationFull:
+		if len(e.Digests) == 0 {
+			return false
+		}
+
+		var checksums []checksum
+		for algorithm, value := range e.Digests {
+			checksums = append(checksums, checksum{algorithm: algorithm, value: value})
+		}
+		v, err := newVerifier(checksums)
+		if err != nil {
+			return false
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return false
+		}
+		defer file.Close()
+
+		if _, err := io.Copy(v, file); err != nil {
+			return false
+		}
+		return v.verify() == nil
+	default:
+		return true
+	}
+}
+
+// freshUntil returns the time until which a response received at the given time is fresh,
+// according to its Cache-Control and Expires headers. It returns the zero time if the
+// response must be revalidated before being used again.
+func freshUntil(header http.Header, received time.Time) time.Time {
+	var maxAge = -1
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			switch {
+			case directive == "no-cache", directive == "no-store":
+				return time.Time{}
+			case strings.HasPrefix(directive, "max-age="):
+				if n, err := strconv.Atoi(strings.Trim(directive[len("max-age="):], `"`)); err == nil {
+					maxAge = n
+				}
+			}
+		}
+	}
+
+	if maxAge >= 0 {
+		// Age tells how long the response was stored by caches before reaching us.
+		age, _ := strconv.Atoi(header.Get("Age"))
+		return received.Add(time.Duration(maxAge-age) * time.Second)
+	}
+
+	expires, err := http.ParseTime(header.Get("Expires"))
+	if err != nil {
+		// Invalid dates, like "0", mean the response already expired.
+		return time.Time{}
+	}
+
+	// Expires is relative to the server clock, which may differ from ours.
+	if date, err := http.ParseTime(header.Get("Date")); err == nil {
+		return received.Add(expires.Sub(date))
+	}
+	return expires
+}
@@ -0,0 +1,317 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+	"github.com/pkg/errors"
+)
+
+func TestFreshUntil(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	date := now.Add(-time.Hour).Format(http.TimeFormat)
+
+	tests := []struct {
+		header http.Header
+		fresh  time.Duration
+	}{
+		{http.Header{"Cache-Control": {"public, max-age=60"}}, time.Minute},
+		{http.Header{"Cache-Control": {"max-age=60"}, "Age": {"20"}}, 40 * time.Second},
+		{http.Header{"Cache-Control": {"max-age=60, no-cache"}}, 0},
+		{http.Header{"Cache-Control": {"no-store"}, "Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, 0},
+		{http.Header{"Date": {date}, "Expires": {now.Format(http.TimeFormat)}}, time.Hour},
+		{http.Header{"Expires": {"0"}}, 0},
+		{http.Header{}, 0},
+	}
+
+	for _, tt := range tests {
+		until := freshUntil(tt.header, now)
+		if tt.fresh == 0 {
+			assert.Cond(t, !now.Before(until), "%v should not be fresh", tt.header)
+			continue
+		}
+		assert.Equals(t, now.Add(tt.fresh), until)
+	}
+}
+
+func TestWithCache(t *testing.T) {
+	requests := 0
+	cacheControl := "max-age=3600"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Cache-Control", cacheControl)
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeFile(w, r, "./fixtures/test")
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "cache")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	storeDir, err := ioutil.TempDir(os.TempDir(), "cache-work")
+	assert.Ok(t, err)
+	defer os.RemoveAll(storeDir)
+
+	gf := New(WithDestDir(destDir), WithCache())
+	gf.store = &diskCache{dir: storeDir}
+
+	f, err := gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	f.Close()
+
+	// The file is fresh, the server is not contacted.
+	requests = 0
+	f, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	f.Close()
+	assert.Equals(t, 0, requests)
+
+	// Once stale, the file is revalidated.
+	meta := getEntry(t, gf.store, ts.URL+"/test")
+	meta.Expires = time.Now().Add(-time.Second)
+	assert.Ok(t, gf.store.Put(meta))
+	cacheControl = "no-cache"
+	f, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	f.Close()
+	assert.Equals(t, 1, requests)
+
+	// Responses with no-cache are always revalidated.
+	f, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	f.Close()
+	assert.Equals(t, 2, requests)
+}
+
+func TestWithCacheValidation(t *testing.T) {
+	expected, err := ioutil.ReadFile("./fixtures/test")
+	assert.Ok(t, err)
+
+	for _, v := range []CacheValidation{CacheValidationQuick, CacheValidationFull} {
+		requests := 0
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.Header().Set("Cache-Control", "max-age=3600")
+			w.Header().Set("ETag", `"v1"`)
+			http.ServeFile(w, r, "./fixtures/test")
+		}))
+
+		destDir, err := ioutil.TempDir(os.TempDir(), "cache-validation")
+		assert.Ok(t, err)
+		storeDir, err := ioutil.TempDir(os.TempDir(), "cache-validation-work")
+		assert.Ok(t, err)
+
+		gf := New(WithDestDir(destDir), WithCache(), WithCacheValidation(v))
+		gf.store = &diskCache{dir: storeDir}
+
+		f, err := gf.Fetch(ts.URL+"/test", nil)
+		assert.Ok(t, err)
+		f.Close()
+
+		// An intact file is reused.
+		requests = 0
+		f, err = gf.Fetch(ts.URL+"/test", nil)
+		assert.Ok(t, err)
+		f.Close()
+		assert.Equals(t, 0, requests)
+
+		// A file tampered with, keeping its size, is downloaded again.
+		tampered := make([]byte, len(expected))
+		path := filepath.Join(destDir, "test")
+		assert.Ok(t, ioutil.WriteFile(path, tampered, 0640))
+		later := time.Now().Add(time.Minute)
+		assert.Ok(t, os.Chtimes(path, later, later))
+
+		f, err = gf.Fetch(ts.URL+"/test", nil)
+		assert.Ok(t, err)
+		data, err := ioutil.ReadAll(f)
+		assert.Ok(t, err)
+		f.Close()
+		assert.Cond(t, requests > 0, "tampered file was reused")
+		assert.Equals(t, expected, data)
+
+		ts.Close()
+		os.RemoveAll(destDir)
+		os.RemoveAll(storeDir)
+	}
+}
+
+func TestWithOfflineMode(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeFile(w, r, "./fixtures/test")
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "offline")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	storeDir, err := ioutil.TempDir(os.TempDir(), "offline-work")
+	assert.Ok(t, err)
+	defer os.RemoveAll(storeDir)
+
+	gf := New(WithDestDir(destDir), WithETag())
+	gf.store = &diskCache{dir: storeDir}
+	f, err := gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	f.Close()
+
+	requests = 0
+	gf = New(WithDestDir(destDir), WithOfflineMode())
+	gf.store = &diskCache{dir: storeDir}
+
+	// Files downloaded before are served from the cache.
+	f, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	f.Close()
+
+	// Anything else fails without reaching the server.
+	_, err = gf.Fetch(ts.URL+"/other", nil)
+	_, ok := errors.Cause(err).(*NotCachedError)
+	assert.Cond(t, ok, "expected a NotCachedError, got %v", err)
+	assert.Equals(t, 0, requests)
+}
+
+func TestWithForceRefresh(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeFile(w, r, "./fixtures/test")
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "refresh")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	storeDir, err := ioutil.TempDir(os.TempDir(), "refresh-work")
+	assert.Ok(t, err)
+	defer os.RemoveAll(storeDir)
+
+	gf := New(WithDestDir(destDir), WithCache())
+	gf.store = &diskCache{dir: storeDir}
+	f, err := gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	f.Close()
+
+	// The file is fresh, yet it is downloaded again.
+	requests = 0
+	gf = New(WithDestDir(destDir), WithCache(), WithForceRefresh())
+	gf.store = &diskCache{dir: storeDir}
+	f, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	f.Close()
+	assert.Cond(t, requests > 0, "file was not downloaded again")
+}
+
+// memCache is a Cache keeping metadata in memory, without content.
+type memCache struct {
+	mu      sync.Mutex
+	entries map[string]CacheEntry
+}
+
+func (c *memCache) Get(url string) (*CacheEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[url]
+	if !ok {
+		return nil, nil
+	}
+	return &e, nil
+}
+
+func (c *memCache) Put(e *CacheEntry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[e.URL] = *e
+	return nil
+}
+
+func (c *memCache) Delete(url string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, url)
+	return nil
+}
+
+func (c *memCache) List() ([]*CacheEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var entries []*CacheEntry
+	for _, e := range c.entries {
+		e := e
+		entries = append(entries, &e)
+	}
+	return entries, nil
+}
+
+func (c *memCache) Clear() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]CacheEntry)
+	return nil
+}
+
+func (c *memCache) Usage() (CacheUsage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheUsage{Entries: len(c.entries)}, nil
+}
+
+func (c *memCache) Stat(algorithm, sum string) (bool, error)           { return false, nil }
+func (c *memCache) Load(algorithm, sum, path string) error             { return os.ErrNotExist }
+func (c *memCache) Store(path string, digests map[string]string) error { return nil }
+
+func TestWithCacheBackend(t *testing.T) {
+	var conditional bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conditional = r.Header.Get("If-None-Match") != ""
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeFile(w, r, "./fixtures/test")
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "cache-backend")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	cache := &memCache{entries: make(map[string]CacheEntry)}
+	gf := New(WithDestDir(destDir), WithETag(), WithCacheBackend(cache))
+
+	f, err := gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	f.Close()
+
+	entries, err := gf.CacheEntries()
+	assert.Ok(t, err)
+	assert.Equals(t, 1, len(entries))
+	assert.Equals(t, `"v1"`, entries[0].ETag)
+
+	// What the backend knows is used to revalidate the file.
+	f, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	f.Close()
+	assert.Cond(t, conditional, "file should be revalidated using the cached ETag")
+
+	assert.Ok(t, gf.PurgeAll())
+	usage, err := gf.CacheUsage()
+	assert.Ok(t, err)
+	assert.Equals(t, 0, usage.Entries)
+}
@@ -0,0 +1,184 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// casAlgorithm is the hashing algorithm files are addressed by in the content-addressable cache.
+const casAlgorithm = "sha256"
+
+// blobPath returns the path of the file with the given SHA-256 digest in the content-addressable cache.
+func (s *diskCache) blobPath(sum string) string {
+	return filepath.Join(s.dir, "cas", casAlgorithm, strings.ToLower(sum))
+}
+
+// indexPath returns the path of the file mapping a digest computed with another
+// algorithm to the SHA-256 digest of the same content.
+func (s *diskCache) indexPath(algorithm, sum string) string {
+	return filepath.Join(s.dir, "cas", strings.ToLower(algorithm), strings.ToLower(sum))
+}
+
+// usedPath returns the path of the file whose modification time is the last time the file with
+// the given SHA-256 digest was stored in or loaded from the content-addressable cache.
+func (s *diskCache) usedPath(sum string) string {
+	return filepath.Join(s.dir, "cas", "used", strings.ToLower(sum))
+}
+
+// touch records that the file with the given SHA-256 digest was just used.
+func (s *diskCache) touch(sum string) error {
+	now := time.Now()
+	path := s.usedPath(sum)
+	if err := os.Chtimes(path, now, now); !os.IsNotExist(err) {
+		return err
+	}
+	return writeFile(path, nil)
+}
+
+// blob returns the path of the cached file with the given digest, whether it exists or not.
+func (s *diskCache) blob(algorithm, sum string) (string, error) {
+	if strings.EqualFold(algorithm, casAlgorithm) {
+		return s.blobPath(sum), nil
+	}
+
+	data, err := ioutil.ReadFile(s.indexPath(algorithm, sum))
+	if err != nil {
+		return "", err
+	}
+	return s.blobPath(string(data)), nil
+}
+
+// Stat reports whether the content-addressable cache holds a file with the given digest.
+func (s *diskCache) Stat(algorithm, sum string) (bool, error) {
+	blob, err := s.blob(algorithm, sum)
+	if err == nil {
+		_, err = os.Stat(blob)
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Load copies the cached file with the given digest to path.
+func (s *diskCache) Load(algorithm, sum, path string) error {
+	blob, err := s.blob(algorithm, sum)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := copyFile(blob, path); err != nil {
+		return err
+	}
+	return s.touch(filepath.Base(blob))
+}
+
+// Store adds a downloaded file to the content-addressable cache, given its digests.
+func (s *diskCache) Store(path string, digests map[string]string) error {
+	sum := digests[casAlgorithm]
+	if sum == "" {
+		return nil
+	}
+
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	blob := s.blobPath(sum)
+	if _, err := os.Stat(blob); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(blob), 0700); err != nil {
+			return err
+		}
+
+		// Files are copied into the cache, rather than linked, so that changes to the
+		// downloaded file do not affect it. They are copied under a temporary name
+		// first, so that concurrent readers never see them partially written.
+		tmp := filepath.Join(filepath.Dir(blob), "."+filepath.Base(blob))
+		os.Remove(tmp)
+		if err := copyFile(path, tmp); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, blob); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+
+		// Until the metadata of its URL is stored, if ever, the file is an entry on its own.
+		if fi, err := os.Stat(blob); err == nil && s.usage != nil {
+			s.usage.Entries++
+			s.usage.Bytes += fi.Size()
+		}
+	}
+
+	if err := s.touch(sum); err != nil {
+		return err
+	}
+
+	for algorithm, value := range digests {
+		if algorithm == casAlgorithm {
+			continue
+		}
+		if err := writeFile(s.indexPath(algorithm, value), []byte(sum)); err != nil {
+			return err
+		}
+	}
+	return s.enforceLimits()
+}
+
+// moveFile renames src to dst or, if they are on different filesystems, copies it next to dst
+// and renames the copy, so dst is never seen partially written.
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+	if !isCrossDevice(err) {
+		return err
+	}
+
+	tmp := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".tmp")
+	os.Remove(tmp)
+	if err := copyFile(src, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// copyFile copies src to dst, which must not exist.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0660)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
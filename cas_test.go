@@ -0,0 +1,146 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestContentAddressableCache(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.ServeFile(w, r, "./fixtures/test")
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "cas")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	cacheDir, err := ioutil.TempDir(os.TempDir(), "cas-work")
+	assert.Ok(t, err)
+	defer os.RemoveAll(cacheDir)
+
+	sha512 := "4ff6e159db38d46a665f26e9f82b98134238c0457cc82727a5258b7184773e4967068cc0eecf3928ecd079f3aea6e22aac024847c6d76c0329c4635c4b6ae327"
+	fetch := func(dir, url string) {
+		gf := New(WithDestDir(dir), WithContentAddressableCache(), WithChecksum("sha512", sha512))
+		gf.store = &diskCache{dir: cacheDir}
+		f, err := gf.Fetch(url, nil)
+		assert.Ok(t, err)
+		f.Close()
+	}
+
+	fetch(destDir, ts.URL+"/test")
+	assert.Cond(t, requests > 0, "The file should have been downloaded")
+	_, err = os.Stat(filepath.Join(cacheDir, "cas", "sha256", fixtureSHA256))
+	assert.Ok(t, err)
+
+	// The same file, from a different URL and to a different destination, is not downloaded again.
+	requests = 0
+	otherDir := filepath.Join(destDir, "other")
+	assert.Ok(t, os.MkdirAll(otherDir, 0700))
+	fetch(otherDir, ts.URL+"/mirror/test")
+	assert.Equals(t, 0, requests)
+
+	expected, err := ioutil.ReadFile("./fixtures/test")
+	assert.Ok(t, err)
+	got, err := ioutil.ReadFile(filepath.Join(otherDir, "test"))
+	assert.Ok(t, err)
+	assert.Equals(t, expected, got)
+
+	// Changing a file loaded from the cache does not modify the cached content.
+	f, err := os.OpenFile(filepath.Join(otherDir, "test"), os.O_WRONLY, 0)
+	assert.Ok(t, err)
+	_, err = f.Write([]byte("changed"))
+	assert.Ok(t, err)
+	assert.Ok(t, f.Close())
+	got, err = ioutil.ReadFile(filepath.Join(cacheDir, "cas", "sha256", fixtureSHA256))
+	assert.Ok(t, err)
+	assert.Equals(t, expected, got)
+
+	// Downloading the file again does not modify the cached content.
+	gf := New(WithDestDir(destDir), WithContentAddressableCache())
+	gf.store = &diskCache{dir: cacheDir}
+	f, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	f.Close()
+	got, err = ioutil.ReadFile(filepath.Join(cacheDir, "cas", "sha256", fixtureSHA256))
+	assert.Ok(t, err)
+	assert.Equals(t, expected, got)
+}
+
+func TestCachePurge(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeFile(w, r, "./fixtures/test")
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "cache-purge")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	cacheDir, err := ioutil.TempDir(os.TempDir(), "cache-purge-work")
+	assert.Ok(t, err)
+	defer os.RemoveAll(cacheDir)
+
+	gf := New(WithDestDir(destDir), WithETag(), WithContentAddressableCache())
+	gf.store = &diskCache{dir: cacheDir}
+
+	for _, path := range []string{"/a/test", "/b/test"} {
+		f, err := gf.Fetch(ts.URL+path, nil)
+		assert.Ok(t, err)
+		f.Close()
+	}
+
+	entries, err := gf.CacheEntries()
+	assert.Ok(t, err)
+	assert.Equals(t, 2, len(entries))
+	assert.Equals(t, `"v1"`, entries[0].ETag)
+	assert.Equals(t, fixtureSHA256, entries[0].Digests["sha256"])
+
+	assert.Ok(t, gf.Purge(ts.URL+"/a/test"))
+	entries, err = gf.CacheEntries()
+	assert.Ok(t, err)
+	assert.Equals(t, 1, len(entries))
+	assert.Equals(t, ts.URL+"/b/test", entries[0].URL)
+	_, err = os.Stat(filepath.Join(cacheDir, "cas", "sha256", fixtureSHA256))
+	assert.Cond(t, os.IsNotExist(err), "Cached content should have been purged")
+
+	assert.Ok(t, gf.PurgeAll())
+	usage, err := gf.CacheUsage()
+	assert.Ok(t, err)
+	assert.Equals(t, CacheUsage{}, usage)
+}
+
+func TestMoveFile(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "move-file")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	assert.Ok(t, ioutil.WriteFile(src, []byte("data"), 0640))
+
+	// Renames failing for other reasons than crossing filesystems are not retried as copies.
+	err = moveFile(src, filepath.Join(dir, "missing", "dst"))
+	le, ok := err.(*os.LinkError)
+	assert.Cond(t, ok && le.Old == src && os.IsNotExist(err), "failed rename should be reported, got %v", err)
+	_, err = os.Stat(src)
+	assert.Ok(t, err)
+
+	dst := filepath.Join(dir, "dst")
+	assert.Ok(t, moveFile(src, dst))
+	data, err := ioutil.ReadFile(dst)
+	assert.Ok(t, err)
+	assert.Equals(t, "data", string(data))
+}
@@ -0,0 +1,386 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/zeebo/blake3"
+	"github.com/zeebo/xxh3"
+	"golang.org/x/crypto/blake2b"
+)
+
+// newHasher returns a hash implementing the given algorithm.
+func newHasher(algorithm string) (hash.Hash, error) {
+	switch strings.ToLower(algorithm) {
+	case "md5":
+		return md5.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	case "blake2b", "blake2b-512":
+		return blake2b.New512(nil)
+	case "blake2b-256":
+		return blake2b.New256(nil)
+	case "blake3":
+		return blake3.New(), nil
+	case "crc32":
+		return crc32.NewIEEE(), nil
+	case "crc32c":
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli)), nil
+	case "xxh3":
+		return xxh3.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported hashing algorithm: %s", algorithm)
+	}
+}
+
+// Verifier verifies downloaded files using custom schemes, like HMACs or notary checks.
+// Verify is given the content of the file and returns an error if it is not valid.
+type Verifier interface {
+	Verify(r io.Reader) error
+}
+
+// checksum is an expected file digest.
+type checksum struct {
+	algorithm string
+	value     string
+	// newHash, if set, creates the hash instead of looking algorithm up.
+	newHash func() hash.Hash
+	// computeOnly is set for digests computed without being verified.
+	computeOnly bool
+}
+
+// verifier computes several digests at once, in a single pass over the data.
+type verifier struct {
+	checksums []checksum
+	hashers   []hash.Hash
+}
+
+// AlgorithmError is returned when a checksum is given without its hashing algorithm,
+// and the algorithm cannot be inferred from the length of the checksum.
+type AlgorithmError struct {
+	Checksum string
+}
+
+func (e *AlgorithmError) Error() string {
+	return fmt.Sprintf("unable to infer the hashing algorithm of checksum %q, %d hex digits long", e.Checksum, len(e.Checksum))
+}
+
+// inferAlgorithm infers the hashing algorithm from the length of a hex encoded checksum. Hashes
+// sharing the same length with the SHA family, like BLAKE2b, need to be given explicitly.
+func inferAlgorithm(checksum string) (string, error) {
+	if _, err := hex.DecodeString(checksum); err != nil {
+		return "", &AlgorithmError{Checksum: checksum}
+	}
+
+	switch len(checksum) {
+	case 32:
+		return "md5", nil
+	case 40:
+		return "sha1", nil
+	case 64:
+		return "sha256", nil
+	case 128:
+		return "sha512", nil
+	default:
+		return "", &AlgorithmError{Checksum: checksum}
+	}
+}
+
+// newVerifier returns a verifier for the given checksums, inferring their
+// hashing algorithm when not given.
+func newVerifier(checksums []checksum) (*verifier, error) {
+	v := &verifier{checksums: make([]checksum, len(checksums))}
+	for i, c := range checksums {
+		if c.newHash != nil {
+			v.checksums[i] = c
+			v.hashers = append(v.hashers, c.newHash())
+			continue
+		}
+
+		if c.algorithm == "" {
+			alg, err := inferAlgorithm(c.value)
+			if err != nil {
+				return nil, err
+			}
+			c.algorithm = alg
+		}
+
+		hasher, err := newHasher(c.algorithm)
+		if err != nil {
+			return nil, err
+		}
+		v.checksums[i] = c
+		v.hashers = append(v.hashers, hasher)
+	}
+	return v, nil
+}
+
+func (v *verifier) Write(p []byte) (int, error) {
+	for _, h := range v.hashers {
+		h.Write(p)
+	}
+	return len(p), nil
+}
+
+// reset discards the data written so far.
+func (v *verifier) reset() {
+	for _, h := range v.hashers {
+		h.Reset()
+	}
+}
+
+// expected returns the lower case hex encoded checksums the data is verified against, keyed
+// by algorithm. It returns nil if there are none.
+func (v *verifier) expected() map[string]string {
+	if v == nil {
+		return nil
+	}
+
+	var sums map[string]string
+	for _, c := range v.checksums {
+		if c.computeOnly || c.value == "" {
+			continue
+		}
+		if sums == nil {
+			sums = make(map[string]string)
+		}
+		sums[strings.ToLower(c.algorithm)] = strings.ToLower(c.value)
+	}
+	return sums
+}
+
+// digests returns the hex encoded digests of the data written so far, keyed by algorithm.
+func (v *verifier) digests() map[string]string {
+	digests := make(map[string]string, len(v.hashers))
+	for i, h := range v.hashers {
+		digests[strings.ToLower(v.checksums[i].algorithm)] = fmt.Sprintf("%x", h.Sum(nil))
+	}
+	return digests
+}
+
+// verify checks that the data written so far matches all the expected checksums.
+func (v *verifier) verify() error {
+	for i, h := range v.hashers {
+		if v.checksums[i].computeOnly {
+			continue
+		}
+		if err := verifyChecksum(h, v.checksums[i].value); err != nil {
+			return errors.Wrap(err, v.checksums[i].algorithm)
+		}
+	}
+	return nil
+}
+
+// verifyChecksum checks that the data written to hasher matches the expected checksum.
+func verifyChecksum(hasher hash.Hash, checksum string) error {
+	result := fmt.Sprintf("%x", hasher.Sum(nil))
+
+	if !strings.EqualFold(result, checksum) {
+		return fmt.Errorf("checksum does not match\n found: %s\n expected: %s", result, checksum)
+	}
+
+	return nil
+}
+
+// serverChecksums returns the checksums of the whole content announced by the server through
+// the Content-MD5, x-goog-hash (Google Cloud Storage) or x-amz-checksum-* (Amazon S3) headers.
+func serverChecksums(header http.Header) []checksum {
+	var checksums []checksum
+	add := func(algorithm, value string) {
+		sum, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil || len(sum) == 0 {
+			return
+		}
+		checksums = append(checksums, checksum{algorithm: algorithm, value: hex.EncodeToString(sum)})
+	}
+
+	// Content-MD5 refers to the body, so it only applies to whole responses.
+	if value := header.Get("Content-MD5"); value != "" && header.Get("Content-Range") == "" {
+		add("md5", value)
+	}
+
+	for _, value := range header.Values("X-Goog-Hash") {
+		for _, hash := range strings.Split(value, ",") {
+			parts := strings.SplitN(strings.TrimSpace(hash), "=", 2)
+			if len(parts) == 2 && (parts[0] == "md5" || parts[0] == "crc32c") {
+				add(parts[0], parts[1])
+			}
+		}
+	}
+
+	for _, alg := range []string{"crc32", "crc32c", "sha1", "sha256"} {
+		// Checksums of multipart uploads, like "abc==-3", are checksums of checksums.
+		if value := header.Get("X-Amz-Checksum-" + alg); value != "" && !strings.Contains(value, "-") {
+			add(alg, value)
+		}
+	}
+	return checksums
+}
+
+// existingFile returns the file at the given path if it matches all the checksums,
+// and signature if set. It returns nil if the file does not exist or does not match.
+// Hashing the file is skipped if its sidecar shows it was already verified.
+func (gf *Fetcher) existingFile(path string, checksums []checksum, signature []byte) (*os.File, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := newVerifier(checksums)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// Files verified before do not need to be hashed again.
+	trusted := gf.sidecar && trustSidecar(file, v.checksums)
+	if !trusted {
+		if _, err := io.Copy(v, file); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	if !trusted && v.verify() != nil {
+		file.Close()
+		return nil, nil
+	}
+
+	if err := gf.verifyFile(file, signature, gf.verifiers); err != nil {
+		file.Close()
+		if errors.Cause(err) == errInvalidFile {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return file, nil
+}
+
+// errInvalidFile is returned when a file fails the verification of its signature or of a custom verifier.
+var errInvalidFile = errors.New("invalid file")
+
+// verifyFile verifies the whole file against its signature and the given custom verifiers,
+// if any, leaving it ready to be read from the beginning.
+func (gf *Fetcher) verifyFile(file *os.File, signature []byte, verifiers []Verifier) error {
+	check := func(verify func(r io.Reader) error) error {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := verify(file); err != nil {
+			return errors.Wrapf(errInvalidFile, "%s", err)
+		}
+		return nil
+	}
+
+	if gf.signature != nil {
+		err := check(func(r io.Reader) error {
+			return verifySignature(gf.signature.keyring, r, signature)
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed verifying file signature")
+		}
+	}
+
+	for _, verifier := range verifiers {
+		if err := check(verifier.Verify); err != nil {
+			return errors.Wrap(err, "failed verifying file")
+		}
+	}
+
+	_, err := file.Seek(0, io.SeekStart)
+	return err
+}
+
+// discard closes the data of a download that failed verification and moves it to the
+// quarantine directory, under the name of its destination, or removes it along with the rest
+// of the download. It returns the verification error, annotated with any error found while
+// getting rid of the data.
+func (gf *Fetcher) discard(file *os.File, destFilePath string, verifyErr error) error {
+	file.Close()
+
+	var err error
+	if gf.quarantineDir != "" {
+		if err = os.MkdirAll(gf.quarantineDir, 0760); err == nil {
+			err = moveFile(file.Name(), filepath.Join(gf.quarantineDir, filepath.Base(destFilePath)))
+		}
+	}
+	// Invalid data is not kept to resume the download, it would fail verification again.
+	if rerr := os.RemoveAll(gf.chunksDir(destFilePath)); err == nil {
+		err = rerr
+	}
+
+	if err != nil {
+		return errors.Wrapf(verifyErr, "unable to discard invalid file: %s", err)
+	}
+	return verifyErr
+}
+
+// blockChecksums holds the checksums of consecutive blocks of the content, so
+// chunks can be verified as soon as they are downloaded.
+type blockChecksums struct {
+	algorithm string
+	size      int64
+	sums      []string
+}
+
+// blockError is returned when a block of a chunk does not match its checksum.
+type blockError struct {
+	block int
+	err   error
+}
+
+func (e *blockError) Error() string {
+	return fmt.Sprintf("block %d is corrupt: %s", e.block, e.err)
+}
+
+// verify checks the blocks read from r, a chunk starting at offset in the content.
+// If a block is corrupt, it returns its position in the chunk.
+func (b *blockChecksums) verify(r io.Reader, offset int64) (int64, error) {
+	first := int(offset / b.size)
+	for i := first; ; i++ {
+		hasher, err := newHasher(b.algorithm)
+		if err != nil {
+			return 0, err
+		}
+
+		n, err := io.Copy(hasher, io.LimitReader(r, b.size))
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			return 0, nil
+		}
+
+		pos := int64(i-first) * b.size
+		if i >= len(b.sums) {
+			return pos, &blockError{block: i, err: errors.New("content is larger than expected")}
+		}
+		if err := verifyChecksum(hasher, b.sums[i]); err != nil {
+			return pos, &blockError{block: i, err: err}
+		}
+	}
+}
@@ -0,0 +1,377 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+	"github.com/pkg/errors"
+)
+
+func TestHashAlgorithms(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		sum       string
+	}{
+		{"md5", "900150983cd24fb0d6963f7d28e17f72"},
+		{"sha256", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{"blake2b", "ba80a53f981c4d0d6a2797b69f12f6e94c212f14685ac4b74b12bb6fdbffa2d17d87c5392aab792dc252d5de4533cc9518d38aa8dbf1925ab92386edd4009923"},
+		{"blake2b-256", "bddd813c634239723171ef3fee98579b94964e3bb1cb3e427262c8c068d52319"},
+		{"blake3", "6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85"},
+		{"crc32c", "364b3fb7"},
+		{"XXH3", "78af5f94892f3950"},
+	}
+
+	for _, tt := range tests {
+		hasher, err := newHasher(tt.algorithm)
+		assert.Ok(t, err)
+		hasher.Write([]byte("abc"))
+		assert.Ok(t, verifyChecksum(hasher, tt.sum))
+	}
+
+	v, err := newVerifier([]checksum{
+		{algorithm: "md5", value: "900150983cd24fb0d6963f7d28e17f72"},
+		{algorithm: "sha256", value: "BA7816BF8F01CFEA414140DE5DAE2223B00361A396177A9CB410FF61F20015AD"},
+	})
+	assert.Ok(t, err)
+	v.Write([]byte("abc"))
+	assert.Ok(t, v.verify())
+
+	_, err = newHasher("whirlpool")
+	assert.Cond(t, err != nil, "whirlpool should not be supported")
+}
+
+func TestWithBlockChecksums(t *testing.T) {
+	data, err := ioutil.ReadFile("./fixtures/test")
+	assert.Ok(t, err)
+
+	blockSize := int64(len(data)/5 + 1)
+	var sums []string
+	for i := int64(0); i < int64(len(data)); i += blockSize {
+		end := i + blockSize
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		sums = append(sums, fmt.Sprintf("%x", sha256.Sum256(data[i:end])))
+	}
+
+	// The server corrupts the third block the first time it is sent.
+	var mu sync.Mutex
+	corrupted := false
+	var ranges []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content := data
+		if r.Method == "GET" {
+			mu.Lock()
+			ranges = append(ranges, r.Header.Get("Range"))
+			if !corrupted && strings.Contains(r.Header.Get("Range"), fmt.Sprintf("bytes=%d-", 2*blockSize)) {
+				corrupted = true
+				content = append([]byte(nil), data...)
+				content[2*blockSize] ^= 0xff
+			}
+			mu.Unlock()
+		}
+		http.ServeContent(w, r, "test", time.Time{}, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "block-checksums")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	gf := New(WithDestDir(destDir), WithConcurrency(5), WithRetries(1, time.Millisecond), WithBlockChecksums("sha256", blockSize, sums...))
+	f, err := gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	defer f.Close()
+
+	got, err := ioutil.ReadAll(f)
+	assert.Ok(t, err)
+	assert.Equals(t, data, got)
+	assert.Cond(t, corrupted, "The corrupt block should have been served")
+	// Only the corrupt chunk is downloaded again.
+	assert.Equals(t, 6, len(ranges))
+
+	gf = New(WithDestDir(destDir), WithBlockChecksums("sha256", blockSize, sums[1:]...))
+	_, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Cond(t, err != nil, "Fetch should fail if the number of block checksums does not match the content length")
+}
+
+func TestWithVerifyExisting(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.ServeFile(w, r, "./fixtures/test")
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "verify-existing")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	sha512 := "4ff6e159db38d46a665f26e9f82b98134238c0457cc82727a5258b7184773e4967068cc0eecf3928ecd079f3aea6e22aac024847c6d76c0329c4635c4b6ae327"
+	gf := New(WithDestDir(destDir), WithVerifyExisting(), WithChecksum("sha512", sha512))
+	f, err := gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	f.Close()
+
+	// The file is already there, so the server is not contacted at all.
+	requests = 0
+	f, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	f.Close()
+	assert.Equals(t, 0, requests)
+
+	// A corrupt file is downloaded again.
+	err = ioutil.WriteFile(filepath.Join(destDir, "test"), []byte("corrupt"), 0600)
+	assert.Ok(t, err)
+	f, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	f.Close()
+	assert.Cond(t, requests > 0, "The file should have been downloaded again")
+}
+
+func TestDiscardInvalid(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "./fixtures/test")
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "discard-invalid")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	destFile := filepath.Join(destDir, "test")
+	wrongSum := strings.Repeat("0", 64)
+
+	// Files already at the destination are left alone by invalid downloads.
+	assert.Ok(t, ioutil.WriteFile(destFile, []byte("previous"), 0640))
+
+	gf := New(WithDestDir(destDir), WithChecksum("sha256", wrongSum))
+	_, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Cond(t, err != nil, "Fetch should fail if the checksum does not match")
+	previous, err := ioutil.ReadFile(destFile)
+	assert.Ok(t, err)
+	assert.Equals(t, "previous", string(previous))
+	_, err = os.Stat(filepath.Join(destDir, "test.chunks"))
+	assert.Cond(t, os.IsNotExist(err), "Invalid download should have been removed")
+	assert.Ok(t, os.Remove(destFile))
+
+	quarantine := filepath.Join(destDir, "quarantine")
+	gf = New(WithDestDir(destDir), WithQuarantineDir(quarantine), WithChecksum("sha256", wrongSum))
+	_, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Cond(t, err != nil, "Fetch should fail if the checksum does not match")
+	_, err = os.Stat(destFile)
+	assert.Cond(t, os.IsNotExist(err), "Invalid file should have been moved")
+	_, err = os.Stat(filepath.Join(quarantine, "test"))
+	assert.Ok(t, err)
+}
+
+func TestInferAlgorithm(t *testing.T) {
+	tests := []struct {
+		checksum  string
+		algorithm string
+	}{
+		{"900150983cd24fb0d6963f7d28e17f72", "md5"},
+		{"a9993e364706816aba3e25717850c26c9cd0d89d", "sha1"},
+		{"BA7816BF8F01CFEA414140DE5DAE2223B00361A396177A9CB410FF61F20015AD", "sha256"},
+		{strings.Repeat("ab", 64), "sha512"},
+		{"364b3fb7", ""},
+		{strings.Repeat("z", 64), ""},
+	}
+
+	for _, tt := range tests {
+		alg, err := inferAlgorithm(tt.checksum)
+		if tt.algorithm == "" {
+			_, ok := err.(*AlgorithmError)
+			assert.Cond(t, ok, "expected an *AlgorithmError for %q, got %v", tt.checksum, err)
+			continue
+		}
+		assert.Ok(t, err)
+		assert.Equals(t, tt.algorithm, alg)
+	}
+
+	v, err := newVerifier([]checksum{{value: "900150983cd24fb0d6963f7d28e17f72"}})
+	assert.Ok(t, err)
+	v.Write([]byte("abc"))
+	assert.Ok(t, v.verify())
+}
+
+func TestWithSidecar(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeFile(w, r, "./fixtures/test")
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "sidecar")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	sha512 := "4ff6e159db38d46a665f26e9f82b98134238c0457cc82727a5258b7184773e4967068cc0eecf3928ecd079f3aea6e22aac024847c6d76c0329c4635c4b6ae327"
+	gf := New(WithDestDir(destDir), WithSidecar(), WithVerifyExisting(), WithChecksum("", sha512))
+	f, err := gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	f.Close()
+
+	data, err := ioutil.ReadFile(filepath.Join(destDir, "test.gofetch.json"))
+	assert.Ok(t, err)
+	var s sidecar
+	assert.Ok(t, json.Unmarshal(data, &s))
+	assert.Equals(t, ts.URL+"/test", s.URL)
+	assert.Equals(t, `"v1"`, s.ETag)
+	assert.Equals(t, sha512, s.Checksums["sha512"])
+
+	f, err = os.Open(filepath.Join(destDir, "test"))
+	assert.Ok(t, err)
+	defer f.Close()
+	assert.Cond(t, trustSidecar(f, []checksum{{algorithm: "sha512", value: sha512}}), "Sidecar should be trusted")
+	assert.Cond(t, !trustSidecar(f, []checksum{{algorithm: "sha256", value: fixtureSHA256}}), "Sidecar should not be trusted for other checksums")
+
+	now := time.Now().Add(time.Minute)
+	assert.Ok(t, os.Chtimes(filepath.Join(destDir, "test"), now, now))
+	assert.Cond(t, !trustSidecar(f, []checksum{{algorithm: "sha512", value: sha512}}), "Sidecar should not be trusted for modified files")
+}
+
+// verifierFunc adapts a function to the Verifier interface.
+type verifierFunc func(r io.Reader) error
+
+func (f verifierFunc) Verify(r io.Reader) error {
+	return f(r)
+}
+
+func TestCustomVerification(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "./fixtures/test")
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "custom-verification")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	data, err := ioutil.ReadFile("./fixtures/test")
+	assert.Ok(t, err)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(data)
+	sum := fmt.Sprintf("%x", mac.Sum(nil))
+	newHMAC := func() hash.Hash { return hmac.New(sha256.New, []byte("secret")) }
+
+	var verified []byte
+	gf := New(WithDestDir(destDir), WithConcurrency(3),
+		WithCustomChecksum("hmac-sha256", newHMAC, sum),
+		WithVerifier(verifierFunc(func(r io.Reader) error {
+			verified, err = ioutil.ReadAll(r)
+			return err
+		})))
+	f, err := gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	defer f.Close()
+	assert.Equals(t, data, verified)
+
+	// The file is left ready to be read from the beginning.
+	got, err := ioutil.ReadAll(f)
+	assert.Ok(t, err)
+	assert.Equals(t, data, got)
+
+	gf = New(WithDestDir(destDir), WithCustomChecksum("hmac-sha256", newHMAC, strings.Repeat("0", 64)))
+	_, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Cond(t, err != nil, "Fetch should fail if the custom checksum does not match")
+
+	gf = New(WithDestDir(destDir), WithVerifier(verifierFunc(func(r io.Reader) error {
+		return errors.New("not notarized")
+	})))
+	_, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Cond(t, err != nil, "Fetch should fail if a verifier fails")
+	_, err = os.Stat(filepath.Join(destDir, "test.chunks"))
+	assert.Cond(t, os.IsNotExist(err), "Invalid download should have been removed")
+
+	// The file downloaded before is left in place.
+	got, err = ioutil.ReadFile(filepath.Join(destDir, "test"))
+	assert.Ok(t, err)
+	assert.Equals(t, data, got)
+}
+
+func TestWithServerChecksums(t *testing.T) {
+	data, err := ioutil.ReadFile("./fixtures/test")
+	assert.Ok(t, err)
+
+	md5sum := md5.Sum(data)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)))
+	sha := sha256.Sum256(data)
+
+	header := http.Header{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			assert.Equals(t, "ENABLED", r.Header.Get("X-Amz-Checksum-Mode"))
+		}
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+		http.ServeContent(w, r, "test", time.Time{}, bytes.NewReader(data))
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "server-checksums")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	header.Set("X-Goog-Hash", "crc32c="+base64.StdEncoding.EncodeToString(crc)+",md5="+base64.StdEncoding.EncodeToString(md5sum[:]))
+	header.Set("X-Amz-Checksum-Sha256", base64.StdEncoding.EncodeToString(sha[:]))
+	assert.Equals(t, 3, len(serverChecksums(header)))
+
+	gf := New(WithDestDir(destDir), WithConcurrency(2), WithServerChecksums())
+	_, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+
+	header.Set("X-Amz-Checksum-Sha256", base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	_, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Cond(t, err != nil, "Fetch should fail if the content does not match the checksums announced by the server")
+
+	// Checksums of multipart uploads are not checksums of the content.
+	header.Set("X-Amz-Checksum-Sha256", base64.StdEncoding.EncodeToString(make([]byte, 32))+"-3")
+	_, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+}
+
+func TestWithDigests(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "./fixtures/test")
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "digests")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	sha512 := "4ff6e159db38d46a665f26e9f82b98134238c0457cc82727a5258b7184773e4967068cc0eecf3928ecd079f3aea6e22aac024847c6d76c0329c4635c4b6ae327"
+	gf := New(WithDestDir(destDir), WithConcurrency(3), WithDigests("sha256"), WithChecksum("sha512", sha512))
+	result, err := gf.FetchContext(context.Background(), ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	defer result.File.Close()
+
+	assert.Equals(t, map[string]string{"sha256": fixtureSHA256, "sha512": sha512}, result.Digests)
+}
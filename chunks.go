@@ -0,0 +1,637 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// minSplitSize is the smallest part of a chunk taken over by another goroutine.
+const minSplitSize = 1 << 20
+
+// defaultMinChunkSize is the smallest chunk content is split in by default, when splitting
+// it in as many chunks as the concurrency.
+const defaultMinChunkSize = 64 << 10
+
+// errChunkSplit is returned when writing past the end of a chunk, after another
+// goroutine took over the rest of it.
+var errChunkSplit = errors.New("chunk was split")
+
+// chunk is a byte range of the content, downloaded by its own request and written
+// at its offset in the file being downloaded.
+type chunk struct {
+	Start int64 `json:"start"`
+	// End is the end of the range, exclusive, or -1 if the size of the content is unknown.
+	// It is updated atomically, since it moves back when the chunk is split.
+	End int64 `json:"end"`
+	// Written is the number of bytes of the range already on disk. It is updated atomically.
+	Written int64 `json:"written"`
+	// Checksum is the hex encoded CRC-32C of the bytes already on disk, as recorded in the
+	// state of the download, to verify them when resuming it.
+	Checksum string `json:"crc32c,omitempty"`
+
+	// mu makes sure crc, the CRC-32C of the bytes already on disk, always matches Written.
+	mu  sync.Mutex
+	crc uint32
+}
+
+// crc32c is the table of the checksums of the bytes of chunks already on disk.
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// written returns the number of bytes of the chunk already on disk.
+func (c *chunk) written() int64 {
+	return atomic.LoadInt64(&c.Written)
+}
+
+// progress returns the number of bytes of the chunk already on disk, along with their CRC-32C.
+func (c *chunk) progress() (int64, uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.written(), c.crc
+}
+
+// advance accounts for the given bytes, just written at the end of what the chunk has on disk.
+func (c *chunk) advance(b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.crc = crc32.Update(c.crc, crc32c, b)
+	atomic.AddInt64(&c.Written, int64(len(b)))
+}
+
+// reset sets the number of bytes of the chunk on disk, whose CRC-32C is crc.
+func (c *chunk) reset(written int64, crc uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.crc = crc
+	atomic.StoreInt64(&c.Written, written)
+}
+
+// checksumRange returns the CRC-32C of n bytes of r from off, and whether there are as many.
+func checksumRange(r io.ReaderAt, off, n int64) (uint32, bool, error) {
+	h := crc32.New(crc32c)
+	copied, err := io.Copy(h, io.NewSectionReader(r, off, n))
+	if err != nil {
+		return 0, false, err
+	}
+	return h.Sum32(), copied == n, nil
+}
+
+// verifyChunks verifies the bytes already on disk of the chunks of an interrupted download
+// against their recorded checksums, so chunks corrupted on disk, or not written yet when the
+// process crashed, are downloaded again. Chunks recorded without checksums are trusted.
+func verifyChunks(file io.ReaderAt, chunks []*chunk) error {
+	for _, c := range chunks {
+		written := c.written()
+		if written == 0 {
+			continue
+		}
+
+		crc, ok, err := checksumRange(file, c.Start, written)
+		if err != nil {
+			return err
+		}
+		if !ok || (c.Checksum != "" && c.Checksum != fmt.Sprintf("%08x", crc)) {
+			c.reset(0, 0)
+			continue
+		}
+		c.reset(written, crc)
+	}
+	return nil
+}
+
+// end returns the end of the chunk.
+func (c *chunk) end() int64 {
+	return atomic.LoadInt64(&c.End)
+}
+
+// done tells whether the chunk was fully downloaded.
+func (c *chunk) done() bool {
+	written, end := c.written(), c.end()
+	return written > 0 && end >= 0 && written >= end-c.Start
+}
+
+// planChunks splits the content in chunks of the configured size or, if not set, in as
+// many chunks as the given concurrency.
+func (gf *Fetcher) planChunks(length int64, concurrency int) []*chunk {
+	if length < 0 {
+		return []*chunk{{Start: 0, End: -1}}
+	}
+
+	chunkSize := gf.chunkSize
+	if chunkSize <= 0 && gf.adaptive && concurrency > 1 {
+		// The number of goroutines changes along the way, so the content is split
+		// in smaller chunks for all of them to get some.
+		chunkSize = length / int64(concurrency*adaptiveChunks)
+		if chunkSize < minAdaptiveChunkSize {
+			chunkSize = minAdaptiveChunkSize
+		}
+	}
+
+	fixed := chunkSize > 0
+	if !fixed {
+		// Small content is split in fewer chunks rather than in tiny ones.
+		if gf.minChunkSize > 0 && length/int64(concurrency) < gf.minChunkSize {
+			concurrency = int(length / gf.minChunkSize)
+			if concurrency == 0 {
+				concurrency = 1
+			}
+		}
+		chunkSize = length / int64(concurrency)
+	}
+
+	if gf.blocks != nil && (concurrency > 1 || fixed) {
+		// Chunks are aligned to blocks so they can be verified independently.
+		chunkSize = chunkSize / gf.blocks.size * gf.blocks.size
+		if chunkSize == 0 {
+			chunkSize = gf.blocks.size
+		}
+	}
+
+	count := concurrency
+	if fixed {
+		count = int((length + chunkSize - 1) / chunkSize)
+		if count == 0 {
+			count = 1
+		}
+	}
+
+	chunks := make([]*chunk, count)
+	for i := range chunks {
+		chunks[i] = &chunk{Start: chunkSize * int64(i), End: chunkSize * int64(i+1)}
+	}
+	// The last chunk takes the remaining bytes.
+	chunks[count-1].End = length
+	return chunks
+}
+
+// downloadState is the control file of a download in progress, recording everything needed
+// to resume it, even after a crash or if the chunk layout changes.
+type downloadState struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	// Size is the length of the content, or -1 if unknown.
+	Size int64 `json:"size"`
+	// Validator is the ETag or Last-Modified date sent along requests resuming chunks, to
+	// make sure the content did not change since they were downloaded.
+	Validator string `json:"validator"`
+	// Digests are the checksums the content is verified against, keyed by algorithm. They
+	// identify the content when resuming it from a mirror.
+	Digests map[string]string `json:"digests,omitempty"`
+	Chunks  []*chunk          `json:"chunks"`
+	// Completed lists the byte ranges already downloaded, end exclusive, sorted and merged.
+	// It is informational, chunks are the source of truth.
+	Completed [][2]int64 `json:"completed"`
+}
+
+// newDownloadState returns the state of a download of the given resource, expected to match
+// the given digests, with no chunks.
+func newDownloadState(url string, rsc *resource, digests map[string]string) downloadState {
+	return downloadState{
+		URL:          url,
+		ETag:         rsc.header.Get("ETag"),
+		LastModified: rsc.header.Get("Last-Modified"),
+		Size:         rsc.size,
+		Validator:    rsc.validator(),
+		Digests:      digests,
+	}
+}
+
+// matches tells whether the state belongs to a download of the given resource, as it is now on
+// the server. Validators are compared as long as both the state and the server have them.
+// Downloads from other URLs match as long as they are expected to have the same digests,
+// since mirrors serve the same content under different validators.
+func (s *downloadState) matches(url string, rsc *resource, digests map[string]string) bool {
+	if s.Size != rsc.size {
+		return false
+	}
+	if s.URL != url {
+		return sameDigests(s.Digests, digests)
+	}
+	if etag := rsc.header.Get("ETag"); s.ETag != "" && etag != "" && s.ETag != etag {
+		return false
+	}
+	if lastModified := rsc.header.Get("Last-Modified"); s.LastModified != "" && lastModified != "" &&
+		s.LastModified != lastModified {
+		return false
+	}
+	return true
+}
+
+// fromMirror tells whether the state belongs to a download of content of the same size from
+// another of the mirrors of the given target, which are known to serve the same content.
+func (s *downloadState) fromMirror(url string, rsc *resource, t *target) bool {
+	if t == nil || s.URL == url || s.Size != rsc.size {
+		return false
+	}
+	for _, mirror := range t.mirrors {
+		if s.URL == mirror {
+			return true
+		}
+	}
+	return false
+}
+
+// sameDigests tells whether two sets of digests have at least one algorithm in common, and
+// agree on all the algorithms they have in common.
+func sameDigests(a, b map[string]string) bool {
+	common := false
+	for alg, sum := range a {
+		if other, ok := b[alg]; ok {
+			if other != sum {
+				return false
+			}
+			common = true
+		}
+	}
+	return common
+}
+
+// loadState reads the control file of an interrupted download. It returns nil if there is
+// none, or if its chunks do not match the length of the content.
+func loadState(stateFile string, length int64) *downloadState {
+	s, err := readState(stateFile)
+	if err != nil || s == nil || !s.fits(length) {
+		return nil
+	}
+	return s
+}
+
+// readState reads the control file of an interrupted download. It returns nil if there is
+// none, or if it is not valid.
+func readState(stateFile string) (*downloadState, error) {
+	data, err := ioutil.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var s downloadState
+	if err := json.Unmarshal(data, &s); err != nil || len(s.Chunks) == 0 {
+		return nil, nil
+	}
+	return &s, nil
+}
+
+// fits tells whether the chunks of the state cover content of the given length.
+func (s *downloadState) fits(length int64) bool {
+	if length < 0 {
+		return len(s.Chunks) == 1 && s.Chunks[0].End < 0
+	}
+
+	// Chunks are not sorted, the ones split off others are added at the end.
+	var end int64
+	for _, c := range s.Chunks {
+		if c.End > end {
+			end = c.End
+		}
+	}
+	return end == length
+}
+
+// saveState records the progress of the chunks of a download, so it can be resumed if interrupted.
+func saveState(stateFile string, s downloadState, chunks []*chunk) error {
+	s.Chunks = make([]*chunk, len(chunks))
+	for i, c := range chunks {
+		written, crc := c.progress()
+		s.Chunks[i] = &chunk{Start: c.Start, End: c.end(), Written: written}
+		if written > 0 {
+			s.Chunks[i].Checksum = fmt.Sprintf("%08x", crc)
+		}
+	}
+	s.Completed = completedRanges(s.Chunks)
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return writeFile(stateFile, data)
+}
+
+// completedRanges returns the byte ranges downloaded of the given chunks, sorted and merged.
+func completedRanges(chunks []*chunk) [][2]int64 {
+	var ranges [][2]int64
+	for _, c := range chunks {
+		end := c.Start + c.Written
+		if c.End >= 0 && end > c.End {
+			end = c.End
+		}
+		if end > c.Start {
+			ranges = append(ranges, [2]int64{c.Start, end})
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && r[0] <= merged[n-1][1] {
+			if r[1] > merged[n-1][1] {
+				merged[n-1][1] = r[1]
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// stateInterval is how often the progress of a download is recorded while it is ongoing.
+const stateInterval = time.Second
+
+// chunkState holds the chunks of a download, and records their progress regularly while they
+// are downloaded, so the download can be resumed even if the process dies.
+type chunkState struct {
+	stateFile string
+	header    downloadState
+	// sync flushes the data of the chunks to disk before recording their progress, if set.
+	sync func() error
+
+	mu     sync.Mutex
+	chunks []*chunk
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+// newChunkState starts recording the progress of the given chunks of a download, along with
+// the given state. If syncData is set, it is called before recording it, so it never gets
+// ahead of the data on disk.
+func newChunkState(stateFile string, header downloadState, chunks []*chunk, syncData func() error) *chunkState {
+	s := &chunkState{
+		stateFile: stateFile,
+		header:    header,
+		sync:      syncData,
+		chunks:    chunks,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(stateInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				s.save()
+			}
+		}
+	}()
+	return s
+}
+
+// list returns the chunks of the download.
+func (s *chunkState) list() []*chunk {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.chunks
+}
+
+// set replaces the chunks of the download.
+func (s *chunkState) set(chunks []*chunk) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.chunks = chunks
+}
+
+// setHeader replaces the state recorded along the chunks, like when the content changed.
+func (s *chunkState) setHeader(header downloadState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.header = header
+}
+
+// split moves the end of the given chunk back to at, as long as it still ends at end, and
+// adds a chunk with the rest of it to the download, returning it. It returns nil if the
+// chunk changed in the meantime.
+func (s *chunkState) split(c *chunk, end, at int64) *chunk {
+	// The chunks are locked so they are never saved in between, with a gap.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !atomic.CompareAndSwapInt64(&c.End, end, at) {
+		return nil
+	}
+	rest := &chunk{Start: at, End: end}
+	s.chunks = append(s.chunks[:len(s.chunks):len(s.chunks)], rest)
+	return rest
+}
+
+func (s *chunkState) save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sync != nil {
+		if err := s.sync(); err != nil {
+			return err
+		}
+	}
+	return saveState(s.stateFile, s.header, s.chunks)
+}
+
+// close stops recording the progress of the chunks, recording it one last time.
+// It is safe to call more than once.
+func (s *chunkState) close() error {
+	s.once.Do(func() {
+		close(s.stop)
+		<-s.done
+		s.err = s.save()
+	})
+	return s.err
+}
+
+// chunkWriter writes the data of a chunk at its offset in the file being downloaded.
+type chunkWriter struct {
+	file  dataFile
+	chunk *chunk
+	// hash hashes the data written, if set.
+	hash *streamHasher
+}
+
+func (w *chunkWriter) Write(b []byte) (int, error) {
+	pos := w.chunk.Start + w.chunk.written()
+
+	var split bool
+	if end := w.chunk.end(); end >= 0 && pos+int64(len(b)) > end {
+		// Another goroutine took over the rest of the chunk.
+		split = true
+		if pos > end {
+			pos = end
+		}
+		b = b[:end-pos]
+	}
+
+	n, err := w.file.WriteAt(b, pos)
+	if w.hash != nil {
+		w.hash.write(w.chunk, b[:n], pos)
+	} else {
+		w.chunk.advance(b[:n])
+	}
+	if err == nil && split {
+		err = errChunkSplit
+	}
+	return n, err
+}
+
+// streamHasher hashes content as it is written, in order from the beginning. Data written
+// ahead of what was hashed so far, by other connections, is read back from the file once the
+// data before it is hashed, as chunks finish, so the file is not read again once downloaded.
+type streamHasher struct {
+	hasher  *verifier
+	file    io.ReaderAt
+	buffers *bufferPool
+	// chunks returns the chunks of the download.
+	chunks func() []*chunk
+
+	mu     sync.Mutex
+	offset int64
+	broken bool
+	// catching is set while the data up to catchEnd is read back, without holding mu.
+	catching bool
+	catchEnd int64
+}
+
+// write hashes data written at the given position of the chunk, advancing the chunk past it
+// under the lock, so data is neither missed nor hashed twice by catchUp.
+func (h *streamHasher) write(c *chunk, b []byte, pos int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c.advance(b)
+	if h.broken {
+		return
+	}
+	switch {
+	case h.catching && pos < h.catchEnd, pos < h.offset:
+		// Data already hashed, or being read back, was written again, like when a chunk was
+		// restarted, so the file needs to be hashed once done.
+		h.broken = true
+	case !h.catching && pos == h.offset:
+		h.hasher.Write(b)
+		h.offset += int64(len(b))
+	}
+}
+
+// catchUp hashes the data written ahead of what was hashed so far, reading it back from the
+// file, as long as it follows it. The data is read without holding the lock, so writes of
+// other connections are not held up meanwhile. It is safe to call on a nil streamHasher.
+func (h *streamHasher) catchUp() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.catching {
+		// Whoever is catching up goes on with the data written meanwhile.
+		return
+	}
+
+	for !h.broken {
+		end := h.writtenAhead()
+		if end == 0 {
+			return
+		}
+
+		start := h.offset
+		h.catching, h.catchEnd = true, end
+		h.mu.Unlock()
+		n, err := h.buffers.copy(h.hasher, io.NewSectionReader(h.file, start, end-start))
+		h.mu.Lock()
+		h.catching, h.catchEnd = false, 0
+		h.offset = start + n
+		if err != nil {
+			h.broken = true
+		}
+	}
+}
+
+// writtenAhead returns the end of the data written from the offset hashed so far on, within
+// the chunk holding it, or 0 if none was.
+func (h *streamHasher) writtenAhead() int64 {
+	for _, c := range h.chunks() {
+		written := c.Start + c.written()
+		if e := c.end(); e >= 0 && e < written {
+			written = e
+		}
+		if c.Start <= h.offset && h.offset < written {
+			return written
+		}
+	}
+	return 0
+}
+
+// reset starts hashing over, once the download starts over.
+func (h *streamHasher) reset() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.hasher.reset()
+	h.offset, h.broken = 0, false
+}
+
+// complete tells whether the whole file was hashed along the way. It is safe to call on
+// a nil streamHasher.
+func (h *streamHasher) complete(file *os.File) bool {
+	if h == nil {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fi, err := file.Stat()
+	return err == nil && !h.broken && h.offset == fi.Size()
+}
+
+// steal splits the chunk with the most bytes left to download, among the ones not skipped,
+// returning a new chunk with the second half of them. It returns nil if no chunk is worth it.
+func (gf *Fetcher) steal(state *chunkState, skip func(*chunk) bool) *chunk {
+	for {
+		var slowest *chunk
+		var end, left int64
+		for _, c := range state.list() {
+			e := c.end()
+			if e < 0 || skip(c) {
+				continue
+			}
+			if l := e - c.Start - c.written(); l > left {
+				slowest, end, left = c, e, l
+			}
+		}
+		if slowest == nil || left < 2*minSplitSize {
+			return nil
+		}
+
+		split := end - left/2
+		if gf.blocks != nil {
+			// Chunks are aligned to blocks so they can be verified independently.
+			split = split / gf.blocks.size * gf.blocks.size
+			if split <= end-left {
+				return nil
+			}
+		}
+
+		// The chunk may have been split by someone else in the meantime.
+		if c := state.split(slowest, end, split); c != nil {
+			return c
+		}
+	}
+}
@@ -0,0 +1,455 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestPlanChunks(t *testing.T) {
+	gf := New(WithMinChunkSize(0))
+	assert.Equals(t, []*chunk{{Start: 0, End: 3}, {Start: 3, End: 6}, {Start: 6, End: 10}}, gf.planChunks(10, 3))
+	assert.Equals(t, []*chunk{{Start: 0, End: -1}}, gf.planChunks(-1, 1))
+
+	// Small content is not split in tiny chunks.
+	gf = New(WithMinChunkSize(4))
+	assert.Equals(t, []*chunk{{Start: 0, End: 5}, {Start: 5, End: 10}}, gf.planChunks(10, 3))
+	assert.Equals(t, []*chunk{{Start: 0, End: 3}}, gf.planChunks(3, 3))
+
+	// Chunks are aligned to blocks.
+	gf = New(WithBlockChecksums("sha256", 4), WithMinChunkSize(0))
+	assert.Equals(t, []*chunk{{Start: 0, End: 4}, {Start: 4, End: 10}}, gf.planChunks(10, 2))
+
+	// The chunk size does not depend on the concurrency.
+	gf = New(WithChunkSize(4))
+	assert.Equals(t, []*chunk{{Start: 0, End: 4}, {Start: 4, End: 8}, {Start: 8, End: 10}}, gf.planChunks(10, 2))
+	assert.Equals(t, []*chunk{{Start: 0, End: 0}}, gf.planChunks(0, 2))
+}
+
+func TestChunkState(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "chunk-state")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	stateFile := filepath.Join(dir, "state")
+	assert.Cond(t, loadState(stateFile, 10) == nil, "There should be no state yet")
+
+	header := downloadState{URL: "https://example.com/file", ETag: `"v1"`, Size: 10, Validator: `"v1"`}
+	chunks := []*chunk{{Start: 0, End: 5, Written: 2, crc: 0xcafe}, {Start: 5, End: 10, Written: 5, crc: 0xbeef}}
+	assert.Ok(t, saveState(stateFile, header, chunks))
+
+	s := loadState(stateFile, 10)
+	assert.Cond(t, s != nil, "State should be recorded")
+	assert.Equals(t, []*chunk{{Start: 0, End: 5, Written: 2, Checksum: "0000cafe"}, {Start: 5, End: 10, Written: 5, Checksum: "0000beef"}}, s.Chunks)
+	assert.Equals(t, header.URL, s.URL)
+	assert.Equals(t, header.Validator, s.Validator)
+	assert.Equals(t, [][2]int64{{0, 2}, {5, 10}}, s.Completed)
+
+	// The state of content of another size is not used.
+	assert.Cond(t, loadState(stateFile, 11) == nil, "State should not match another content length")
+}
+
+func TestDownloadStateMatches(t *testing.T) {
+	rsc := &resource{size: 10, header: http.Header{"Etag": {`"v1"`}, "Last-Modified": {"Wed, 21 Oct 2015 07:28:00 GMT"}}}
+	s := newDownloadState("https://example.com/file", rsc, nil)
+	assert.Cond(t, s.matches("https://example.com/file", rsc, nil), "State should match the same content")
+	assert.Cond(t, !s.matches("https://example.com/other/file", rsc, nil), "State should not match another URL")
+
+	changed := &resource{size: 10, header: http.Header{"Etag": {`"v2"`}}}
+	assert.Cond(t, !s.matches("https://example.com/file", changed, nil), "State should not match another ETag")
+
+	changed = &resource{size: 10, header: http.Header{"Last-Modified": {"Thu, 22 Oct 2015 07:28:00 GMT"}}}
+	assert.Cond(t, !s.matches("https://example.com/file", changed, nil), "State should not match another Last-Modified date")
+
+	changed = &resource{size: 11, header: rsc.header}
+	assert.Cond(t, !s.matches("https://example.com/file", changed, nil), "State should not match another size")
+
+	// Validators missing on either side are not compared.
+	assert.Cond(t, s.matches("https://example.com/file", &resource{size: 10}, nil), "State should match content without validators")
+
+	// Mirrors are told apart by digests rather than validators.
+	s = newDownloadState("https://example.com/file", rsc, map[string]string{"sha256": "aa", "md5": "bb"})
+	assert.Cond(t, !s.matches("https://mirror.example.com/file", changed, map[string]string{"sha256": "aa"}),
+		"State should not match a mirror with content of another size")
+	mirror := &resource{size: 10, header: http.Header{"Etag": {`"mirror"`}}}
+	assert.Cond(t, s.matches("https://mirror.example.com/file", mirror, map[string]string{"sha256": "aa"}), "State should match a mirror with the same digest")
+	assert.Cond(t, !s.matches("https://mirror.example.com/file", mirror, map[string]string{"sha256": "aa", "md5": "cc"}), "State should not match a mirror with another digest")
+	assert.Cond(t, !s.matches("https://mirror.example.com/file", mirror, map[string]string{"sha1": "aa"}), "State should not match a mirror without digests in common")
+	assert.Cond(t, !s.matches("https://mirror.example.com/file", mirror, nil), "State should not match a mirror without digests")
+}
+
+func TestVerifyChunks(t *testing.T) {
+	data := []byte("0123456789abcdef")
+	sum := func(b []byte) string { return fmt.Sprintf("%08x", crc32.Checksum(b, crc32c)) }
+
+	chunks := []*chunk{
+		{Start: 0, End: 4, Written: 4, Checksum: sum(data[:4])},
+		// Corrupted on disk.
+		{Start: 4, End: 8, Written: 4, Checksum: sum([]byte("xxxx"))},
+		// Recorded without checksum.
+		{Start: 8, End: 12, Written: 2},
+		// Not written yet when the process crashed.
+		{Start: 12, End: 20, Written: 8, Checksum: sum(append(data[12:], "zzzz"...))},
+	}
+	assert.Ok(t, verifyChunks(bytes.NewReader(data), chunks))
+
+	assert.Equals(t, int64(4), chunks[0].written())
+	assert.Equals(t, int64(0), chunks[1].written())
+	assert.Equals(t, int64(2), chunks[2].written())
+	assert.Equals(t, int64(0), chunks[3].written())
+
+	// Writes resume from the checksum of what is on disk.
+	chunks[2].advance(data[10:12])
+	_, crc := chunks[2].progress()
+	assert.Equals(t, crc32.Checksum(data[8:12], crc32c), crc)
+}
+
+func TestCompletedRanges(t *testing.T) {
+	chunks := []*chunk{{Start: 6, End: 10, Written: 4}, {Start: 0, End: 3, Written: 3}, {Start: 3, End: 6, Written: 9}, {Start: 10, End: 12}}
+	assert.Equals(t, [][2]int64{{0, 10}}, completedRanges(chunks))
+	assert.Equals(t, [][2]int64(nil), completedRanges(nil))
+}
+
+func TestPreallocate(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "prealloc")
+	assert.Ok(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	assert.Ok(t, preallocate(f, 1<<20))
+	fi, err := f.Stat()
+	assert.Ok(t, err)
+	assert.Equals(t, int64(1<<20), fi.Size())
+
+	// Preallocating again keeps what was written.
+	_, err = f.WriteAt([]byte("data"), 10)
+	assert.Ok(t, err)
+	assert.Ok(t, preallocate(f, 1<<20))
+	data := make([]byte, 4)
+	_, err = f.ReadAt(data, 10)
+	assert.Ok(t, err)
+	assert.Equals(t, "data", string(data))
+}
+
+func TestWithChunkSize(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			atomic.AddInt32(&requests, 1)
+		}
+		http.ServeFile(w, r, "./fixtures/test")
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "chunk-size")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	gf := New(WithDestDir(destDir), WithConcurrency(3), WithChunkSize(1<<20))
+	file, err := gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	defer file.Close()
+
+	// The 10 MiB fixture is downloaded in 1 MiB chunks.
+	assert.Equals(t, int32(10), atomic.LoadInt32(&requests))
+
+	hasher := sha512.New()
+	_, err = io.Copy(hasher, file)
+	assert.Ok(t, err)
+	assert.Equals(t, "4ff6e159db38d46a665f26e9f82b98134238c0457cc82727a5258b7184773e4967068cc0eecf3928ecd079f3aea6e22aac024847c6d76c0329c4635c4b6ae327", fmt.Sprintf("%x", hasher.Sum(nil)))
+}
+
+func TestWithSingleConnectionThreshold(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			atomic.AddInt32(&requests, 1)
+		}
+		http.ServeFile(w, r, "./fixtures/test")
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "single-connection")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	gf := New(WithDestDir(destDir), WithConcurrency(4), WithSingleConnectionThreshold(16<<20))
+	file, err := gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	defer file.Close()
+
+	// The 10 MiB fixture is below the threshold.
+	assert.Equals(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestSteal(t *testing.T) {
+	gf := New()
+	slow := &chunk{Start: 0, End: 10 << 20, Written: 2 << 20}
+	state := &chunkState{chunks: []*chunk{slow, {Start: 10 << 20, End: 11 << 20}}}
+
+	c := gf.steal(state, func(*chunk) bool { return false })
+	assert.Equals(t, &chunk{Start: 6 << 20, End: 10 << 20}, c)
+	assert.Equals(t, int64(6<<20), slow.end())
+	assert.Equals(t, 3, len(state.list()))
+
+	// Writing past the new end of the chunk stops at it.
+	f, err := ioutil.TempFile(os.TempDir(), "steal")
+	assert.Ok(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	atomic.StoreInt64(&slow.Written, 6<<20-2)
+	n, err := (&chunkWriter{file: f, chunk: slow}).Write([]byte("data"))
+	assert.Equals(t, errChunkSplit, err)
+	assert.Equals(t, 2, n)
+	assert.Cond(t, slow.done(), "chunk should be done")
+
+	// Chunks too small are not split.
+	state = &chunkState{chunks: []*chunk{{Start: 0, End: 1 << 20}}}
+	assert.Cond(t, gf.steal(state, func(*chunk) bool { return false }) == nil, "chunk should not be split")
+}
+
+// slowWriter slows down responses.
+type slowWriter struct {
+	http.ResponseWriter
+}
+
+func (w slowWriter) Write(b []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	return w.ResponseWriter.Write(b)
+}
+
+func TestWithWorkStealing(t *testing.T) {
+	content := make([]byte, 8<<20)
+	for i := range content {
+		content[i] = byte(i)
+	}
+
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			atomic.AddInt32(&requests, 1)
+		}
+		// The connection downloading the first half of the content is slow.
+		if r.Header.Get("Range") == "bytes=0-4194303" {
+			w = slowWriter{w}
+		}
+		http.ServeContent(w, r, "test", time.Time{}, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "work-stealing")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	gf := New(WithDestDir(destDir), WithConcurrency(2), WithWorkStealing())
+	file, err := gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(file)
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(content, data), "downloaded content does not match")
+	assert.Cond(t, atomic.LoadInt32(&requests) > 2, "slow chunk should have been split")
+}
+
+func TestStreamHasher(t *testing.T) {
+	file, err := ioutil.TempFile(os.TempDir(), "stream-hasher")
+	assert.Ok(t, err)
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	hasher, err := newVerifier([]checksum{{algorithm: "sha256", computeOnly: true}})
+	assert.Ok(t, err)
+	chunks := []*chunk{{Start: 0, End: 3}, {Start: 3, End: 6}}
+	h := &streamHasher{hasher: hasher, file: file, buffers: newBufferPool(32 * 1024), chunks: func() []*chunk { return chunks }}
+
+	// The second chunk is written ahead of the first one, and read back once it is done.
+	_, err = (&chunkWriter{file: file, chunk: chunks[1], hash: h}).Write([]byte("def"))
+	assert.Ok(t, err)
+	_, err = (&chunkWriter{file: file, chunk: chunks[0], hash: h}).Write([]byte("abc"))
+	assert.Ok(t, err)
+	assert.Cond(t, !h.complete(file), "Data written ahead should not be hashed until caught up with")
+	h.catchUp()
+	assert.Cond(t, h.complete(file), "Data should be hashed completely")
+	assert.Equals(t, fmt.Sprintf("%x", sha256.Sum256([]byte("abcdef"))), hasher.digests()["sha256"])
+
+	// Writing data again means it has to be hashed once done.
+	h.write(chunks[0], []byte("abc"), 0)
+	assert.Cond(t, !h.complete(file), "Data written again should not be hashed")
+
+	var none *streamHasher
+	assert.Cond(t, !none.complete(file), "Nothing should be hashed without a hasher")
+
+	// Other connections keep writing while data is read back.
+	hasher.reset()
+	chunks = []*chunk{{Start: 0, End: 3}, {Start: 3, End: 6}, {Start: 6, End: 9}}
+	reading, gate := make(chan struct{}), make(chan struct{})
+	h = &streamHasher{hasher: hasher, file: &gatedReaderAt{ReaderAt: file, reading: reading, gate: gate},
+		buffers: newBufferPool(32 * 1024), chunks: func() []*chunk { return chunks }}
+	_, err = (&chunkWriter{file: file, chunk: chunks[1], hash: h}).Write([]byte("def"))
+	assert.Ok(t, err)
+	_, err = (&chunkWriter{file: file, chunk: chunks[0], hash: h}).Write([]byte("abc"))
+	assert.Ok(t, err)
+	caughtUp := make(chan struct{})
+	go func() {
+		h.catchUp()
+		close(caughtUp)
+	}()
+	<-reading
+	written := make(chan error)
+	go func() {
+		_, err := (&chunkWriter{file: file, chunk: chunks[2], hash: h}).Write([]byte("ghi"))
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		assert.Ok(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Writes should not wait for data to be read back")
+	}
+	close(gate)
+	<-caughtUp
+	h.catchUp()
+	assert.Equals(t, fmt.Sprintf("%x", sha256.Sum256([]byte("abcdefghi"))), hasher.digests()["sha256"])
+}
+
+// gatedReaderAt tells when it is read from, and waits for its gate to be open to be read.
+type gatedReaderAt struct {
+	io.ReaderAt
+	reading chan struct{}
+	gate    chan struct{}
+	once    sync.Once
+}
+
+func (r *gatedReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	r.once.Do(func() { close(r.reading) })
+	<-r.gate
+	return r.ReaderAt.ReadAt(b, off)
+}
+
+func TestWithSync(t *testing.T) {
+	ts := httptest.NewServer(http.FileServer(http.Dir("./fixtures")))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "sync")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	// Progress is recorded only once the data is flushed.
+	var synced int32
+	state := newChunkState(filepath.Join(destDir, "state"), downloadState{}, []*chunk{{Start: 0, End: 10}}, func() error {
+		atomic.AddInt32(&synced, 1)
+		return nil
+	})
+	assert.Ok(t, state.close())
+	assert.Equals(t, int32(1), atomic.LoadInt32(&synced))
+
+	gf := New(WithDestDir(destDir), WithConcurrency(4), WithSync(SyncFull))
+	file, err := gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	defer file.Close()
+
+	hasher := sha512.New()
+	_, err = io.Copy(hasher, file)
+	assert.Ok(t, err)
+	assert.Equals(t, "4ff6e159db38d46a665f26e9f82b98134238c0457cc82727a5258b7184773e4967068cc0eecf3928ecd079f3aea6e22aac024847c6d76c0329c4635c4b6ae327", fmt.Sprintf("%x", hasher.Sum(nil)))
+}
+
+func TestWithTempDir(t *testing.T) {
+	ts := httptest.NewServer(http.FileServer(http.Dir("./fixtures")))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "temp-dir-dest")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	tempDir, err := ioutil.TempDir(os.TempDir(), "temp-dir")
+	assert.Ok(t, err)
+	defer os.RemoveAll(tempDir)
+
+	gf := New(WithDestDir(destDir), WithTempDir(tempDir), WithConcurrency(2))
+	assert.Equals(t, filepath.Join(tempDir, "test-resume.chunks"), gf.chunksDir(ts.URL+"/test-resume"))
+
+	file, err := gf.Fetch(ts.URL+"/test-resume", nil)
+	assert.Ok(t, err)
+	defer file.Close()
+	assert.Equals(t, filepath.Join(destDir, "test-resume"), file.Name())
+
+	entries, err := ioutil.ReadDir(tempDir)
+	assert.Ok(t, err)
+	assert.Equals(t, 0, len(entries))
+}
+
+func TestWithCleanupOnFailure(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeFile(w, r, "./fixtures/test-resume")
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "cleanup-on-failure")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	// Failed downloads are kept to resume them by default.
+	gf := New(WithDestDir(destDir))
+	_, err = gf.Fetch(ts.URL+"/test-resume", nil)
+	assert.Cond(t, err != nil, "Download should fail")
+	_, err = os.Stat(gf.chunksDir(ts.URL + "/test-resume"))
+	assert.Ok(t, err)
+
+	gf = New(WithDestDir(destDir), WithCleanupOnFailure())
+	_, err = gf.Fetch(ts.URL+"/test-resume", nil)
+	assert.Cond(t, err != nil, "Download should fail")
+	_, err = os.Stat(gf.chunksDir(ts.URL + "/test-resume"))
+	assert.Cond(t, os.IsNotExist(err), "Chunks should be removed")
+}
+
+func TestRemoveStaleChunks(t *testing.T) {
+	destDir, err := ioutil.TempDir(os.TempDir(), "stale-chunks")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	old := time.Now().Add(-2 * time.Hour)
+	for _, name := range []string{"stale.chunks", "recent.chunks", "other"} {
+		dir := filepath.Join(destDir, name)
+		assert.Ok(t, os.MkdirAll(dir, 0760))
+		assert.Ok(t, ioutil.WriteFile(filepath.Join(dir, "state"), []byte("{}"), 0660))
+		if name != "recent.chunks" {
+			assert.Ok(t, os.Chtimes(filepath.Join(dir, "state"), old, old))
+			assert.Ok(t, os.Chtimes(dir, old, old))
+		}
+	}
+
+	gf := New(WithDestDir(destDir))
+	assert.Ok(t, gf.RemoveStaleChunks(time.Hour))
+
+	_, err = os.Stat(filepath.Join(destDir, "stale.chunks"))
+	assert.Cond(t, os.IsNotExist(err), "Stale chunks should be removed")
+	_, err = os.Stat(filepath.Join(destDir, "recent.chunks"))
+	assert.Ok(t, err)
+	_, err = os.Stat(filepath.Join(destDir, "other"))
+	assert.Ok(t, err)
+}
@@ -0,0 +1,423 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxDASHSegments bounds the number of segments of DASH manifests, whose templates could
+// otherwise describe endless streams.
+const maxDASHSegments = 1000000
+
+// mpd is the part of DASH manifests, or Media Presentation Descriptions, telling which segments
+// make up the stream.
+type mpd struct {
+	Type     string      `xml:"type,attr"`
+	Duration string      `xml:"mediaPresentationDuration,attr"`
+	BaseURL  []string    `xml:"BaseURL"`
+	Periods  []mpdPeriod `xml:"Period"`
+}
+
+type mpdPeriod struct {
+	Duration        string              `xml:"duration,attr"`
+	BaseURL         []string            `xml:"BaseURL"`
+	SegmentList     *mpdSegmentList     `xml:"SegmentList"`
+	SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+	AdaptationSets  []mpdAdaptationSet  `xml:"AdaptationSet"`
+}
+
+type mpdAdaptationSet struct {
+	MimeType        string              `xml:"mimeType,attr"`
+	ContentType     string              `xml:"contentType,attr"`
+	BaseURL         []string            `xml:"BaseURL"`
+	SegmentList     *mpdSegmentList     `xml:"SegmentList"`
+	SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+	Representations []mpdRepresentation `xml:"Representation"`
+}
+
+type mpdRepresentation struct {
+	ID              string              `xml:"id,attr"`
+	Bandwidth       int64               `xml:"bandwidth,attr"`
+	MimeType        string              `xml:"mimeType,attr"`
+	BaseURL         []string            `xml:"BaseURL"`
+	SegmentList     *mpdSegmentList     `xml:"SegmentList"`
+	SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+}
+
+type mpdURL struct {
+	SourceURL string `xml:"sourceURL,attr"`
+	Range     string `xml:"range,attr"`
+}
+
+type mpdSegmentList struct {
+	Initialization *mpdURL `xml:"Initialization"`
+	SegmentURLs    []struct {
+		Media      string `xml:"media,attr"`
+		MediaRange string `xml:"mediaRange,attr"`
+	} `xml:"SegmentURL"`
+}
+
+type mpdSegmentTemplate struct {
+	Media          string       `xml:"media,attr"`
+	Initialization string       `xml:"initialization,attr"`
+	StartNumber    *int64       `xml:"startNumber,attr"`
+	Timescale      *int64       `xml:"timescale,attr"`
+	Duration       *int64       `xml:"duration,attr"`
+	Timeline       *mpdTimeline `xml:"SegmentTimeline"`
+}
+
+type mpdTimeline struct {
+	S []struct {
+		T *int64 `xml:"t,attr"`
+		D int64  `xml:"d,attr"`
+		R int64  `xml:"r,attr"`
+	} `xml:"S"`
+}
+
+// inherit returns the template with the attributes missing from it taken from the given one,
+// as templates of representations inherit the ones of their adaptation set and period.
+func (t *mpdSegmentTemplate) inherit(parent *mpdSegmentTemplate) *mpdSegmentTemplate {
+	if t == nil {
+		return parent
+	}
+	if parent == nil {
+		return t
+	}
+	merged := *t
+	if merged.Media == "" {
+		merged.Media = parent.Media
+	}
+	if merged.Initialization == "" {
+		merged.Initialization = parent.Initialization
+	}
+	if merged.StartNumber == nil {
+		merged.StartNumber = parent.StartNumber
+	}
+	if merged.Timescale == nil {
+		merged.Timescale = parent.Timescale
+	}
+	if merged.Duration == nil {
+		merged.Duration = parent.Duration
+	}
+	if merged.Timeline == nil {
+		merged.Timeline = parent.Timeline
+	}
+	return &merged
+}
+
+// parseDASH parses the DASH manifest at the given location, returning the segments of the
+// representation with the highest bandwidth of each period, among the video ones if any, and
+// their extension.
+func parseDASH(location string, data []byte) ([]segment, string, error) {
+	var m mpd
+	if err := xml.Unmarshal(data, &m); err != nil {
+		return nil, "", errors.Wrapf(err, "failed parsing manifest %s", location)
+	}
+	if m.Type == "dynamic" {
+		return nil, "", fmt.Errorf("manifest %s describes a live stream, which is not supported", location)
+	}
+
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, "", err
+	}
+	if base, err = resolveBaseURL(base, m.BaseURL); err != nil {
+		return nil, "", err
+	}
+
+	var segments []segment
+	var mimeType string
+	for i, p := range m.Periods {
+		as, r := p.representation()
+		if r == nil {
+			continue
+		}
+		if mimeType == "" {
+			if mimeType = r.MimeType; mimeType == "" {
+				mimeType = as.MimeType
+			}
+		}
+
+		repBase := base
+		for _, urls := range [][]string{p.BaseURL, as.BaseURL, r.BaseURL} {
+			if repBase, err = resolveBaseURL(repBase, urls); err != nil {
+				return nil, "", err
+			}
+		}
+
+		duration := p.Duration
+		if duration == "" && len(m.Periods) == 1 {
+			duration = m.Duration
+		}
+
+		var s []segment
+		switch {
+		case r.SegmentList != nil || as.SegmentList != nil || p.SegmentList != nil:
+			list := r.SegmentList
+			for _, l := range []*mpdSegmentList{as.SegmentList, p.SegmentList} {
+				if list == nil {
+					list = l
+				}
+			}
+			s, err = dashSegmentList(repBase, list)
+		case r.SegmentTemplate != nil || as.SegmentTemplate != nil || p.SegmentTemplate != nil:
+			t := r.SegmentTemplate.inherit(as.SegmentTemplate.inherit(p.SegmentTemplate))
+			s, err = dashSegmentTemplate(repBase, t, r, duration)
+		default:
+			// Representations with a single segment are the file at their base URL.
+			s = []segment{{url: repBase.String(), size: -1}}
+		}
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "period %d of manifest %s", i+1, location)
+		}
+		segments = append(segments, s...)
+	}
+
+	ext := ".mp4"
+	switch {
+	case strings.HasSuffix(mimeType, "/webm"):
+		ext = ".webm"
+	case strings.HasPrefix(mimeType, "audio/mp4"):
+		ext = ".m4a"
+	}
+	return segments, ext, nil
+}
+
+// representation returns the representation of the period with the highest bandwidth,
+// preferring the ones of video adaptation sets, along with its adaptation set.
+func (p *mpdPeriod) representation() (*mpdAdaptationSet, *mpdRepresentation) {
+	var bestSet *mpdAdaptationSet
+	var best *mpdRepresentation
+	var bestVideo bool
+	for i := range p.AdaptationSets {
+		as := &p.AdaptationSets[i]
+		for j := range as.Representations {
+			r := &as.Representations[j]
+			video := as.ContentType == "video" || strings.HasPrefix(as.MimeType, "video/") || strings.HasPrefix(r.MimeType, "video/")
+			if best == nil || video && !bestVideo || video == bestVideo && r.Bandwidth > best.Bandwidth {
+				bestSet, best, bestVideo = as, r, video
+			}
+		}
+	}
+	return bestSet, best
+}
+
+// resolveBaseURL resolves the first of the given BaseURL elements, if any, against the base.
+func resolveBaseURL(base *url.URL, urls []string) (*url.URL, error) {
+	if len(urls) == 0 {
+		return base, nil
+	}
+	u, err := base.Parse(strings.TrimSpace(urls[0]))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid base URL %q", urls[0])
+	}
+	return u, nil
+}
+
+// dashSegment returns the segment at the given URI, resolved against the base URL, limited to
+// the given byte range, like 0-1023, if any.
+func dashSegment(base *url.URL, uri, byteRange string) (segment, error) {
+	u := base
+	if uri != "" {
+		var err error
+		if u, err = base.Parse(uri); err != nil {
+			return segment{}, errors.Wrapf(err, "invalid segment URL %q", uri)
+		}
+	}
+	s := segment{url: u.String(), size: -1}
+	if byteRange == "" {
+		return s, nil
+	}
+
+	i := strings.Index(byteRange, "-")
+	if i < 0 {
+		return segment{}, fmt.Errorf("invalid byte range %q", byteRange)
+	}
+	start, err := strconv.ParseInt(byteRange[:i], 10, 64)
+	if err != nil || start < 0 {
+		return segment{}, fmt.Errorf("invalid byte range %q", byteRange)
+	}
+	s.offset = start
+	if byteRange[i+1:] != "" {
+		end, err := strconv.ParseInt(byteRange[i+1:], 10, 64)
+		if err != nil || end < start {
+			return segment{}, fmt.Errorf("invalid byte range %q", byteRange)
+		}
+		s.size = end - start + 1
+	}
+	return s, nil
+}
+
+// dashSegmentList returns the segments listed by a SegmentList element.
+func dashSegmentList(base *url.URL, list *mpdSegmentList) ([]segment, error) {
+	var segments []segment
+	if init := list.Initialization; init != nil {
+		s, err := dashSegment(base, init.SourceURL, init.Range)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, s)
+	}
+	for _, u := range list.SegmentURLs {
+		s, err := dashSegment(base, u.Media, u.MediaRange)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, s)
+	}
+	return segments, nil
+}
+
+// dashSegmentTemplate returns the segments described by a SegmentTemplate element, either
+// through its timeline or, if missing, through the duration of the segments and of the period.
+func dashSegmentTemplate(base *url.URL, t *mpdSegmentTemplate, r *mpdRepresentation, duration string) ([]segment, error) {
+	if t.Media == "" {
+		return nil, errors.New("segment template without media")
+	}
+	number := int64(1)
+	if t.StartNumber != nil {
+		number = *t.StartNumber
+	}
+	timescale := int64(1)
+	if t.Timescale != nil && *t.Timescale > 0 {
+		timescale = *t.Timescale
+	}
+
+	var segments []segment
+	add := func(tmpl string, number, time int64) error {
+		s, err := dashSegment(base, expandDASHTemplate(tmpl, r, number, time), "")
+		if err != nil {
+			return err
+		}
+		segments = append(segments, s)
+		return nil
+	}
+	if t.Initialization != "" {
+		if err := add(t.Initialization, 0, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	periodEnd := int64(-1)
+	if duration != "" {
+		d, err := parseISODuration(duration)
+		if err != nil {
+			return nil, err
+		}
+		periodEnd = int64(math.Ceil(d.Seconds() * float64(timescale)))
+	}
+
+	if t.Timeline != nil {
+		var time int64
+		for i, s := range t.Timeline.S {
+			if s.T != nil {
+				time = *s.T
+			}
+			if s.D <= 0 {
+				return nil, errors.New("segment timeline with segments of no duration")
+			}
+			repeat := s.R
+			if repeat < 0 {
+				// Segments are repeated up to the next one, or up to the end of the period.
+				end := periodEnd
+				if i+1 < len(t.Timeline.S) && t.Timeline.S[i+1].T != nil {
+					end = *t.Timeline.S[i+1].T
+				}
+				if end < 0 {
+					return nil, errors.New("segment timeline repeated up to an unknown end")
+				}
+				repeat = (end-time+s.D-1)/s.D - 1
+			}
+			for j := int64(0); j <= repeat; j++ {
+				if len(segments) > maxDASHSegments {
+					return nil, fmt.Errorf("more than %d segments", maxDASHSegments)
+				}
+				if err := add(t.Media, number, time); err != nil {
+					return nil, err
+				}
+				number++
+				time += s.D
+			}
+		}
+		return segments, nil
+	}
+
+	if t.Duration == nil || *t.Duration <= 0 {
+		return nil, errors.New("segment template with neither timeline nor duration")
+	}
+	if periodEnd < 0 {
+		return nil, errors.New("segment template in a period of unknown duration")
+	}
+	count := (periodEnd + *t.Duration - 1) / *t.Duration
+	if count > maxDASHSegments {
+		return nil, fmt.Errorf("more than %d segments", maxDASHSegments)
+	}
+	for i := int64(0); i < count; i++ {
+		if err := add(t.Media, number+i, i**t.Duration); err != nil {
+			return nil, err
+		}
+	}
+	return segments, nil
+}
+
+// dashIdentifier matches the identifiers of segment templates, like $Number$ or $Number%05d$.
+var dashIdentifier = regexp.MustCompile(`\$(RepresentationID|Number|Bandwidth|Time)(%0\d+d)?\$|\$\$`)
+
+// expandDASHTemplate substitutes the identifiers of the given segment template.
+func expandDASHTemplate(tmpl string, r *mpdRepresentation, number, time int64) string {
+	return dashIdentifier.ReplaceAllStringFunc(tmpl, func(id string) string {
+		if id == "$$" {
+			return "$"
+		}
+		m := dashIdentifier.FindStringSubmatch(id)
+		format := "%d"
+		if m[2] != "" {
+			format = m[2]
+		}
+		switch m[1] {
+		case "RepresentationID":
+			return r.ID
+		case "Number":
+			return fmt.Sprintf(format, number)
+		case "Bandwidth":
+			return fmt.Sprintf(format, r.Bandwidth)
+		default:
+			return fmt.Sprintf(format, time)
+		}
+	})
+}
+
+// isoDuration matches the durations of DASH manifests, like PT1H2M3.5S.
+var isoDuration = regexp.MustCompile(`^P(?:(\d+(?:\.\d+)?)Y)?(?:(\d+(?:\.\d+)?)M)?(?:(\d+(?:\.\d+)?)D)?(?:T(?:(\d+(?:\.\d+)?)H)?(?:(\d+(?:\.\d+)?)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// parseISODuration parses ISO 8601 durations, taking years as 365 days and months as 30 days.
+func parseISODuration(s string) (time.Duration, error) {
+	m := isoDuration.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil || s == "P" || strings.HasSuffix(s, "T") {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	var d float64
+	for i, unit := range []float64{365 * 24 * 3600, 30 * 24 * 3600, 24 * 3600, 3600, 60, 1} {
+		if m[i+1] == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(m[i+1], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		d += v * unit
+	}
+	return time.Duration(d * float64(time.Second)), nil
+}
@@ -0,0 +1,108 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestParseDASH(t *testing.T) {
+	manifest := `<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static" mediaPresentationDuration="PT9.5S">
+  <BaseURL>media/</BaseURL>
+  <Period>
+    <AdaptationSet contentType="audio" mimeType="audio/mp4">
+      <Representation id="audio" bandwidth="9000000"/>
+    </AdaptationSet>
+    <AdaptationSet mimeType="video/mp4">
+      <SegmentTemplate timescale="1000" duration="4000" startNumber="0"
+        initialization="$RepresentationID$/init.mp4" media="$RepresentationID$/seg-$Number%03d$.m4s"/>
+      <Representation id="360p" bandwidth="800000"/>
+      <Representation id="720p" bandwidth="2400000"/>
+    </AdaptationSet>
+  </Period>
+</MPD>`
+	segments, ext, err := parseDASH("https://example.com/video/manifest.mpd", []byte(manifest))
+	assert.Ok(t, err)
+	assert.Equals(t, ".mp4", ext)
+	assert.Equals(t, []segment{
+		{url: "https://example.com/video/media/720p/init.mp4", size: -1},
+		{url: "https://example.com/video/media/720p/seg-000.m4s", size: -1},
+		{url: "https://example.com/video/media/720p/seg-001.m4s", size: -1},
+		{url: "https://example.com/video/media/720p/seg-002.m4s", size: -1},
+	}, segments)
+
+	timeline := `<MPD type="static">
+  <Period duration="PT20S">
+    <AdaptationSet mimeType="video/webm">
+      <Representation id="v" bandwidth="1000">
+        <SegmentTemplate timescale="10" media="chunk-$Time$.webm" initialization="init-$Bandwidth$.webm">
+          <SegmentTimeline><S t="0" d="50" r="1"/><S d="25" r="-1"/></SegmentTimeline>
+        </SegmentTemplate>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+</MPD>`
+	segments, ext, err = parseDASH("https://example.com/manifest.mpd", []byte(timeline))
+	assert.Ok(t, err)
+	assert.Equals(t, ".webm", ext)
+	var urls []string
+	for _, s := range segments {
+		urls = append(urls, s.url)
+	}
+	assert.Equals(t, []string{
+		"https://example.com/init-1000.webm",
+		"https://example.com/chunk-0.webm",
+		"https://example.com/chunk-50.webm",
+		"https://example.com/chunk-100.webm",
+		"https://example.com/chunk-125.webm",
+		"https://example.com/chunk-150.webm",
+		"https://example.com/chunk-175.webm",
+	}, urls)
+
+	list := `<MPD>
+  <Period>
+    <AdaptationSet>
+      <Representation id="v" bandwidth="1000">
+        <BaseURL>https://cdn.example.com/video.mp4</BaseURL>
+        <SegmentList>
+          <Initialization range="0-99"/>
+          <SegmentURL mediaRange="100-1099"/>
+          <SegmentURL mediaRange="1100-"/>
+        </SegmentList>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+</MPD>`
+	segments, _, err = parseDASH("https://example.com/manifest.mpd", []byte(list))
+	assert.Ok(t, err)
+	assert.Equals(t, []segment{
+		{url: "https://cdn.example.com/video.mp4", offset: 0, size: 100},
+		{url: "https://cdn.example.com/video.mp4", offset: 100, size: 1000},
+		{url: "https://cdn.example.com/video.mp4", offset: 1100, size: -1},
+	}, segments)
+
+	_, _, err = parseDASH("https://example.com/manifest.mpd", []byte(`<MPD type="dynamic"><Period/></MPD>`))
+	assert.Cond(t, err != nil, "live manifests should be rejected")
+}
+
+func TestParseISODuration(t *testing.T) {
+	for s, expected := range map[string]time.Duration{
+		"PT9.5S":    9500 * time.Millisecond,
+		"PT1H2M3S":  time.Hour + 2*time.Minute + 3*time.Second,
+		"P1DT0.25S": 24*time.Hour + 250*time.Millisecond,
+	} {
+		d, err := parseISODuration(s)
+		assert.Ok(t, err)
+		assert.Equals(t, expected, d)
+	}
+	for _, s := range []string{"", "P", "PT", "1H", "PT1X"} {
+		_, err := parseISODuration(s)
+		assert.Cond(t, err != nil, "%q should not be a valid duration", s)
+	}
+}
@@ -0,0 +1,117 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// dataHandler fetches the content embedded in data: URIs (RFC 2397).
+type dataHandler struct{}
+
+func (dataHandler) Stat(ctx context.Context, rawURL string) (*ContentInfo, error) {
+	_, data, err := parseDataURI(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return &ContentInfo{Size: int64(len(data)), Ranges: true}, nil
+}
+
+func (dataHandler) Open(ctx context.Context, rawURL string, offset, length int64) (io.ReadCloser, error) {
+	_, data, err := parseDataURI(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return ioutil.NopCloser(bytes.NewReader(data[offset:])), nil
+}
+
+// parseDataURI returns the parameters of the media type of a data: URI, keyed by lower case
+// name, and the content it embeds.
+func parseDataURI(rawURL string) (map[string]string, []byte, error) {
+	if len(rawURL) < len("data:") || !strings.EqualFold(rawURL[:len("data:")], "data:") {
+		return nil, nil, fmt.Errorf("invalid data URI: %.32s", rawURL)
+	}
+	comma := strings.IndexByte(rawURL, ',')
+	if comma < 0 {
+		return nil, nil, fmt.Errorf("invalid data URI, missing comma: %.32s", rawURL)
+	}
+
+	var encoded bool
+	params := make(map[string]string)
+	for i, param := range strings.Split(rawURL[len("data:"):comma], ";") {
+		if i == 0 {
+			// The media type itself.
+			continue
+		}
+		if strings.EqualFold(param, "base64") {
+			encoded = true
+			continue
+		}
+		if parts := strings.SplitN(param, "=", 2); len(parts) == 2 {
+			value, err := url.PathUnescape(parts[1])
+			if err != nil {
+				value = parts[1]
+			}
+			params[strings.ToLower(parts[0])] = value
+		}
+	}
+
+	payload, err := url.PathUnescape(rawURL[comma+1:])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid data URI: %s", err)
+	}
+	if !encoded {
+		return params, []byte(payload), nil
+	}
+
+	payload = strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, payload)
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		// Padding is often left out.
+		if data, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(payload, "=")); err != nil {
+			return nil, nil, fmt.Errorf("invalid data URI: %s", err)
+		}
+	}
+	return params, data, nil
+}
+
+// stdinURL is the URL content is read from the standard input through.
+const stdinURL = "-"
+
+// stdinRead is set to 1 once the standard input is opened, it is updated atomically.
+var stdinRead int32
+
+// stdinHandler fetches the content of the standard input, which can only be read once.
+type stdinHandler struct{}
+
+func (stdinHandler) Stat(ctx context.Context, rawURL string) (*ContentInfo, error) {
+	return &ContentInfo{Size: -1}, nil
+}
+
+func (stdinHandler) Open(ctx context.Context, rawURL string, offset, length int64) (io.ReadCloser, error) {
+	if !atomic.CompareAndSwapInt32(&stdinRead, 0, 1) {
+		return nil, errors.New("standard input was already read")
+	}
+	return ioutil.NopCloser(os.Stdin), nil
+}
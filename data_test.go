@@ -0,0 +1,77 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestDataURI(t *testing.T) {
+	destDir, err := ioutil.TempDir(os.TempDir(), "data-uri")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	tests := []struct {
+		url  string
+		name string
+		data string
+	}{
+		{"data:,Hello%2C%20World%21", "data", "Hello, World!"},
+		{"data:text/plain;name=hello.txt;base64,SGVsbG8sIFdvcmxkIQ==", "hello.txt", "Hello, World!"},
+		{"data:application/json;name=..%2F..%2Fescape.json;base64,eyJvayI6dHJ1ZX0", "escape.json", `{"ok":true}`},
+	}
+
+	for _, tt := range tests {
+		gf := New(WithDestDir(destDir), WithChecksum("sha256", fmt.Sprintf("%x", sha256.Sum256([]byte(tt.data)))))
+		file, err := gf.Fetch(tt.url, nil)
+		assert.Ok(t, err)
+
+		got, err := ioutil.ReadAll(file)
+		file.Close()
+		assert.Ok(t, err)
+		assert.Equals(t, tt.data, string(got))
+		assert.Equals(t, filepath.Join(destDir, tt.name), file.Name())
+	}
+
+	_, err = New(WithDestDir(destDir)).Fetch("data:text/plain;base64", nil)
+	assert.Cond(t, err != nil, "data URI without comma should be rejected")
+}
+
+func TestStdin(t *testing.T) {
+	destDir, err := ioutil.TempDir(os.TempDir(), "stdin")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	input := filepath.Join(destDir, "input")
+	assert.Ok(t, ioutil.WriteFile(input, []byte("piped payload"), 0640))
+	stdin, err := os.Open(input)
+	assert.Ok(t, err)
+	defer stdin.Close()
+
+	defer func(orig *os.File) { os.Stdin = orig }(os.Stdin)
+	os.Stdin = stdin
+	stdinRead = 0
+
+	gf := New(WithDestDir(destDir), WithChecksum("sha256", fmt.Sprintf("%x", sha256.Sum256([]byte("piped payload")))))
+	file, err := gf.Fetch("-", nil)
+	assert.Ok(t, err)
+	defer file.Close()
+
+	got, err := ioutil.ReadAll(file)
+	assert.Ok(t, err)
+	assert.Equals(t, "piped payload", string(got))
+	assert.Equals(t, filepath.Join(destDir, "stdin"), file.Name())
+
+	// The standard input cannot be read twice.
+	_, err = New(WithDestDir(filepath.Join(destDir, "again"))).Fetch("-", nil)
+	assert.Cond(t, err != nil, "standard input should only be read once")
+}
@@ -0,0 +1,210 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// digestAuth implements HTTP Digest access authentication as described in RFC 7616.
+// Once the server sends a challenge, it is reused to authenticate subsequent requests
+// upfront, so chunk requests do not need an extra round trip each.
+type digestAuth struct {
+	username string
+	password string
+
+	mu        sync.Mutex
+	challenge *digestChallenge
+	nc        int
+}
+
+// digestChallenge holds the parameters of a WWW-Authenticate: Digest challenge.
+type digestChallenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	qop       string
+}
+
+// do sends the request, authenticating it if a challenge is known already, or
+// resending it with credentials if the server responds with a new challenge.
+func (d *digestAuth) do(client *http.Client, req *http.Request) (*http.Response, error) {
+	d.authorize(req)
+
+	res, err := client.Do(req)
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+
+	challenge := parseDigestChallenge(res.Header["Www-Authenticate"])
+	if challenge == nil {
+		return res, nil
+	}
+	res.Body.Close()
+
+	d.mu.Lock()
+	d.challenge = challenge
+	d.nc = 0
+	d.mu.Unlock()
+
+	retry := req.Clone(req.Context())
+	d.authorize(retry)
+	return client.Do(retry)
+}
+
+// authorize adds the Authorization header to the request if a challenge is known.
+func (d *digestAuth) authorize(req *http.Request) {
+	d.mu.Lock()
+	c := d.challenge
+	d.nc++
+	nc := fmt.Sprintf("%08x", d.nc)
+	d.mu.Unlock()
+
+	if c == nil {
+		return
+	}
+
+	var h func() hash.Hash
+	switch strings.TrimSuffix(strings.ToUpper(c.algorithm), "-SESS") {
+	case "SHA-256":
+		h = sha256.New
+	default:
+		h = md5.New
+	}
+
+	digest := func(values ...string) string {
+		hasher := h()
+		hasher.Write([]byte(strings.Join(values, ":")))
+		return hex.EncodeToString(hasher.Sum(nil))
+	}
+
+	cnonce := newCnonce()
+	uri := req.URL.RequestURI()
+
+	ha1 := digest(d.username, c.realm, d.password)
+	if strings.HasSuffix(strings.ToUpper(c.algorithm), "-SESS") {
+		ha1 = digest(ha1, c.nonce, cnonce)
+	}
+	ha2 := digest(req.Method, uri)
+
+	var response string
+	if c.qop == "" {
+		// RFC 2069 compatibility.
+		response = digest(ha1, c.nonce, ha2)
+	} else {
+		response = digest(ha1, c.nonce, nc, cnonce, c.qop, ha2)
+	}
+
+	auth := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s"`,
+		d.username, c.realm, c.nonce, uri, response)
+	if c.algorithm != "" {
+		auth += ", algorithm=" + c.algorithm
+	}
+	if c.qop != "" {
+		auth += fmt.Sprintf(`, qop=%s, nc=%s, cnonce="%s"`, c.qop, nc, cnonce)
+	}
+	if c.opaque != "" {
+		auth += fmt.Sprintf(`, opaque="%s"`, c.opaque)
+	}
+	req.Header.Set("Authorization", auth)
+}
+
+// parseDigestChallenge returns the strongest supported Digest challenge found
+// in the given WWW-Authenticate header values, or nil if there is none.
+func parseDigestChallenge(values []string) *digestChallenge {
+	var best *digestChallenge
+	for _, value := range values {
+		if !strings.HasPrefix(strings.ToLower(value), "digest ") {
+			continue
+		}
+
+		params := parseAuthParams(value[len("digest "):])
+		c := &digestChallenge{
+			realm:     params["realm"],
+			nonce:     params["nonce"],
+			opaque:    params["opaque"],
+			algorithm: params["algorithm"],
+		}
+
+		// Only the auth quality of protection is supported.
+		if qop, ok := params["qop"]; ok {
+			for _, q := range strings.Split(qop, ",") {
+				if strings.TrimSpace(q) == "auth" {
+					c.qop = "auth"
+				}
+			}
+			if c.qop == "" {
+				continue
+			}
+		}
+
+		switch strings.ToUpper(c.algorithm) {
+		case "", "MD5", "MD5-SESS":
+			if best == nil {
+				best = c
+			}
+		case "SHA-256", "SHA-256-SESS":
+			return c
+		}
+	}
+	return best
+}
+
+// parseAuthParams parses a comma separated list of key=value pairs, where values may be quoted.
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " ,")
+		eq := strings.IndexByte(s, '=')
+		if eq == -1 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " ")
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			end := 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				value = strings.Replace(s[1:], `\`, "", -1)
+				s = ""
+			} else {
+				value = strings.Replace(s[1:end], `\`, "", -1)
+				s = s[end+1:]
+			}
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end == -1 {
+				end = len(s)
+			}
+			value = strings.TrimSpace(s[:end])
+			s = s[end:]
+		}
+		params[key] = value
+	}
+	return params
+}
+
+// newCnonce returns a random client nonce.
+func newCnonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
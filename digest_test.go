@@ -0,0 +1,68 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestDigestAuth(t *testing.T) {
+	md5hex := func(s string) string {
+		return fmt.Sprintf("%x", md5.Sum([]byte(s)))
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Digest ") {
+			w.Header().Set("WWW-Authenticate", `Digest realm="device", qop="auth,auth-int", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", opaque="5ccc069c403ebaf9f0171e9517f40e41"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		params := parseAuthParams(auth[len("Digest "):])
+		ha1 := md5hex("admin:device:secret")
+		ha2 := md5hex(r.Method + ":" + params["uri"])
+		expected := md5hex(strings.Join([]string{ha1, params["nonce"], params["nc"], params["cnonce"], params["qop"], ha2}, ":"))
+		if params["response"] != expected || params["opaque"] != "5ccc069c403ebaf9f0171e9517f40e41" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		file, err := os.Open("./fixtures/test")
+		assert.Ok(t, err)
+		assert.Cond(t, file != nil, "Failed loading fixture file")
+		defer file.Close()
+
+		http.ServeContent(w, r, file.Name(), time.Time{}, file)
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "digest-auth")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	gf := New(WithDestDir(destDir), WithConcurrency(4), WithDigestAuth("admin", "secret"))
+	file, err := gf.Fetch(ts.URL+"/firmware.bin", nil)
+	assert.Ok(t, err)
+	defer file.Close()
+
+	fi, err := file.Stat()
+	assert.Ok(t, err)
+	assert.Equals(t, int64(10485760), fi.Size())
+
+	gf = New(WithDestDir(destDir), WithDigestAuth("admin", "wrong"))
+	_, err = gf.Fetch(ts.URL+"/firmware.bin", nil)
+	assert.Cond(t, err != nil, "Fetch should fail with wrong credentials")
+}
@@ -0,0 +1,234 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrTooSlow is returned when a download is aborted because its transfer
+// speed stayed below the minimum set with WithMinSpeed.
+var ErrTooSlow = errors.New("download is too slow")
+
+// download holds the state shared by all the chunks of an ongoing download.
+type download struct {
+	url        string
+	progressCh chan<- ProgressReport
+	// ifRange is the validator sent when resuming chunks, to make sure the
+	// content did not change since they were downloaded.
+	ifRange string
+	// encoding is the encoding of the content being decoded, if any.
+	encoding string
+	// handler fetches the content if it is not served over HTTP, in which case ranges
+	// tells whether it can be read from any offset.
+	handler Handler
+	ranges  bool
+	// singleRanges is set to 1 once the server answers a request for several byte ranges
+	// with anything but them, for chunks to be requested one by one from then on.
+	singleRanges int32
+	// mirrors serve the same content, chunks are downloaded from them too, taking turns
+	// with the URL of the download through next, which is updated atomically.
+	mirrors []mirror
+	next    uint32
+	// report is the template for the reports sent through the progress channel.
+	report ProgressReport
+	// transferred is the number of bytes received so far, it is updated atomically.
+	transferred int64
+	// slow is set to 1 when the download is aborted for being too slow.
+	slow int32
+	// hash hashes the content as it is written, if set.
+	hash *streamHasher
+
+	// progressInterval and progressBytes are the minimum time and number of bytes between
+	// progress reports, if set.
+	progressInterval time.Duration
+	progressBytes    int64
+
+	progressMu sync.Mutex
+	// unreported is the number of bytes written since the last progress report, of which
+	// unreportedExisting were already on disk.
+	unreported         int64
+	unreportedExisting int64
+	lastReport         time.Time
+	// reported is the number of bytes reported so far, of which reportedExisting were
+	// already on disk.
+	reported         int64
+	reportedExisting int64
+	speed            speedWindow
+}
+
+// mirror is a source of the content of a download.
+type mirror struct {
+	url     string
+	handler Handler
+	ranges  bool
+	// ifRange is the validator sent when resuming chunks from the mirror.
+	ifRange string
+}
+
+// source returns where to download the next chunk from, either the URL of the download or,
+// in turns, one of its mirrors.
+func (d *download) source() mirror {
+	if len(d.mirrors) > 0 {
+		if i := atomic.AddUint32(&d.next, 1) % uint32(len(d.mirrors)+1); i > 0 {
+			return d.mirrors[i-1]
+		}
+	}
+	return mirror{url: d.url, handler: d.handler, ranges: d.ranges, ifRange: d.ifRange}
+}
+
+// written accounts for n bytes just written to disk and reports them
+// through the progress channel.
+func (d *download) written(n int64) {
+	atomic.AddInt64(&d.transferred, n)
+	d.progress(n)
+}
+
+// progress reports n bytes written to disk through the progress channel, along with the ones
+// not reported yet, unless reports are throttled and it is too soon for another one.
+func (d *download) progress(n int64) {
+	d.addProgress(n, 0)
+}
+
+// existing reports n bytes already on disk when the download started, like progress.
+func (d *download) existing(n int64) {
+	d.addProgress(n, n)
+}
+
+// addProgress reports n bytes written to disk, of which existing were already there.
+func (d *download) addProgress(n, existing int64) {
+	if d.progressCh == nil {
+		return
+	}
+
+	// Reports are sent while locked, so they arrive in order.
+	d.progressMu.Lock()
+	defer d.progressMu.Unlock()
+
+	d.unreported += n
+	d.unreportedExisting += existing
+	now := time.Now()
+	pending := d.unreported
+	if pending < 0 {
+		pending = -pending
+	}
+	if (d.progressInterval > 0 && now.Sub(d.lastReport) < d.progressInterval) ||
+		(d.progressBytes > 0 && pending < d.progressBytes) {
+		return
+	}
+	d.sendProgress(now)
+}
+
+// flushProgress reports the bytes held back by throttling, if any.
+func (d *download) flushProgress() {
+	if d.progressCh == nil {
+		return
+	}
+
+	d.progressMu.Lock()
+	defer d.progressMu.Unlock()
+	if d.unreported != 0 {
+		d.sendProgress(time.Now())
+	}
+}
+
+// sendProgress reports the bytes not reported yet, along with the progress of the whole
+// download. The caller must hold progressMu.
+func (d *download) sendProgress(now time.Time) {
+	n, existing := d.unreported, d.unreportedExisting
+	d.unreported, d.unreportedExisting, d.lastReport = 0, 0, now
+	d.reported += n
+	d.reportedExisting += existing
+
+	report := d.report
+	report.WrittenBytes = n - existing
+	report.Downloaded = d.reported
+	report.ResumedBytes = d.reportedExisting
+	report.BytesPerSecond = d.speed.rate(now, atomic.LoadInt64(&d.transferred))
+
+	switch {
+	case report.Total < 0:
+		report.Percent = -1
+	case report.Total == 0:
+		report.Percent = 100
+	default:
+		report.Percent = float64(report.Downloaded) / float64(report.Total) * 100
+	}
+
+	if left := report.Total - report.Downloaded; report.Total >= 0 && left > 0 && report.BytesPerSecond > 0 {
+		report.ETA = time.Duration(float64(left) / report.BytesPerSecond * float64(time.Second))
+	}
+	d.progressCh <- report
+}
+
+// speedInterval is the period of time the speed reported for downloads is measured over.
+const speedInterval = 5 * time.Second
+
+// speedSample is the number of bytes transferred at a point in time.
+type speedSample struct {
+	at    time.Time
+	bytes int64
+}
+
+// speedWindow measures the speed of a download over the last speedInterval.
+type speedWindow struct {
+	samples []speedSample
+}
+
+// rate records that the given number of bytes were transferred so far, returning the
+// number of bytes per second transferred over the window.
+func (w *speedWindow) rate(now time.Time, transferred int64) float64 {
+	// Samples are taken every so often, to keep them few when reports are frequent.
+	if n := len(w.samples); n == 0 || now.Sub(w.samples[n-1].at) >= speedInterval/50 {
+		w.samples = append(w.samples, speedSample{at: now, bytes: transferred})
+	}
+
+	// Drops the samples out of the window, keeping the latest of them as its start.
+	i := 0
+	for i < len(w.samples)-1 && now.Sub(w.samples[i+1].at) >= speedInterval {
+		i++
+	}
+	w.samples = w.samples[i:]
+
+	first := w.samples[0]
+	elapsed := now.Sub(first.at).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(transferred-first.bytes) / elapsed
+}
+
+// monitorSpeed cancels the download if less than minSpeed bytes per second
+// are transferred during a whole window of time.
+func (d *download) monitorSpeed(ctx context.Context, cancel context.CancelFunc, minSpeed int64, window time.Duration) {
+	ticker := time.NewTicker(window)
+	defer ticker.Stop()
+
+	var last int64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			current := atomic.LoadInt64(&d.transferred)
+			if float64(current-last) < float64(minSpeed)*window.Seconds() {
+				atomic.StoreInt32(&d.slow, 1)
+				cancel()
+				return
+			}
+			last = current
+		}
+	}
+}
+
+// tooSlow tells whether the download was aborted for being too slow.
+func (d *download) tooSlow() bool {
+	return atomic.LoadInt32(&d.slow) == 1
+}
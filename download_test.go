@@ -0,0 +1,70 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestSpeedWindow(t *testing.T) {
+	var w speedWindow
+	start := time.Now()
+	assert.Equals(t, float64(0), w.rate(start, 0))
+	assert.Equals(t, float64(1000), w.rate(start.Add(time.Second), 1000))
+
+	// Only the last few seconds are taken into account.
+	w.rate(start.Add(4*time.Second), 1000)
+	assert.Equals(t, float64(0), w.rate(start.Add(9*time.Second), 1000))
+	assert.Equals(t, float64(1000)/7, w.rate(start.Add(11*time.Second), 2000))
+}
+
+func TestProgressReport(t *testing.T) {
+	progressCh := make(chan ProgressReport, 3)
+	d := &download{progressCh: progressCh, report: ProgressReport{Total: 100}}
+	d.written(25)
+	d.written(75)
+	close(progressCh)
+
+	var reports []ProgressReport
+	for r := range progressCh {
+		reports = append(reports, r)
+	}
+	assert.Equals(t, 2, len(reports))
+	assert.Equals(t, int64(25), reports[0].Downloaded)
+	assert.Equals(t, float64(25), reports[0].Percent)
+	assert.Equals(t, int64(100), reports[1].Downloaded)
+	assert.Equals(t, float64(100), reports[1].Percent)
+	assert.Equals(t, time.Duration(0), reports[1].ETA)
+
+	progressCh = make(chan ProgressReport, 1)
+	d = &download{progressCh: progressCh, report: ProgressReport{Total: -1}}
+	d.written(10)
+	assert.Equals(t, float64(-1), (<-progressCh).Percent)
+}
+
+func TestResumedBytes(t *testing.T) {
+	progressCh := make(chan ProgressReport, 3)
+	d := &download{progressCh: progressCh, report: ProgressReport{Total: 100}, progressBytes: 50}
+	d.existing(40)
+	d.written(20)
+	d.written(40)
+	d.flushProgress()
+	close(progressCh)
+
+	var reports []ProgressReport
+	for r := range progressCh {
+		reports = append(reports, r)
+	}
+	assert.Equals(t, 2, len(reports))
+	assert.Equals(t, int64(20), reports[0].WrittenBytes)
+	assert.Equals(t, int64(40), reports[0].ResumedBytes)
+	assert.Equals(t, int64(60), reports[0].Downloaded)
+	assert.Equals(t, int64(40), reports[1].WrittenBytes)
+	assert.Equals(t, int64(40), reports[1].ResumedBytes)
+	assert.Equals(t, int64(100), reports[1].Downloaded)
+}
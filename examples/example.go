@@ -34,9 +34,9 @@ func main() {
 	var totalWritten int64
 	for p := range progressCh {
 		// p.WrittenBytes does not accumulate, it represents the chunk size written
-		// in the current operation.
+		// in the current operation. Bytes downloaded before resuming are in p.ResumedBytes.
 		totalWritten += p.WrittenBytes
-		fmt.Printf("\r%d of %d bytes", totalWritten, p.Total)
+		fmt.Printf("\r%d of %d bytes", p.ResumedBytes+totalWritten, p.Total)
 	}
 
 	<-doneCh
@@ -0,0 +1,115 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// fileHandler fetches local files through file:// URLs.
+type fileHandler struct{}
+
+func (fileHandler) Stat(ctx context.Context, rawURL string) (*ContentInfo, error) {
+	path, err := filePath(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", path)
+	}
+	return &ContentInfo{Size: fi.Size(), Ranges: true, ModTime: fi.ModTime()}, nil
+}
+
+func (fileHandler) Open(ctx context.Context, rawURL string, offset, length int64) (io.ReadCloser, error) {
+	path, err := filePath(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// filePath returns the local path of a file:// URL.
+func filePath(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return "", fmt.Errorf("unsupported file URL of a remote host: %s", rawURL)
+	}
+
+	path := u.Path
+	// Paths with a drive letter, like /C:/dir/file, are absolute on their own on Windows.
+	if runtime.GOOS == "windows" && len(path) > 2 && path[0] == '/' && path[2] == ':' {
+		path = path[1:]
+	}
+	return filepath.FromSlash(path), nil
+}
+
+// linkFile hard links the local file of a file:// URL as the data of its download, hashing it
+// with hasher, if set. It returns nil if the file cannot be linked, like when it is on another
+// filesystem, so it is copied instead.
+func (gf *Fetcher) linkFile(rawURL, destFilePath string, size int64, hasher *verifier, progressCh chan<- ProgressReport) (*os.File, error) {
+	path, err := filePath(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	chunksDir := gf.chunksDir(destFilePath)
+	if err := os.RemoveAll(chunksDir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(chunksDir, 0760); err != nil {
+		return nil, err
+	}
+
+	dataPath := filepath.Join(chunksDir, "data")
+	if err := os.Link(path, dataPath); err != nil {
+		return nil, nil
+	}
+
+	file, err := os.Open(dataPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if hasher != nil {
+		if _, err := gf.buffers.copy(hasher, file); err != nil {
+			file.Close()
+			return nil, err
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	if progressCh != nil {
+		d := &download{url: rawURL, progressCh: progressCh, report: ProgressReport{Total: size}}
+		d.written(size)
+		close(progressCh)
+	}
+	return file, nil
+}
@@ -0,0 +1,94 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func fileURL(t *testing.T, path string) string {
+	abs, err := filepath.Abs(path)
+	assert.Ok(t, err)
+	if runtime.GOOS == "windows" {
+		abs = "/" + abs
+	}
+	return "file://" + filepath.ToSlash(abs)
+}
+
+func TestFileURL(t *testing.T) {
+	data, err := ioutil.ReadFile("./fixtures/test")
+	assert.Ok(t, err)
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "file-url")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	gf := New(WithDestDir(destDir), WithConcurrency(2), WithChecksum("sha256", fmt.Sprintf("%x", sha256.Sum256(data))))
+	progressCh := make(chan ProgressReport)
+	var result *Result
+	done := make(chan error)
+	go func() {
+		var err error
+		result, err = gf.FetchContext(context.Background(), fileURL(t, "./fixtures/test"), progressCh)
+		done <- err
+	}()
+
+	var total int64
+	for p := range progressCh {
+		total += p.WrittenBytes
+	}
+	assert.Ok(t, <-done)
+	defer result.File.Close()
+	assert.Equals(t, int64(len(data)), total)
+
+	got, err := ioutil.ReadAll(result.File)
+	assert.Ok(t, err)
+	assert.Equals(t, data, got)
+
+	gf = New(WithDestDir(destDir), WithChecksum("sha256", fmt.Sprintf("%x", sha256.Sum256(nil))))
+	_, err = gf.Fetch(fileURL(t, "./fixtures/test"), nil)
+	assert.Cond(t, err != nil, "Fetch should fail if the checksum does not match")
+
+	_, err = gf.Fetch("file://example.com/test", nil)
+	assert.Cond(t, err != nil, "Fetch should fail for files of remote hosts")
+}
+
+func TestWithFileLinks(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "file-links")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	data := []byte("linked content")
+	src := filepath.Join(dir, "src", "file")
+	assert.Ok(t, os.MkdirAll(filepath.Dir(src), 0760))
+	assert.Ok(t, ioutil.WriteFile(src, data, 0640))
+
+	destDir := filepath.Join(dir, "dest")
+	gf := New(WithDestDir(destDir), WithFileLinks(), WithChecksum("sha256", fmt.Sprintf("%x", sha256.Sum256(data))))
+	progressCh := make(chan ProgressReport, 1)
+	f, err := gf.Fetch(fileURL(t, src), progressCh)
+	assert.Ok(t, err)
+	defer f.Close()
+	assert.Equals(t, int64(len(data)), (<-progressCh).Downloaded)
+
+	got, err := ioutil.ReadAll(f)
+	assert.Ok(t, err)
+	assert.Equals(t, data, got)
+
+	srcInfo, err := os.Stat(src)
+	assert.Ok(t, err)
+	destInfo, err := f.Stat()
+	assert.Ok(t, err)
+	assert.Cond(t, os.SameFile(srcInfo, destInfo), "File should have been linked")
+}
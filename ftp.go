@@ -0,0 +1,143 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// FTPHandler fetches content from FTP servers through ftp:// URLs, and through ftps:// URLs
+// securing connections with explicit TLS. It logs in with the credentials of the URL, or
+// anonymously if there are none, and transfers data in passive mode. Downloads are resumed and
+// split in chunks through the REST command, each chunk using a connection of its own.
+// It is registered for both schemes by default.
+type FTPHandler struct {
+	// TLSConfig is the configuration of ftps:// connections. The system's root certificates
+	// are used if nil.
+	TLSConfig *tls.Config
+	// Timeout is the timeout for connecting to servers. It is 30 seconds if zero.
+	Timeout time.Duration
+	// DisableEPSV makes passive mode use the PASV command rather than EPSV, for servers
+	// behind firewalls not supporting it.
+	DisableEPSV bool
+}
+
+func (h *FTPHandler) Stat(ctx context.Context, rawURL string) (*ContentInfo, error) {
+	conn, path, err := h.dial(ctx, rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Quit()
+
+	info := &ContentInfo{Size: -1}
+	// Not every server supports SIZE, in which case the content is downloaded in one go.
+	if size, err := conn.FileSize(path); err == nil {
+		info.Size = size
+		info.Ranges = true
+	}
+	if conn.IsGetTimeSupported() {
+		if modTime, err := conn.GetTime(path); err == nil {
+			info.ModTime = modTime
+		}
+	}
+	return info, nil
+}
+
+func (h *FTPHandler) Open(ctx context.Context, rawURL string, offset, length int64) (io.ReadCloser, error) {
+	conn, path, err := h.dial(ctx, rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := conn.RetrFrom(path, uint64(offset))
+	if err != nil {
+		conn.Quit()
+		return nil, err
+	}
+
+	r := &ftpReader{Response: res, conn: conn, done: make(chan struct{})}
+	go func() {
+		// Reads are not bound to the context, so they are unblocked by expiring the connection.
+		select {
+		case <-ctx.Done():
+			res.SetDeadline(time.Now())
+		case <-r.done:
+		}
+	}()
+	return r, nil
+}
+
+// dial connects and logs in to the server of the given URL, returning the path of the file.
+func (h *FTPHandler) dial(ctx context.Context, rawURL string) (*ftp.ServerConn, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "21")
+	}
+
+	timeout := h.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+
+	options := []ftp.DialOption{
+		ftp.DialWithContext(ctx),
+		ftp.DialWithTimeout(timeout),
+		ftp.DialWithDisabledEPSV(h.DisableEPSV),
+	}
+	if strings.EqualFold(u.Scheme, "ftps") {
+		config := h.TLSConfig
+		if config == nil {
+			config = &tls.Config{}
+		}
+		if config.ServerName == "" {
+			config = config.Clone()
+			config.ServerName = u.Hostname()
+		}
+		options = append(options, ftp.DialWithExplicitTLS(config))
+	}
+
+	conn, err := ftp.Dial(host, options...)
+	if err != nil {
+		return nil, "", err
+	}
+
+	user, password := "anonymous", "anonymous"
+	if u.User != nil {
+		user = u.User.Username()
+		password, _ = u.User.Password()
+	}
+	if err := conn.Login(user, password); err != nil {
+		conn.Quit()
+		return nil, "", err
+	}
+	return conn, u.Path, nil
+}
+
+// ftpReader reads a file being retrieved, closing its connection when done.
+type ftpReader struct {
+	*ftp.Response
+	conn *ftp.ServerConn
+	done chan struct{}
+}
+
+func (r *ftpReader) Close() error {
+	close(r.done)
+	// Closing a transfer before its end is reported as an error by most servers.
+	r.Response.Close()
+	return r.conn.Quit()
+}
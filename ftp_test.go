@@ -0,0 +1,202 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+// ftpServer is a minimal FTP server serving a single file in passive mode, failing SIZE
+// commands if noSize is set.
+type ftpServer struct {
+	ln     net.Listener
+	data   []byte
+	noSize bool
+
+	mu      sync.Mutex
+	offsets []int64
+}
+
+func newFTPServer(t *testing.T, data []byte, noSize bool) *ftpServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Ok(t, err)
+
+	s := &ftpServer{ln: ln, data: data, noSize: noSize}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *ftpServer) URL() string {
+	return "ftp://user:secret@" + s.ln.Addr().String() + "/pub/file"
+}
+
+func (s *ftpServer) Close() {
+	s.ln.Close()
+}
+
+func (s *ftpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reply := func(format string, args ...interface{}) {
+		fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+
+	var user string
+	var offset int64
+	var pasv net.Listener
+	defer func() {
+		if pasv != nil {
+			pasv.Close()
+		}
+	}()
+
+	reply("220 Ready")
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		parts := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		cmd, arg := parts[0], ""
+		if len(parts) == 2 {
+			arg = parts[1]
+		}
+
+		switch cmd {
+		case "USER":
+			user = arg
+			reply("331 Password required")
+		case "PASS":
+			if user != "user" || arg != "secret" {
+				reply("530 Login incorrect")
+				continue
+			}
+			reply("230 Logged in")
+		case "FEAT":
+			reply("211-Features:\r\n SIZE\r\n MDTM\r\n REST STREAM\r\n211 End")
+		case "TYPE":
+			reply("200 Type set")
+		case "SIZE":
+			if s.noSize || arg != "/pub/file" {
+				reply("550 Could not get file size")
+				continue
+			}
+			reply("213 %d", len(s.data))
+		case "MDTM":
+			reply("213 20200102030405")
+		case "EPSV":
+			if pasv, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+				reply("425 Can't open data connection")
+				continue
+			}
+			reply("229 Entering Extended Passive Mode (|||%d|)", pasv.Addr().(*net.TCPAddr).Port)
+		case "REST":
+			if offset, err = strconv.ParseInt(arg, 10, 64); err != nil {
+				reply("501 Invalid offset")
+				continue
+			}
+			reply("350 Restarting at %d", offset)
+		case "RETR":
+			if arg != "/pub/file" || pasv == nil {
+				reply("550 File not found")
+				continue
+			}
+			s.mu.Lock()
+			s.offsets = append(s.offsets, offset)
+			s.mu.Unlock()
+
+			reply("150 Opening data connection")
+			data, err := pasv.Accept()
+			if err != nil {
+				return
+			}
+			_, err = data.Write(s.data[offset:])
+			data.Close()
+			pasv.Close()
+			pasv, offset = nil, 0
+			if err != nil {
+				reply("426 Transfer aborted")
+				continue
+			}
+			reply("226 Transfer complete")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+func TestFTP(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64<<10)
+	server := newFTPServer(t, data, false)
+	defer server.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "ftp")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	gf := New(WithDestDir(destDir), WithConcurrency(4), WithChecksum("sha256", fmt.Sprintf("%x", sha256.Sum256(data))))
+	file, err := gf.Fetch(server.URL(), nil)
+	assert.Ok(t, err)
+	defer file.Close()
+
+	got, err := ioutil.ReadAll(file)
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(data, got), "downloaded file does not match")
+
+	// Chunks are retrieved from their offset.
+	server.mu.Lock()
+	offsets := server.offsets
+	server.mu.Unlock()
+	assert.Equals(t, 4, len(offsets))
+	for i, offset := range offsets {
+		assert.Cond(t, offset%int64(len(data)/4) == 0, "unexpected offset %d of chunk %d", offset, i)
+	}
+
+	_, err = New(WithDestDir(destDir)).Fetch("ftp://user:wrong@"+server.ln.Addr().String()+"/pub/other", nil)
+	assert.Cond(t, err != nil, "login with wrong credentials should fail")
+}
+
+func TestFTPWithoutSize(t *testing.T) {
+	data := []byte("firmware image")
+	server := newFTPServer(t, data, true)
+	defer server.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "ftp")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	gf := New(WithDestDir(destDir), WithConcurrency(4))
+	file, err := gf.Fetch(server.URL(), nil)
+	assert.Ok(t, err)
+	defer file.Close()
+
+	got, err := ioutil.ReadAll(file)
+	assert.Ok(t, err)
+	assert.Equals(t, data, got)
+	assert.Equals(t, []int64{0}, server.offsets)
+}
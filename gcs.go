@@ -0,0 +1,451 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GCSHandler fetches objects from Google Cloud Storage through gs://bucket/object URLs, using
+// the JSON API. Requests are authorized with the OAuth2 access token of GOOGLE_OAUTH_ACCESS_TOKEN,
+// of the credentials file of GOOGLE_APPLICATION_CREDENTIALS or gcloud's application default
+// credentials, or of the service account of the Compute Engine instance, in that order, and
+// sent anonymously, for public buckets, if there are none. Objects are fetched through signed
+// URLs instead if SignURL is set. Objects are read in byte ranges, so downloads are resumed and
+// split in chunks, resumed chunks being requested only if the object was not replaced since.
+// The CRC32C and MD5 digests of objects are verified when WithServerChecksums is set.
+// It is registered for the gs scheme by default.
+type GCSHandler struct {
+	// Endpoint is the URL of the service, like the one of an emulator. It is
+	// https://storage.googleapis.com if empty.
+	Endpoint string
+	// Token returns the OAuth2 access token to authorize requests with, or an empty one to send
+	// them anonymously. The token is looked up as described above if nil.
+	Token func(ctx context.Context) (string, error)
+	// SignURL returns the signed URL of the given object, to fetch it through rather than
+	// through the JSON API.
+	SignURL func(ctx context.Context, bucket, object string) (string, error)
+	// Client sends the requests, including the ones for access tokens. The client of the
+	// fetcher is used if nil, with its TLS settings, proxy and timeouts, or http.DefaultClient
+	// outside a fetcher.
+	Client *http.Client
+
+	mu sync.Mutex
+	// token holds the access token looked up last, if tokenChecked.
+	token        oauthToken
+	tokenChecked bool
+}
+
+// oauthToken is an OAuth2 access token, along with the time it expires at.
+type oauthToken struct {
+	value   string
+	expires time.Time
+}
+
+func (h *GCSHandler) Stat(ctx context.Context, rawURL string) (*ContentInfo, error) {
+	bucket, object, err := parseGCSURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if h.SignURL != nil {
+		return h.statSigned(ctx, bucket, object)
+	}
+
+	res, err := h.send(ctx, h.objectURL(bucket, object, nil), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, &statusError{code: res.StatusCode, status: res.Status}
+	}
+
+	var meta struct {
+		Size       string    `json:"size"`
+		Generation string    `json:"generation"`
+		Updated    time.Time `json:"updated"`
+		MD5Hash    string    `json:"md5Hash"`
+		CRC32C     string    `json:"crc32c"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&meta); err != nil {
+		return nil, fmt.Errorf("invalid object metadata: %s", err)
+	}
+
+	size, err := strconv.ParseInt(meta.Size, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid object size: %q", meta.Size)
+	}
+	info := &ContentInfo{Size: size, Ranges: true, ModTime: meta.Updated}
+	if meta.Generation != "" {
+		info.ETag = strconv.Quote(meta.Generation)
+	}
+	for alg, value := range map[string]string{"md5": meta.MD5Hash, "crc32c": meta.CRC32C} {
+		// Composite objects have no MD5 digest.
+		if sum, err := base64.StdEncoding.DecodeString(value); err == nil && len(sum) > 0 {
+			if info.Checksums == nil {
+				info.Checksums = make(map[string]string)
+			}
+			info.Checksums[alg] = hex.EncodeToString(sum)
+		}
+	}
+	return info, nil
+}
+
+// statSigned describes the given object by requesting its first byte through its signed URL,
+// which is only valid for GET requests.
+func (h *GCSHandler) statSigned(ctx context.Context, bucket, object string) (*ContentInfo, error) {
+	signedURL, err := h.SignURL(ctx, bucket, object)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := h.send(ctx, signedURL, http.Header{"Range": {"bytes=0-0"}})
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+
+	info := &ContentInfo{Ranges: true}
+	switch res.StatusCode {
+	case http.StatusOK:
+		info.Size = res.ContentLength
+	case http.StatusPartialContent:
+		if _, err := fmt.Sscanf(res.Header.Get("Content-Range"), "bytes 0-0/%d", &info.Size); err != nil {
+			return nil, fmt.Errorf("invalid Content-Range: %q", res.Header.Get("Content-Range"))
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The object is empty.
+	default:
+		return nil, &statusError{code: res.StatusCode, status: res.Status}
+	}
+
+	if generation := res.Header.Get("X-Goog-Generation"); generation != "" {
+		info.ETag = strconv.Quote(generation)
+	}
+	if modTime, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = modTime
+	}
+	for _, c := range serverChecksums(res.Header) {
+		if info.Checksums == nil {
+			info.Checksums = make(map[string]string)
+		}
+		info.Checksums[c.algorithm] = c.value
+	}
+	return info, nil
+}
+
+func (h *GCSHandler) Open(ctx context.Context, rawURL string, offset, length int64) (io.ReadCloser, error) {
+	return h.OpenIfMatch(ctx, rawURL, offset, length, "")
+}
+
+func (h *GCSHandler) OpenIfMatch(ctx context.Context, rawURL string, offset, length int64, etag string) (io.ReadCloser, error) {
+	bucket, object, err := parseGCSURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	header := http.Header{}
+	if rng := rangeHeader(offset, length); rng != "" {
+		header.Set("Range", rng)
+	}
+	// ETags are the generation of objects, which changes whenever they are replaced.
+	generation, _ := strconv.Unquote(etag)
+
+	var objectURL string
+	if h.SignURL != nil {
+		if objectURL, err = h.SignURL(ctx, bucket, object); err != nil {
+			return nil, err
+		}
+		if generation != "" {
+			header.Set("X-Goog-If-Generation-Match", generation)
+		}
+	} else {
+		query := url.Values{"alt": {"media"}}
+		if generation != "" {
+			query.Set("ifGenerationMatch", generation)
+		}
+		objectURL = h.objectURL(bucket, object, query)
+	}
+
+	res, err := h.send(ctx, objectURL, header)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case res.StatusCode == http.StatusPreconditionFailed:
+		res.Body.Close()
+		return nil, ErrContentChanged
+	// Servers may send the whole content when asked for a range of it from its beginning.
+	case res.StatusCode != http.StatusPartialContent && (offset > 0 || res.StatusCode != http.StatusOK):
+		res.Body.Close()
+		return nil, &statusError{code: res.StatusCode, status: res.Status}
+	}
+	return res.Body, nil
+}
+
+// parseGCSURL returns the bucket and object of a gs:// URL.
+func parseGCSURL(rawURL string) (string, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", err
+	}
+	bucket, object := u.Host, strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || object == "" {
+		return "", "", fmt.Errorf("invalid Cloud Storage URL, expected gs://bucket/object: %s", rawURL)
+	}
+	return bucket, object, nil
+}
+
+// objectURL returns the JSON API URL of the given object, with the given query.
+func (h *GCSHandler) objectURL(bucket, object string, query url.Values) string {
+	endpoint := h.Endpoint
+	if endpoint == "" {
+		endpoint = "https://storage.googleapis.com"
+	}
+	objectURL := strings.TrimSuffix(endpoint, "/") + "/storage/v1/b/" + url.PathEscape(bucket) + "/o/" + url.PathEscape(object)
+	if len(query) > 0 {
+		objectURL += "?" + query.Encode()
+	}
+	return objectURL
+}
+
+// send sends a GET request to the given URL, authorized unless it is a signed URL.
+func (h *GCSHandler) send(ctx context.Context, rawURL string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	if h.SignURL == nil {
+		token, err := h.accessToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+
+	return h.client(ctx).Do(req)
+}
+
+// client returns the client requests are sent through.
+func (h *GCSHandler) client(ctx context.Context) *http.Client {
+	if h.Client != nil {
+		return h.Client
+	}
+	return httpClientFrom(ctx)
+}
+
+// accessToken returns the access token to authorize requests with, or an empty one if there
+// is none.
+func (h *GCSHandler) accessToken(ctx context.Context) (string, error) {
+	if h.Token != nil {
+		return h.Token(ctx)
+	}
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		return token, nil
+	}
+
+	// Tokens obtained from credentials are renewed before they expire.
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.tokenChecked && (h.token.value == "" || time.Until(h.token.expires) > 5*time.Minute) {
+		return h.token.value, nil
+	}
+
+	token, err := googleCredentialsToken(ctx, h.client(ctx))
+	if err != nil {
+		return "", err
+	}
+	if token == nil {
+		if token, err = gceToken(ctx); err != nil {
+			return "", err
+		}
+	}
+	if token == nil {
+		token = &oauthToken{}
+	}
+	h.token, h.tokenChecked = *token, true
+	return token.value, nil
+}
+
+// gcsReadOnlyScope is the OAuth2 scope access tokens are requested for.
+const gcsReadOnlyScope = "https://www.googleapis.com/auth/devstorage.read_only"
+
+// googleCredentialsToken returns an access token obtained with the service account or user
+// credentials of GOOGLE_APPLICATION_CREDENTIALS or, if unset, of gcloud's application default
+// credentials, through the given client. It returns nil if there are no credentials.
+func googleCredentialsToken(ctx context.Context, client *http.Client) (*oauthToken, error) {
+	path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if path == "" {
+		dir := os.Getenv("APPDATA")
+		if runtime.GOOS != "windows" {
+			home, _ := os.UserHomeDir()
+			dir = filepath.Join(home, ".config")
+		}
+		path = filepath.Join(dir, "gcloud", "application_default_credentials.json")
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && os.Getenv("GOOGLE_APPLICATION_CREDENTIALS") == "" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var creds struct {
+		Type         string `json:"type"`
+		ClientEmail  string `json:"client_email"`
+		PrivateKey   string `json:"private_key"`
+		TokenURI     string `json:"token_uri"`
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("invalid credentials file %s: %s", path, err)
+	}
+	if creds.TokenURI == "" {
+		creds.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	form := url.Values{}
+	switch creds.Type {
+	case "service_account":
+		assertion, err := serviceAccountJWT(creds.ClientEmail, creds.PrivateKey, creds.TokenURI, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+		form.Set("assertion", assertion)
+	case "authorized_user":
+		form.Set("grant_type", "refresh_token")
+		form.Set("client_id", creds.ClientID)
+		form.Set("client_secret", creds.ClientSecret)
+		form.Set("refresh_token", creds.RefreshToken)
+	default:
+		return nil, fmt.Errorf("unsupported credentials type %q in %s", creds.Type, path)
+	}
+
+	req, err := http.NewRequest("POST", creds.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return requestToken(client, req)
+}
+
+// gceToken returns an access token of the service account of the Compute Engine instance,
+// obtained from the metadata server. It returns nil if the server cannot be reached, as when
+// not running on Compute Engine.
+func gceToken(ctx context.Context) (*oauthToken, error) {
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = "metadata.google.internal"
+	}
+
+	req, err := http.NewRequest("GET", "http://"+host+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	// The server answers right away, if it is there at all.
+	token, err := requestToken(&http.Client{Timeout: 2 * time.Second}, req)
+	if _, ok := err.(*statusError); err != nil && !ok && ctx.Err() == nil {
+		return nil, nil
+	}
+	return token, err
+}
+
+// requestToken sends a request for an OAuth2 access token.
+func requestToken(client *http.Client, req *http.Request) (*oauthToken, error) {
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, &statusError{code: res.StatusCode, status: res.Status}
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return nil, fmt.Errorf("invalid access token response: %s", err)
+	}
+	return &oauthToken{
+		value:   token.AccessToken,
+		expires: time.Now().Add(time.Duration(token.ExpiresIn) * time.Second),
+	}, nil
+}
+
+// serviceAccountJWT returns the JWT a service account exchanges for an access token, signed
+// with its PEM encoded private key.
+func serviceAccountJWT(email, privateKey, audience string, now time.Time) (string, error) {
+	block, _ := pem.Decode([]byte(privateKey))
+	if block == nil {
+		return "", fmt.Errorf("invalid private key of service account %s", email)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return "", fmt.Errorf("invalid private key of service account %s: %s", email, err)
+		}
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", fmt.Errorf("private key of service account %s is not an RSA key", email)
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   email,
+		"scope": gcsReadOnlyScope,
+		"aud":   audience,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
@@ -0,0 +1,221 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+// newGCSServer serves the given object as dir/object of the bucket bucket, through the JSON
+// API and through a fake signed URL, /signed. Its CRC32C is sent as crc32c.
+func newGCSServer(t *testing.T, data []byte, crc32c uint32) *httptest.Server {
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	md5Hash := md5.Sum(data)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32c)
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var generation string
+		switch r.URL.Path {
+		case "/storage/v1/b/bucket/o/dir/object":
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if r.URL.Query().Get("alt") != "media" {
+				json.NewEncoder(w).Encode(map[string]string{
+					"size":       fmt.Sprint(len(data)),
+					"generation": "1577934245000000",
+					"updated":    modTime.Format(time.RFC3339),
+					"md5Hash":    base64.StdEncoding.EncodeToString(md5Hash[:]),
+					"crc32c":     base64.StdEncoding.EncodeToString(crc),
+				})
+				return
+			}
+			generation = r.URL.Query().Get("ifGenerationMatch")
+		case "/signed":
+			generation = r.Header.Get("X-Goog-If-Generation-Match")
+			w.Header().Set("X-Goog-Generation", "1577934245000000")
+			w.Header().Add("X-Goog-Hash", "crc32c="+base64.StdEncoding.EncodeToString(crc))
+			w.Header().Add("X-Goog-Hash", "md5="+base64.StdEncoding.EncodeToString(md5Hash[:]))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if generation != "" && generation != "1577934245000000" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		http.ServeContent(w, r, "", modTime, bytes.NewReader(data))
+	}))
+}
+
+func TestGCS(t *testing.T) {
+	destDir, err := ioutil.TempDir(os.TempDir(), "gcs")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	t.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", "secret")
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64<<10)
+	server := newGCSServer(t, data, crc32.Checksum(data, crc32c))
+	defer server.Close()
+
+	handler := &GCSHandler{Endpoint: server.URL}
+	RegisterScheme("gs", handler)
+	defer RegisterScheme("gs", &GCSHandler{})
+
+	gf := New(WithDestDir(destDir), WithConcurrency(4), WithServerChecksums())
+	file, err := gf.Fetch("gs://bucket/dir/object", nil)
+	assert.Ok(t, err)
+	defer file.Close()
+
+	got, err := ioutil.ReadAll(file)
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(data, got), "downloaded object does not match")
+
+	// Resumed chunks are only read if the object was not replaced.
+	_, err = handler.OpenIfMatch(context.Background(), "gs://bucket/dir/object", 10, -1, `"1"`)
+	assert.Equals(t, ErrContentChanged, err)
+
+	// Objects not matching their CRC32C are rejected.
+	corrupt := newGCSServer(t, data, 0)
+	defer corrupt.Close()
+	RegisterScheme("gs", &GCSHandler{Endpoint: corrupt.URL})
+	_, err = New(WithDestDir(filepath.Join(destDir, "corrupt")), WithServerChecksums()).Fetch("gs://bucket/dir/object", nil)
+	assert.Cond(t, err != nil, "object not matching its CRC32C should be rejected")
+	assert.Cond(t, strings.Contains(err.Error(), "crc32c"), "unexpected error: %s", err)
+}
+
+func TestGCSSignedURL(t *testing.T) {
+	destDir, err := ioutil.TempDir(os.TempDir(), "gcs-signed")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64<<10)
+	server := newGCSServer(t, data, crc32.Checksum(data, crc32c))
+	defer server.Close()
+
+	handler := &GCSHandler{SignURL: func(ctx context.Context, bucket, object string) (string, error) {
+		assert.Equals(t, "bucket", bucket)
+		assert.Equals(t, "dir/object", object)
+		return server.URL + "/signed", nil
+	}}
+	RegisterScheme("gs", handler)
+	defer RegisterScheme("gs", &GCSHandler{})
+
+	info, err := handler.Stat(context.Background(), "gs://bucket/dir/object")
+	assert.Ok(t, err)
+	assert.Equals(t, int64(len(data)), info.Size)
+	assert.Equals(t, `"1577934245000000"`, info.ETag)
+	assert.Equals(t, 2, len(info.Checksums))
+
+	gf := New(WithDestDir(destDir), WithConcurrency(4), WithServerChecksums())
+	file, err := gf.Fetch("gs://bucket/dir/object", nil)
+	assert.Ok(t, err)
+	defer file.Close()
+
+	got, err := ioutil.ReadAll(file)
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(data, got), "downloaded object does not match")
+
+	_, err = handler.OpenIfMatch(context.Background(), "gs://bucket/dir/object", 10, -1, `"1"`)
+	assert.Equals(t, ErrContentChanged, err)
+}
+
+func TestGCSCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "gcs-credentials")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	t.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", "")
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Ok(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.Ok(t, err)
+
+	// The token server checks the JWT of the service account before granting a token.
+	tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(r.FormValue("assertion"), ".")
+		if r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || len(parts) != 3 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature) != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"access_token": "from-service-account", "expires_in": 3600}`)
+	}))
+	defer tokens.Close()
+
+	creds, err := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "fetcher@project.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":    tokens.URL,
+	})
+	assert.Ok(t, err)
+	path := filepath.Join(dir, "credentials.json")
+	assert.Ok(t, ioutil.WriteFile(path, creds, 0600))
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", path)
+
+	// Tokens are requested through the client of the fetcher.
+	var hooked int32
+	gf := New(WithRequestHook(func(r *http.Request) error {
+		atomic.AddInt32(&hooked, 1)
+		return nil
+	}))
+	token, err := (&GCSHandler{}).accessToken(gf.handlerContext(context.Background()))
+	assert.Ok(t, err)
+	assert.Equals(t, "from-service-account", token)
+	assert.Equals(t, int32(1), atomic.LoadInt32(&hooked))
+
+	// The service account of the instance is used if there are no credentials.
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" || r.URL.Path != "/computeMetadata/v1/instance/service-accounts/default/token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, `{"access_token": "from-instance", "expires_in": 3600}`)
+	}))
+	defer metadata.Close()
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+	t.Setenv("HOME", dir)
+	t.Setenv("APPDATA", dir)
+	t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(metadata.URL, "http://"))
+
+	token, err = (&GCSHandler{}).accessToken(context.Background())
+	assert.Ok(t, err)
+	assert.Equals(t, "from-instance", token)
+}
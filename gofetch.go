@@ -5,22 +5,23 @@
 package gofetch
 
 import (
-	"crypto/md5"
-	"crypto/sha1"
-	"crypto/sha256"
-	"crypto/sha512"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"hash"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
+	"time"
 
-	"github.com/hooklift/httpclient"
+	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/mitchellh/go-homedir"
 	"github.com/pkg/errors"
 )
@@ -29,8 +30,36 @@ import (
 type ProgressReport struct {
 	// Total length in bytes of the file being downloaded
 	Total int64
-	// Written bytes to disk on a write by write basis. It does not accumulate.
+	// Written bytes to disk on a write by write basis. It does not accumulate, and it does
+	// not include the bytes downloaded before resuming.
 	WrittenBytes int64
+	// Downloaded is the number of bytes written to disk so far, including the ones
+	// downloaded before resuming.
+	Downloaded int64
+	// ResumedBytes is the number of bytes of Downloaded that were already on disk when the
+	// download was resumed, rather than transferred this time.
+	ResumedBytes int64
+	// Percent is the percentage of the file downloaded so far, or -1 if its length is unknown.
+	Percent float64
+	// BytesPerSecond is the download speed over the last few seconds.
+	BytesPerSecond float64
+	// ETA is the estimated time left to finish the download, or 0 if unknown.
+	ETA time.Duration
+}
+
+// Result represents the outcome of a download.
+type Result struct {
+	// File is the downloaded file, positioned at its beginning so it is ready to be read.
+	File *os.File
+	// URL is the final location the content was downloaded from, after following redirects.
+	URL string
+	// ContentEncoding is the encoding the content was transferred with, such as gzip, before
+	// being decoded and written to disk. It is empty if the content was not encoded.
+	ContentEncoding string
+	// Digests holds the hex encoded digests computed while downloading the content, keyed
+	// by hashing algorithm, for the checksums verified and the digests requested with WithDigests.
+	// It is nil if the download was skipped.
+	Digests map[string]string
 }
 
 // Fetcher represents an instance of gofetch, holding global configuration options.
@@ -38,9 +67,89 @@ type Fetcher struct {
 	destDir     string
 	etag        bool
 	concurrency int
-	algorithm   string
-	checksum    string
+	checksums   []checksum
+	manifests   []checksumFile
+	discover    bool
+	signature   *gpgSignature
+	blocks      *blockChecksums
 	httpClient  *http.Client
+	// handlerHTTP is the client the built-in handlers send their HTTP requests through.
+	handlerHTTP *http.Client
+	tlsConfig   *tls.Config
+	certPins    []string
+	spkiPins    []string
+	redirects   *redirectPolicy
+	userAgent   string
+	protocol    int
+	retries     int
+	backoff     time.Duration
+
+	connectTimeout        time.Duration
+	responseHeaderTimeout time.Duration
+	idleTimeout           time.Duration
+	stallTimeout          time.Duration
+	minSpeed              int64
+	minSpeedWindow        time.Duration
+	skipHEAD              bool
+	lastModified          bool
+	encoding              string
+	signer                Signer
+	digest                *digestAuth
+	requestHooks          []func(*http.Request) error
+	verifyExisting        bool
+	quarantineDir         string
+	sidecar               bool
+	verifiers             []Verifier
+	serverChecksums       bool
+	digests               []checksum
+	store                 Cache
+	cacheLimits           *CacheLimits
+	cache                 bool
+	etagMatch             ETagMatch
+	cas                   bool
+	cacheValidation       CacheValidation
+	offline               bool
+	forceRefresh          bool
+	preserveModTime       bool
+	chunkSize             int64
+	adaptive              bool
+	workStealing          bool
+	chunkRetries          int
+	chunkBackoff          time.Duration
+	maxConnsPerHost       int
+	maxIdleConnsPerHost   int
+	keepAlive             time.Duration
+	bufferSize            int
+	mmapWrites            bool
+	rateLimiter           *rateLimiter
+	progressInterval      time.Duration
+	progressBytes         int64
+	singleConnThreshold   int64
+	minChunkSize          int64
+	connections           *priorityLimit
+	syncPolicy            SyncPolicy
+	multiplex             bool
+	tempDir               string
+	cleanupOnFailure      bool
+	linkFiles             bool
+	buffers               *bufferPool
+	probeMirrors          bool
+	fastestMirrors        int
+	mirrorChunks          bool
+	deltaUpdates          bool
+	multiRange            int
+	resolver              *net.Resolver
+	hosts                 map[string][]string
+	dohEndpoint           string
+	doh                   *dohResolver
+
+	// unixHTTP is the client requests to Unix domain sockets are sent through, see unixClient.
+	unixOnce sync.Once
+	unixHTTP *http.Client
+
+	// running holds the cancel functions of the downloads in progress.
+	runningMu sync.Mutex
+	running   map[*context.CancelFunc]struct{}
 }
 
 // Option as explained in http://commandcenter.blogspot.com/2014/01/self-referential-functions-and-design.html
@@ -62,8 +171,52 @@ func WithConcurrency(c int) Option {
 	}
 }
 
-// WithETag enables ETag support, meaning that if an already downloaded file is currently on disk and matches the ETag value returned by the server,
-// it will not be downloaded again. By default it is set to false. Be aware that different servers, serving the same file,
+// WithChunkSize splits downloads in chunks of the given size, in bytes, downloaded by as many
+// goroutines as set with WithConcurrency, instead of in as many chunks as goroutines. Smaller
+// chunks are retried faster and keep all the goroutines busy until the end of the download.
+func WithChunkSize(size int64) Option {
+	return func(f *Fetcher) {
+		f.chunkSize = size
+	}
+}
+
+// WithSingleConnectionThreshold downloads files smaller than the given number of bytes through
+// a single connection, regardless of the concurrency set. By default it is not set.
+func WithSingleConnectionThreshold(size int64) Option {
+	return func(f *Fetcher) {
+		f.singleConnThreshold = size
+	}
+}
+
+// WithMinChunkSize sets the smallest chunk, in bytes, files are split in according to the
+// concurrency, so a high concurrency does not split small files in many tiny requests. It
+// does not apply to chunk sizes set with WithChunkSize. By default it is set to 64 KiB.
+func WithMinChunkSize(size int64) Option {
+	return func(f *Fetcher) {
+		f.minChunkSize = size
+	}
+}
+
+// WithAdaptiveConcurrency starts downloads with a couple of goroutines and adjusts their number,
+// up to the concurrency set with WithConcurrency, according to the measured throughput, adding
+// connections while they make downloads faster and removing them when they make them slower.
+func WithAdaptiveConcurrency() Option {
+	return func(f *Fetcher) {
+		f.adaptive = true
+	}
+}
+
+// WithWorkStealing lets goroutines done with their chunks take over half of the biggest chunk
+// left to download, so a slow connection does not hold up the whole download. Chunks are split
+// as long as each half is at least 1 MiB.
+func WithWorkStealing() Option {
+	return func(f *Fetcher) {
+		f.workStealing = true
+	}
+}
+
+// WithETag enables ETag support, meaning that if an already downloaded file is currently on disk, the server is asked to only send it
+// again if its ETag changed, using If-None-Match, and it will not be downloaded again otherwise. By default it is set to false. Be aware that different servers, serving the same file,
 // are likely to return different ETag values, causing the file to be re-downloaded, even though it might already exist on disk.
 func WithETag() Option {
 	return func(f *Fetcher) {
@@ -71,336 +224,2081 @@ func WithETag() Option {
 	}
 }
 
-// WithHTTPClient allows to provide a custom HTTP client. By default a HTTP client with support for read/write timeouts is used.
-func WithHTTPClient(c *http.Client) Option {
+// ETagMatch tells how ETags are compared to find out whether a file changed since it was downloaded.
+type ETagMatch int
+
+const (
+	// ETagStrong only considers files unchanged if their strong ETags are identical. This is the default.
+	ETagStrong ETagMatch = iota
+	// ETagWeak also considers files unchanged if their weak ETags, W/"...", are identical.
+	ETagWeak
+	// ETagMirrors is like ETagWeak but, since mirrors serving the same file usually return different
+	// ETags, files are also considered unchanged if their size and Last-Modified date are identical.
+	ETagMirrors
+)
+
+// same tells whether the content described by the preflight response is the one downloaded before.
+func (m ETagMatch) same(meta *CacheEntry, rsc *resource) bool {
+	etag := rsc.header.Get("ETag")
+	weak := strings.HasPrefix(etag, "W/") || strings.HasPrefix(meta.ETag, "W/")
+	if etag != "" && meta.ETag != "" {
+		if !weak && etag == meta.ETag {
+			return true
+		}
+		if m >= ETagWeak && strings.TrimPrefix(etag, "W/") == strings.TrimPrefix(meta.ETag, "W/") {
+			return true
+		}
+	}
+
+	lastModified := rsc.header.Get("Last-Modified")
+	return m == ETagMirrors && lastModified != "" && lastModified == meta.LastModified &&
+		rsc.size >= 0 && rsc.size == meta.Size
+}
+
+// WithETagMatching sets how ETags are compared when ETag support is enabled, see WithETag.
+func WithETagMatching(m ETagMatch) Option {
 	return func(f *Fetcher) {
-		f.httpClient = c
+		f.etagMatch = m
 	}
 }
 
-// WithChecksum verifies the file once it is fully downloaded using the provided hash and expected value.
-func WithChecksum(alg, value string) Option {
+// WithLastModified enables conditional downloads based on the Last-Modified date returned by
+// the server. The date is recorded once a file is downloaded and, as long as the file is still
+// on disk, subsequent fetches ask the server to only send it again if it was modified since
+// then. This complements WithETag, for servers that do not provide ETags. By default it is
+// set to false.
+func WithLastModified() Option {
 	return func(f *Fetcher) {
-		f.algorithm = alg
-		f.checksum = value
+		f.lastModified = true
 	}
 }
 
-var workDir string
+// WithIdentityEncoding asks servers to send content as is, without compressing it, which keeps
+// sizes, byte ranges and checksums consistent with the file stored on disk. By default no
+// preference is sent and servers decide.
+func WithIdentityEncoding() Option {
+	return func(f *Fetcher) {
+		f.encoding = "identity"
+	}
+}
 
-func init() {
-	dir, err := homedir.Dir()
-	if err != nil {
-		fmt.Printf(`Unable to get user home directory err=%s\n`, err)
+// WithCompression tells servers that gzip compressed responses are accepted and transparently
+// decompresses them. Since byte ranges refer to the compressed data, compressed content is
+// downloaded using a single connection and it is not resumed if interrupted. Result reports
+// whether the content was compressed. By default no preference is sent and servers decide.
+func WithCompression() Option {
+	return func(f *Fetcher) {
+		f.encoding = "gzip"
 	}
-	workDir = filepath.Join(dir, ".gofetch")
 }
 
-// New creates a new instance of goFetch with the given options.
-func New(opts ...Option) *Fetcher {
-	// Creates instance and assigns defaults.
-	gofetch := &Fetcher{
-		concurrency: 1,
-		destDir:     "./",
-		httpClient:  httpclient.Default(),
+// WithRequestHook registers a function to be called before sending every request, including the
+// preflight request, chunk requests and retries, so headers can be added or requests audited.
+// Hooks run in the order they were registered, before requests are signed. If a hook returns an
+// error, the request is not sent and the download fails with it. The requests the built-in
+// handlers of other schemes send over HTTP go through hooks too, once signed by the handlers.
+func WithRequestHook(hook func(*http.Request) error) Option {
+	return func(f *Fetcher) {
+		f.requestHooks = append(f.requestHooks, hook)
 	}
+}
 
-	for _, opt := range opts {
-		opt(gofetch)
+// WithSigner allows to sign every request sent, including retries, right before sending it.
+func WithSigner(s Signer) Option {
+	return func(f *Fetcher) {
+		f.signer = s
 	}
+}
 
-	return gofetch
+// WithAWSCredentials signs every request using AWS Signature Version 4, so private objects
+// in S3 and S3 compatible services, such as Cloudflare R2 or MinIO, can be downloaded without
+// presigned URLs. The session token is only required for temporary credentials.
+func WithAWSCredentials(accessKeyID, secretAccessKey, sessionToken, region string) Option {
+	return WithSigner(&AWSSigner{
+		AccessKeyID:     accessKeyID,
+		SecretAccessKey: secretAccessKey,
+		SessionToken:    sessionToken,
+		Region:          region,
+	})
 }
 
-// Fetch downloads content from the provided URL. It supports resuming and
-// parallelizing downloads while being very memory efficient.
-func (gf *Fetcher) Fetch(url string, progressCh chan<- ProgressReport) (*os.File, error) {
-	if url == "" {
-		return nil, errors.New("URL is required")
+// WithDigestAuth authenticates requests using HTTP Digest access authentication, as described in
+// RFC 7616, which Go's HTTP client does not support natively. Both MD5 and SHA-256 are supported.
+func WithDigestAuth(username, password string) Option {
+	return func(f *Fetcher) {
+		f.digest = &digestAuth{username: username, password: password}
 	}
+}
 
-	// We need to make a preflight request to get the size of the content and check if the server
-	// supports requesting byte ranges.
-	res, err := http.Head(url)
-	if err != nil {
-		return nil, err
+// WithHTTPClient allows to provide a custom HTTP client. By default a HTTP client with support for read/write timeouts is used.
+func WithHTTPClient(c *http.Client) Option {
+	return func(f *Fetcher) {
+		f.httpClient = c
 	}
+}
 
-	if !strings.HasPrefix(res.Status, "2") {
-		return nil, fmt.Errorf("HTTP requests returned a non 2xx status code: %s", res.Status)
+// WithTLSConfig allows to provide a custom TLS configuration, for instance, to trust
+// certificate authorities not present in the system pool or to present client
+// certificates to the server. It is ignored if a custom HTTP client is provided.
+func WithTLSConfig(c *tls.Config) Option {
+	return func(f *Fetcher) {
+		f.tlsConfig = c
 	}
+}
 
-	if res.Header.Get("Accept-Ranges") != "bytes" {
-		// Server does not support sending byte ranges, setting concurrency to 1
-		gf.concurrency = 1
+// WithResolver resolves host names through the given resolver, like one querying the DNS
+// servers of a private network, instead of the system resolver. It is ignored if a custom HTTP
+// client is provided or HTTP/3 is forced.
+func WithResolver(r *net.Resolver) Option {
+	return func(f *Fetcher) {
+		f.resolver = r
 	}
+}
 
-	fileName := path.Base(url)
-	destFilePath := filepath.Join(gf.destDir, fileName)
+// WithHostOverride connects to the given IP addresses, tried in turn, instead of resolving the
+// host name, like /etc/hosts does, to pin hosts, such as mirrors, to known-good addresses, or to
+// reach hosts resolved differently inside and outside of a network. Certificates are still
+// verified against the host name. It can be given once per host. It is ignored if a custom HTTP
+// client is provided or HTTP/3 is forced.
+func WithHostOverride(host string, ips ...string) Option {
+	return func(f *Fetcher) {
+		if f.hosts == nil {
+			f.hosts = make(map[string][]string)
+		}
+		f.hosts[normalizeHost(host)] = ips
+	}
+}
 
-	var etag string
-	if gf.etag {
-		// Go's stdlib returns header value enclosed in double quotes.
-		etag = strings.Trim(res.Header.Get("ETag"), `"`)
+// WithDNSOverHTTPS resolves host names through the given DNS-over-HTTPS server (RFC 8484), like
+// https://cloudflare-dns.com/dns-query, caching its answers as long as their TTL tells. Hosts
+// given to WithHostOverride are not looked up, and neither is the host of the server, which is
+// resolved through WithHostOverride or WithResolver, if given, or the system resolver. It is
+// ignored if a custom HTTP client is provided or HTTP/3 is forced.
+func WithDNSOverHTTPS(endpoint string) Option {
+	return func(f *Fetcher) {
+		f.dohEndpoint = endpoint
+	}
+}
 
-		if etag == "" {
-			goto FETCH
+// WithPinnedCert makes downloads fail unless the server's leaf certificate matches one of
+// the given SHA-256 fingerprints, hex encoded, with or without colons. It is ignored if a
+// custom HTTP client is provided.
+func WithPinnedCert(fingerprints ...string) Option {
+	return func(f *Fetcher) {
+		for _, fp := range fingerprints {
+			f.certPins = append(f.certPins, strings.ToLower(strings.Replace(fp, ":", "", -1)))
 		}
+	}
+}
 
-		// Create directory if it doesn't exist, we ignore errors if it already exists.
-		cacheDir := filepath.Join(workDir, fileName)
-		etagPath := filepath.Join(cacheDir, etag)
-		os.MkdirAll(cacheDir, 0700)
-
-		if _, err := os.Stat(etagPath); err == nil {
-			// Our file has been already fully downloaded, return a file
-			// descriptor to it and skip fetching altogether.
-			fi, err := os.Stat(destFilePath)
-			if err == nil && fi.Size() == res.ContentLength {
-				if progressCh != nil {
-					close(progressCh)
-				}
-				return os.Open(destFilePath)
-			}
-		} else {
-			f, err := os.Create(etagPath)
-			if err != nil {
-				return nil, err
-			}
-			f.Close()
+// WithPinnedSPKI makes downloads fail unless a certificate in the chain presented by the server
+// has a public key matching one of the given pins. Pins are base64 encoded SHA-256 hashes of the
+// DER-encoded SubjectPublicKeyInfo, the same format used by HPKP and curl's --pinnedpubkey. It is
+// ignored if a custom HTTP client is provided.
+func WithPinnedSPKI(pins ...string) Option {
+	return func(f *Fetcher) {
+		for _, pin := range pins {
+			f.spkiPins = append(f.spkiPins, strings.TrimPrefix(pin, "sha256//"))
 		}
 	}
+}
 
-FETCH:
-	f, err := gf.parallelFetch(url, destFilePath, res.ContentLength, progressCh)
-	if err != nil {
-		return nil, err
+// WithMaxRedirects sets the maximum number of redirects to follow. Setting it to 0 makes
+// downloads fail if the server responds with a redirect. By default up to 10 redirects are followed.
+func WithMaxRedirects(n int) Option {
+	return func(f *Fetcher) {
+		f.redirectPolicy().max = n
 	}
+}
 
-	if gf.algorithm != "" {
-		if err := gf.verify(f, gf.algorithm, gf.checksum); err != nil {
-			return nil, errors.Wrap(err, "failed veryfing file integrity")
-		}
+// WithoutCrossHostRedirects makes downloads fail if the server redirects to a different host.
+func WithoutCrossHostRedirects() Option {
+	return func(f *Fetcher) {
+		f.redirectPolicy().sameHost = true
+	}
+}
 
-		// We need to make sure we return the file descriptor ready to be read by the user again
-		f.Seek(0, 0)
+// WithRedirectAuthStripping removes Authorization, Proxy-Authorization and Cookie headers from
+// requests redirected to a different origin, even if it is a subdomain of the original host.
+func WithRedirectAuthStripping() Option {
+	return func(f *Fetcher) {
+		f.redirectPolicy().stripAuth = true
 	}
+}
 
-	return f, nil
+// WithHTTP2PriorKnowledge forces the use of HTTP/2, without negotiating it with the server
+// first. Plain HTTP URLs are fetched using HTTP/2 over cleartext TCP (h2c), and HTTPS URLs
+// fail if the server does not support HTTP/2. It is ignored if a custom HTTP client is provided.
+func WithHTTP2PriorKnowledge() Option {
+	return func(f *Fetcher) {
+		f.protocol = protoHTTP2
+	}
 }
 
-func (gf *Fetcher) verify(f *os.File, algorithm string, checksum string) error {
-	var hasher hash.Hash
-	switch algorithm {
-	case "md5":
-		hasher = md5.New()
-	case "sha1":
-		hasher = sha1.New()
-	case "sha256":
-		hasher = sha256.New()
-	case "sha512":
-		hasher = sha512.New()
-	default:
-		return fmt.Errorf("unsupported hashing algorithm: %s", algorithm)
+// WithHTTP2Multiplexing sends the requests for all the chunks of a download as concurrent
+// streams over a single HTTP/2 connection, instead of opening a connection for each of them,
+// when servers support HTTP/2 over TLS. It is friendlier to servers, and often faster behind
+// CDNs throttling many parallel connections. Servers not supporting HTTP/2 still get a
+// connection per chunk. It is ignored if a custom HTTP client is provided.
+func WithHTTP2Multiplexing() Option {
+	return func(f *Fetcher) {
+		f.multiplex = true
 	}
+}
 
-	// Makes sure file cursor is positioned at the beginning
-	_, err := f.Seek(0, 0)
-	if err != nil {
-		return err
+// WithHTTP3 makes gofetch use HTTP/3 over QUIC, which allows multiplexing all chunk requests
+// over a single connection and usually performs better on high-latency links. Since it pulls
+// in a QUIC implementation, it is only available when building with the http3 build tag;
+// otherwise downloads fail. It is ignored if a custom HTTP client is provided.
+func WithHTTP3() Option {
+	return func(f *Fetcher) {
+		f.protocol = protoHTTP3
 	}
+}
 
-	_, err = io.Copy(hasher, f)
-	if err != nil {
-		return err
+// WithoutHEAD skips the preflight HEAD request, which some servers, like S3 presigned URLs
+// and several CDNs, reject. Instead, the size of the content and support for byte ranges
+// are found out by requesting its first byte with a GET request. This is done automatically
+// if the server responds to the HEAD request with 403, 405 or 501, so this option only saves
+// a round trip.
+func WithoutHEAD() Option {
+	return func(f *Fetcher) {
+		f.skipHEAD = true
 	}
+}
 
-	result := fmt.Sprintf("%x", hasher.Sum(nil))
+// WithUserAgent sets the User-Agent header sent on every request.
+// By default it is set to: gofetch (+https://github.com/c4milo/gofetch)
+func WithUserAgent(ua string) Option {
+	return func(f *Fetcher) {
+		f.userAgent = ua
+	}
+}
 
-	if result != checksum {
-		return fmt.Errorf("checksum does not match\n found: %s\n expected: %s", result, checksum)
+// WithConnectTimeout sets the maximum amount of time to wait for a connection to the server
+// to be established. By default it is set to 30 seconds. It is ignored if a custom HTTP client
+// is provided.
+func WithConnectTimeout(d time.Duration) Option {
+	return func(f *Fetcher) {
+		f.connectTimeout = d
 	}
+}
 
-	return nil
+// WithResponseHeaderTimeout sets the maximum amount of time to wait for the server's response
+// headers after sending a request. By default there is no limit other than the idle timeout.
+// It is ignored if a custom HTTP client, or HTTP/2 or HTTP/3 are forced.
+func WithResponseHeaderTimeout(d time.Duration) Option {
+	return func(f *Fetcher) {
+		f.responseHeaderTimeout = d
+	}
 }
 
-// parallelFetch fetches using multiple goroutines, each piece is streamed down
-// to disk which makes it very efficient in terms of memory usage.
-func (gf *Fetcher) parallelFetch(url, destFilePath string, length int64, progressCh chan<- ProgressReport) (*os.File, error) {
-	if progressCh != nil {
-		defer close(progressCh)
+// WithIdleTimeout sets the maximum amount of time a connection may go without sending or receiving
+// any data. Unlike a deadline for the whole request, it is reset on every read or write, so large
+// downloads are not interrupted as long as data keeps flowing. By default it is set to 30 seconds,
+// and 0 disables it. It is ignored if a custom HTTP client is provided.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(f *Fetcher) {
+		f.idleTimeout = d
 	}
+}
 
-	var wg sync.WaitGroup
+// WithBufferSize sets the size, in bytes, of the buffers downloaded data is copied through.
+// Larger buffers, like 1 MiB, mean fewer writes and can noticeably improve throughput on fast
+// links. By default it is set to 32 KiB.
+func WithBufferSize(size int) Option {
+	return func(f *Fetcher) {
+		f.bufferSize = size
+	}
+}
 
-	report := ProgressReport{Total: length}
-	concurrency := int64(gf.concurrency)
-	chunkSize := length / concurrency
-	remainingSize := length % concurrency
-	chunksDir := filepath.Join(gf.destDir, path.Base(url)+".chunks")
+// WithMemoryMappedWrites maps files being downloaded to memory, on 64-bit platforms supporting
+// it, so chunks are copied to them instead of written through a system call each time. It can
+// reduce the overhead of many connections writing small pieces at once. Files of unknown size,
+// and platforms not supporting it, fall back to regular writes.
+func WithMemoryMappedWrites() Option {
+	return func(f *Fetcher) {
+		f.mmapWrites = true
+	}
+}
 
-	if err := os.MkdirAll(chunksDir, 0760); err != nil {
-		return nil, err
+// WithRateLimit caps the bandwidth used by the Fetcher to the given number of bytes per
+// second, shared by all the goroutines and downloads, so it does not saturate the network.
+// By default there is no limit. See ContextWithRateLimit to limit downloads individually.
+func WithRateLimit(bytesPerSec int64) Option {
+	return func(f *Fetcher) {
+		if bytesPerSec > 0 {
+			f.rateLimiter = newRateLimiter(bytesPerSec)
+		}
 	}
+}
 
-	var errs []error
-	for i := int64(0); i < concurrency; i++ {
-		min := chunkSize * i
-		max := chunkSize * (i + 1)
+// WithProgressThrottle coalesces progress reports, so consumers like terminal UIs are not
+// flooded with one report for every write. Reports are sent at most once per interval, and
+// once at least the given number of bytes are written; zero values disable either bound.
+// By default a report is sent for every write.
+func WithProgressThrottle(interval time.Duration, bytes int64) Option {
+	return func(f *Fetcher) {
+		f.progressInterval = interval
+		f.progressBytes = bytes
+	}
+}
 
-		if i == (concurrency - 1) {
-			// Add the remaining bytes in the last request
-			max += remainingSize
+// WithMaxConnections caps the number of chunks downloaded at once across all the downloads of
+// the Fetcher, so running many downloads at once does not open as many connections times the
+// concurrency. Chunks beyond it wait for others to finish, by the priority of their download.
+// By default there is no limit.
+func WithMaxConnections(n int) Option {
+	return func(f *Fetcher) {
+		if n > 0 {
+			f.connections = newPriorityLimit(n)
 		}
+	}
+}
 
-		wg.Add(1)
-		go func(min, max int64, chunkNumber int) {
-			defer wg.Done()
-			chunkFile := filepath.Join(chunksDir, strconv.Itoa(chunkNumber))
+// SyncPolicy controls how downloaded files are flushed to disk, trading throughput for
+// durability in case of crashes or power losses.
+type SyncPolicy int
+
+const (
+	// SyncNone leaves flushing files to disk to the operating system. It is the default.
+	SyncNone SyncPolicy = iota
+	// SyncFile flushes downloaded files to disk before moving them to their destination.
+	SyncFile
+	// SyncFull also flushes partial downloads every time their progress is recorded, so they
+	// are resumed from data actually on disk, and the destination directory once files are
+	// moved to it.
+	SyncFull
+)
 
-			if err := gf.fetch(url, chunkFile, min, max, report, progressCh); err != nil {
-				fmt.Printf("gofetch: error %#v\n", err)
-				errs = append(errs, err)
-			}
-		}(min, max, int(i))
+// WithSync sets how downloaded files are flushed to disk. By default it is set to SyncNone.
+func WithSync(policy SyncPolicy) Option {
+	return func(f *Fetcher) {
+		f.syncPolicy = policy
 	}
-	wg.Wait()
+}
 
-	if len(errs) > 0 {
-		return nil, fmt.Errorf("errors: \n %s", errs)
+// WithTempDir sets the directory the data of downloads is kept in until they finish, which
+// can be on a different filesystem than the destination directory. By default it is kept
+// in the destination directory.
+func WithTempDir(dir string) Option {
+	return func(f *Fetcher) {
+		f.tempDir = dir
 	}
+}
 
-	file, err := gf.assembleChunks(destFilePath, chunksDir)
-	if err != nil {
-		return nil, err
+// WithCleanupOnFailure removes the data of failed downloads right away, instead of keeping it
+// to resume them later. Downloads canceled through their context keep it anyway. See also
+// RemoveStaleChunks.
+func WithCleanupOnFailure() Option {
+	return func(f *Fetcher) {
+		f.cleanupOnFailure = true
 	}
+}
 
-	os.RemoveAll(chunksDir)
+// WithFileLinks hard links files fetched through file:// URLs to their destination, instead of
+// copying them, as long as they are on the same filesystem. Linked files share their content,
+// so changing either of them changes the other. By default files are copied.
+func WithFileLinks() Option {
+	return func(f *Fetcher) {
+		f.linkFiles = true
+	}
+}
 
-	// Makes sure to return the file on the correct offset so it can be
-	// consumed by users.
-	_, err = file.Seek(0, 0)
-	if err != nil {
-		return nil, err
+// WithMaxConnsPerHost caps the number of simultaneous connections to each host, so high
+// concurrency does not exhaust ephemeral ports or trip per-IP connection limits on servers.
+// Requests beyond it wait for a connection to be available. By default there is no limit.
+// It is ignored if a custom HTTP client, or HTTP/2 or HTTP/3 are forced.
+func WithMaxConnsPerHost(n int) Option {
+	return func(f *Fetcher) {
+		f.maxConnsPerHost = n
 	}
+}
 
-	return file, err
+// WithMaxIdleConnsPerHost sets how many idle connections to each host are kept for later
+// requests. By default it is set to the concurrency, or 2 if lower. It is ignored if a
+// custom HTTP client, or HTTP/2 or HTTP/3 are forced.
+func WithMaxIdleConnsPerHost(n int) Option {
+	return func(f *Fetcher) {
+		f.maxIdleConnsPerHost = n
+	}
 }
 
-// assembleChunks join all the data pieces together
-func (gf *Fetcher) assembleChunks(destFile, chunksDir string) (*os.File, error) {
-	file, err := os.Create(destFile)
-	if err != nil {
-		return nil, err
+// WithKeepAlive sets the interval between TCP keep-alive probes. By default it is set to
+// 30 seconds. A negative value disables keep-alives altogether, both TCP probes and reusing
+// connections for several requests. It is ignored if a custom HTTP client is provided.
+func WithKeepAlive(d time.Duration) Option {
+	return func(f *Fetcher) {
+		f.keepAlive = d
 	}
+}
 
-	for i := 0; i < gf.concurrency; i++ {
-		chunkFile, err := os.Open(filepath.Join(chunksDir, strconv.Itoa(i)))
-		if err != nil {
-			return nil, err
-		}
-		// Deferring within a loop is not ideal but we expect not too many chunks to exists.
-		defer chunkFile.Close()
+// WithStallTimeout makes gofetch watch every chunk request and, if no data is received for
+// the given amount of time, transparently re-issue the request from where it was left off.
+// Unlike WithIdleTimeout, it also works with custom HTTP clients. Reconnecting does not
+// count as a retry unless the stalled request did not receive any data at all.
+// By default stall detection is disabled.
+func WithStallTimeout(d time.Duration) Option {
+	return func(f *Fetcher) {
+		f.stallTimeout = d
+	}
+}
 
-		if _, err := io.Copy(file, chunkFile); err != nil {
-			return nil, err
+// WithMinSpeed aborts downloads, failing with ErrTooSlow, if the overall transfer speed stays
+// below bytesPerSec during the given window of time, similar to curl's --speed-limit and
+// --speed-time options. By default there is no minimum speed. It is ignored unless both the
+// speed and the window are positive.
+func WithMinSpeed(bytesPerSec int64, window time.Duration) Option {
+	return func(f *Fetcher) {
+		if bytesPerSec <= 0 || window <= 0 {
+			return
 		}
+		f.minSpeed = bytesPerSec
+		f.minSpeedWindow = window
 	}
-	return file, nil
 }
 
-// fetch downloads files using one unbuffered HTTP connection and supports
-// resuming downloads if interrupted.
-func (gf *Fetcher) fetch(url, destFile string, min, max int64,
-	report ProgressReport, progressCh chan<- ProgressReport) error {
+// WithFastestMirrors probes the mirrors given to FetchFromMirrors and FetchMetalink before
+// downloading, with small ranged requests sent to all of them at once, and tries them from the
+// fastest to the slowest, keeping only the n fastest ones, or all of them if n is 0 or less.
+// See ProbeMirrors. By default mirrors are tried in the order given.
+func WithFastestMirrors(n int) Option {
+	return func(f *Fetcher) {
+		f.probeMirrors = true
+		f.fastestMirrors = n
+	}
+}
 
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return err
+// WithMirrorChunks downloads the chunks of the content given to FetchFromMirrors and
+// FetchMetalink from all of its mirrors at once, rather than from one mirror at a time, to
+// download it faster than any of them would on its own. Mirrors are expected to serve the same
+// content, only the ones serving content of the same size, and supporting byte ranges, are
+// used. Retried chunks are downloaded from the next mirror. By default chunks are downloaded
+// from a single mirror.
+func WithMirrorChunks() Option {
+	return func(f *Fetcher) {
+		f.mirrorChunks = true
 	}
+}
 
-	// In order to resume previous interrupted downloads we need to open the file
-	// in append mode.
-	file, err := os.OpenFile(destFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0660)
-	if err != nil {
-		return err
+// WithDeltaUpdates updates files already in the destination directory by downloading only the
+// blocks that changed, as told by the zsync control file published next to the content, with
+// the .zsync extension, if any. The other blocks are copied from the file already there, and
+// the result is verified against the SHA-1 digest of the control file. Content without control
+// file, or whose server does not support byte ranges, is downloaded as a whole. See FetchZsync.
+// By default files are downloaded as a whole.
+func WithDeltaUpdates() Option {
+	return func(f *Fetcher) {
+		f.deltaUpdates = true
 	}
-	defer file.Close()
+}
 
-	fi, err := file.Stat()
-	if err != nil {
-		return err
+// WithMultiRange downloads up to n chunks through a single request for several byte ranges,
+// whose multipart/byteranges response is written to their offsets, so content split in many
+// chunks, like with WithChunkSize or WithDeltaUpdates, is downloaded through fewer connections.
+// Chunks are downloaded one by one from servers not supporting it. By default each chunk is
+// requested on its own.
+func WithMultiRange(n int) Option {
+	return func(f *Fetcher) {
+		f.multiRange = n
 	}
+}
 
-	currFileSize := fi.Size()
-	currChunkSize := (max - min)
+// WithRetries retries failed requests up to max times, when the failure is likely to be
+// transient, such as connection resets, timeouts or 502, 503 and 504 responses. Each chunk
+// is retried independently, resuming from where it was left off, waiting an exponentially
+// increasing and randomized amount of time, starting at backoff, between attempts.
+// By default requests are not retried.
+func WithRetries(max int, backoff time.Duration) Option {
+	return func(f *Fetcher) {
+		f.retries = max
+		f.backoff = backoff
+	}
+}
 
-	// Report bytes written already into the file
-	if progressCh != nil {
-		report.WrittenBytes = currFileSize
-		progressCh <- report
+// WithChunkRetries retries chunks up to max times, instead of the number of times set with
+// WithRetries, so parts of the download can be given more chances than other requests. Failing
+// chunks are retried independently, while the others keep downloading, and the download only
+// fails once they run out of retries. What was downloaded is kept, so it can be resumed later.
+func WithChunkRetries(max int, backoff time.Duration) Option {
+	return func(f *Fetcher) {
+		f.chunkRetries = max
+		f.chunkBackoff = backoff
 	}
+}
 
-	// There is nothing to do if chunk data file was fully downloaded.
-	if currFileSize > 0 && currFileSize == currChunkSize {
-		return nil
+// WithChecksumFile verifies the file against its entry in a checksum manifest, like SHA256SUMS
+// or foo.tar.gz.sha256, located at the given local path or HTTP(S) URL. If alg is empty, the
+// hashing algorithm is inferred from the manifest name or the length of the hash.
+func WithChecksumFile(alg, location string) Option {
+	return func(f *Fetcher) {
+		f.manifests = append(f.manifests, checksumFile{algorithm: alg, location: location})
 	}
+}
 
-	// Adjusts min to resume file download from where it was left off.
-	if currFileSize > 0 {
-		min = min + currFileSize
+// WithSignedChecksumFile is like WithChecksumFile but it also verifies the manifest against
+// a detached OpenPGP signature made by one of the keys in keyring, before trusting its content.
+// If signature is empty, it defaults to the manifest location with a .gpg extension, as in
+// SHA256SUMS and SHA256SUMS.gpg.
+func WithSignedChecksumFile(alg, location, signature string, keyring openpgp.KeyRing) Option {
+	return func(f *Fetcher) {
+		if signature == "" {
+			signature = location + ".gpg"
+		}
+		f.manifests = append(f.manifests, checksumFile{
+			algorithm: alg,
+			location:  location,
+			signature: &gpgSignature{location: signature, keyring: keyring},
+		})
 	}
+}
 
-	// Prepares writer to report download progress.
-	writer := fetchWriter{
-		Writer:         file,
-		progressCh:     progressCh,
-		progressReport: report,
+// WithChecksumDiscovery looks for checksum files published alongside the downloaded file,
+// <url>.sha256, <url>.sha512 or SHA256SUMS, and verifies the file against the first one found.
+// It is only done when no checksum was given explicitly, and the file is not verified if none is found.
+// Release assets fetched with FetchRelease are looked up in the checksum files of their release.
+func WithChecksumDiscovery() Option {
+	return func(f *Fetcher) {
+		f.discover = true
 	}
+}
 
-	brange := fmt.Sprintf("bytes=%d-%d", min, max-1)
-	if max == -1 {
-		brange = fmt.Sprintf("bytes=%d-", min)
+// WithGPGSignature verifies the file against a detached OpenPGP signature, armored (.asc) or
+// binary (.sig), located at the given local path or HTTP(S) URL. The signature must have been
+// made by one of the keys in keyring, which can be loaded with openpgp.ReadArmoredKeyRing.
+func WithGPGSignature(location string, keyring openpgp.KeyRing) Option {
+	return func(f *Fetcher) {
+		f.signature = &gpgSignature{location: location, keyring: keyring}
 	}
+}
 
-	req.Header.Add("Range", brange)
-	//fmt.Printf("range %s\n", brange)
-	res, err := gf.httpClient.Do(req)
-	if err != nil {
-		return err
+// WithBlockChecksums verifies the file as it is downloaded, using the checksums of each one of
+// its consecutive blocks of blockSize bytes, the last block being possibly shorter. Chunks are
+// verified as soon as they complete, and only the corrupt parts are downloaded again, either
+// while retrying, see WithRetries, or when resuming the download.
+func WithBlockChecksums(alg string, blockSize int64, sums ...string) Option {
+	return func(f *Fetcher) {
+		f.blocks = &blockChecksums{algorithm: alg, size: blockSize, sums: sums}
 	}
-	defer res.Body.Close()
+}
 
-	if !strings.HasPrefix(res.Status, "2") {
-		return fmt.Errorf("HTTP requests returned a non 2xx status code: %s", res.Status)
+// WithVerifyExisting skips the download if the destination file already exists and matches
+// the expected checksums, and signature if any. It has no effect if no checksum is provided.
+func WithVerifyExisting() Option {
+	return func(f *Fetcher) {
+		f.verifyExisting = true
 	}
+}
 
-	reader := res.Body.(io.Reader)
-	if max > 0 {
-		// Known content-length, so we only read from body the amount of bytes of requested chunk.
-		reader = io.LimitReader(res.Body, currChunkSize)
+// WithQuarantineDir moves downloaded files failing checksum or signature verification
+// to the given directory, so they can be inspected later on.
+func WithQuarantineDir(dir string) Option {
+	return func(f *Fetcher) {
+		f.quarantineDir = dir
 	}
-	_, err = io.Copy(&writer, reader)
-	return err
 }
 
-// fetchWriter implements a custom io.Writer so we can send granular
-// progress reports when streaming down content.
-type fetchWriter struct {
-	io.Writer
-	//progressCh is the channel sent by the user to get download updates.
-	progressCh chan<- ProgressReport
-	// report is the structure sent through the progress channel.
-	progressReport ProgressReport
+// WithCustomChecksum verifies the file once downloaded using the hash returned by newHash,
+// like an HMAC, and the expected hex encoded value. The name identifies the hash in sidecar files.
+func WithCustomChecksum(name string, newHash func() hash.Hash, value string) Option {
+	return func(f *Fetcher) {
+		f.checksums = append(f.checksums, checksum{algorithm: name, value: value, newHash: newHash})
+	}
 }
 
-func (fw *fetchWriter) Write(b []byte) (int, error) {
-	n, err := fw.Writer.Write(b)
+// WithVerifier verifies the file once downloaded using the given verifier. It can be used
+// several times, the file is read once for each verifier.
+func WithVerifier(v Verifier) Option {
+	return func(f *Fetcher) {
+		f.verifiers = append(f.verifiers, v)
+	}
+}
+
+// WithServerChecksums validates the file against the checksums announced by the server, if
+// any, through the Content-MD5, x-goog-hash or x-amz-checksum-* response headers, in addition
+// to the checksums provided explicitly.
+func WithServerChecksums() Option {
+	return func(f *Fetcher) {
+		f.serverChecksums = true
+	}
+}
+
+// WithDigests computes the digests of the content using the given hashing algorithms while
+// downloading it, and returns them in Result.Digests, without verifying them.
+func WithDigests(algs ...string) Option {
+	return func(f *Fetcher) {
+		for _, alg := range algs {
+			f.digests = append(f.digests, checksum{algorithm: alg, computeOnly: true})
+		}
+	}
+}
 
-	if fw.progressCh != nil {
-		fw.progressReport.WrittenBytes = int64(n)
-		fw.progressCh <- fw.progressReport
+// WithCache honors the caching headers sent by servers, Cache-Control and Expires, so files
+// fetched again while they are still fresh are returned right away, without even asking the
+// server whether they changed. Files are never considered fresh if servers send Cache-Control
+// no-cache or no-store.
+func WithCache() Option {
+	return func(f *Fetcher) {
+		f.cache = true
 	}
+}
 
+// WithCacheLimits bounds the size of the cache gofetch keeps in ~/.gofetch, evicting the
+// least recently used URLs when it grows over the limits, or once they expire. It applies
+// to caches created with NewDiskCache too, see WithCacheBackend.
+func WithCacheLimits(limits CacheLimits) Option {
+	return func(f *Fetcher) {
+		f.cacheLimits = &limits
+	}
+}
+
+// WithCacheBackend replaces the cache gofetch keeps in ~/.gofetch.
+func WithCacheBackend(c Cache) Option {
+	return func(f *Fetcher) {
+		f.store = c
+	}
+}
+
+// WithContentAddressableCache stores downloaded files in the gofetch cache, ~/.gofetch, addressed
+// by their digest, so the same file requested from different URLs or to different destinations is
+// downloaded only once. Cached files are found using the expected checksums, see WithChecksum, and
+// are copied to their destination, so they can be modified without affecting the cache.
+func WithContentAddressableCache() Option {
+	return func(f *Fetcher) {
+		f.cas = true
+	}
+}
+
+// WithCacheValidation validates files on disk before reusing them, when they did not change on
+// the server, see WithETag, WithLastModified and WithCache. Invalid files are downloaded again.
+func WithCacheValidation(v CacheValidation) Option {
+	return func(f *Fetcher) {
+		f.cacheValidation = v
+	}
+}
+
+// WithOfflineMode never contacts servers, files are served from the cache only: files downloaded
+// before with WithETag, WithLastModified or WithCache, files in the content-addressable cache, see
+// WithContentAddressableCache, and existing files matching their checksums, see WithVerifyExisting.
+// Fetching anything else fails with a *NotCachedError.
+func WithOfflineMode() Option {
+	return func(f *Fetcher) {
+		f.offline = true
+	}
+}
+
+// WithForceRefresh always downloads files again, overwriting them, regardless of what the
+// cache knows about them. It is useful when files were replaced on the server keeping their
+// validators, like ETags. The cache is updated with the downloaded files.
+func WithForceRefresh() Option {
+	return func(f *Fetcher) {
+		f.forceRefresh = true
+	}
+}
+
+// WithPreserveModTime sets the modification time of downloaded files to the Last-Modified
+// date sent by the server, if any, like wget -N does, for tools relying on timestamps.
+func WithPreserveModTime() Option {
+	return func(f *Fetcher) {
+		f.preserveModTime = true
+	}
+}
+
+// WithSidecar records the digests of downloaded files, the ones verified and the ones requested
+// with WithDigests, in a sidecar file named after the downloaded file with a .gofetch.json
+// extension, along with their source URL and ETag. Combined with WithVerifyExisting, files whose
+// digests were recorded are not hashed again as long as their size and modification time did not change.
+func WithSidecar() Option {
+	return func(f *Fetcher) {
+		f.sidecar = true
+	}
+}
+
+// WithChecksum verifies the file once it is fully downloaded using the provided hash and expected value.
+// The expected value is hex encoded and the supported algorithms are: md5, sha1, sha256, sha512,
+// blake2b (or blake2b-512), blake2b-256, blake3, crc32, crc32c and xxh3 (64 bits). If alg is empty,
+// it is inferred from the length of the checksum among md5, sha1, sha256 and sha512, or
+// an *AlgorithmError is returned when fetching.
+//
+// It can be used several times to verify more than one checksum, all of them are computed
+// in a single pass over the downloaded data.
+func WithChecksum(alg, value string) Option {
+	return func(f *Fetcher) {
+		f.checksums = append(f.checksums, checksum{algorithm: alg, value: value})
+	}
+}
+
+const defaultUserAgent = "gofetch (+https://github.com/c4milo/gofetch)"
+
+var workDir string
+
+func init() {
+	dir, err := homedir.Dir()
+	if err != nil {
+		fmt.Printf(`Unable to get user home directory err=%s\n`, err)
+	}
+	workDir = filepath.Join(dir, ".gofetch")
+}
+
+// New creates a new instance of goFetch with the given options.
+func New(opts ...Option) *Fetcher {
+	// Creates instance and assigns defaults.
+	gofetch := &Fetcher{
+		concurrency: 1,
+		destDir:     "./",
+		userAgent:   defaultUserAgent,
+
+		// Chunks follow the retry policy of other requests unless told otherwise.
+		chunkRetries: -1,
+
+		connectTimeout: defaultConnectTimeout,
+		idleTimeout:    defaultIdleTimeout,
+		keepAlive:      defaultKeepAlive,
+		minChunkSize:   defaultMinChunkSize,
+
+		store:   &diskCache{dir: workDir},
+		running: make(map[*context.CancelFunc]struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(gofetch)
+	}
+
+	if gofetch.bufferSize <= 0 {
+		gofetch.bufferSize = defaultBufferSize
+	}
+	gofetch.buffers = newBufferPool(gofetch.bufferSize)
+
+	// Limits apply to the cache whether they were given before or after its backend.
+	if d, ok := gofetch.store.(*diskCache); ok && gofetch.cacheLimits != nil {
+		d.limits = *gofetch.cacheLimits
+	}
+
+	if gofetch.dohEndpoint != "" {
+		gofetch.doh = newDoHResolver(gofetch, gofetch.dohEndpoint)
+	}
+
+	// The default client is created last so it can honor the options given.
+	if gofetch.httpClient == nil {
+		gofetch.httpClient = newHTTPClient(gofetch)
+	}
+
+	if gofetch.redirects != nil {
+		// Makes a copy to avoid changing the behavior of a client provided by the user.
+		client := *gofetch.httpClient
+		client.CheckRedirect = gofetch.redirects.check
+		gofetch.httpClient = &client
+	}
+	gofetch.handlerHTTP = newHandlerClient(gofetch)
+
+	return gofetch
+}
+
+// Fetch downloads content from the provided URL. It supports resuming and
+// parallelizing downloads while being very memory efficient. Share links of Google Drive and
+// Dropbox are followed to the files they share, going through the confirmation pages of
+// Google Drive, and the files are saved under their own names.
+func (gf *Fetcher) Fetch(url string, progressCh chan<- ProgressReport) (*os.File, error) {
+	result, err := gf.FetchContext(context.Background(), url, progressCh)
+	if err != nil {
+		return nil, err
+	}
+	return result.File, nil
+}
+
+// FetchContext is like Fetch but it aborts the download if the given context is canceled,
+// and returns further details about the download.
+func (gf *Fetcher) FetchContext(ctx context.Context, url string, progressCh chan<- ProgressReport) (*Result, error) {
+	return gf.fetchTarget(ctx, url, progressCh, nil)
+}
+
+// target describes the file a download is saved as, when it is known beforehand, like when
+// described by a Metalink.
+type target struct {
+	// name is the name of the file in the destination directory, instead of the one in the URL.
+	name string
+	// checksums are verified along with the ones given as options.
+	checksums []checksum
+	// size is the size of the file, or -1 if unknown.
+	size int64
+	// mirrors are the URLs serving the same content, whose partial downloads are resumed
+	// even if there are no digests to tell whether they have the same content.
+	mirrors []string
+	// sources are the mirrors chunks are downloaded from too, see WithMirrorChunks.
+	sources []string
+	// verifiers are run along with the ones given as options.
+	verifiers []Verifier
+	// delta describes the blocks of the content, to copy the ones that did not change from the
+	// file at the destination rather than downloading them, see FetchZsync.
+	delta *Zsync
+	// handler reads the content instead of the one of the scheme of the URL, like the segments
+	// of streams, see FetchStream.
+	handler Handler
+}
+
+// fetchTarget downloads the content of the given URL, saving it as the given target, if set.
+func (gf *Fetcher) fetchTarget(ctx context.Context, url string, progressCh chan<- ProgressReport, t *target) (*Result, error) {
+	if url == "" {
+		return nil, errors.New("URL is required")
+	}
+
+	ctx, cancel := context.WithCancel(gf.handlerContext(ctx))
+	defer cancel()
+	defer gf.track(&cancel)()
+
+	// Share links lead to web pages previewing the files, rather than to the files themselves.
+	fileName := destFileName(url)
+	if link := parseShareLink(url); link != nil {
+		if link.drive && !gf.offline {
+			err := gf.retry(ctx, func() error {
+				return gf.confirmDrive(ctx, link)
+			})
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed resolving share link %s", url)
+			}
+		}
+		url, fileName = link.url, link.name
+	}
+
+	handler, err := schemeHandler(url)
+	if err != nil {
+		return nil, err
+	}
+	if t != nil && t.handler != nil {
+		handler = t.handler
+	}
+
+	checksums := gf.checksums
+	verifiers := gf.verifiers
+	if t != nil {
+		if t.name != "" {
+			fileName = t.name
+		}
+		checksums = append(checksums[:len(checksums):len(checksums)], t.checksums...)
+		verifiers = append(verifiers[:len(verifiers):len(verifiers)], t.verifiers...)
+	}
+	destFilePath := filepath.Join(gf.destDir, fileName)
+
+	for _, m := range gf.manifests {
+		c, err := gf.manifestChecksum(ctx, m, fileName)
+		if err != nil {
+			return nil, err
+		}
+		checksums = append(checksums[:len(checksums):len(checksums)], c)
+	}
+
+	if gf.discover && !gf.offline && len(checksums) == 0 {
+		c, err := gf.discoverChecksum(ctx, url, fileName)
+		if err != nil {
+			return nil, err
+		}
+		if c != nil {
+			checksums = []checksum{*c}
+		}
+	}
+
+	// The signature is fetched upfront so we do not download the file for nothing.
+	var signature []byte
+	if gf.signature != nil {
+		var err error
+		if signature, err = gf.readLocation(ctx, gf.signature.location); err != nil {
+			return nil, errors.Wrapf(err, "failed reading signature %s", gf.signature.location)
+		}
+	}
+
+	// Checksums are computed while assembling the downloaded chunks, so the
+	// file does not need to be read once again to verify it.
+	digests := gf.digests
+	if gf.cas || gf.cacheValidation == CacheValidationFull {
+		// Files are addressed by their SHA-256 digest in the content-addressable cache,
+		// which is also used to validate them before reusing them.
+		digests = append(digests[:len(digests):len(digests)], checksum{algorithm: casAlgorithm, computeOnly: true})
+	}
+
+	var v *verifier
+	if len(checksums) > 0 || len(digests) > 0 {
+		var err error
+		if v, err = newVerifier(append(checksums[:len(checksums):len(checksums)], digests...)); err != nil {
+			return nil, err
+		}
+	}
+
+	// Other processes downloading the same file are waited for, instead of racing on its chunks.
+	unlock, err := lockFile(ctx, destLock(destFilePath))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed locking destination file")
+	}
+	defer unlock()
+
+	if gf.verifyExisting && !gf.forceRefresh && len(checksums) > 0 {
+		f, err := gf.existingFile(destFilePath, checksums, signature)
+		if err != nil {
+			return nil, err
+		}
+		if f != nil {
+			if progressCh != nil {
+				close(progressCh)
+			}
+			return &Result{File: f, URL: url}, nil
+		}
+	}
+
+	if gf.cas && !gf.forceRefresh {
+		if result, err := gf.fromCAS(checksums, url, destFilePath, signature, progressCh); result != nil || err != nil {
+			return result, err
+		}
+	}
+
+	// What we know about the file from previous downloads, as long as it is still on disk.
+	var meta *CacheEntry
+	if (gf.etag || gf.lastModified || gf.cache || gf.offline) && !gf.forceRefresh {
+		fi, err := os.Stat(destFilePath)
+		m, merr := gf.store.Get(url)
+		if merr != nil {
+			return nil, errors.Wrap(merr, "failed reading cache")
+		}
+		if err == nil && m != nil && fi.Size() == m.Size && gf.validCached(destFilePath, fi, m) {
+			meta = m
+		}
+	}
+
+	// Files still fresh, according to the caching headers sent by the server, are
+	// not even checked with the server. Nor are files downloaded before, when offline.
+	if meta != nil && (gf.offline || gf.cache && time.Now().Before(meta.Expires)) {
+		if progressCh != nil {
+			close(progressCh)
+		}
+		// Storing the metadata again marks it as recently used.
+		if err := gf.store.Put(meta); err != nil {
+			return nil, err
+		}
+		f, err := os.Open(destFilePath)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{File: f, URL: url}, nil
+	}
+
+	if gf.offline {
+		return nil, &NotCachedError{URL: url}
+	}
+
+	// Otherwise, the file is only downloaded again if it was modified since then, the
+	// server responds with 304 Not Modified if it was not. Stale cached files are
+	// revalidated the same way.
+	conditions := http.Header{}
+	if meta != nil {
+		if (gf.etag || gf.cache) && meta.ETag != "" {
+			conditions.Set("If-None-Match", meta.ETag)
+		}
+		if (gf.lastModified || gf.cache) && meta.LastModified != "" {
+			conditions.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+
+	// We need to make a preflight request to get the size of the content and check if the server
+	// supports requesting byte ranges.
+	var rsc *resource
+	err = gf.retry(ctx, func() error {
+		var err error
+		if handler != nil {
+			rsc, err = handlerResource(ctx, handler, url)
+		} else {
+			rsc, err = gf.preflight(ctx, url, conditions)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if t != nil && t.size >= 0 && rsc.size >= 0 && rsc.size != t.size {
+		return nil, fmt.Errorf("content of %s is %d bytes long, expected %d bytes", url, rsc.size, t.size)
+	}
+
+	// Servers ignoring conditional requests, or mirrors returning different validators,
+	// can still tell us the content did not change.
+	if gf.etag && meta != nil && !rsc.notModified && gf.etagMatch.same(meta, rsc) {
+		rsc.notModified = true
+	}
+
+	result := &Result{URL: rsc.url}
+
+	if rsc.notModified {
+		if progressCh != nil {
+			close(progressCh)
+		}
+		result.File, err = os.Open(destFilePath)
+		if err != nil {
+			return nil, err
+		}
+
+		if meta != nil {
+			if gf.cache {
+				// The file is fresh for a while longer.
+				meta.Expires = freshUntil(rsc.header, time.Now())
+				meta.Updated = time.Now()
+			}
+			if err := gf.store.Put(meta); err != nil {
+				result.File.Close()
+				return nil, err
+			}
+		}
+		return result, nil
+	}
+
+	concurrency := gf.concurrency
+	if !rsc.ranges {
+		// Server does not support sending byte ranges, setting concurrency to 1
+		concurrency = 1
+	}
+
+	if rsc.size >= 0 && rsc.size < gf.singleConnThreshold {
+		// Small files are downloaded faster through a single connection.
+		concurrency = 1
+	}
+
+	if rsc.encoding != "" {
+		// Content is going to be decompressed, so we can neither split it using byte
+		// ranges nor know its final size beforehand.
+		result.ContentEncoding = rsc.encoding
+		concurrency = 1
+		rsc.size = -1
+	}
+
+	// Content addressed by its digests is always verified against them.
+	if len(rsc.digests) > 0 {
+		checksums = append(checksums[:len(checksums):len(checksums)], rsc.digests...)
+		if v, err = newVerifier(append(checksums, digests...)); err != nil {
+			return nil, err
+		}
+	}
+
+	// Checksums announced by the server refer to the content as stored, so they
+	// cannot be used if the content is going to be decoded.
+	if server := append(serverChecksums(rsc.header), rsc.checksums...); gf.serverChecksums && rsc.encoding == "" && len(server) > 0 {
+		checksums = append(checksums[:len(checksums):len(checksums)], server...)
+		if v, err = newVerifier(append(checksums, digests...)); err != nil {
+			return nil, err
+		}
+
+		if gf.cas && !gf.forceRefresh {
+			if result, err := gf.fromCAS(server, url, destFilePath, signature, progressCh); result != nil || err != nil {
+				return result, err
+			}
+		}
+	}
+
+	// Files at the destination are updated by downloading only the blocks that changed.
+	if gf.deltaUpdates && (t == nil || t.delta == nil) && rsc.ranges && rsc.encoding == "" && rsc.size > 0 {
+		if fi, err := os.Stat(destFilePath); err == nil && fi.Mode().IsRegular() && fi.Size() > 0 {
+			z, err := gf.discoverZsync(ctx, url, rsc.size)
+			if err != nil {
+				return nil, err
+			}
+			if z != nil {
+				dt := target{size: -1}
+				if t != nil {
+					dt = *t
+				}
+				dt.delta = z
+				t = &dt
+
+				if z.SHA1 != "" {
+					checksums = append(checksums[:len(checksums):len(checksums)], checksum{algorithm: "sha1", value: z.SHA1})
+					if v, err = newVerifier(append(checksums, digests...)); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+	}
+
+	if gf.blocks != nil && gf.blocks.size <= 0 {
+		return nil, fmt.Errorf("invalid block size: %d", gf.blocks.size)
+	}
+
+	if gf.blocks != nil && rsc.size >= 0 {
+		blocks := int((rsc.size + gf.blocks.size - 1) / gf.blocks.size)
+		if blocks != len(gf.blocks.sums) {
+			return nil, fmt.Errorf("expected %d block checksums for %d bytes, got %d", blocks, rsc.size, len(gf.blocks.sums))
+		}
+		// Chunks are made of whole blocks, so there cannot be more chunks than blocks.
+		if concurrency > blocks {
+			concurrency = blocks
+		}
+	}
+
+	var f *os.File
+	if _, ok := handler.(fileHandler); ok && gf.linkFiles {
+		f, err = gf.linkFile(url, destFilePath, rsc.size, v, progressCh)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if f == nil {
+		f, err = gf.parallelFetch(ctx, url, destFilePath, rsc, t, concurrency, v, progressCh)
+	}
+	if err != nil {
+		// Canceled downloads keep what they downloaded anyway, since they are likely to be
+		// resumed, like when paused.
+		if gf.cleanupOnFailure && ctx.Err() == nil {
+			os.RemoveAll(gf.chunksDir(destFilePath))
+		}
+		return nil, err
+	}
+
+	// The download is verified before being moved to its destination, so invalid
+	// files never make it there.
+	if v != nil {
+		if err := v.verify(); err != nil {
+			return nil, gf.discard(f, destFilePath, errors.Wrap(err, "failed veryfing file integrity"))
+		}
+	}
+
+	if err := gf.verifyFile(f, signature, verifiers); err != nil {
+		if errors.Cause(err) != errInvalidFile {
+			f.Close()
+			return nil, err
+		}
+		return nil, gf.discard(f, destFilePath, err)
+	}
+
+	if f, err = gf.finalize(f, destFilePath); err != nil {
+		return nil, err
+	}
+
+	if gf.preserveModTime {
+		if modTime, err := http.ParseTime(rsc.header.Get("Last-Modified")); err == nil {
+			if err := os.Chtimes(f.Name(), time.Now(), modTime); err != nil {
+				f.Close()
+				return nil, err
+			}
+		}
+	}
+
+	if v != nil && gf.sidecar {
+		if err := writeSidecar(f, url, rsc.header.Get("ETag"), v.digests()); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	result.File = f
+	if v != nil {
+		result.Digests = v.digests()
+	}
+
+	if gf.cas {
+		if err := gf.store.Store(destFilePath, result.Digests); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	if gf.etag || gf.lastModified || gf.cache {
+		fi, err := f.Stat()
+		if err == nil {
+			m := &CacheEntry{
+				URL:          url,
+				ETag:         rsc.header.Get("ETag"),
+				LastModified: rsc.header.Get("Last-Modified"),
+				Size:         fi.Size(),
+				ModTime:      fi.ModTime(),
+				Digests:      result.Digests,
+				Updated:      time.Now(),
+			}
+			if gf.cache {
+				m.Expires = freshUntil(rsc.header, m.Updated)
+			}
+			err = gf.store.Put(m)
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// track registers the cancel function of a download in progress, so it is canceled by
+// Cancel, returning a function to unregister it once done.
+func (gf *Fetcher) track(cancel *context.CancelFunc) func() {
+	gf.runningMu.Lock()
+	gf.running[cancel] = struct{}{}
+	gf.runningMu.Unlock()
+
+	return func() {
+		gf.runningMu.Lock()
+		delete(gf.running, cancel)
+		gf.runningMu.Unlock()
+	}
+}
+
+// Cancel cancels all the downloads in progress, which fail with an error caused by
+// context.Canceled. What they downloaded so far is kept, along with their state, so they
+// are resumed from where they were left off by the next Fetch of their URLs.
+func (gf *Fetcher) Cancel() {
+	gf.runningMu.Lock()
+	defer gf.runningMu.Unlock()
+	for cancel := range gf.running {
+		(*cancel)()
+	}
+}
+
+// fromCAS places a file matching any of the given checksums from the content-addressable cache at
+// the destination, instead of downloading it. It returns a nil result if the cache does not hold it.
+func (gf *Fetcher) fromCAS(checksums []checksum, url, destFilePath string, signature []byte, progressCh chan<- ProgressReport) (*Result, error) {
+	var found *checksum
+	for i, c := range checksums {
+		if c.value == "" || c.newHash != nil {
+			continue
+		}
+		ok, err := gf.store.Stat(c.algorithm, c.value)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed reading cache")
+		}
+		if ok {
+			found = &checksums[i]
+			break
+		}
+	}
+	if found == nil {
+		return nil, nil
+	}
+
+	if progressCh != nil {
+		close(progressCh)
+	}
+
+	if err := gf.store.Load(found.algorithm, found.value, destFilePath); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(destFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := gf.verifyFile(f, signature, gf.verifiers); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Result{File: f, URL: url}, nil
+}
+
+// CacheEntries returns the URLs gofetch knows about, in its cache.
+func (gf *Fetcher) CacheEntries() ([]*CacheEntry, error) {
+	return gf.store.List()
+}
+
+// Purge removes a URL from the cache, so it is downloaded again next time.
+func (gf *Fetcher) Purge(url string) error {
+	return gf.store.Delete(url)
+}
+
+// PurgeAll empties the cache.
+func (gf *Fetcher) PurgeAll() error {
+	return gf.store.Clear()
+}
+
+// CacheUsage reports the current size of the cache.
+func (gf *Fetcher) CacheUsage() (CacheUsage, error) {
+	return gf.store.Usage()
+}
+
+// do runs the request hooks, signs the request, if a signer was provided, and sends it.
+func (gf *Fetcher) do(req *http.Request) (*http.Response, error) {
+	for _, hook := range gf.requestHooks {
+		if err := hook(req); err != nil {
+			return nil, err
+		}
+	}
+
+	if gf.signer != nil {
+		if err := gf.signer.Sign(req); err != nil {
+			return nil, errors.Wrap(err, "failed signing request")
+		}
+	}
+
+	client := gf.httpClient
+	if _, ok := unixSocket(req.URL.Host); ok {
+		client = gf.unixClient()
+	}
+
+	if gf.digest != nil {
+		return gf.digest.do(client, req)
+	}
+	return client.Do(req)
+}
+
+// newRequest creates an HTTP request bound to the given context, with the
+// headers gofetch sends on every request.
+func (gf *Fetcher) newRequest(ctx context.Context, method, url string) (*http.Request, error) {
+	target, err := requestURL(url)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if isUnixURL(url) {
+		// The host requests are sent to only names the socket.
+		req.Host = "localhost"
+	}
+
+	if gf.userAgent != "" {
+		req.Header.Set("User-Agent", gf.userAgent)
+	}
+
+	if gf.encoding != "" {
+		req.Header.Set("Accept-Encoding", gf.encoding)
+	}
+
+	for k, v := range requestHeaderFrom(ctx) {
+		req.Header[k] = v
+	}
+	return req.WithContext(ctx), nil
+}
+
+// requestHeaderKey is the context key of the headers sent along the requests of a download.
+type requestHeaderKey struct{}
+
+// withRequestHeader returns a context sending the given headers along the requests of the
+// downloads using it, like the credentials of the API serving release assets.
+func withRequestHeader(ctx context.Context, header http.Header) context.Context {
+	if len(header) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, requestHeaderKey{}, header)
+}
+
+// requestHeaderFrom returns the headers sent along the requests of the download using the
+// given context.
+func requestHeaderFrom(ctx context.Context) http.Header {
+	header, _ := ctx.Value(requestHeaderKey{}).(http.Header)
+	return header
+}
+
+// parallelFetch fetches using multiple goroutines, each piece is streamed down to disk, at
+// its offset in the file, which makes it very efficient in terms of memory usage. It returns
+// the downloaded data, which is moved to its destination by finalize once verified.
+func (gf *Fetcher) parallelFetch(ctx context.Context, url, destFilePath string, rsc *resource, t *target,
+	concurrency int, hasher *verifier, progressCh chan<- ProgressReport) (*os.File, error) {
+	if progressCh != nil {
+		defer close(progressCh)
+	}
+
+	length := rsc.size
+	d := &download{
+		url:        url,
+		progressCh: progressCh,
+		report:     ProgressReport{Total: length},
+		encoding:   rsc.encoding,
+		handler:    rsc.handler,
+		ranges:     rsc.ranges,
+
+		progressInterval: gf.progressInterval,
+		progressBytes:    gf.progressBytes,
+	}
+	defer d.flushProgress()
+
+	if concurrency > 1 {
+		d.mirrors = gf.chunkMirrors(ctx, rsc, t)
+	}
+
+	if gf.minSpeed > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		go d.monitorSpeed(ctx, cancel, gf.minSpeed, gf.minSpeedWindow)
+	}
+
+	chunksDir := gf.chunksDir(destFilePath)
+	stateFile := filepath.Join(chunksDir, "state")
+	dataPath := filepath.Join(chunksDir, "data")
+
+	// Validators cannot be trusted when refreshing, so partial downloads are not resumed either.
+	if gf.forceRefresh {
+		if err := os.RemoveAll(chunksDir); err != nil {
+			return nil, err
+		}
+	}
+
+	// Chunks are resumed only if the content did not change since they were downloaded,
+	// which is checked upfront with the validators of the content at the time, and then
+	// by the server, through If-Range, in case it changes in the meantime.
+	// Downloads expected to match a digest can also be resumed from mirrors, since they are
+	// verified once complete.
+	var chunks []*chunk
+	fresh := false
+	digests := hasher.expected()
+	header := newDownloadState(url, rsc, digests)
+	saved := loadState(stateFile, length)
+	if saved != nil && (saved.matches(url, rsc, digests) || saved.fromMirror(url, rsc, t)) && recoverData(dataPath, destFilePath, saved) {
+		chunks = saved.Chunks
+		if saved.URL == url {
+			header, header.Chunks, header.Completed = *saved, nil, nil
+			d.ifRange = saved.Validator
+		} else {
+			// The validators of the mirror are the ones telling whether the content
+			// changes from now on.
+			d.ifRange = header.Validator
+		}
+	} else {
+		if err := os.RemoveAll(chunksDir); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(chunksDir, 0760); err != nil {
+			return nil, err
+		}
+		chunks = gf.planChunks(length, concurrency)
+		fresh = true
+	}
+
+	file, err := os.OpenFile(dataPath, os.O_RDWR|os.O_CREATE, 0660)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if length > 0 {
+		// Chunks are written at their offset, so the file is given its final size upfront.
+		if err := preallocate(file, length); err != nil {
+			return nil, errors.Wrapf(err, "failed allocating %d bytes for %s", length, destFilePath)
+		}
+	}
+
+	// Blocks of the file at the destination that did not change are copied rather than
+	// downloaded, they are then verified like the chunks of interrupted downloads.
+	if fresh && t != nil && t.delta != nil && t.delta.Length == length && length > 0 && rsc.ranges &&
+		rsc.encoding == "" && gf.blocks == nil {
+		if seed, err := os.Open(destFilePath); err == nil {
+			fi, err := seed.Stat()
+			var found []bool
+			if err == nil {
+				found, err = t.delta.reuse(seed, fi.Size(), file)
+			}
+			seed.Close()
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed reusing blocks of %s", destFilePath)
+			}
+			chunks = deltaChunks(found, int64(t.delta.BlockSize), length, concurrency)
+		}
+	}
+
+	// What was downloaded before is verified, rather than trusted, before resuming it.
+	if err := verifyChunks(file, chunks); err != nil {
+		return nil, err
+	}
+
+	var out dataFile = file
+	if gf.mmapWrites && length > 0 {
+		// Chunks are written through regular system calls if the file cannot be mapped.
+		if m, err := mapFile(file, length); err == nil {
+			defer m.close()
+			out = m
+		}
+	}
+
+	var syncData func() error
+	if gf.syncPolicy >= SyncFull {
+		syncData = file.Sync
+	}
+	state := newChunkState(stateFile, header, chunks, syncData)
+	defer state.close()
+
+	// Downloads are hashed along the way, so the file is not read again. Only the bytes on
+	// disk before resuming are read back right away.
+	if hasher != nil {
+		d.hash = &streamHasher{hasher: hasher, file: out, buffers: gf.buffers, chunks: state.list}
+		d.hash.catchUp()
+	}
+
+	errs := gf.fetchChunks(ctx, d, out, state, concurrency, true)
+
+	if containsError(errs, ErrContentChanged) {
+		// The content changed since the download started, so the data downloaded
+		// so far is no longer valid and we need to start over.
+		for _, c := range state.list() {
+			c.reset(0, 0)
+		}
+		d.hash.reset()
+		d.ifRange = rsc.validator()
+		state.setHeader(newDownloadState(url, rsc, digests))
+		if err := state.save(); err != nil {
+			return nil, err
+		}
+		errs = gf.fetchChunks(ctx, d, out, state, concurrency, false)
+	}
+
+	if chunks := state.list(); len(chunks) > 1 && containsError(errs, errRangesIgnored) {
+		// The server claims to support byte ranges but it is sending the whole content
+		// instead. The first chunk is the only one holding valid data, so we keep it
+		// and continue downloading the rest of the content through it.
+		written, crc := chunks[0].progress()
+		state.set([]*chunk{{Start: 0, End: length, Written: written, crc: crc}})
+		errs = gf.fetchChunks(ctx, d, out, state, 1, false)
+	}
+
+	d.hash.catchUp()
+
+	// The data is flushed before recording the progress of the chunks one last time, so
+	// the download is resumed precisely, even if it was canceled.
+	if m, ok := out.(*mappedFile); ok {
+		if err := m.close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := state.close(); err != nil {
+		return nil, err
+	}
+
+	if d.tooSlow() {
+		return nil, errors.Wrapf(ErrTooSlow, "less than %d bytes per second during %s", gf.minSpeed, gf.minSpeedWindow)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Wrap(err, "download interrupted, it can be resumed")
+	}
+
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("errors: \n %s", errs)
+	}
+
+	if gf.syncPolicy >= SyncFile {
+		if err := file.Sync(); err != nil {
+			return nil, err
+		}
+	}
+
+	if hasher != nil && !d.hash.complete(file) {
+		hasher.reset()
+		if _, err := gf.buffers.copy(hasher, file); err != nil {
+			return nil, err
+		}
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+
+	// Decoded content cannot be checked against the length announced by the server.
+	if fi, err := os.Stat(dataPath); err != nil {
+		return nil, err
+	} else if length >= 0 && fi.Size() != length {
+		return nil, fmt.Errorf("expected %d bytes, got %d", length, fi.Size())
+	}
+
+	return os.Open(dataPath)
+}
+
+// finalize moves the verified data of a download to its destination, returning the file at
+// the destination. Files are renamed into place, so consumers watching the destination
+// directory never see them partially written.
+func (gf *Fetcher) finalize(file *os.File, destFilePath string) (*os.File, error) {
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+
+	// The existing file is removed rather than overwritten, since it may be hard linked
+	// to another file, see WithFileLinks.
+	if err := os.Remove(destFilePath); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := moveFile(file.Name(), destFilePath); err != nil {
+		return nil, err
+	}
+	if gf.syncPolicy >= SyncFull {
+		// Makes sure the file is not lost if the system crashes right after the rename.
+		if err := syncDir(filepath.Dir(destFilePath)); err != nil {
+			return nil, err
+		}
+	}
+
+	os.RemoveAll(gf.chunksDir(destFilePath))
+
+	return os.Open(destFilePath)
+}
+
+// chunksDir returns the directory holding the data and state of the download saved at the
+// given destination path while it is in progress.
+func (gf *Fetcher) chunksDir(destFilePath string) string {
+	dir := gf.tempDir
+	if dir == "" {
+		dir = gf.destDir
+	}
+	// Files saved in subdirectories of the destination directory, like the files of torrents,
+	// keep their chunks in the same subdirectories, so files with the same name do not clash.
+	name, err := filepath.Rel(gf.destDir, destFilePath)
+	if err != nil || strings.HasPrefix(name, "..") {
+		name = filepath.Base(destFilePath)
+	}
+	return filepath.Join(dir, name+".chunks")
+}
+
+// destFileName returns the name the content of the given URL is saved under: the last element
+// of its path, the name parameter of data: URIs or "data" if missing, "stdin" for the standard
+// input, or the repository and digest of OCI blobs, like image@sha256-<hex>.
+func destFileName(url string) string {
+	if url == stdinURL {
+		return "stdin"
+	}
+	if len(url) >= len("data:") && strings.EqualFold(url[:len("data:")], "data:") {
+		params, _, _ := parseDataURI(url)
+		if name := path.Base(filepath.ToSlash(params["name"])); name != "." && name != "/" && name != ".." {
+			return name
+		}
+		return "data"
+	}
+	if len(url) >= len("oci://") && strings.EqualFold(url[:len("oci://")], "oci://") {
+		// Colons are not allowed in file names on Windows.
+		return strings.Replace(path.Base(url), ":", "-", -1)
+	}
+	return path.Base(url)
+}
+
+// RemoveStaleChunks removes the data of interrupted downloads not resumed for longer than the
+// given duration, which is otherwise kept to resume them. Downloads in progress are left alone.
+func (gf *Fetcher) RemoveStaleChunks(olderThan time.Duration) error {
+	dir := gf.tempDir
+	if dir == "" {
+		dir = gf.destDir
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	// Downloads in progress hold their lock, which is only tried once.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() || !strings.HasSuffix(name, ".chunks") {
+			continue
+		}
+
+		chunksDir := filepath.Join(dir, name)
+		// The state is recorded regularly while downloading, so its age tells how long
+		// ago the download was interrupted.
+		modTime := e.ModTime()
+		if fi, err := os.Stat(filepath.Join(chunksDir, "state")); err == nil {
+			modTime = fi.ModTime()
+		}
+		if time.Since(modTime) < olderThan {
+			continue
+		}
+
+		unlock, err := lockFile(ctx, destLock(filepath.Join(gf.destDir, strings.TrimSuffix(name, ".chunks"))))
+		if err != nil {
+			continue
+		}
+		err = os.RemoveAll(chunksDir)
+		unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recoverData makes sure the data of an interrupted download is in place, telling whether it
+// is. Downloads interrupted while being moved to their destination, once complete, are moved
+// back, so they are finished without downloading them again.
+func recoverData(dataPath, destFilePath string, s *downloadState) bool {
+	if _, err := os.Stat(dataPath); err == nil {
+		return true
+	}
+
+	for _, c := range s.Chunks {
+		if !c.done() {
+			return false
+		}
+	}
+	fi, err := os.Stat(destFilePath)
+	if err != nil || fi.Size() != s.Size {
+		return false
+	}
+	return os.Rename(destFilePath, dataPath) == nil
+}
+
+// fetchChunks downloads the chunks of the download using as many goroutines as the given
+// concurrency, returning the errors found along the way.
+func (gf *Fetcher) fetchChunks(ctx context.Context, d *download, file dataFile, state *chunkState,
+	concurrency int, reportExisting bool) []error {
+	var wg sync.WaitGroup
+
+	var errs []error
+	failed := make(map[*chunk]bool)
+	var errsMu sync.Mutex
+	// Chunks failing for good do not stop the others, what they download is kept
+	// for the download to be resumed.
+	fail := func(c *chunk, err error) {
+		err = errors.Wrapf(err, "failed downloading bytes %d-%d", c.Start, c.end()-1)
+		errsMu.Lock()
+		errs = append(errs, err)
+		failed[c] = true
+		errsMu.Unlock()
+	}
+
+	fetchChunk := func(c *chunk, reportExisting bool) {
+		// Bytes already on disk are only reported once, retries resume the chunk from
+		// where the previous attempt left off.
+		err := gf.retryChunk(ctx, func() error {
+			for {
+				err := gf.fetch(ctx, d, file, c, reportExisting)
+				reportExisting = false
+
+				if se, ok := err.(*stallError); ok && se.written > 0 {
+					// The connection stalled after making some progress,
+					// reconnect right away.
+					continue
+				}
+				if err == nil && gf.blocks != nil {
+					err = gf.verifyBlocks(d, file, c)
+				}
+				return err
+			}
+		})
+
+		if err != nil {
+			fail(c, err)
+		}
+		// The data downloaded ahead of what was hashed so far may now follow it.
+		d.hash.catchUp()
+	}
+
+	fetchBatch := func(batch []*chunk) {
+		if len(batch) > 1 {
+			if reportExisting {
+				for _, c := range batch {
+					d.existing(c.written())
+				}
+			}
+			// Whatever the request for all the chunks did not download, because it failed
+			// or the server does not support it, is downloaded chunk by chunk.
+			gf.fetchRanges(ctx, d, file, batch)
+		}
+		for _, c := range batch {
+			fetchChunk(c, reportExisting && len(batch) == 1)
+		}
+	}
+
+	// Failed chunks are not worth taking over, the download fails anyway.
+	skip := func(c *chunk) bool {
+		errsMu.Lock()
+		defer errsMu.Unlock()
+		return failed[c]
+	}
+
+	batches := batchChunks(state.list(), gf.multiRange)
+	if concurrency > len(batches) {
+		concurrency = len(batches)
+	}
+
+	limit := newWorkerLimit(concurrency)
+	if gf.adaptive && concurrency > adaptiveStart {
+		limit.set(adaptiveStart)
+		adaptCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go d.adaptConcurrency(adaptCtx, limit, concurrency)
+	}
+
+	work := make(chan []*chunk)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				limit.acquire()
+				batch, ok := <-work
+				if !ok && gf.workStealing {
+					if c := gf.steal(state, skip); c != nil {
+						batch = []*chunk{c}
+					}
+				}
+				if batch == nil {
+					limit.release()
+					return
+				}
+				if gf.connections == nil {
+					fetchBatch(batch)
+				} else if err := gf.connections.acquire(ctx, priorityFrom(ctx)); err != nil {
+					for _, c := range batch {
+						fail(c, err)
+					}
+				} else {
+					fetchBatch(batch)
+					gf.connections.release()
+				}
+				limit.release()
+			}
+		}()
+	}
+
+	for _, batch := range batches {
+		work <- batch
+	}
+	close(work)
+	wg.Wait()
+
+	return errs
+}
+
+// verifyBlocks verifies the blocks of a chunk as soon as it is downloaded. Corrupt
+// blocks are discarded, along with the rest of the chunk after them, so they are
+// downloaded again when the chunk is resumed.
+func (gf *Fetcher) verifyBlocks(d *download, file dataFile, c *chunk) error {
+	written := c.written()
+	// Chunks split while being downloaded may have a few bytes written past their end.
+	size := written
+	if end := c.end(); end >= 0 && end-c.Start < size {
+		size = end - c.Start
+	}
+	pos, err := gf.blocks.verify(io.NewSectionReader(file, c.Start, size), c.Start)
+	if _, ok := err.(*blockError); !ok {
+		return err
+	}
+
+	crc, _, cerr := checksumRange(file, c.Start, pos)
+	if cerr != nil {
+		return cerr
+	}
+	c.reset(pos, crc)
+	// Those bytes are going to be downloaded and reported again.
+	d.written(pos - written)
+	return err
+}
+
+// containsError tells whether any of the given errors was caused by target.
+func containsError(errs []error, target error) bool {
+	for _, err := range errs {
+		if errors.Cause(err) == target {
+			return true
+		}
+	}
+	return false
+}
+
+// errRangesIgnored is returned when a server responds with the whole content
+// to a request for a byte range.
+var errRangesIgnored = errors.New("server ignored the requested byte range")
+
+// ErrContentChanged is returned when resuming a download whose content changed
+// on the server since it was started. Downloads failing with it are started over.
+var ErrContentChanged = errors.New("content changed since the download started")
+
+// fetch downloads a chunk of the content into file using one unbuffered HTTP connection
+// and supports resuming it if interrupted.
+func (gf *Fetcher) fetch(ctx context.Context, d *download, file dataFile, c *chunk, reportExisting bool) error {
+
+	var watchdog *stallWatchdog
+	if gf.stallTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, watchdog, cancel = newStallWatchdog(ctx, gf.stallTimeout)
+		defer cancel()
+	}
+
+	written := c.written()
+
+	// Report bytes written already into the file
+	if reportExisting {
+		d.existing(written)
+	}
+
+	// There is nothing to do if the chunk was fully downloaded.
+	if c.done() {
+		return nil
+	}
+
+	// Adjusts min to resume the chunk from where it was left off.
+	start, min, max := c.Start, c.Start+written, c.end()
+	src := d.source()
+
+	// Prepares writer to report download progress.
+	writer := fetchWriter{
+		Writer:   &chunkWriter{file: file, chunk: c, hash: d.hash},
+		download: d,
+	}
+
+	// restart discards what was downloaded of the chunk before, those bytes were already
+	// reported, so they are not reported again.
+	restart := func() error {
+		if max < 0 {
+			// The size of the content is unknown, so it could be shorter this time.
+			if err := file.Truncate(0); err != nil {
+				return err
+			}
+		}
+		c.reset(0, 0)
+		writer.unreported = written
+		min = start
+		return nil
+	}
+
+	if d.encoding != "" {
+		// Compressed content is downloaded as a whole, since byte ranges refer to the
+		// compressed data and not to the decompressed data we write to disk.
+		if err := restart(); err != nil {
+			return err
+		}
+	}
+
+	// request asks for the rest of the chunk, from min.
+	request := func() (*http.Response, error) {
+		req, err := gf.newRequest(ctx, "GET", src.url)
+		if err != nil {
+			return nil, err
+		}
+
+		if d.encoding == "" {
+			brange := fmt.Sprintf("bytes=%d-%d", min, max-1)
+			if max == -1 {
+				brange = fmt.Sprintf("bytes=%d-", min)
+			}
+
+			req.Header.Add("Range", brange)
+			if min > start && src.ifRange != "" {
+				// Makes the server send the whole content if it changed since we started
+				// downloading this chunk.
+				req.Header.Set("If-Range", src.ifRange)
+			}
+		}
+
+		res, err := gf.do(req)
+		if err != nil {
+			return nil, watchdog.Err(err, 0)
+		}
+		return res, nil
+	}
+
+	var body io.ReadCloser
+	var header http.Header
+	if src.handler != nil {
+		if min > 0 && !src.ranges {
+			// The content can only be read from its beginning.
+			if err := restart(); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		length := int64(-1)
+		if max >= 0 {
+			length = max - min
+		}
+		// ETags are quoted, unlike the modification dates used as validators when missing.
+		if ch, ok := src.handler.(ConditionalHandler); ok && min > start && strings.HasPrefix(src.ifRange, `"`) {
+			body, err = ch.OpenIfMatch(ctx, src.url, min, length, src.ifRange)
+		} else {
+			body, err = src.handler.Open(ctx, src.url, min, length)
+		}
+		if err != nil {
+			return watchdog.Err(err, 0)
+		}
+		defer body.Close()
+	} else {
+		res, err := request()
+		if err != nil {
+			return err
+		}
+
+		if res.StatusCode == http.StatusRequestedRangeNotSatisfiable && min > start {
+			// What was downloaded of the chunk goes beyond the end of the content, because it
+			// is corrupt or the content was truncated on the server, so it is downloaded again.
+			res.Body.Close()
+			if err := restart(); err != nil {
+				return err
+			}
+			if res, err = request(); err != nil {
+				return err
+			}
+		}
+		defer res.Body.Close()
+
+		if !strings.HasPrefix(res.Status, "2") {
+			return &statusError{code: res.StatusCode, status: res.Status}
+		}
+
+		if res.StatusCode != http.StatusPartialContent && min > start && src.ifRange != "" &&
+			validator(res.Header) != src.ifRange {
+			return ErrContentChanged
+		}
+
+		if res.StatusCode != http.StatusPartialContent && min > 0 {
+			// The server ignored the requested range and is sending the whole content.
+			if start > 0 {
+				return errRangesIgnored
+			}
+
+			// This chunk starts at the beginning of the content, so we can still use the
+			// response by discarding what was downloaded before.
+			if err := restart(); err != nil {
+				return err
+			}
+		}
+
+		body, header = res.Body, res.Header
+	}
+
+	reader := gf.limitRate(ctx, watchdog.Reader(body))
+	if gf.decodedEncoding(header) == "gzip" {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return watchdog.Err(err, 0)
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	if max > 0 {
+		// Known content-length, so we only read from body the amount of bytes of requested chunk.
+		reader = io.LimitReader(reader, max-min)
+	}
+
+	n, err := gf.buffers.copy(&writer, reader)
+	if err == errChunkSplit {
+		// The rest of the chunk is being downloaded by another goroutine.
+		return nil
+	}
+	if err != nil {
+		return watchdog.Err(err, n)
+	}
+
+	if max > 0 && n < max-min {
+		// The server closed the connection before sending the whole chunk.
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// fetchWriter implements a custom io.Writer so we can send granular
+// progress reports when streaming down content.
+type fetchWriter struct {
+	io.Writer
+	// download is the download the written data belongs to.
+	download *download
+	// unreported is the number of bytes to write before reporting progress again.
+	unreported int64
+}
+
+func (fw *fetchWriter) Write(b []byte) (int, error) {
+	n, err := fw.Writer.Write(b)
+
+	reported := int64(n)
+	if fw.unreported > 0 {
+		skipped := reported
+		if skipped > fw.unreported {
+			skipped = fw.unreported
+		}
+		fw.unreported -= skipped
+		reported -= skipped
+	}
+
+	if reported > 0 {
+		fw.download.written(reported)
+	}
 	return n, err
 }
@@ -5,20 +5,36 @@
 package gofetch
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
 	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/hooklift/assert"
 	"github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 func TestFetchWithoutContentLength(t *testing.T) {
@@ -95,7 +111,11 @@ func TestFetchWithContentLength(t *testing.T) {
 }
 
 func TestResume(t *testing.T) {
+	var requestedRange string
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			requestedRange = r.Header.Get("Range")
+		}
 		file, err := os.Open("./fixtures/test")
 		assert.Ok(t, err)
 		assert.Cond(t, file != nil, "Failed loading fixture file")
@@ -116,14 +136,19 @@ func TestResume(t *testing.T) {
 	fixtureFile, err := os.Open("./fixtures/test-resume")
 	assert.Ok(t, err)
 
-	chunkFile, err := os.Create(filepath.Join(chunksDir, "0"))
+	dataFile, err := os.Create(filepath.Join(chunksDir, "data"))
 	assert.Ok(t, err)
 
-	_, err = io.Copy(chunkFile, fixtureFile)
+	written, err := io.Copy(dataFile, fixtureFile)
 	assert.Ok(t, err)
 
 	fixtureFile.Close()
-	chunkFile.Close()
+	dataFile.Close()
+
+	fixture, err := ioutil.ReadFile("./fixtures/test-resume")
+	assert.Ok(t, err)
+	assert.Ok(t, saveState(filepath.Join(chunksDir, "state"), downloadState{URL: ts.URL, Size: 10485760},
+		[]*chunk{{Start: 0, End: 10485760, Written: written, crc: crc32.Checksum(fixture, crc32c)}}))
 
 	done := make(chan bool)
 	progressCh := make(chan ProgressReport)
@@ -136,14 +161,19 @@ func TestResume(t *testing.T) {
 		done <- true
 	}()
 
-	var total int64
+	var total, resumed int64
 	for p := range progressCh {
 		//fmt.Printf("\r%d of %d", p.WrittenBytes, p.Total)
 		total += p.WrittenBytes
+		resumed = p.ResumedBytes
 	}
-	// It should report the complete file size through the channel
-	assert.Equals(t, int64(10485760), total)
+	// It should report the complete file size through the channel, telling apart the
+	// bytes that were already on disk.
+	assert.Equals(t, written, resumed)
+	assert.Equals(t, int64(10485760), resumed+total)
 	<-done
+	// Only the missing bytes were requested.
+	assert.Equals(t, fmt.Sprintf("bytes=%d-10485759", written), requestedRange)
 	// Fetch finished and we can now use the file without causing data races.
 
 	// Checks that the downloaded file has the same size as the test fixture
@@ -207,6 +237,42 @@ func TestEtagSupport(t *testing.T) {
 	assert.Ok(t, err)
 }
 
+func TestEtagSupportQuoted(t *testing.T) {
+	var downloads int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, err := os.Open("./fixtures/test")
+		assert.Ok(t, err)
+		defer file.Close()
+
+		w.Header().Add("Etag", `"7h153746154w350m3"`)
+		if r.Method == http.MethodGet && r.Header.Get("If-None-Match") != `"7h153746154w350m3"` {
+			downloads++
+		}
+		http.ServeContent(w, r, file.Name(), time.Time{}, file)
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "etag-quoted")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	gf := New(WithDestDir(destDir), WithConcurrency(1), WithETag())
+	for i := 0; i < 2; i++ {
+		f, err := gf.Fetch(ts.URL+"/test", nil)
+		assert.Ok(t, err)
+		f.Close()
+	}
+
+	// The file is only downloaded once, the server answers the conditional request with Not Modified.
+	assert.Equals(t, 1, downloads)
+
+	// Cleans up ~/.gofetch work dir
+	dir, err := homedir.Dir()
+	assert.Ok(t, err)
+	err = os.RemoveAll(filepath.Join(dir, ".gofetch"))
+	assert.Ok(t, err)
+}
+
 func TestWithChecksum(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		file, err := os.Open("./fixtures/test")
@@ -226,3 +292,1104 @@ func TestWithChecksum(t *testing.T) {
 	_, err = gf.Fetch(ts.URL+"/test", nil)
 	assert.Ok(t, err)
 }
+
+func TestWithTLSConfig(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, err := os.Open("./fixtures/test")
+		assert.Ok(t, err)
+		assert.Cond(t, file != nil, "Failed loading fixture file")
+		defer file.Close()
+
+		http.ServeContent(w, r, file.Name(), time.Time{}, file)
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "tls-config")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	// The test server certificate is not trusted by the system pool.
+	gf := New(WithDestDir(destDir))
+	_, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Cond(t, err != nil, "Fetch should fail when the server certificate is not trusted")
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+
+	gf = New(WithDestDir(destDir), WithConcurrency(2), WithTLSConfig(&tls.Config{RootCAs: pool}))
+	file, err := gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	defer file.Close()
+
+	fi, err := file.Stat()
+	assert.Ok(t, err)
+	assert.Equals(t, int64(10485760), fi.Size())
+}
+
+func TestCertificatePinning(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, err := os.Open("./fixtures/test")
+		assert.Ok(t, err)
+		assert.Cond(t, file != nil, "Failed loading fixture file")
+		defer file.Close()
+
+		http.ServeContent(w, r, file.Name(), time.Time{}, file)
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "cert-pinning")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+	config := &tls.Config{RootCAs: pool}
+
+	fingerprint := sha256.Sum256(ts.Certificate().Raw)
+	spki := sha256.Sum256(ts.Certificate().RawSubjectPublicKeyInfo)
+
+	gf := New(WithDestDir(destDir), WithTLSConfig(config), WithPinnedCert(hex.EncodeToString(fingerprint[:])))
+	_, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+
+	gf = New(WithDestDir(destDir), WithTLSConfig(config), WithPinnedSPKI(base64.StdEncoding.EncodeToString(spki[:])))
+	_, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+
+	gf = New(WithDestDir(destDir), WithTLSConfig(config), WithPinnedSPKI("47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="))
+	_, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Cond(t, err != nil, "Fetch should fail when pins do not match")
+
+	// Pins are checked on resumed TLS sessions too.
+	config.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+	gf = New(WithDestDir(destDir), WithTLSConfig(config), WithPinnedCert(hex.EncodeToString(fingerprint[:])))
+	_, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	gf = New(WithDestDir(destDir), WithTLSConfig(config), WithPinnedSPKI("47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="))
+	_, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Cond(t, err != nil, "Fetch should fail when pins do not match a resumed session")
+}
+
+func TestRedirects(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, err := os.Open("./fixtures/test")
+		assert.Ok(t, err)
+		assert.Cond(t, file != nil, "Failed loading fixture file")
+		defer file.Close()
+
+		http.ServeContent(w, r, file.Name(), time.Time{}, file)
+	}))
+	defer ts.Close()
+
+	redirector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/elsewhere/test" {
+			http.Redirect(w, r, ts.URL+"/test", http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, "/elsewhere/test", http.StatusFound)
+	}))
+	defer redirector.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "redirects")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	gf := New(WithDestDir(destDir), WithConcurrency(2))
+	result, err := gf.FetchContext(context.Background(), redirector.URL+"/test", nil)
+	assert.Ok(t, err)
+	defer result.File.Close()
+	assert.Equals(t, ts.URL+"/test", result.URL)
+
+	gf = New(WithDestDir(destDir), WithMaxRedirects(1))
+	_, err = gf.Fetch(redirector.URL+"/test", nil)
+	assert.Cond(t, err != nil, "Fetch should fail after exceeding the maximum number of redirects")
+
+	gf = New(WithDestDir(destDir), WithoutCrossHostRedirects())
+	_, err = gf.Fetch(redirector.URL+"/test", nil)
+	assert.Cond(t, err != nil, "Fetch should fail when redirected to a different host")
+}
+
+func TestUserAgent(t *testing.T) {
+	var agents []string
+	var mu sync.Mutex
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		agents = append(agents, r.UserAgent())
+		mu.Unlock()
+
+		file, err := os.Open("./fixtures/test")
+		assert.Ok(t, err)
+		assert.Cond(t, file != nil, "Failed loading fixture file")
+		defer file.Close()
+
+		http.ServeContent(w, r, file.Name(), time.Time{}, file)
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "user-agent")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	gf := New(WithDestDir(destDir))
+	_, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	assert.Equals(t, []string{defaultUserAgent, defaultUserAgent}, agents)
+
+	agents = nil
+	gf = New(WithDestDir(destDir), WithConcurrency(2), WithUserAgent("mytool/1.0"))
+	_, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	assert.Equals(t, []string{"mytool/1.0", "mytool/1.0", "mytool/1.0"}, agents)
+}
+
+func TestHTTP2PriorKnowledge(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equals(t, 2, r.ProtoMajor)
+
+		file, err := os.Open("./fixtures/test")
+		assert.Ok(t, err)
+		assert.Cond(t, file != nil, "Failed loading fixture file")
+		defer file.Close()
+
+		http.ServeContent(w, r, file.Name(), time.Time{}, file)
+	})
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "http2")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	// HTTP/2 over cleartext TCP.
+	ts := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	defer ts.Close()
+
+	gf := New(WithDestDir(destDir), WithConcurrency(4), WithHTTP2PriorKnowledge())
+	_, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+
+	// HTTP/2 over TLS.
+	tlsServer := httptest.NewUnstartedServer(handler)
+	tlsServer.EnableHTTP2 = true
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(tlsServer.Certificate())
+
+	gf = New(WithDestDir(destDir), WithConcurrency(4), WithHTTP2PriorKnowledge(), WithTLSConfig(&tls.Config{RootCAs: pool}))
+	_, err = gf.Fetch(tlsServer.URL+"/test", nil)
+	assert.Ok(t, err)
+}
+
+func TestRetries(t *testing.T) {
+	var mu sync.Mutex
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		fail := requests%2 == 1
+		mu.Unlock()
+
+		// Every other request fails.
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		file, err := os.Open("./fixtures/test")
+		assert.Ok(t, err)
+		assert.Cond(t, file != nil, "Failed loading fixture file")
+		defer file.Close()
+
+		http.ServeContent(w, r, file.Name(), time.Time{}, file)
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "retries")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	gf := New(WithDestDir(destDir))
+	_, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Cond(t, err != nil, "Fetch should fail without retries")
+
+	gf = New(WithDestDir(destDir), WithConcurrency(4), WithRetries(10, time.Millisecond))
+	file, err := gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	defer file.Close()
+
+	fi, err := file.Stat()
+	assert.Ok(t, err)
+	assert.Equals(t, int64(10485760), fi.Size())
+}
+
+func TestChunkRetries(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.Header.Get("Range")]++
+		failures := requests["bytes=5242880-10485759"]
+		mu.Unlock()
+
+		// The second chunk fails the first three times.
+		if r.Header.Get("Range") == "bytes=5242880-10485759" && failures <= 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeFile(w, r, "./fixtures/test")
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "chunk-retries")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	gf := New(WithDestDir(destDir), WithConcurrency(2), WithChunkRetries(1, time.Millisecond))
+	_, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Cond(t, err != nil && strings.Contains(err.Error(), "bytes 5242880-10485759"), "Fetch should fail once the chunk runs out of retries, got %v", err)
+
+	gf = New(WithDestDir(destDir), WithConcurrency(2), WithChunkRetries(5, time.Millisecond))
+	file, err := gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	defer file.Close()
+
+	// The first chunk was downloaded only once.
+	mu.Lock()
+	assert.Equals(t, 1, requests["bytes=0-5242879"])
+	mu.Unlock()
+
+	hasher := sha512.New()
+	_, err = io.Copy(hasher, file)
+	assert.Ok(t, err)
+	assert.Equals(t, "4ff6e159db38d46a665f26e9f82b98134238c0457cc82727a5258b7184773e4967068cc0eecf3928ecd079f3aea6e22aac024847c6d76c0329c4635c4b6ae327", fmt.Sprintf("%x", hasher.Sum(nil)))
+}
+
+func TestTimeouts(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow-headers" {
+			time.Sleep(500 * time.Millisecond)
+		}
+
+		file, err := os.Open("./fixtures/test")
+		assert.Ok(t, err)
+		assert.Cond(t, file != nil, "Failed loading fixture file")
+		defer file.Close()
+
+		if r.URL.Path == "/stalled" && r.Method == "GET" {
+			w.Header().Set("Content-Length", "10485760")
+			w.WriteHeader(http.StatusOK)
+			io.CopyN(w, file, 1024)
+			w.(http.Flusher).Flush()
+			time.Sleep(500 * time.Millisecond)
+			return
+		}
+
+		http.ServeContent(w, r, file.Name(), time.Time{}, file)
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "timeouts")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	gf := New(WithDestDir(destDir), WithResponseHeaderTimeout(100*time.Millisecond))
+	_, err = gf.Fetch(ts.URL+"/slow-headers", nil)
+	assert.Cond(t, err != nil, "Fetch should fail if response headers take too long")
+
+	gf = New(WithDestDir(destDir), WithIdleTimeout(100*time.Millisecond))
+	_, err = gf.Fetch(ts.URL+"/stalled", nil)
+	assert.Cond(t, err != nil, "Fetch should fail if the connection stalls")
+
+	// A slow server is fine as long as data keeps flowing.
+	gf = New(WithDestDir(destDir), WithIdleTimeout(time.Second))
+	_, err = gf.Fetch(ts.URL+"/slow-headers", nil)
+	assert.Ok(t, err)
+}
+
+func TestStallTimeout(t *testing.T) {
+	var mu sync.Mutex
+	var stalled bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, err := os.Open("./fixtures/test")
+		assert.Ok(t, err)
+		assert.Cond(t, file != nil, "Failed loading fixture file")
+		defer file.Close()
+
+		mu.Lock()
+		stall := r.Method == "GET" && !stalled
+		stalled = stalled || stall
+		mu.Unlock()
+
+		// The first download request stalls after sending some data.
+		if stall {
+			w.Header().Set("Content-Length", "10485760")
+			w.WriteHeader(http.StatusOK)
+			io.CopyN(w, file, 1024)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+
+		http.ServeContent(w, r, file.Name(), time.Time{}, file)
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "stall-timeout")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	gf := New(WithDestDir(destDir), WithIdleTimeout(0), WithStallTimeout(100*time.Millisecond))
+	file, err := gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	defer file.Close()
+
+	hasher := sha512.New()
+	_, err = io.Copy(hasher, file)
+	assert.Ok(t, err)
+	assert.Equals(t, "4ff6e159db38d46a665f26e9f82b98134238c0457cc82727a5258b7184773e4967068cc0eecf3928ecd079f3aea6e22aac024847c6d76c0329c4635c4b6ae327", fmt.Sprintf("%x", hasher.Sum(nil)))
+}
+
+func TestMinSpeed(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			return
+		}
+
+		// Trickles data way slower than the minimum speed.
+		for i := 0; i < 100; i++ {
+			if _, err := w.Write([]byte("x")); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "min-speed")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	gf := New(WithDestDir(destDir), WithMinSpeed(1024, 200*time.Millisecond))
+	_, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Cond(t, err != nil, "Fetch should fail when the download is too slow")
+	assert.Equals(t, ErrTooSlow, errors.Cause(err))
+
+	// A window of zero is ignored rather than making the download panic.
+	gf = New(WithDestDir(destDir), WithMinSpeed(1024, 0))
+	_, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+}
+
+func TestWithoutHEAD(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		file, err := os.Open("./fixtures/test")
+		assert.Ok(t, err)
+		assert.Cond(t, file != nil, "Failed loading fixture file")
+		defer file.Close()
+
+		http.ServeContent(w, r, file.Name(), time.Time{}, file)
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "without-head")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	// Falls back to a GET request automatically.
+	gf := New(WithDestDir(destDir), WithConcurrency(2))
+	_, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+
+	progressCh := make(chan ProgressReport)
+	done := make(chan bool)
+
+	gf = New(WithDestDir(destDir), WithConcurrency(4), WithoutHEAD())
+	go func() {
+		_, err := gf.Fetch(ts.URL+"/test", progressCh)
+		assert.Ok(t, err)
+		done <- true
+	}()
+
+	var total int64
+	for p := range progressCh {
+		total += p.WrittenBytes
+		assert.Equals(t, int64(10485760), p.Total)
+	}
+	assert.Equals(t, int64(10485760), total)
+	<-done
+}
+
+func TestServerIgnoringRanges(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, err := os.Open("./fixtures/test")
+		assert.Ok(t, err)
+		assert.Cond(t, file != nil, "Failed loading fixture file")
+		defer file.Close()
+
+		// Advertises support for byte ranges but always sends the whole content.
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Length", "10485760")
+		if r.Method == "GET" {
+			io.Copy(w, file)
+		}
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "ignored-ranges")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	progressCh := make(chan ProgressReport)
+	done := make(chan bool)
+
+	var file *os.File
+	gf := New(WithDestDir(destDir), WithConcurrency(4))
+	go func() {
+		var err error
+		file, err = gf.Fetch(ts.URL+"/test", progressCh)
+		assert.Ok(t, err)
+		done <- true
+	}()
+
+	var total int64
+	for p := range progressCh {
+		total += p.WrittenBytes
+	}
+	<-done
+	defer file.Close()
+	assert.Equals(t, int64(10485760), total)
+
+	hasher := sha512.New()
+	_, err = io.Copy(hasher, file)
+	assert.Ok(t, err)
+	assert.Equals(t, "4ff6e159db38d46a665f26e9f82b98134238c0457cc82727a5258b7184773e4967068cc0eecf3928ecd079f3aea6e22aac024847c6d76c0329c4635c4b6ae327", fmt.Sprintf("%x", hasher.Sum(nil)))
+}
+
+func TestIfRangeOnResume(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, err := os.Open("./fixtures/test")
+		assert.Ok(t, err)
+		assert.Cond(t, file != nil, "Failed loading fixture file")
+		defer file.Close()
+
+		w.Header().Set("ETag", `"v2"`)
+		http.ServeContent(w, r, file.Name(), time.Time{}, file)
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "if-range")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	// Simulates a download interrupted while the server had a previous version of the file.
+	chunksDir := filepath.Join(destDir, "test.chunks")
+	err = os.MkdirAll(chunksDir, 0760)
+	assert.Ok(t, err)
+	err = ioutil.WriteFile(filepath.Join(chunksDir, "data"), make([]byte, 1024), 0660)
+	assert.Ok(t, err)
+	// Without the ETag in the state, the change is only caught by the server, through If-Range.
+	err = saveState(filepath.Join(chunksDir, "state"), downloadState{URL: ts.URL + "/test", Size: 10485760, Validator: `"v1"`},
+		[]*chunk{{Start: 0, End: 5242880, Written: 1024, crc: crc32.Checksum(make([]byte, 1024), crc32c)}, {Start: 5242880, End: 10485760}})
+	assert.Ok(t, err)
+
+	gf := New(WithDestDir(destDir), WithConcurrency(2))
+	file, err := gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	defer file.Close()
+
+	hasher := sha512.New()
+	_, err = io.Copy(hasher, file)
+	assert.Ok(t, err)
+	assert.Equals(t, "4ff6e159db38d46a665f26e9f82b98134238c0457cc82727a5258b7184773e4967068cc0eecf3928ecd079f3aea6e22aac024847c6d76c0329c4635c4b6ae327", fmt.Sprintf("%x", hasher.Sum(nil)))
+}
+
+func TestLastModifiedSupport(t *testing.T) {
+	var mu sync.Mutex
+	var downloads int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, err := os.Open("./fixtures/test")
+		assert.Ok(t, err)
+		assert.Cond(t, file != nil, "Failed loading fixture file")
+		defer file.Close()
+
+		if r.Method == "GET" {
+			mu.Lock()
+			downloads++
+			mu.Unlock()
+		}
+
+		http.ServeContent(w, r, file.Name(), time.Date(2017, 7, 4, 0, 0, 0, 0, time.UTC), file)
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "last-modified")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	// Cleans up ~/.gofetch work dir
+	defer os.RemoveAll(workDir)
+
+	gf := New(WithDestDir(destDir), WithLastModified())
+	_, err = gf.Fetch(ts.URL+"/last-modified-test", nil)
+	assert.Ok(t, err)
+	assert.Equals(t, 1, downloads)
+
+	progressCh := make(chan ProgressReport)
+	go func() {
+		// Attempts to fetch file once again.
+		_, err := gf.Fetch(ts.URL+"/last-modified-test", progressCh)
+		assert.Ok(t, err)
+	}()
+
+	var progressCount int
+	for range progressCh {
+		progressCount++
+	}
+
+	// Since the file was not modified, it should not be downloaded again.
+	assert.Equals(t, 0, progressCount)
+	assert.Equals(t, 1, downloads)
+}
+
+func TestContentEncoding(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, err := os.Open("./fixtures/test")
+		assert.Ok(t, err)
+		assert.Cond(t, file != nil, "Failed loading fixture file")
+		defer file.Close()
+
+		switch r.Header.Get("Accept-Encoding") {
+		case "gzip":
+			w.Header().Set("Content-Encoding", "gzip")
+			if r.Method == "GET" {
+				gz := gzip.NewWriter(w)
+				io.Copy(gz, file)
+				gz.Close()
+			}
+		case "identity":
+			http.ServeContent(w, r, file.Name(), time.Time{}, file)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "content-encoding")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	gf := New(WithDestDir(destDir), WithConcurrency(2), WithIdentityEncoding())
+	result, err := gf.FetchContext(context.Background(), ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	assert.Equals(t, "", result.ContentEncoding)
+	result.File.Close()
+
+	gf = New(WithDestDir(destDir), WithConcurrency(2), WithCompression())
+	result, err = gf.FetchContext(context.Background(), ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	defer result.File.Close()
+	assert.Equals(t, "gzip", result.ContentEncoding)
+
+	hasher := sha512.New()
+	_, err = io.Copy(hasher, result.File)
+	assert.Ok(t, err)
+	assert.Equals(t, "4ff6e159db38d46a665f26e9f82b98134238c0457cc82727a5258b7184773e4967068cc0eecf3928ecd079f3aea6e22aac024847c6d76c0329c4635c4b6ae327", fmt.Sprintf("%x", hasher.Sum(nil)))
+}
+
+func TestRequestHook(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Token") != "s3cr3t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		file, err := os.Open("./fixtures/test")
+		assert.Ok(t, err)
+		assert.Cond(t, file != nil, "Failed loading fixture file")
+		defer file.Close()
+
+		http.ServeContent(w, r, file.Name(), time.Time{}, file)
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "request-hook")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	var mu sync.Mutex
+	var methods []string
+	gf := New(WithDestDir(destDir), WithConcurrency(2),
+		WithRequestHook(func(r *http.Request) error {
+			r.Header.Set("X-Token", "s3cr3t")
+			return nil
+		}),
+		WithRequestHook(func(r *http.Request) error {
+			mu.Lock()
+			methods = append(methods, r.Method)
+			mu.Unlock()
+			return nil
+		}))
+
+	_, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	assert.Equals(t, []string{"HEAD", "GET", "GET"}, methods)
+
+	gf = New(WithDestDir(destDir), WithRequestHook(func(r *http.Request) error {
+		return errors.New("forbidden by policy")
+	}))
+	_, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Cond(t, err != nil, "Fetch should fail if a hook fails")
+}
+
+func TestWithChecksumMismatch(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, err := os.Open("./fixtures/test")
+		assert.Ok(t, err)
+		assert.Cond(t, file != nil, "Failed loading fixture file")
+		defer file.Close()
+
+		http.ServeContent(w, r, file.Name(), time.Time{}, file)
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "checksum-mismatch")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	gf := New(WithDestDir(destDir), WithConcurrency(4), WithChecksum("sha256", "29a8b9009509b39d542ecb229787cdf48f05e739a932289de9e9858d7c487c80"))
+	_, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Cond(t, err != nil, "Fetch should fail if the checksum does not match")
+
+	// Every checksum must match, not just one of them.
+	gf = New(WithDestDir(destDir),
+		WithChecksum("sha512", "4ff6e159db38d46a665f26e9f82b98134238c0457cc82727a5258b7184773e4967068cc0eecf3928ecd079f3aea6e22aac024847c6d76c0329c4635c4b6ae327"),
+		WithChecksum("sha256", "29a8b9009509b39d542ecb229787cdf48f05e739a932289de9e9858d7c487c80"))
+	_, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Cond(t, err != nil, "Fetch should fail if any of the checksums does not match")
+
+	gf = New(WithDestDir(destDir), WithChecksum("whirlpool", "29a8b9009509b39d542ecb229787cdf48f05e739a932289de9e9858d7c487c80"))
+	_, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Cond(t, err != nil, "Fetch should fail if the hashing algorithm is not supported")
+}
+
+func TestWithPreserveModTime(t *testing.T) {
+	modTime := time.Date(2017, time.March, 1, 10, 30, 0, 0, time.UTC)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "test", modTime, strings.NewReader("modification time"))
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "modtime")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	gf := New(WithDestDir(destDir), WithPreserveModTime())
+	f, err := gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	defer f.Close()
+
+	fi, err := f.Stat()
+	assert.Ok(t, err)
+	assert.Cond(t, fi.ModTime().Equal(modTime), "expected modification time %s, got %s", modTime, fi.ModTime())
+}
+
+func TestWithMaxConnsPerHost(t *testing.T) {
+	var mu sync.Mutex
+	var open, maxOpen int
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "./fixtures/test")
+	}))
+	ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch state {
+		case http.StateNew:
+			open++
+			if open > maxOpen {
+				maxOpen = open
+			}
+		case http.StateClosed, http.StateHijacked:
+			open--
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "max-conns")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	gf := New(WithDestDir(destDir), WithConcurrency(8), WithMaxConnsPerHost(2))
+	f, err := gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	defer f.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Cond(t, maxOpen <= 2, "expected at most 2 connections at once, got %d", maxOpen)
+}
+
+func TestTransportLimits(t *testing.T) {
+	tr := newTransport(New(WithConcurrency(8)))
+	assert.Equals(t, 8, tr.MaxIdleConnsPerHost)
+	assert.Equals(t, false, tr.DisableKeepAlives)
+
+	tr = newTransport(New(WithMaxIdleConnsPerHost(3), WithKeepAlive(-1)))
+	assert.Equals(t, 3, tr.MaxIdleConnsPerHost)
+	assert.Equals(t, true, tr.DisableKeepAlives)
+}
+
+func TestWithProgressThrottle(t *testing.T) {
+	ts := httptest.NewServer(http.FileServer(http.Dir("./fixtures")))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "progress-throttle")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	progressCh := make(chan ProgressReport)
+	done := make(chan bool)
+
+	gf := New(WithDestDir(destDir), WithConcurrency(4), WithProgressThrottle(0, 1<<20))
+	go func() {
+		f, err := gf.Fetch(ts.URL+"/test", progressCh)
+		assert.Ok(t, err)
+		f.Close()
+		done <- true
+	}()
+
+	var total int64
+	reports := 0
+	for p := range progressCh {
+		total += p.WrittenBytes
+		reports++
+	}
+	<-done
+
+	// Every report but the last one holds at least 1 MiB.
+	assert.Equals(t, int64(10485760), total)
+	assert.Cond(t, reports <= 11, "expected at most 11 reports, got %d", reports)
+}
+
+func TestWithHTTP2Multiplexing(t *testing.T) {
+	var mu sync.Mutex
+	conns := make(map[string]bool)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equals(t, 2, r.ProtoMajor)
+		mu.Lock()
+		conns[r.RemoteAddr] = true
+		mu.Unlock()
+		http.ServeFile(w, r, "./fixtures/test")
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "http2-multiplexing")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+
+	gf := New(WithDestDir(destDir), WithConcurrency(4), WithHTTP2Multiplexing(), WithTLSConfig(&tls.Config{RootCAs: pool}))
+	f, err := gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	defer f.Close()
+
+	// All the chunks are downloaded over the same connection.
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equals(t, 1, len(conns))
+}
+
+func TestResumeContentChanged(t *testing.T) {
+	var mu sync.Mutex
+	var ranges []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			mu.Lock()
+			ranges = append(ranges, r.Header.Get("Range"))
+			mu.Unlock()
+		}
+		w.Header().Set("ETag", `"v2"`)
+		http.ServeFile(w, r, "./fixtures/test")
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "resume-changed")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	// Simulates a download interrupted while the server had a previous version of the file.
+	chunksDir := filepath.Join(destDir, "test.chunks")
+	assert.Ok(t, os.MkdirAll(chunksDir, 0760))
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(chunksDir, "data"), make([]byte, 1024), 0660))
+	assert.Ok(t, saveState(filepath.Join(chunksDir, "state"), downloadState{URL: ts.URL + "/test", ETag: `"v1"`, Size: 10485760, Validator: `"v1"`},
+		[]*chunk{{Start: 0, End: 10485760, Written: 1024, crc: crc32.Checksum(make([]byte, 1024), crc32c)}}))
+
+	gf := New(WithDestDir(destDir))
+	file, err := gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	defer file.Close()
+
+	// The download starts over right away, instead of resuming stale data.
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equals(t, []string{"bytes=0-10485759"}, ranges)
+
+	hasher := sha512.New()
+	_, err = io.Copy(hasher, file)
+	assert.Ok(t, err)
+	assert.Equals(t, "4ff6e159db38d46a665f26e9f82b98134238c0457cc82727a5258b7184773e4967068cc0eecf3928ecd079f3aea6e22aac024847c6d76c0329c4635c4b6ae327", fmt.Sprintf("%x", hasher.Sum(nil)))
+}
+
+func TestResumeFromMirror(t *testing.T) {
+	var mu sync.Mutex
+	var ranges []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			mu.Lock()
+			ranges = append(ranges, r.Header.Get("Range"))
+			mu.Unlock()
+		}
+		// Every mirror returns a different ETag for the same file.
+		w.Header().Set("ETag", fmt.Sprintf("%q", path.Dir(r.URL.Path)))
+		http.ServeFile(w, r, "./fixtures/test")
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "resume-mirror")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	data, err := ioutil.ReadFile("./fixtures/test")
+	assert.Ok(t, err)
+	sum := fmt.Sprintf("%x", sha512.Sum512(data))
+
+	// Simulates a download interrupted while fetching the file from another mirror.
+	chunksDir := filepath.Join(destDir, "test.chunks")
+	assert.Ok(t, os.MkdirAll(chunksDir, 0760))
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(chunksDir, "data"), data[:1024], 0660))
+	assert.Ok(t, saveState(filepath.Join(chunksDir, "state"), downloadState{URL: ts.URL + "/a/test", ETag: `"/a"`, Size: 10485760,
+		Validator: `"/a"`, Digests: map[string]string{"sha512": sum}}, []*chunk{{Start: 0, End: 10485760, Written: 1024, crc: crc32.Checksum(data[:1024], crc32c)}}))
+
+	gf := New(WithDestDir(destDir), WithChecksum("sha512", sum))
+	file, err := gf.Fetch(ts.URL+"/b/test", nil)
+	assert.Ok(t, err)
+	defer file.Close()
+
+	// The download is resumed from the other mirror.
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equals(t, []string{"bytes=1024-10485759"}, ranges)
+
+	got, err := ioutil.ReadAll(file)
+	assert.Ok(t, err)
+	assert.Equals(t, data, got)
+}
+
+func TestResumeRangeNotSatisfiable(t *testing.T) {
+	data, err := ioutil.ReadFile("./fixtures/test-resume")
+	assert.Ok(t, err)
+
+	var mu sync.Mutex
+	var ranges []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The length of the content is not known upfront.
+		if r.Method == "HEAD" {
+			w.Header().Set("Accept-Ranges", "bytes")
+			return
+		}
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		http.ServeContent(w, r, "test-resume", time.Time{}, bytes.NewReader(data))
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "resume-416")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	// Simulates an interrupted download holding more data than the content has now.
+	chunksDir := filepath.Join(destDir, "test-resume.chunks")
+	assert.Ok(t, os.MkdirAll(chunksDir, 0760))
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(chunksDir, "data"), make([]byte, 300000), 0660))
+	assert.Ok(t, saveState(filepath.Join(chunksDir, "state"), downloadState{URL: ts.URL + "/test-resume", Size: -1},
+		[]*chunk{{Start: 0, End: -1, Written: 300000, crc: crc32.Checksum(make([]byte, 300000), crc32c)}}))
+
+	gf := New(WithDestDir(destDir))
+	file, err := gf.Fetch(ts.URL+"/test-resume", nil)
+	assert.Ok(t, err)
+	defer file.Close()
+
+	// The download starts over instead of failing.
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equals(t, []string{"bytes=300000-", "bytes=0-"}, ranges)
+
+	got, err := ioutil.ReadAll(file)
+	assert.Ok(t, err)
+	assert.Equals(t, data, got)
+}
+
+func TestResumeCorrupted(t *testing.T) {
+	var mu sync.Mutex
+	var ranges []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			mu.Lock()
+			ranges = append(ranges, r.Header.Get("Range"))
+			mu.Unlock()
+		}
+		http.ServeFile(w, r, "./fixtures/test-resume")
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "resume-corrupted")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	data, err := ioutil.ReadFile("./fixtures/test-resume")
+	assert.Ok(t, err)
+	size := int64(len(data))
+
+	// Simulates a download whose data got corrupted on disk after being interrupted.
+	chunksDir := filepath.Join(destDir, "test-resume.chunks")
+	assert.Ok(t, os.MkdirAll(chunksDir, 0760))
+	corrupted := append([]byte("corrupted"), data[9:1024]...)
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(chunksDir, "data"), corrupted, 0660))
+	assert.Ok(t, saveState(filepath.Join(chunksDir, "state"), downloadState{URL: ts.URL + "/test-resume", Size: size},
+		[]*chunk{{Start: 0, End: size, Written: 1024, crc: crc32.Checksum(data[:1024], crc32c)}}))
+
+	gf := New(WithDestDir(destDir))
+	file, err := gf.Fetch(ts.URL+"/test-resume", nil)
+	assert.Ok(t, err)
+	defer file.Close()
+
+	// The corrupted chunk is downloaded again.
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equals(t, []string{fmt.Sprintf("bytes=0-%d", size-1)}, ranges)
+
+	got, err := ioutil.ReadAll(file)
+	assert.Ok(t, err)
+	assert.Equals(t, data, got)
+}
+
+func TestResumeFinalizing(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			atomic.AddInt32(&requests, 1)
+		}
+		http.ServeFile(w, r, "./fixtures/test-resume")
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "resume-finalizing")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	// Simulates a download interrupted right after being moved to its destination.
+	data, err := ioutil.ReadFile("./fixtures/test-resume")
+	assert.Ok(t, err)
+	size := int64(len(data))
+	chunksDir := filepath.Join(destDir, "test-resume.chunks")
+	assert.Ok(t, os.MkdirAll(chunksDir, 0760))
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(destDir, "test-resume"), data, 0660))
+	assert.Ok(t, saveState(filepath.Join(chunksDir, "state"), downloadState{URL: ts.URL + "/test-resume", Size: size},
+		[]*chunk{{Start: 0, End: size, Written: size, crc: crc32.Checksum(data, crc32c)}}))
+
+	gf := New(WithDestDir(destDir))
+	file, err := gf.Fetch(ts.URL+"/test-resume", nil)
+	assert.Ok(t, err)
+	defer file.Close()
+
+	// The download is finished without downloading it again.
+	assert.Equals(t, int32(0), atomic.LoadInt32(&requests))
+	fetched, err := ioutil.ReadAll(file)
+	assert.Ok(t, err)
+	assert.Equals(t, data, fetched)
+	_, err = os.Stat(chunksDir)
+	assert.Cond(t, os.IsNotExist(err), "Chunks directory should be removed")
+
+	// Without its data, the state of the download is not trusted.
+	assert.Ok(t, os.MkdirAll(chunksDir, 0760))
+	assert.Ok(t, os.Remove(filepath.Join(destDir, "test-resume")))
+	assert.Ok(t, saveState(filepath.Join(chunksDir, "state"), downloadState{URL: ts.URL + "/test-resume", Size: size},
+		[]*chunk{{Start: 0, End: size, Written: size, crc: crc32.Checksum(data, crc32c)}}))
+
+	file2, err := gf.Fetch(ts.URL+"/test-resume", nil)
+	assert.Ok(t, err)
+	defer file2.Close()
+	assert.Equals(t, int32(1), atomic.LoadInt32(&requests))
+	fetched, err = ioutil.ReadAll(file2)
+	assert.Ok(t, err)
+	assert.Equals(t, data, fetched)
+}
+
+func TestCancel(t *testing.T) {
+	var mu sync.Mutex
+	var ranges []string
+	content := strings.Repeat("x", 512<<10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			mu.Lock()
+			ranges = append(ranges, r.Header.Get("Range"))
+			mu.Unlock()
+		}
+		http.ServeContent(w, r, "file", time.Time{}, strings.NewReader(content))
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "cancel")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	gf := New(WithDestDir(destDir), WithRateLimit(1<<20))
+	progressCh := make(chan ProgressReport)
+	done := make(chan error)
+	go func() {
+		_, err := gf.Fetch(ts.URL+"/file", progressCh)
+		done <- err
+	}()
+
+	canceled := false
+	for p := range progressCh {
+		if !canceled && p.Downloaded > 0 {
+			canceled = true
+			gf.Cancel()
+		}
+	}
+	err = <-done
+	assert.Cond(t, errors.Cause(err) == context.Canceled, "Fetch should fail with context.Canceled, got %v", err)
+
+	// The progress made is recorded, so the download is resumed precisely.
+	p, err := gf.Partial(ts.URL + "/file")
+	assert.Ok(t, err)
+	assert.Cond(t, p != nil && p.Downloaded > 0 && p.Downloaded < int64(len(content)), "Progress should have been recorded")
+
+	f, err := gf.Fetch(ts.URL+"/file", nil)
+	assert.Ok(t, err)
+	defer f.Close()
+	got, err := ioutil.ReadAll(f)
+	assert.Ok(t, err)
+	assert.Equals(t, content, string(got))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equals(t, fmt.Sprintf("bytes=%d-%d", p.Downloaded, len(content)-1), ranges[len(ranges)-1])
+}
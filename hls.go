@@ -0,0 +1,228 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// hlsPlaylist is an HLS playlist, either a master playlist listing the variants of a stream,
+// or a media playlist listing its segments.
+type hlsPlaylist struct {
+	// variants are the URIs of the media playlists of a master playlist, and bandwidths
+	// their peak bandwidth.
+	variants   []string
+	bandwidths []int64
+	segments   []segment
+	// fragmented tells whether segments are fragmented MP4, rather than MPEG-TS, as told by
+	// their initialization segment.
+	fragmented bool
+}
+
+// hlsSegments returns the segments of the HLS playlist at the given location, and their
+// extension, looking up the variant with the highest bandwidth of master playlists.
+func (gf *Fetcher) hlsSegments(ctx context.Context, location string, data []byte) ([]segment, string, error) {
+	p, err := parseHLS(location, data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(p.variants) > 0 {
+		best := 0
+		for i, b := range p.bandwidths {
+			if b > p.bandwidths[best] {
+				best = i
+			}
+		}
+		location = p.variants[best]
+		if data, err = gf.readLocation(ctx, location); err != nil {
+			return nil, "", errors.Wrapf(err, "failed reading playlist %s", location)
+		}
+		if p, err = parseHLS(location, data); err != nil {
+			return nil, "", err
+		}
+		if len(p.variants) > 0 {
+			return nil, "", fmt.Errorf("variant %s is a master playlist", location)
+		}
+	}
+
+	ext := ".ts"
+	if p.fragmented {
+		ext = ".mp4"
+	} else if len(p.segments) > 0 {
+		u, err := url.Parse(p.segments[len(p.segments)-1].url)
+		if err == nil && path.Ext(u.Path) == ".aac" {
+			ext = ".aac"
+		}
+	}
+	return p.segments, ext, nil
+}
+
+// parseHLS parses the HLS playlist at the given location, resolving the URIs it lists against it.
+func parseHLS(location string, data []byte) (*hlsPlaylist, error) {
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	resolve := func(uri string) (string, error) {
+		u, err := base.Parse(uri)
+		if err != nil {
+			return "", errors.Wrapf(err, "invalid URI %q in playlist %s", uri, location)
+		}
+		return u.String(), nil
+	}
+
+	p := &hlsPlaylist{}
+	// ends are where the last byte range of each file ends, for the ranges following it.
+	ends := make(map[string]int64)
+	var bandwidth int64
+	var variant bool
+	// next is the byte range of the next segment, if any, and init its initialization segment.
+	var next *segment
+	var init string
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, maxManifestSize)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		tag, value := line, ""
+		if i := strings.Index(line, ":"); i >= 0 && strings.HasPrefix(line, "#") {
+			tag, value = line[:i], line[i+1:]
+		}
+
+		switch {
+		case line == "" || n == 1 && line == "#EXTM3U":
+		case tag == "#EXT-X-STREAM-INF":
+			attrs := parseHLSAttributes(value)
+			bandwidth, _ = strconv.ParseInt(attrs["BANDWIDTH"], 10, 64)
+			variant = true
+		case tag == "#EXT-X-KEY" || tag == "#EXT-X-SESSION-KEY":
+			if method := parseHLSAttributes(value)["METHOD"]; method != "NONE" && tag == "#EXT-X-KEY" {
+				return nil, fmt.Errorf("playlist %s is encrypted with %s, which is not supported", location, method)
+			}
+		case tag == "#EXT-X-MAP":
+			attrs := parseHLSAttributes(value)
+			u, err := resolve(attrs["URI"])
+			if err != nil {
+				return nil, err
+			}
+			s := segment{url: u, size: -1}
+			if r, ok := attrs["BYTERANGE"]; ok {
+				if s.offset, s.size, err = parseHLSByteRange(r, 0); err != nil {
+					return nil, errors.Wrapf(err, "line %d of playlist %s", n, location)
+				}
+			}
+			// Initialization segments are only repeated when they change.
+			if key := fmt.Sprintf("%s@%d", s.url, s.offset); key != init {
+				p.segments = append(p.segments, s)
+				init = key
+			}
+			p.fragmented = true
+		case tag == "#EXT-X-BYTERANGE":
+			next = &segment{}
+			if next.offset, next.size, err = parseHLSByteRange(value, -1); err != nil {
+				return nil, errors.Wrapf(err, "line %d of playlist %s", n, location)
+			}
+		case strings.HasPrefix(line, "#"):
+			// Comments and tags not affecting which bytes are downloaded.
+		default:
+			u, err := resolve(line)
+			if err != nil {
+				return nil, err
+			}
+			if variant {
+				p.variants = append(p.variants, u)
+				p.bandwidths = append(p.bandwidths, bandwidth)
+				variant = false
+				continue
+			}
+
+			s := segment{url: u, size: -1}
+			if next != nil {
+				s.offset, s.size = next.offset, next.size
+				if s.offset < 0 {
+					// Ranges without offset follow the previous range of the same file.
+					end, ok := ends[u]
+					if !ok {
+						return nil, fmt.Errorf("line %d of playlist %s: byte range without offset does not follow another one", n, location)
+					}
+					s.offset = end
+				}
+				ends[u] = s.offset + s.size
+				next = nil
+			}
+			p.segments = append(p.segments, s)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed reading playlist %s", location)
+	}
+	return p, nil
+}
+
+// parseHLSByteRange parses byte ranges of HLS playlists, like 1024@512, returning their offset,
+// or the given one if missing, and their length.
+func parseHLSByteRange(value string, offset int64) (int64, int64, error) {
+	length := value
+	if i := strings.Index(value, "@"); i >= 0 {
+		var err error
+		length = value[:i]
+		if offset, err = strconv.ParseInt(value[i+1:], 10, 64); err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("invalid byte range %q", value)
+		}
+	}
+	size, err := strconv.ParseInt(length, 10, 64)
+	if err != nil || size < 0 {
+		return 0, 0, fmt.Errorf("invalid byte range %q", value)
+	}
+	return offset, size, nil
+}
+
+// parseHLSAttributes parses attribute lists of HLS tags, like BANDWIDTH=1280000,CODECS="a,b",
+// unquoting their values.
+func parseHLSAttributes(list string) map[string]string {
+	attrs := make(map[string]string)
+	for list != "" {
+		i := strings.Index(list, "=")
+		if i < 0 {
+			break
+		}
+		name := strings.TrimSpace(list[:i])
+		list = list[i+1:]
+
+		var value string
+		if strings.HasPrefix(list, `"`) {
+			end := strings.Index(list[1:], `"`)
+			if end < 0 {
+				end = len(list) - 1
+			}
+			value = list[1 : end+1]
+			list = list[end+1:]
+			if len(list) > 0 {
+				list = list[1:]
+			}
+			if i := strings.Index(list, ","); i >= 0 {
+				list = list[i+1:]
+			} else {
+				list = ""
+			}
+		} else if i := strings.Index(list, ","); i >= 0 {
+			value, list = list[:i], list[i+1:]
+		} else {
+			value, list = list, ""
+		}
+		attrs[name] = strings.TrimSpace(value)
+	}
+	return attrs
+}
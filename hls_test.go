@@ -0,0 +1,65 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestParseHLS(t *testing.T) {
+	master := `#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=1280000,CODECS="avc1.4d401f,mp4a.40.2",RESOLUTION=640x360
+low/index.m3u8
+#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=86000,URI="low/iframe.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=2560000,CODECS="avc1.4d401f,mp4a.40.2"
+https://cdn.example.com/high/index.m3u8
+`
+	p, err := parseHLS("https://example.com/video/master.m3u8", []byte(master))
+	assert.Ok(t, err)
+	assert.Equals(t, []string{"https://example.com/video/low/index.m3u8", "https://cdn.example.com/high/index.m3u8"}, p.variants)
+	assert.Equals(t, []int64{1280000, 2560000}, p.bandwidths)
+
+	media := `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:10
+#EXT-X-MAP:URI="init.mp4",BYTERANGE="720@0"
+#EXT-X-KEY:METHOD=NONE
+#EXTINF:10.0,
+#EXT-X-BYTERANGE:1000@720
+main.mp4
+#EXTINF:10.0,
+#EXT-X-BYTERANGE:2000
+main.mp4
+#EXTINF:4.5,
+/other/last.m4s?token=abc
+#EXT-X-ENDLIST
+`
+	p, err = parseHLS("https://example.com/video/index.m3u8", []byte(media))
+	assert.Ok(t, err)
+	assert.Cond(t, p.fragmented, "segments with an initialization segment should be fragmented MP4")
+	assert.Equals(t, []segment{
+		{url: "https://example.com/video/init.mp4", offset: 0, size: 720},
+		{url: "https://example.com/video/main.mp4", offset: 720, size: 1000},
+		{url: "https://example.com/video/main.mp4", offset: 1720, size: 2000},
+		{url: "https://example.com/other/last.m4s?token=abc", size: -1},
+	}, p.segments)
+
+	_, err = parseHLS("https://example.com/index.m3u8", []byte("#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"key.bin\"\n#EXTINF:10,\na.ts\n"))
+	assert.Cond(t, err != nil, "encrypted playlists should be rejected")
+
+	_, err = parseHLS("https://example.com/index.m3u8", []byte("#EXTM3U\n#EXT-X-BYTERANGE:100\na.ts\n"))
+	assert.Cond(t, err != nil, "byte ranges without offset should follow another one")
+}
+
+func TestParseHLSAttributes(t *testing.T) {
+	assert.Equals(t, map[string]string{
+		"BANDWIDTH":  "1280000",
+		"CODECS":     "avc1.4d401f,mp4a.40.2",
+		"RESOLUTION": "640x360",
+		"URI":        "",
+	}, parseHLSAttributes(`BANDWIDTH=1280000,CODECS="avc1.4d401f,mp4a.40.2",RESOLUTION=640x360,URI=""`))
+}
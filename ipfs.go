@@ -0,0 +1,691 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// defaultIPFSGateways are the gateways IPFS content is fetched through by default.
+var defaultIPFSGateways = []string{"https://trustless-gateway.link", "https://ipfs.io", "https://dweb.link"}
+
+// maxIPFSBlockSize is the largest block gofetch is willing to read, twice the largest block
+// IPFS nodes exchange.
+const maxIPFSBlockSize = 4 << 20
+
+// IPFSHandler fetches files from IPFS through ipfs://<cid> URLs, using trustless HTTP gateways,
+// which send the blocks making up files in CAR archives. Every block is verified against its
+// CID before its data is written, so gateways do not need to be trusted. Gateways are tried in
+// order, moving on to the next one, from where the previous one left off, if a gateway fails
+// or sends invalid blocks. Files are read from any offset, so downloads are resumed and split
+// in chunks. SHA-256 digests of files stored in a single raw block are verified when
+// WithServerChecksums is set. It is registered for the ipfs scheme by default.
+type IPFSHandler struct {
+	// Gateways are the base URLs of the gateways to fetch content through, like
+	// https://ipfs.io. They are taken from IPFS_GATEWAY, separated by commas, if empty, or
+	// default to a few public gateways.
+	Gateways []string
+	// Client sends the requests. The client of the fetcher is used if nil, with its TLS
+	// settings, proxy and timeouts, or http.DefaultClient outside a fetcher.
+	Client *http.Client
+}
+
+func (h *IPFSHandler) Stat(ctx context.Context, rawURL string) (*ContentInfo, error) {
+	c, err := parseIPFSURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// The size of files is found in their root block.
+	var block []byte
+	err = h.eachGateway(ctx, func(gateway string) error {
+		res, err := h.get(ctx, gateway, c, "raw", "")
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		data, err := ioutil.ReadAll(io.LimitReader(res.Body, maxIPFSBlockSize))
+		if err != nil {
+			return err
+		}
+		if err := c.verify(data); err != nil {
+			return err
+		}
+		block = data
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	node, err := decodeDAGNode(c, block)
+	if err != nil {
+		return nil, err
+	}
+
+	// Content is addressed by its CID, which therefore never changes.
+	info := &ContentInfo{Size: node.fileSize, Ranges: true, ETag: `"` + c.String() + `"`}
+	if code, digest, _ := c.multihash(); c.codec == codecRaw && code == multihashSHA256 {
+		info.Checksums = map[string]string{"sha256": hex.EncodeToString(digest)}
+	}
+	return info, nil
+}
+
+func (h *IPFSHandler) Open(ctx context.Context, rawURL string, offset, length int64) (io.ReadCloser, error) {
+	c, err := parseIPFSURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &ipfsReader{ctx: ctx, handler: h, cid: c, offset: offset, end: -1, gateways: h.gateways()}
+	if length >= 0 {
+		r.end = offset + length - 1
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// gateways returns the base URLs of the gateways to fetch content through.
+func (h *IPFSHandler) gateways() []string {
+	if len(h.Gateways) > 0 {
+		return h.Gateways
+	}
+	if env := os.Getenv("IPFS_GATEWAY"); env != "" {
+		var gateways []string
+		for _, g := range strings.Split(env, ",") {
+			if g = strings.TrimSpace(g); g != "" {
+				gateways = append(gateways, g)
+			}
+		}
+		return gateways
+	}
+	return defaultIPFSGateways
+}
+
+// eachGateway calls fn with the gateways in order, until it succeeds with one of them.
+func (h *IPFSHandler) eachGateway(ctx context.Context, fn func(gateway string) error) error {
+	err := errors.New("no IPFS gateways")
+	for _, gateway := range h.gateways() {
+		if err = fn(gateway); err == nil || ctx.Err() != nil {
+			return err
+		}
+	}
+	return errors.Wrap(err, "no IPFS gateway served the content")
+}
+
+// get requests the given CID from the given gateway in the given format, "raw" for its block
+// or "car" for the blocks of the bytes of the file asked for by the query.
+func (h *IPFSHandler) get(ctx context.Context, gateway string, c cid, format string, query string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", strings.TrimSuffix(gateway, "/")+"/ipfs/"+c.String()+"?format="+format+query, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if format == "car" {
+		// Blocks are verified as they are received, so they are asked for in the order
+		// their data is laid out in the file, even if repeated.
+		req.Header.Set("Accept", "application/vnd.ipld.car; version=1; order=dfs; dups=y")
+	} else {
+		req.Header.Set("Accept", "application/vnd.ipld.raw")
+	}
+
+	client := h.Client
+	if client == nil {
+		client = httpClientFrom(ctx)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, &statusError{code: res.StatusCode, status: res.Status}
+	}
+	return res, nil
+}
+
+// parseIPFSURL returns the CID of the given ipfs:// URL.
+func parseIPFSURL(rawURL string) (cid, error) {
+	if !strings.HasPrefix(strings.ToLower(rawURL), "ipfs://") {
+		return cid{}, fmt.Errorf("invalid IPFS URL %s", rawURL)
+	}
+	s := strings.TrimSuffix(rawURL[len("ipfs://"):], "/")
+	if strings.ContainsAny(s, "/?#") {
+		return cid{}, fmt.Errorf("invalid IPFS URL %s, paths within content are not supported", rawURL)
+	}
+	return parseCID(s)
+}
+
+// ipfsReader reads a file from IPFS gateways, moving on to the next gateway, from where the
+// previous one left off, if one fails.
+type ipfsReader struct {
+	ctx     context.Context
+	handler *IPFSHandler
+	cid     cid
+	// offset is the offset in the file of the next byte to read, and end the one of the last
+	// byte to read, or -1 to read the file to its end.
+	offset int64
+	end    int64
+	// gateways are the gateways left to try.
+	gateways []string
+	body     io.ReadCloser
+	dag      *dagReader
+	err      error
+}
+
+// open reads the file from the next gateway able to serve it.
+func (r *ipfsReader) open() error {
+	for len(r.gateways) > 0 && r.ctx.Err() == nil {
+		gateway := r.gateways[0]
+		r.gateways = r.gateways[1:]
+
+		// Gateways send the blocks holding the requested bytes, along with the ones needed to
+		// get to them from the root block.
+		to := "*"
+		if r.end >= 0 {
+			to = strconv.FormatInt(r.end, 10)
+		}
+		res, err := r.handler.get(r.ctx, gateway, r.cid, "car", fmt.Sprintf("&dag-scope=entity&entity-bytes=%d:%s", r.offset, to))
+		if err != nil {
+			r.err = err
+			continue
+		}
+		r.body, r.dag = res.Body, newDAGReader(res.Body, r.cid, r.offset)
+		return nil
+	}
+	if err := r.ctx.Err(); err != nil {
+		return err
+	}
+	if r.err == nil {
+		return fmt.Errorf("no IPFS gateways to fetch %s from", r.cid)
+	}
+	return errors.Wrapf(r.err, "no IPFS gateway served %s", r.cid)
+}
+
+func (r *ipfsReader) Read(p []byte) (int, error) {
+	for {
+		if r.dag == nil {
+			if err := r.open(); err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := r.dag.Read(p)
+		r.offset += int64(n)
+		if err == nil || err == io.EOF || r.ctx.Err() != nil {
+			return n, err
+		}
+
+		r.body.Close()
+		r.body, r.dag, r.err = nil, nil, err
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (r *ipfsReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	return r.body.Close()
+}
+
+// dagReader reads a UnixFS file out of a CAR archive holding its blocks in depth-first order,
+// verifying them against their CIDs.
+type dagReader struct {
+	car  *bufio.Reader
+	root cid
+	// skip is the number of bytes of the file to skip, whose blocks may be missing.
+	skip    int64
+	started bool
+	// pending are the blocks left to read, the next one last.
+	pending []cid
+	buf     []byte
+}
+
+func newDAGReader(car io.Reader, root cid, skip int64) *dagReader {
+	return &dagReader{car: bufio.NewReader(car), root: root, skip: skip}
+}
+
+func (r *dagReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if !r.started {
+			if err := r.readHeader(); err != nil {
+				return 0, err
+			}
+			r.pending, r.started = []cid{r.root}, true
+		}
+		if len(r.pending) == 0 {
+			return 0, io.EOF
+		}
+
+		c := r.pending[len(r.pending)-1]
+		r.pending = r.pending[:len(r.pending)-1]
+		block, err := r.block(c)
+		if err != nil {
+			return 0, err
+		}
+		node, err := decodeDAGNode(c, block)
+		if err != nil {
+			return 0, err
+		}
+
+		data := node.data
+		if r.skip >= int64(len(data)) {
+			r.skip -= int64(len(data))
+			data = nil
+		} else {
+			data, r.skip = data[r.skip:], 0
+		}
+
+		// Children holding only bytes to skip are not even read, if their sizes are known.
+		var children []cid
+		for i, child := range node.links {
+			if len(children) == 0 && len(node.sizes) == len(node.links) && r.skip >= int64(node.sizes[i]) {
+				r.skip -= int64(node.sizes[i])
+				continue
+			}
+			children = append(children, child)
+		}
+		for i := len(children) - 1; i >= 0; i-- {
+			r.pending = append(r.pending, children[i])
+		}
+		r.buf = data
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// readHeader skips the header of the CAR archive.
+func (r *dagReader) readHeader() error {
+	n, err := binary.ReadUvarint(r.car)
+	if err != nil {
+		return errors.Wrap(err, "invalid CAR archive")
+	}
+	if n > maxIPFSBlockSize {
+		return errors.New("invalid CAR archive, header too large")
+	}
+	_, err = io.CopyN(ioutil.Discard, r.car, int64(n))
+	return err
+}
+
+// block returns the data of the given block, verified against its CID. Blocks received
+// before it are ignored, like the ones of data before the requested bytes, sent by gateways
+// unable to send only the ones needed.
+func (r *dagReader) block(c cid) ([]byte, error) {
+	if code, digest, err := c.multihash(); err == nil && code == multihashIdentity {
+		return digest, nil
+	}
+
+	for {
+		n, err := binary.ReadUvarint(r.car)
+		if err == io.EOF {
+			return nil, fmt.Errorf("block %s missing from CAR archive", c)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n > maxIPFSBlockSize {
+			return nil, fmt.Errorf("invalid CAR archive, block of %d bytes", n)
+		}
+		section := make([]byte, n)
+		if _, err := io.ReadFull(r.car, section); err != nil {
+			return nil, err
+		}
+
+		bc, size, err := decodeCID(section)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid CAR archive")
+		}
+		// The same content can be addressed by CIDs of different versions, its
+		// multihash is what matters.
+		if !bytes.Equal(bc.hash, c.hash) {
+			continue
+		}
+		data := section[size:]
+		if err := c.verify(data); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+}
+
+// dagNode is a node of the DAG of a UnixFS file.
+type dagNode struct {
+	// data is the data of the file held by the node itself, before the data of its children.
+	data []byte
+	// links are the children of the node, holding sizes bytes of the file each, if known.
+	links []cid
+	sizes []uint64
+	// fileSize is the number of bytes of the file held by the node and its children.
+	fileSize int64
+}
+
+// UnixFS data types of files.
+const (
+	unixfsRaw  = 0
+	unixfsFile = 2
+)
+
+// decodeDAGNode decodes the given block of a UnixFS file, either raw data or a dag-pb node.
+func decodeDAGNode(c cid, block []byte) (*dagNode, error) {
+	switch c.codec {
+	case codecRaw:
+		return &dagNode{data: block, fileSize: int64(len(block))}, nil
+	case codecDagPB:
+	default:
+		return nil, fmt.Errorf("unsupported IPLD codec 0x%x of %s", c.codec, c)
+	}
+
+	node := &dagNode{}
+	var unixfs []byte
+	err := protoFields(block, func(field int, _ uint64, value []byte) error {
+		switch field {
+		case 1:
+			unixfs = value
+		case 2:
+			return protoFields(value, func(field int, _ uint64, value []byte) error {
+				if field != 1 {
+					return nil
+				}
+				link, n, err := decodeCID(value)
+				if err != nil || n != len(value) {
+					return fmt.Errorf("invalid link in %s", c)
+				}
+				node.links = append(node.links, link)
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	kind, fileSize := uint64(unixfsRaw), int64(-1)
+	err = protoFields(unixfs, func(field int, n uint64, value []byte) error {
+		switch field {
+		case 1:
+			kind = n
+		case 2:
+			node.data = value
+		case 3:
+			fileSize = int64(n)
+		case 4:
+			if value == nil {
+				node.sizes = append(node.sizes, n)
+				return nil
+			}
+			// Sizes may also be packed.
+			for len(value) > 0 {
+				size, m := binary.Uvarint(value)
+				if m <= 0 {
+					return fmt.Errorf("invalid block sizes in %s", c)
+				}
+				node.sizes = append(node.sizes, size)
+				value = value[m:]
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if kind != unixfsFile && kind != unixfsRaw {
+		return nil, fmt.Errorf("%s is not a file, its UnixFS type is %d", c, kind)
+	}
+
+	if fileSize < 0 {
+		fileSize = int64(len(node.data))
+		for _, size := range node.sizes {
+			fileSize += int64(size)
+		}
+	}
+	node.fileSize = fileSize
+	return node, nil
+}
+
+// protoFields calls fn with the number and value of each field of the given protocol buffers
+// message, varints being given as n and length-delimited fields as value.
+func protoFields(msg []byte, fn func(field int, n uint64, value []byte) error) error {
+	for len(msg) > 0 {
+		key, m := binary.Uvarint(msg)
+		if m <= 0 {
+			return errors.New("invalid protocol buffers message")
+		}
+		msg = msg[m:]
+
+		var n uint64
+		var value []byte
+		switch key & 7 {
+		case 0:
+			if n, m = binary.Uvarint(msg); m <= 0 {
+				return errors.New("invalid protocol buffers varint")
+			}
+			msg = msg[m:]
+		case 1:
+			if len(msg) < 8 {
+				return io.ErrUnexpectedEOF
+			}
+			msg = msg[8:]
+			continue
+		case 2:
+			size, m := binary.Uvarint(msg)
+			if m <= 0 || size > uint64(len(msg)-m) {
+				return errors.New("invalid protocol buffers field length")
+			}
+			value, msg = msg[m:m+int(size)], msg[m+int(size):]
+		case 5:
+			if len(msg) < 4 {
+				return io.ErrUnexpectedEOF
+			}
+			msg = msg[4:]
+			continue
+		default:
+			return fmt.Errorf("unsupported protocol buffers wire type %d", key&7)
+		}
+
+		if err := fn(int(key>>3), n, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Multicodec codes of the content of blocks and of their hashes.
+const (
+	codecRaw          = 0x55
+	codecDagPB        = 0x70
+	multihashIdentity = 0x00
+	multihashSHA256   = 0x12
+	multihashSHA512   = 0x13
+)
+
+// cid is a content identifier, addressing a block by its multihash.
+type cid struct {
+	version uint64
+	codec   uint64
+	// hash is the multihash of the block.
+	hash []byte
+}
+
+// parseCID parses a CID in its string form: CIDv0 in base58btc, or CIDv1 in base32, base58btc
+// or base16.
+func parseCID(s string) (cid, error) {
+	if len(s) == 46 && strings.HasPrefix(s, "Qm") {
+		hash, err := base58Decode(s)
+		if err != nil {
+			return cid{}, errors.Wrapf(err, "invalid CID %s", s)
+		}
+		return cid{version: 0, codec: codecDagPB, hash: hash}, nil
+	}
+	if s == "" {
+		return cid{}, errors.New("CID is required")
+	}
+
+	var b []byte
+	var err error
+	switch s[0] {
+	case 'b', 'B':
+		b, err = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(s[1:]))
+	case 'z':
+		b, err = base58Decode(s[1:])
+	case 'f', 'F':
+		b, err = hex.DecodeString(s[1:])
+	default:
+		err = fmt.Errorf("unsupported multibase prefix %q", s[0])
+	}
+	if err != nil {
+		return cid{}, errors.Wrapf(err, "invalid CID %s", s)
+	}
+
+	c, n, err := decodeCID(b)
+	if err != nil || n != len(b) || c.version != 1 {
+		return cid{}, fmt.Errorf("invalid CID %s", s)
+	}
+	return c, nil
+}
+
+// decodeCID decodes the binary CID at the beginning of b, returning its length.
+func decodeCID(b []byte) (cid, int, error) {
+	if len(b) >= 34 && b[0] == multihashSHA256 && b[1] == 32 {
+		return cid{version: 0, codec: codecDagPB, hash: b[:34]}, 34, nil
+	}
+
+	var c cid
+	var fields [4]uint64
+	pos := 0
+	for i := range fields {
+		v, n := binary.Uvarint(b[pos:])
+		if n <= 0 {
+			return cid{}, 0, errors.New("invalid CID")
+		}
+		fields[i], pos = v, pos+n
+		if i == 1 {
+			// The multihash starts after the version and the codec.
+			c.version, c.codec = fields[0], fields[1]
+			c.hash = b[pos:]
+		}
+	}
+	if c.version != 1 || fields[3] > uint64(len(b)-pos) {
+		return cid{}, 0, errors.New("invalid CID")
+	}
+	end := pos + int(fields[3])
+	c.hash = c.hash[:len(c.hash)-(len(b)-end)]
+	return c, end, nil
+}
+
+// multihash returns the code of the hashing function and the digest of the multihash of the CID.
+func (c cid) multihash() (uint64, []byte, error) {
+	code, n := binary.Uvarint(c.hash)
+	if n <= 0 {
+		return 0, nil, errors.New("invalid multihash")
+	}
+	size, m := binary.Uvarint(c.hash[n:])
+	if m <= 0 || size != uint64(len(c.hash)-n-m) {
+		return 0, nil, errors.New("invalid multihash")
+	}
+	return code, c.hash[n+m:], nil
+}
+
+// verify checks that the given block is the one addressed by the CID.
+func (c cid) verify(block []byte) error {
+	code, digest, err := c.multihash()
+	if err != nil {
+		return err
+	}
+
+	var sum []byte
+	switch code {
+	case multihashIdentity:
+		sum = block
+	case multihashSHA256:
+		s := sha256.Sum256(block)
+		sum = s[:]
+	case multihashSHA512:
+		s := sha512.Sum512(block)
+		sum = s[:]
+	default:
+		return fmt.Errorf("unsupported multihash function 0x%x of %s", code, c)
+	}
+	if !bytes.Equal(sum, digest) {
+		return fmt.Errorf("block %s is corrupt", c)
+	}
+	return nil
+}
+
+// String returns the CID in base58btc, for CIDv0, or in base32, for CIDv1.
+func (c cid) String() string {
+	if c.version == 0 {
+		return base58Encode(c.hash)
+	}
+	b := make([]byte, 2*binary.MaxVarintLen64, 2*binary.MaxVarintLen64+len(c.hash))
+	n := binary.PutUvarint(b, c.version)
+	n += binary.PutUvarint(b[n:], c.codec)
+	b = append(b[:n], c.hash...)
+	return "b" + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))
+}
+
+// base58Alphabet is the Bitcoin base58 alphabet used by IPFS.
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+func base58Decode(s string) ([]byte, error) {
+	n := new(big.Int)
+	for _, r := range s {
+		i := strings.IndexRune(base58Alphabet, r)
+		if i < 0 {
+			return nil, fmt.Errorf("invalid base58 character %q", r)
+		}
+		n.Mul(n, big.NewInt(58))
+		n.Add(n, big.NewInt(int64(i)))
+	}
+
+	// Leading ones encode leading zeros.
+	var zeros int
+	for zeros < len(s) && s[zeros] == '1' {
+		zeros++
+	}
+	return append(make([]byte, zeros), n.Bytes()...), nil
+}
+
+func base58Encode(b []byte) string {
+	n := new(big.Int).SetBytes(b)
+	var out []byte
+	mod := new(big.Int)
+	for n.Sign() > 0 {
+		n.DivMod(n, big.NewInt(58), mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+	for i := 0; i < len(b) && b[i] == 0; i++ {
+		out = append(out, '1')
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
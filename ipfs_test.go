@@ -0,0 +1,218 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func uvarint(n uint64) []byte {
+	b := make([]byte, binary.MaxVarintLen64)
+	return b[:binary.PutUvarint(b, n)]
+}
+
+func protoField(field int, value []byte) []byte {
+	return append(append(uvarint(uint64(field<<3|2)), uvarint(uint64(len(value)))...), value...)
+}
+
+func protoVarint(field int, n uint64) []byte {
+	return append(uvarint(uint64(field<<3)), uvarint(n)...)
+}
+
+// newCID returns the CIDv1 of the given block, hashed with SHA-256.
+func newCID(codec uint64, block []byte) cid {
+	sum := sha256.Sum256(block)
+	return cid{version: 1, codec: codec, hash: append([]byte{multihashSHA256, 32}, sum[:]...)}
+}
+
+func (c cid) bytes() []byte {
+	if c.version == 0 {
+		return c.hash
+	}
+	return append(append(uvarint(c.version), uvarint(c.codec)...), c.hash...)
+}
+
+// newIPFSFile splits data in raw leaves linked from a dag-pb root, returning the CID of the
+// root and the blocks of the file, in depth-first order.
+func newIPFSFile(data []byte, leafSize int) (cid, map[string][]byte, []cid) {
+	blocks := make(map[string][]byte)
+	var leaves []cid
+	var links, unixfs []byte
+	unixfs = append(unixfs, protoVarint(1, unixfsFile)...)
+	unixfs = append(unixfs, protoVarint(3, uint64(len(data)))...)
+	for i := 0; i < len(data); i += leafSize {
+		end := i + leafSize
+		if end > len(data) {
+			end = len(data)
+		}
+		leaf := newCID(codecRaw, data[i:end])
+		blocks[string(leaf.hash)] = data[i:end]
+		leaves = append(leaves, leaf)
+		links = append(links, protoField(2, protoField(1, leaf.bytes()))...)
+		unixfs = append(unixfs, protoVarint(4, uint64(end-i))...)
+	}
+
+	node := append(links, protoField(1, unixfs)...)
+	root := newCID(codecDagPB, node)
+	blocks[string(root.hash)] = node
+	return root, blocks, append([]cid{root}, leaves...)
+}
+
+// newIPFSGateway serves the given blocks as a trustless gateway, sending all the blocks of
+// files regardless of the bytes requested. Blocks are altered by corrupt, if set.
+func newIPFSGateway(blocks map[string][]byte, order []cid, corrupt func(c cid, block []byte) []byte) (*httptest.Server, *[]string) {
+	var mu sync.Mutex
+	var ranges []string
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := parseCID(strings.TrimPrefix(r.URL.Path, "/ipfs/"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Query().Get("format") {
+		case "raw":
+			w.Write(blocks[string(c.hash)])
+		case "car":
+			mu.Lock()
+			ranges = append(ranges, r.URL.Query().Get("entity-bytes"))
+			mu.Unlock()
+
+			header := []byte("fake CBOR header")
+			w.Write(append(uvarint(uint64(len(header))), header...))
+			for _, c := range order {
+				block := blocks[string(c.hash)]
+				if corrupt != nil {
+					block = corrupt(c, block)
+				}
+				section := append(c.bytes(), block...)
+				w.Write(append(uvarint(uint64(len(section))), section...))
+			}
+		default:
+			http.Error(w, "unsupported format", http.StatusBadRequest)
+		}
+	})), &ranges
+}
+
+func TestIPFS(t *testing.T) {
+	destDir, err := ioutil.TempDir(os.TempDir(), "ipfs")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	// Leaves differ from each other, so they have different CIDs.
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < 320000; i++ {
+		fmt.Fprintf(&buf, "%08d", i)
+	}
+	data := buf.Bytes()
+	root, blocks, order := newIPFSFile(data, 100000)
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer down.Close()
+	// Corrupts the second leaf.
+	corrupt, _ := newIPFSGateway(blocks, order, func(c cid, block []byte) []byte {
+		if bytes.Equal(c.hash, order[2].hash) {
+			block = append([]byte{}, block...)
+			block[0] ^= 0xff
+		}
+		return block
+	})
+	defer corrupt.Close()
+	good, ranges := newIPFSGateway(blocks, order, nil)
+	defer good.Close()
+
+	RegisterScheme("ipfs", &IPFSHandler{Gateways: []string{down.URL, corrupt.URL, good.URL}})
+	defer RegisterScheme("ipfs", &IPFSHandler{})
+
+	// Gateways are requested through the client of the fetcher.
+	var hooked int32
+	gf := New(WithDestDir(destDir), WithRequestHook(func(r *http.Request) error {
+		atomic.AddInt32(&hooked, 1)
+		return nil
+	}))
+	file, err := gf.Fetch("ipfs://"+root.String(), nil)
+	assert.Ok(t, err)
+	defer file.Close()
+	assert.Cond(t, atomic.LoadInt32(&hooked) > 0, "requests should go through the client of the fetcher")
+
+	got, err := ioutil.ReadAll(file)
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(data, got), "downloaded file does not match")
+	assert.Equals(t, filepath.Join(destDir, root.String()), file.Name())
+	// The good gateway takes over from where the corrupt one left off, up to the end of the chunk.
+	assert.Equals(t, []string{"100000:319999"}, *ranges)
+
+	// Bytes from any offset can be read, skipping the blocks before them.
+	handler := &IPFSHandler{Gateways: []string{good.URL}}
+	r, err := handler.Open(context.Background(), "ipfs://"+root.String(), 250000, -1)
+	assert.Ok(t, err)
+	got, err = ioutil.ReadAll(r)
+	r.Close()
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(data[250000:], got), "content read from an offset does not match")
+
+	// Corrupt content is rejected if no gateway sends it intact.
+	handler = &IPFSHandler{Gateways: []string{corrupt.URL}}
+	r, err = handler.Open(context.Background(), "ipfs://"+root.String(), 0, -1)
+	assert.Ok(t, err)
+	_, err = ioutil.ReadAll(r)
+	r.Close()
+	assert.Cond(t, err != nil && strings.Contains(err.Error(), "corrupt"), "corrupt blocks should be rejected, got %v", err)
+}
+
+func TestIPFSRawBlock(t *testing.T) {
+	data := []byte("Hello, IPFS!")
+	c := newCID(codecRaw, data)
+	gateway, _ := newIPFSGateway(map[string][]byte{string(c.hash): data}, []cid{c}, nil)
+	defer gateway.Close()
+
+	handler := &IPFSHandler{Gateways: []string{gateway.URL}}
+	info, err := handler.Stat(context.Background(), "ipfs://"+c.String())
+	assert.Ok(t, err)
+	assert.Equals(t, int64(len(data)), info.Size)
+	assert.Equals(t, `"`+c.String()+`"`, info.ETag)
+	assert.Equals(t, map[string]string{"sha256": fmt.Sprintf("%x", sha256.Sum256(data))}, info.Checksums)
+
+	_, err = handler.Stat(context.Background(), "ipfs://"+c.String()+"/dir/file")
+	assert.Cond(t, err != nil, "paths within content should be rejected")
+}
+
+func TestParseCID(t *testing.T) {
+	sum := sha256.Sum256([]byte("block"))
+	v0 := cid{version: 0, codec: codecDagPB, hash: append([]byte{multihashSHA256, 32}, sum[:]...)}
+	s := v0.String()
+	assert.Cond(t, len(s) == 46 && strings.HasPrefix(s, "Qm"), "unexpected CIDv0 %s", s)
+	c, err := parseCID(s)
+	assert.Ok(t, err)
+	assert.Equals(t, v0, c)
+
+	v1 := newCID(codecRaw, []byte("block"))
+	s = v1.String()
+	assert.Cond(t, strings.HasPrefix(s, "bafkrei"), "unexpected CIDv1 %s", s)
+	for _, s := range []string{s, strings.ToUpper(s), fmt.Sprintf("f%x", v1.bytes())} {
+		c, err = parseCID(s)
+		assert.Ok(t, err)
+		assert.Equals(t, v1, c)
+	}
+
+	_, err = parseCID("bafkrei")
+	assert.Cond(t, err != nil, "truncated CID should be rejected")
+}
@@ -0,0 +1,81 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// lockRetryInterval is how often a lock held by someone else is tried again.
+const lockRetryInterval = 50 * time.Millisecond
+
+// lockFile takes an exclusive lock on the file at the given path, creating it if needed, so that
+// different processes, or different fetchers in the same process, do not step on each other.
+// It waits for the lock to be released if someone else holds it. Calling the returned function
+// releases the lock and removes the file, so lock files are not left behind.
+func lockFile(ctx context.Context, path string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0760); err != nil {
+		return nil, err
+	}
+
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0660)
+		if err != nil {
+			return nil, err
+		}
+
+		locked, err := tryLock(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if locked {
+			if !lockedPath(f, path) {
+				// The file was removed by whoever held the lock before, the lock is taken
+				// again on the file now at the path.
+				unlock(f)
+				f.Close()
+				continue
+			}
+			return func() {
+				// The file is removed while the lock is held, so whoever waits for it finds
+				// out once they take it. Files cannot be removed while open on Windows,
+				// where they are removed once closed unless someone else opened them.
+				os.Remove(path)
+				unlock(f)
+				f.Close()
+				if runtime.GOOS == "windows" {
+					os.Remove(path)
+				}
+			}, nil
+		}
+		f.Close()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
+
+// lockedPath tells whether the given open file is still the one at the given path.
+func lockedPath(f *os.File, path string) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	pfi, err := os.Stat(path)
+	return err == nil && os.SameFile(fi, pfi)
+}
+
+// destLock returns the path of the lock file guarding the download of the given destination file.
+func destLock(destFilePath string) string {
+	return filepath.Join(filepath.Dir(destFilePath), "."+filepath.Base(destFilePath)+".lock")
+}
@@ -0,0 +1,20 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package gofetch
+
+import "os"
+
+// tryLock does nothing on platforms without file locking; concurrent downloads are not guarded.
+func tryLock(f *os.File) (bool, error) {
+	return true, nil
+}
+
+// unlock releases a lock taken with tryLock.
+func unlock(f *os.File) error {
+	return nil
+}
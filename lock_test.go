@@ -0,0 +1,74 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestLockFile(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "lock")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.lock")
+	unlock, err := lockFile(context.Background(), path)
+	assert.Ok(t, err)
+
+	// The lock is held, so taking it again waits until the context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = lockFile(ctx, path)
+	assert.Equals(t, context.DeadlineExceeded, err)
+
+	// Whoever waits for the lock takes it once released.
+	taken := make(chan func())
+	go func() {
+		unlock, err := lockFile(context.Background(), path)
+		assert.Ok(t, err)
+		taken <- unlock
+	}()
+	time.Sleep(2 * lockRetryInterval)
+	unlock()
+	unlock = <-taken
+	_, err = os.Stat(path)
+	assert.Ok(t, err)
+
+	// Lock files are not left behind.
+	unlock()
+	_, err = os.Stat(path)
+	assert.Cond(t, os.IsNotExist(err), "lock file should have been removed")
+}
+
+func TestDestLockRemoved(t *testing.T) {
+	ts := httptest.NewServer(http.FileServer(http.Dir("./fixtures")))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "dest-lock")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	file, err := New(WithDestDir(destDir)).Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	file.Close()
+
+	// Only the downloaded file is left in the destination directory.
+	entries, err := ioutil.ReadDir(destDir)
+	assert.Ok(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	assert.Equals(t, []string{"test"}, names)
+}
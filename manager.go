@@ -0,0 +1,223 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"context"
+	"os"
+	"sync"
+)
+
+// Manager runs many downloads through a shared Fetcher, bounding how many of them run at once.
+// Downloads beyond the bound are queued until others finish, by priority, see
+// ContextWithPriority. Combined with WithMaxConnections, it also bounds the number of
+// connections open at once across all of them. Downloads can be paused and resumed all at once.
+//
+// It is safe for concurrent use.
+type Manager struct {
+	fetcher   *Fetcher
+	downloads *priorityLimit
+
+	mu     sync.Mutex
+	paused bool
+	// resumed is closed once downloads are resumed.
+	resumed chan struct{}
+	running map[*managedRun]struct{}
+}
+
+// managedRun is an attempt at running a download, which is canceled when paused.
+type managedRun struct {
+	cancel context.CancelFunc
+	paused bool
+}
+
+// NewManager returns a Manager running up to maxDownloads downloads at once, through a Fetcher
+// configured with the given options.
+func NewManager(maxDownloads int, opts ...Option) *Manager {
+	if maxDownloads < 1 {
+		maxDownloads = 1
+	}
+	return &Manager{
+		fetcher:   New(opts...),
+		downloads: newPriorityLimit(maxDownloads),
+		running:   make(map[*managedRun]struct{}),
+	}
+}
+
+// Fetch downloads content from the provided URL, once there is room for it.
+// See Fetcher.Fetch.
+func (m *Manager) Fetch(url string, progressCh chan<- ProgressReport) (*os.File, error) {
+	result, err := m.FetchContext(context.Background(), url, progressCh)
+	if err != nil {
+		return nil, err
+	}
+	return result.File, nil
+}
+
+// FetchContext downloads content from the provided URL, once there is room for it. The
+// context applies to the time waiting in the queue, or paused, too. See Fetcher.FetchContext.
+func (m *Manager) FetchContext(ctx context.Context, url string, progressCh chan<- ProgressReport) (*Result, error) {
+	if progressCh != nil {
+		defer close(progressCh)
+	}
+
+	var reported managedProgress
+	for {
+		if err := m.waitResumed(ctx); err != nil {
+			return nil, err
+		}
+		if err := m.downloads.acquire(ctx, priorityFrom(ctx)); err != nil {
+			return nil, err
+		}
+		result, paused, err := m.run(ctx, url, progressCh, &reported)
+		m.downloads.release()
+		if !paused {
+			return result, err
+		}
+		// Paused downloads are resumed from where they were left off, once resumed.
+		reported.retried = true
+	}
+}
+
+// run makes an attempt at running a download, telling whether it was paused meanwhile.
+func (m *Manager) run(ctx context.Context, url string, progressCh chan<- ProgressReport,
+	reported *managedProgress) (*Result, bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	m.mu.Lock()
+	if m.paused {
+		m.mu.Unlock()
+		return nil, true, nil
+	}
+	r := &managedRun{cancel: cancel}
+	m.running[r] = struct{}{}
+	m.mu.Unlock()
+
+	var result *Result
+	var err error
+	reported.attempt(progressCh, func(ch chan<- ProgressReport) {
+		result, err = m.fetcher.FetchContext(ctx, url, ch)
+	})
+
+	m.mu.Lock()
+	delete(m.running, r)
+	paused := r.paused
+	m.mu.Unlock()
+
+	if err != nil && paused {
+		return nil, true, nil
+	}
+	return result, false, err
+}
+
+// waitResumed waits until downloads are not paused, or the context is done.
+func (m *Manager) waitResumed(ctx context.Context) error {
+	m.mu.Lock()
+	paused, resumed := m.paused, m.resumed
+	m.mu.Unlock()
+	if !paused {
+		return nil
+	}
+
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Pause stops all the downloads, and keeps queued ones from starting, until resumed. Downloads
+// in progress are interrupted, keeping what they downloaded so far, so their calls to Fetch
+// wait until resumed to finish.
+func (m *Manager) Pause() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.paused {
+		return
+	}
+
+	m.paused = true
+	m.resumed = make(chan struct{})
+	for r := range m.running {
+		r.paused = true
+		r.cancel()
+	}
+}
+
+// Resume resumes the downloads paused, from where they were left off.
+func (m *Manager) Resume() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.paused {
+		return
+	}
+
+	m.paused = false
+	close(m.resumed)
+}
+
+// SetMaxDownloads changes the number of downloads run at once. Downloads in progress are not
+// interrupted if there are more than that, queued ones wait for them to finish instead.
+func (m *Manager) SetMaxDownloads(n int) {
+	if n < 1 {
+		n = 1
+	}
+	m.downloads.set(n)
+}
+
+// managedProgress is what was reported of a download so far, across attempts.
+type managedProgress struct {
+	downloaded int64
+	resumed    int64
+	// retried is set once the download is paused, bytes found on disk by the attempts
+	// after that were downloaded by the earlier ones.
+	retried bool
+}
+
+// attempt calls fetch with a channel whose reports are forwarded to progressCh, if set,
+// adjusted with forward. Reports are forwarded rather than sent directly, since the Fetcher
+// closes the channel after each attempt.
+func (p *managedProgress) attempt(progressCh chan<- ProgressReport, fetch func(chan<- ProgressReport)) {
+	if progressCh == nil {
+		fetch(nil)
+		return
+	}
+
+	ch := make(chan ProgressReport)
+	finished := make(chan struct{})
+	forwarded := make(chan struct{})
+	go func() {
+		defer close(forwarded)
+		for {
+			select {
+			case report, ok := <-ch:
+				if !ok {
+					return
+				}
+				p.forward(&report)
+				progressCh <- report
+			case <-finished:
+				return
+			}
+		}
+	}()
+
+	fetch(ch)
+	// Nothing else is sent once done, whether the channel was closed or not.
+	close(finished)
+	<-forwarded
+}
+
+// forward adjusts a report of the current attempt to account for the earlier ones, so their
+// bytes are neither reported again nor counted as resumed.
+func (p *managedProgress) forward(report *ProgressReport) {
+	if p.retried {
+		report.ResumedBytes = p.resumed
+	}
+	report.WrittenBytes = report.Downloaded - p.downloaded - (report.ResumedBytes - p.resumed)
+	p.downloaded, p.resumed = report.Downloaded, report.ResumedBytes
+}
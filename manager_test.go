@@ -0,0 +1,181 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+// concurrencyServer serves 256 KiB files, recording the most GET requests it served at once.
+func concurrencyServer() (*httptest.Server, func() int) {
+	var mu sync.Mutex
+	var active, max int
+	content := strings.Repeat("x", 256<<10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			mu.Lock()
+			active++
+			if active > max {
+				max = active
+			}
+			mu.Unlock()
+			defer func() {
+				mu.Lock()
+				active--
+				mu.Unlock()
+			}()
+			// Gives other requests the chance to overlap.
+			time.Sleep(20 * time.Millisecond)
+		}
+		http.ServeContent(w, r, "file", time.Time{}, strings.NewReader(content))
+	}))
+
+	return ts, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return max
+	}
+}
+
+func TestManager(t *testing.T) {
+	ts, maxActive := concurrencyServer()
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "manager")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	m := NewManager(2, WithDestDir(destDir))
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f, err := m.Fetch(fmt.Sprintf("%s/file%d", ts.URL, i), nil)
+			assert.Ok(t, err)
+			f.Close()
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Cond(t, maxActive() <= 2, "expected at most 2 downloads at once, got %d", maxActive())
+
+	// Downloads waiting for room can be canceled.
+	m = NewManager(1, WithDestDir(destDir))
+	assert.Ok(t, m.downloads.acquire(context.Background(), PriorityNormal))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = m.FetchContext(ctx, ts.URL+"/file", nil)
+	assert.Equals(t, context.DeadlineExceeded, err)
+}
+
+func TestWithMaxConnections(t *testing.T) {
+	ts, maxActive := concurrencyServer()
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "max-connections")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	// Up to 4 downloads of 4 chunks each, but no more than 3 chunks at once overall.
+	m := NewManager(4, WithDestDir(destDir), WithConcurrency(4), WithMaxConnections(3))
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f, err := m.Fetch(fmt.Sprintf("%s/file%d", ts.URL, i), nil)
+			assert.Ok(t, err)
+			f.Close()
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Cond(t, maxActive() <= 3, "expected at most 3 connections at once, got %d", maxActive())
+}
+
+func TestManagerPause(t *testing.T) {
+	var mu sync.Mutex
+	var ranges []string
+	content := strings.Repeat("x", 512<<10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			mu.Lock()
+			ranges = append(ranges, r.Header.Get("Range"))
+			mu.Unlock()
+		}
+		http.ServeContent(w, r, "file", time.Time{}, strings.NewReader(content))
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "manager-pause")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	m := NewManager(1, WithDestDir(destDir), WithRateLimit(1<<20))
+	progressCh := make(chan ProgressReport)
+	done := make(chan error)
+	go func() {
+		f, err := m.Fetch(ts.URL+"/file", progressCh)
+		if f != nil {
+			f.Close()
+		}
+		done <- err
+	}()
+
+	var total int64
+	paused := false
+	for p := range progressCh {
+		total += p.WrittenBytes
+		if !paused && total > 0 && total < int64(len(content))/2 {
+			paused = true
+			m.Pause()
+			select {
+			case <-done:
+				t.Fatal("Paused download should not finish")
+			case <-time.After(50 * time.Millisecond):
+			}
+			m.Resume()
+		}
+	}
+	assert.Ok(t, <-done)
+	assert.Equals(t, int64(len(content)), total)
+
+	// The download was resumed from where it was paused.
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Cond(t, len(ranges) > 1, "Download should have been resumed")
+	assert.Cond(t, ranges[len(ranges)-1] != "bytes=0-", "Download should not start over, got %s", ranges[len(ranges)-1])
+}
+
+func TestManagedProgress(t *testing.T) {
+	var p managedProgress
+	report := ProgressReport{Downloaded: 30, ResumedBytes: 10}
+	p.forward(&report)
+	assert.Equals(t, int64(20), report.WrittenBytes)
+
+	// Bytes downloaded before pausing are found on disk once resumed.
+	p.retried = true
+	report = ProgressReport{Downloaded: 30, ResumedBytes: 30}
+	p.forward(&report)
+	assert.Equals(t, int64(0), report.WrittenBytes)
+	assert.Equals(t, int64(10), report.ResumedBytes)
+
+	report = ProgressReport{Downloaded: 50, ResumedBytes: 30}
+	p.forward(&report)
+	assert.Equals(t, int64(20), report.WrittenBytes)
+	assert.Equals(t, int64(10), report.ResumedBytes)
+}
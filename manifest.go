@@ -0,0 +1,200 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxManifestSize is the largest checksum manifest, or signature, gofetch is willing to read.
+const maxManifestSize = 1 << 20
+
+// errNoChecksum is returned when a checksum manifest does not list the file being downloaded.
+var errNoChecksum = errors.New("no checksum found")
+
+// checksumFile is a checksum manifest, like SHA256SUMS, listing the digests of one or more files.
+// Its signature, if set, is verified before trusting any of the digests.
+type checksumFile struct {
+	algorithm string
+	location  string
+	signature *gpgSignature
+}
+
+// manifestChecksum looks up the checksum of fileName in the given checksum manifest.
+func (gf *Fetcher) manifestChecksum(ctx context.Context, m checksumFile, fileName string) (checksum, error) {
+	data, err := gf.readLocation(ctx, m.location)
+	if err != nil {
+		return checksum{}, errors.Wrapf(err, "failed reading checksum file %s", m.location)
+	}
+
+	if m.signature != nil {
+		signature, err := gf.readLocation(ctx, m.signature.location)
+		if err != nil {
+			return checksum{}, errors.Wrapf(err, "failed reading signature %s", m.signature.location)
+		}
+		if err := verifySignature(m.signature.keyring, bytes.NewReader(data), signature); err != nil {
+			return checksum{}, errors.Wrapf(err, "checksum file %s", m.location)
+		}
+	}
+
+	value, err := findChecksum(bytes.NewReader(data), fileName)
+	if err != nil {
+		return checksum{}, errors.Wrapf(err, "checksum file %s", m.location)
+	}
+
+	algorithm := m.algorithm
+	if algorithm == "" {
+		algorithm = manifestAlgorithm(m.location)
+	}
+	return checksum{algorithm: algorithm, value: value}, nil
+}
+
+// discoverChecksum looks for checksum files published next to the given URL:
+// <url>.sha256, <url>.sha512 or a SHA256SUMS file in the same directory, in that order.
+// It returns nil if none of them exists or lists the file.
+func (gf *Fetcher) discoverChecksum(ctx context.Context, rawURL, fileName string) (*checksum, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = ""
+	u.Fragment = ""
+
+	dir := *u
+	dir.Path = path.Join(path.Dir(u.Path), "SHA256SUMS")
+	candidates := []string{u.String() + ".sha256", u.String() + ".sha512", dir.String()}
+
+	for _, location := range candidates {
+		c, err := gf.manifestChecksum(ctx, checksumFile{location: location}, fileName)
+		if err == nil {
+			return &c, nil
+		}
+
+		if _, ok := errors.Cause(err).(*statusError); ok || errors.Cause(err) == errNoChecksum {
+			continue
+		}
+		return nil, err
+	}
+	return nil, nil
+}
+
+// readLocation reads a small file, like a checksum manifest or a signature,
+// either from a local path or from an HTTP(S) URL.
+func (gf *Fetcher) readLocation(ctx context.Context, location string) ([]byte, error) {
+	var data []byte
+	err := gf.retry(ctx, func() error {
+		r, err := gf.openLocation(ctx, location)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		data, err = ioutil.ReadAll(io.LimitReader(r, maxManifestSize))
+		return err
+	})
+	return data, err
+}
+
+// openLocation opens a local path, an HTTP(S) URL, including the ones of Unix domain sockets,
+// or a URL of a registered scheme for reading.
+func (gf *Fetcher) openLocation(ctx context.Context, location string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") && !isUnixURL(location) {
+		if handler, err := schemeHandler(location); err == nil && handler != nil {
+			return handler.Open(gf.handlerContext(ctx), location, 0, -1)
+		}
+		return os.Open(location)
+	}
+
+	if gf.offline {
+		return nil, &NotCachedError{URL: location}
+	}
+
+	req, err := gf.newRequest(ctx, "GET", location)
+	if err != nil {
+		return nil, err
+	}
+	// These files are small, ask for them uncompressed.
+	req.Header.Del("Accept-Encoding")
+
+	res, err := gf.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, &statusError{code: res.StatusCode, status: res.Status}
+	}
+	return res.Body, nil
+}
+
+// findChecksum returns the checksum listed for fileName. It understands the
+// GNU coreutils format, "<hash>  <file>" or "<hash> *<file>", the BSD format,
+// "SHA256 (<file>) = <hash>", and files containing only a hash.
+func findChecksum(r io.Reader, fileName string) (string, error) {
+	var bare string
+	entries := 0
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries++
+
+		var value, name string
+		if i, j := strings.Index(line, " ("), strings.LastIndex(line, ") = "); i > 0 && j > i {
+			name, value = line[i+2:j], line[j+4:]
+		} else if fields := strings.SplitN(line, " ", 2); len(fields) == 2 {
+			value = fields[0]
+			name = strings.TrimPrefix(strings.TrimLeft(fields[1], " "), "*")
+		} else {
+			bare = line
+			continue
+		}
+
+		if path.Base(name) == fileName {
+			return value, nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	// Files like foo.tar.gz.sha256 sometimes carry the bare hash only.
+	if entries == 1 && bare != "" {
+		return bare, nil
+	}
+	return "", errors.Wrapf(errNoChecksum, "%s", fileName)
+}
+
+// manifestAlgorithm guesses the hashing algorithm used by a checksum manifest from its name,
+// like SHA256SUMS or foo.tar.gz.sha512. It returns an empty string if the name does not tell,
+// leaving the algorithm to be inferred from the length of the hash.
+func manifestAlgorithm(location string) string {
+	name := strings.ToLower(path.Base(location))
+	for _, alg := range []string{"sha512", "sha256", "sha1", "md5", "blake2b"} {
+		if strings.Contains(name, alg) {
+			return alg
+		}
+	}
+	if strings.HasPrefix(name, "b2sum") {
+		return "blake2b"
+	}
+	return ""
+}
@@ -0,0 +1,122 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+const fixtureSHA256 = "fbd2bfb411ec34dc0ba3dada3f31fd13c082b174af25571cf35023ba4ad80456"
+
+func TestFindChecksum(t *testing.T) {
+	tests := []struct {
+		manifest string
+		sum      string
+	}{
+		{"# comment\n0123  other.tar.gz\n" + fixtureSHA256 + "  test\n", fixtureSHA256},
+		{fixtureSHA256 + " *./dist/test\n", fixtureSHA256},
+		{"SHA256 (test) = " + fixtureSHA256 + "\n", fixtureSHA256},
+		{fixtureSHA256 + "\n", fixtureSHA256},
+		{"0123  other.tar.gz\n", ""},
+	}
+
+	for _, tt := range tests {
+		sum, err := findChecksum(strings.NewReader(tt.manifest), "test")
+		if tt.sum == "" {
+			assert.Cond(t, err != nil, "expected no checksum for %q", tt.manifest)
+			continue
+		}
+		assert.Ok(t, err)
+		assert.Equals(t, tt.sum, sum)
+	}
+
+	assert.Equals(t, "sha256", manifestAlgorithm("https://example.com/SHA256SUMS"))
+	assert.Equals(t, "sha512", manifestAlgorithm("test.sha512"))
+	assert.Equals(t, "", manifestAlgorithm("CHECKSUMS"))
+}
+
+func TestWithChecksumFile(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/SHA256SUMS" {
+			fmt.Fprintf(w, "%s  test\n", fixtureSHA256)
+			return
+		}
+
+		file, err := os.Open("./fixtures/test")
+		assert.Ok(t, err)
+		defer file.Close()
+
+		http.ServeContent(w, r, file.Name(), time.Time{}, file)
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "checksum-file")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	gf := New(WithDestDir(destDir), WithConcurrency(4), WithChecksumFile("", ts.URL+"/SHA256SUMS"))
+	_, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+
+	manifest := filepath.Join(destDir, "test.sha256")
+	err = ioutil.WriteFile(manifest, []byte(strings.Repeat("0", 64)+"  test\n"), 0600)
+	assert.Ok(t, err)
+
+	gf = New(WithDestDir(destDir), WithChecksumFile("", manifest))
+	_, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Cond(t, err != nil, "Fetch should fail if the checksum in the manifest does not match")
+
+	gf = New(WithDestDir(destDir), WithChecksumFile("", filepath.Join(destDir, "missing")))
+	_, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Cond(t, err != nil, "Fetch should fail if the checksum file does not exist")
+}
+
+func TestWithChecksumDiscovery(t *testing.T) {
+	sums := map[string]string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sum, ok := sums[r.URL.Path]; ok {
+			fmt.Fprint(w, sum)
+			return
+		}
+		if r.URL.Path != "/dist/test" {
+			http.NotFound(w, r)
+			return
+		}
+
+		file, err := os.Open("./fixtures/test")
+		assert.Ok(t, err)
+		defer file.Close()
+
+		http.ServeContent(w, r, file.Name(), time.Time{}, file)
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "checksum-discovery")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	// Nothing is published next to the file.
+	gf := New(WithDestDir(destDir), WithChecksumDiscovery())
+	_, err = gf.Fetch(ts.URL+"/dist/test", nil)
+	assert.Ok(t, err)
+
+	sums["/dist/SHA256SUMS"] = strings.Repeat("0", 64) + "  test\n"
+	_, err = gf.Fetch(ts.URL+"/dist/test", nil)
+	assert.Cond(t, err != nil, "Fetch should fail if the discovered checksum does not match")
+
+	sums["/dist/test.sha512"] = "4ff6e159db38d46a665f26e9f82b98134238c0457cc82727a5258b7184773e4967068cc0eecf3928ecd079f3aea6e22aac024847c6d76c0329c4635c4b6ae327  test\n"
+	_, err = gf.Fetch(ts.URL+"/dist/test", nil)
+	assert.Ok(t, err)
+}
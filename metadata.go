@@ -0,0 +1,431 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheEntry is what gofetch remembers about a downloaded URL, in order to
+// avoid downloading it again if it did not change.
+type CacheEntry struct {
+	// URL is the URL the file was downloaded from.
+	URL string `json:"url"`
+	// ETag and LastModified are the validators sent by the server along with the file.
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	// Size and ModTime are the size in bytes and modification time of the file once downloaded.
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	// Digests holds the digests of the file computed while downloading it, keyed by hashing algorithm.
+	Digests map[string]string `json:"digests,omitempty"`
+	// Updated is the last time the file was downloaded or checked with the server.
+	Updated time.Time `json:"updated"`
+	// Expires is the time until which the file is fresh, if caching headers are honored.
+	Expires time.Time `json:"expires"`
+}
+
+// diskCache is the cache gofetch keeps on disk, in ~/.gofetch by default. It stores the
+// metadata of downloaded URLs, as one JSON file per URL so that different URLs serving
+// files with the same name do not collide, and the content of files if requested.
+type diskCache struct {
+	dir    string
+	limits CacheLimits
+
+	// mu guards usage and expires, along with the lock shared with other processes.
+	mu sync.Mutex
+	// usage is the size of the cache as of the last time it was walked, plus what was added
+	// since, or nil if unknown. expires is the earliest time an entry may expire. They keep
+	// the cache from being walked every time something is added to it.
+	usage   *CacheUsage
+	expires time.Time
+}
+
+// NewDiskCache returns the cache gofetch uses by default, keeping it in the given directory
+// instead of ~/.gofetch, like a volume shared by several machines. See WithCacheBackend.
+func NewDiskCache(dir string) Cache {
+	return &diskCache{dir: dir}
+}
+
+// path returns the path of the file holding the metadata of the given URL.
+func (s *diskCache) path(url string) string {
+	key := sha256.Sum256([]byte(url))
+	return filepath.Join(s.dir, "metadata", hex.EncodeToString(key[:])+".json")
+}
+
+// Get returns the metadata of the given URL, or nil if there is none, marking it as recently used.
+func (s *diskCache) Get(url string) (*CacheEntry, error) {
+	path := s.path(url)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Unreadable metadata is as good as none, the file is downloaded again.
+	var m CacheEntry
+	if err := json.Unmarshal(data, &m); err != nil || m.URL != url {
+		return nil, nil
+	}
+
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// Put stores the metadata of a URL, replacing any previous one and marking it as recently used.
+func (s *diskCache) Put(m *CacheEntry) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	path := s.path(m.URL)
+	fi, statErr := os.Stat(path)
+	if err := writeFile(path, data); err != nil {
+		return err
+	}
+
+	if s.usage != nil {
+		if statErr == nil {
+			s.usage.Bytes -= fi.Size()
+		} else {
+			s.usage.Entries++
+		}
+		s.usage.Bytes += int64(len(data))
+	}
+	return s.enforceLimits()
+}
+
+// lock takes the lock guarding changes to the cache spanning several files, shared with other processes.
+func (s *diskCache) lock() (func(), error) {
+	s.mu.Lock()
+	unlock, err := lockFile(context.Background(), filepath.Join(s.dir, ".lock"))
+	if err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	return func() {
+		unlock()
+		s.mu.Unlock()
+	}, nil
+}
+
+// enforceLimits evicts entries from the cache if it is over its limits. The cache must be locked.
+func (s *diskCache) enforceLimits() error {
+	limits := s.limits
+	if limits == (CacheLimits{}) {
+		return nil
+	}
+
+	// The cache is only walked if it may be over its limits. Entries added by other
+	// processes are accounted for the next time it is.
+	if u := s.usage; u != nil {
+		over := (limits.MaxEntries > 0 && u.Entries > limits.MaxEntries) ||
+			(limits.MaxBytes > 0 && u.Bytes > limits.MaxBytes)
+		expired := limits.TTL > 0 && !time.Now().Before(s.expires)
+		if !over && !expired {
+			return nil
+		}
+	}
+	return s.evict(limits)
+}
+
+// writeFile writes data to a temporary file first, and then moves it to the given path,
+// so that concurrent readers never see it partially written.
+func writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// CacheLimits bounds the size of the gofetch cache, stored in ~/.gofetch. Zero values mean no limit.
+type CacheLimits struct {
+	// MaxBytes is the maximum size of the cache in bytes.
+	MaxBytes int64
+	// MaxEntries is the maximum number of entries in the cache, see CacheUsage.
+	MaxEntries int
+	// TTL is how long entries are kept in the cache since they were last used.
+	TTL time.Duration
+}
+
+// CacheUsage reports the current size of the gofetch cache.
+type CacheUsage struct {
+	// Entries is the number of entries in the cache: the URLs it knows about and,
+	// when the content-addressable cache is enabled, the files it stores for other URLs.
+	Entries int
+	// Bytes is the space taken by the cache on disk.
+	Bytes int64
+}
+
+// cacheEntry is an entry of the cache, as seen on disk: the metadata of a URL along with the
+// content stored for it, or content stored for URLs the cache does not know about.
+type cacheEntry struct {
+	paths []string
+	used  time.Time
+}
+
+// entries returns the entries of the cache, the least recently used first, along with the
+// size of every file in the cache.
+func (s *diskCache) entries() ([]cacheEntry, map[string]int64, error) {
+	files := make(map[string]os.FileInfo)
+	err := filepath.Walk(s.dir, func(path string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Temporary files are not entries yet.
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			return nil
+		}
+		files[path] = fi
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var entries []cacheEntry
+	claimed := make(map[string]bool)
+	add := func(e cacheEntry) {
+		for _, path := range e.paths {
+			if fi := files[path]; fi != nil && fi.ModTime().After(e.used) {
+				e.used = fi.ModTime()
+			}
+			claimed[path] = true
+		}
+		entries = append(entries, e)
+	}
+	// owned returns the given paths that exist and are not part of another entry yet.
+	owned := func(paths ...string) []string {
+		var found []string
+		for _, path := range paths {
+			if files[path] != nil && !claimed[path] {
+				found = append(found, path)
+			}
+		}
+		return found
+	}
+
+	// The metadata of a URL comes with the content stored for it. Content stored for
+	// several URLs goes with any of them.
+	metadata := filepath.Join(s.dir, "metadata")
+	for path := range files {
+		if filepath.Dir(path) != metadata {
+			continue
+		}
+
+		var m CacheEntry
+		data, err := ioutil.ReadFile(path)
+		if err == nil && json.Unmarshal(data, &m) == nil && s.path(m.URL) == path {
+			add(cacheEntry{paths: owned(s.entryPaths(&m)...)})
+		} else {
+			add(cacheEntry{paths: []string{path}})
+		}
+	}
+
+	// The content stored for URLs the cache does not know about comes with the
+	// digests it is indexed by.
+	indexes := make(map[string][]string)
+	for path := range files {
+		algorithm := filepath.Base(filepath.Dir(path))
+		if claimed[path] || filepath.Dir(filepath.Dir(path)) != filepath.Join(s.dir, "cas") ||
+			algorithm == casAlgorithm || algorithm == "used" {
+			continue
+		}
+		if data, err := ioutil.ReadFile(path); err == nil {
+			indexes[string(data)] = append(indexes[string(data)], path)
+		}
+	}
+	for path := range files {
+		if claimed[path] || filepath.Dir(path) != filepath.Dir(s.blobPath("")) {
+			continue
+		}
+		sum := filepath.Base(path)
+		add(cacheEntry{paths: append(owned(path, s.usedPath(sum)), indexes[sum]...)})
+	}
+
+	// Anything else left behind is an entry on its own, so it is eventually evicted.
+	for path := range files {
+		if !claimed[path] {
+			add(cacheEntry{paths: []string{path}})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].used.Before(entries[j].used)
+	})
+	sizes := make(map[string]int64, len(files))
+	for path, fi := range files {
+		sizes[path] = fi.Size()
+	}
+	return entries, sizes, nil
+}
+
+// entryPaths returns the paths of the files making up the cache entry of the given URL: its
+// metadata, along with the content stored for it by the content-addressable cache.
+func (s *diskCache) entryPaths(e *CacheEntry) []string {
+	var paths []string
+	for algorithm, sum := range e.Digests {
+		if algorithm == casAlgorithm {
+			paths = append(paths, s.blobPath(sum), s.usedPath(sum))
+		} else {
+			paths = append(paths, s.indexPath(algorithm, sum))
+		}
+	}
+	return append(paths, s.path(e.URL))
+}
+
+// Usage returns how many entries the cache holds and the space they take.
+func (s *diskCache) Usage() (CacheUsage, error) {
+	entries, sizes, err := s.entries()
+	if err != nil {
+		return CacheUsage{}, err
+	}
+
+	usage := CacheUsage{Entries: len(entries)}
+	for _, size := range sizes {
+		usage.Bytes += size
+	}
+	return usage, nil
+}
+
+// evict removes expired entries and then, if the store is still over its limits,
+// the least recently used ones. The cache must be locked.
+func (s *diskCache) evict(limits CacheLimits) error {
+	entries, sizes, err := s.entries()
+	if err != nil {
+		return err
+	}
+
+	var bytes int64
+	for _, size := range sizes {
+		bytes += size
+	}
+
+	count := len(entries)
+	for len(entries) > 0 {
+		e := entries[0]
+		expired := limits.TTL > 0 && time.Since(e.used) > limits.TTL
+		over := (limits.MaxEntries > 0 && count > limits.MaxEntries) ||
+			(limits.MaxBytes > 0 && bytes > limits.MaxBytes)
+		if !expired && !over {
+			// Entries are sorted by last use, so the following ones are neither expired.
+			break
+		}
+
+		for _, path := range e.paths {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			bytes -= sizes[path]
+			delete(sizes, path)
+		}
+		count--
+		entries = entries[1:]
+	}
+
+	s.usage = &CacheUsage{Entries: count, Bytes: bytes}
+	s.expires = time.Now().Add(limits.TTL)
+	if len(entries) > 0 {
+		s.expires = entries[0].used.Add(limits.TTL)
+	}
+	return nil
+}
+
+// List returns the URLs the cache knows about.
+func (s *diskCache) List() ([]*CacheEntry, error) {
+	files, err := ioutil.ReadDir(filepath.Join(s.dir, "metadata"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*CacheEntry
+	for _, fi := range files {
+		if fi.IsDir() || filepath.Ext(fi.Name()) != ".json" {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(s.dir, "metadata", fi.Name()))
+		if err != nil {
+			continue
+		}
+		var e CacheEntry
+		if err := json.Unmarshal(data, &e); err == nil {
+			entries = append(entries, &e)
+		}
+	}
+	return entries, nil
+}
+
+// Delete removes a URL from the cache, along with its content if the
+// content-addressable cache stores it.
+func (s *diskCache) Delete(url string) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	e, err := s.Get(url)
+	if e == nil || err != nil {
+		return err
+	}
+
+	// The size of the cache is known again the next time it is walked.
+	s.usage = nil
+	for _, path := range s.entryPaths(e) {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Clear removes everything from the cache.
+func (s *diskCache) Clear() error {
+	return os.RemoveAll(s.dir)
+}
@@ -0,0 +1,230 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestMetadataStore(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "metadata-store")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	store := &diskCache{dir: dir}
+	assert.Cond(t, getEntry(t, store, "https://example.com/a/file") == nil, "Metadata should not exist yet")
+
+	m := &CacheEntry{URL: "https://example.com/a/file", ETag: `"v1"`, Size: 10, Digests: map[string]string{"sha256": "abc"}}
+	assert.Ok(t, store.Put(m))
+	assert.Equals(t, m.ETag, getEntry(t, store, m.URL).ETag)
+	assert.Equals(t, m.Digests, getEntry(t, store, m.URL).Digests)
+	assert.Cond(t, getEntry(t, store, "https://example.com/b/file") == nil, "URLs with the same file name should not collide")
+}
+
+func TestEtagSameFileName(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Both files have the same name, size and ETag, but different content.
+		w.Header().Set("ETag", `"same"`)
+		content := strings.Repeat(strings.TrimPrefix(r.URL.Path[:2], "/"), 1024)
+		http.ServeContent(w, r, "file", time.Time{}, strings.NewReader(content))
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "etag-same-name")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	storeDir, err := ioutil.TempDir(os.TempDir(), "etag-same-name-work")
+	assert.Ok(t, err)
+	defer os.RemoveAll(storeDir)
+
+	gf := New(WithDestDir(destDir), WithETag())
+	gf.store = &diskCache{dir: storeDir}
+
+	for _, path := range []string{"/a/file", "/b/file"} {
+		f, err := gf.Fetch(ts.URL+path, nil)
+		assert.Ok(t, err)
+		data, err := ioutil.ReadAll(f)
+		assert.Ok(t, err)
+		f.Close()
+		assert.Equals(t, path[1:2], string(data[:1]))
+	}
+}
+
+func TestEtagConditionalGet(t *testing.T) {
+	var conditions []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conditions = append(conditions, r.Method+" "+r.Header.Get("If-None-Match"))
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeFile(w, r, "./fixtures/test")
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "etag-conditional-get")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	storeDir, err := ioutil.TempDir(os.TempDir(), "etag-conditional-get-work")
+	assert.Ok(t, err)
+	defer os.RemoveAll(storeDir)
+
+	gf := New(WithDestDir(destDir), WithETag(), WithoutHEAD())
+	gf.store = &diskCache{dir: storeDir}
+
+	f, err := gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	f.Close()
+
+	conditions = nil
+	f, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	f.Close()
+	assert.Equals(t, []string{`GET "v1"`}, conditions)
+}
+
+func TestETagMatch(t *testing.T) {
+	meta := &CacheEntry{ETag: `W/"v1"`, LastModified: "Wed, 21 Oct 2015 07:28:00 GMT", Size: 10}
+	rsc := func(etag string, size int64) *resource {
+		return &resource{size: size, header: http.Header{"Etag": {etag}, "Last-Modified": {meta.LastModified}}}
+	}
+
+	assert.Cond(t, !ETagStrong.same(meta, rsc(`W/"v1"`, 10)), "Weak ETags should not match strongly")
+	assert.Cond(t, ETagWeak.same(meta, rsc(`W/"v1"`, 10)), "Weak ETags should match weakly")
+	assert.Cond(t, ETagWeak.same(meta, rsc(`"v1"`, 10)), "Weak comparison should ignore the weak indicator")
+	assert.Cond(t, !ETagWeak.same(meta, rsc(`"mirror"`, 10)), "Different ETags should not match")
+	assert.Cond(t, ETagMirrors.same(meta, rsc(`"mirror"`, 10)), "Same size and Last-Modified should match in mirrors mode")
+	assert.Cond(t, !ETagMirrors.same(meta, rsc(`"mirror"`, 11)), "Different sizes should not match in mirrors mode")
+
+	meta.ETag = `"v1"`
+	assert.Cond(t, ETagStrong.same(meta, rsc(`"v1"`, 10)), "Strong ETags should match")
+}
+
+func TestETagMirrors(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Every mirror returns a different ETag for the same file.
+		requests++
+		w.Header().Set("ETag", fmt.Sprintf(`"mirror-%d"`, requests))
+		http.ServeContent(w, r, "file", time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC), strings.NewReader("content"))
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "etag-mirrors")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	storeDir, err := ioutil.TempDir(os.TempDir(), "etag-mirrors-work")
+	assert.Ok(t, err)
+	defer os.RemoveAll(storeDir)
+
+	gf := New(WithDestDir(destDir), WithETag(), WithETagMatching(ETagMirrors))
+	gf.store = &diskCache{dir: storeDir}
+
+	f, err := gf.Fetch(ts.URL+"/file", nil)
+	assert.Ok(t, err)
+	f.Close()
+
+	// Only the preflight request is sent.
+	requests = 0
+	f, err = gf.Fetch(ts.URL+"/file", nil)
+	assert.Ok(t, err)
+	f.Close()
+	assert.Equals(t, 1, requests)
+}
+
+func TestCacheLimits(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "cache-limits")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	store := &diskCache{dir: dir, limits: CacheLimits{MaxEntries: 2}}
+	for i, url := range []string{"https://example.com/a", "https://example.com/b", "https://example.com/c"} {
+		assert.Ok(t, store.Put(&CacheEntry{URL: url}))
+		// Makes sure entries are used at different times.
+		used := time.Now().Add(time.Duration(i-10) * time.Second)
+		assert.Ok(t, os.Chtimes(store.path(url), used, used))
+		if i == 1 {
+			now := time.Now()
+			assert.Ok(t, os.Chtimes(store.path("https://example.com/a"), now, now))
+		}
+	}
+
+	// The least recently used entry is evicted.
+	assert.Cond(t, getEntry(t, store, "https://example.com/a") != nil, "Recently used entry should not be evicted")
+	assert.Cond(t, getEntry(t, store, "https://example.com/b") == nil, "Least recently used entry should be evicted")
+	assert.Cond(t, getEntry(t, store, "https://example.com/c") != nil, "Last entry should not be evicted")
+
+	usage, err := store.Usage()
+	assert.Ok(t, err)
+	assert.Equals(t, 2, usage.Entries)
+	assert.Cond(t, usage.Bytes > 0, "Cache should take some space")
+
+	// Entries not used for a while expire.
+	old := time.Now().Add(-2 * time.Hour)
+	assert.Ok(t, os.Chtimes(store.path("https://example.com/a"), old, old))
+	assert.Ok(t, store.evict(CacheLimits{TTL: time.Hour}))
+	assert.Cond(t, getEntry(t, store, "https://example.com/a") == nil, "Expired entry should be evicted")
+
+	// The size of the cache is bounded too.
+	assert.Ok(t, store.evict(CacheLimits{MaxBytes: 1}))
+	usage, err = store.Usage()
+	assert.Ok(t, err)
+	assert.Equals(t, CacheUsage{}, usage)
+
+	// Reading an entry marks it as used.
+	assert.Ok(t, store.Put(&CacheEntry{URL: "https://example.com/d"}))
+	assert.Ok(t, os.Chtimes(store.path("https://example.com/d"), old, old))
+	getEntry(t, store, "https://example.com/d")
+	assert.Ok(t, store.evict(CacheLimits{TTL: time.Hour}))
+	assert.Cond(t, getEntry(t, store, "https://example.com/d") != nil, "Recently read entry should not be evicted")
+
+	// The content stored for a URL is part of its entry, and is evicted along with it.
+	src := filepath.Join(dir, "src")
+	assert.Ok(t, ioutil.WriteFile(src, []byte("data"), 0640))
+	digests := map[string]string{"sha256": "3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7", "md5": "8d777f385d3dfec8815d20f7496026dc"}
+	assert.Ok(t, store.Store(src, digests))
+	assert.Ok(t, os.Remove(src))
+	assert.Ok(t, store.Put(&CacheEntry{URL: "https://example.com/e", Digests: digests}))
+	assert.Ok(t, store.evict(CacheLimits{MaxEntries: 1}))
+	assert.Cond(t, getEntry(t, store, "https://example.com/d") == nil, "Least recently used entry should be evicted")
+	usage, err = store.Usage()
+	assert.Ok(t, err)
+	assert.Equals(t, 1, usage.Entries)
+
+	assert.Ok(t, store.evict(CacheLimits{MaxBytes: 1}))
+	usage, err = store.Usage()
+	assert.Ok(t, err)
+	assert.Equals(t, CacheUsage{}, usage)
+	ok, err := store.Stat("md5", digests["md5"])
+	assert.Ok(t, err)
+	assert.Cond(t, !ok, "Stored content should be evicted")
+
+	// Limits apply whatever the order of the options.
+	limits := CacheLimits{MaxEntries: 10}
+	for _, opts := range [][]Option{
+		{WithCacheLimits(limits), WithCacheBackend(NewDiskCache(dir))},
+		{WithCacheBackend(NewDiskCache(dir)), WithCacheLimits(limits)},
+	} {
+		gf := New(opts...)
+		assert.Equals(t, limits, gf.store.(*diskCache).limits)
+	}
+}
+
+// getEntry returns the metadata of the given URL in the cache, failing the test on errors.
+func getEntry(t *testing.T, c Cache, url string) *CacheEntry {
+	e, err := c.Get(url)
+	assert.Ok(t, err)
+	return e
+}
@@ -0,0 +1,192 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Metalink describes files along with the mirrors they can be downloaded from and their
+// hashes, as published in Metalink (RFC 5854) .meta4 files or Metalink 3 .metalink files.
+type Metalink struct {
+	Files []MetalinkFile
+}
+
+// MetalinkFile is a file described by a Metalink.
+type MetalinkFile struct {
+	Name string
+	// Size is the size of the file in bytes, or -1 if unknown.
+	Size int64
+	// Hashes are the hex encoded hashes of the file, keyed by hashing algorithm, like "sha256".
+	// Only the algorithms supported by gofetch are kept.
+	Hashes map[string]string
+	// URLs are the mirrors of the file, sorted by priority.
+	URLs []MetalinkURL
+}
+
+// MetalinkURL is a mirror of a file described by a Metalink.
+type MetalinkURL struct {
+	URL string
+	// Location is the ISO 3166-1 alpha-2 code of the country the mirror is in, if known.
+	Location string
+	// Priority is the priority of the mirror, the lower the more preferred.
+	Priority int
+}
+
+// lowestPriority is the priority of mirrors given none, the lowest allowed by RFC 5854.
+const lowestPriority = 999999
+
+type metalinkXML struct {
+	Files   []metalinkFileXML `xml:"file"`
+	FilesV3 []metalinkFileXML `xml:"files>file"`
+}
+
+type metalinkFileXML struct {
+	Name     string            `xml:"name,attr"`
+	Size     string            `xml:"size"`
+	Hashes   []metalinkHashXML `xml:"hash"`
+	HashesV3 []metalinkHashXML `xml:"verification>hash"`
+	URLs     []metalinkURLXML  `xml:"url"`
+	URLsV3   []metalinkURLXML  `xml:"resources>url"`
+}
+
+type metalinkHashXML struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type metalinkURLXML struct {
+	Location string `xml:"location,attr"`
+	// Priority is set by RFC 5854, preference by Metalink 3, which prefers higher ones.
+	Priority   int    `xml:"priority,attr"`
+	Preference int    `xml:"preference,attr"`
+	Value      string `xml:",chardata"`
+}
+
+// ParseMetalink parses a Metalink, in either the format of RFC 5854 or Metalink 3.
+func ParseMetalink(r io.Reader) (*Metalink, error) {
+	var doc metalinkXML
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, errors.Wrap(err, "failed parsing metalink")
+	}
+
+	m := &Metalink{}
+	for _, f := range append(doc.Files, doc.FilesV3...) {
+		file := MetalinkFile{Name: strings.TrimSpace(f.Name), Size: -1}
+		if file.Name == "" {
+			return nil, errors.New("invalid metalink, file without name")
+		}
+		if size := strings.TrimSpace(f.Size); size != "" {
+			var err error
+			if file.Size, err = strconv.ParseInt(size, 10, 64); err != nil || file.Size < 0 {
+				return nil, fmt.Errorf("invalid metalink, size of %s is %q", file.Name, size)
+			}
+		}
+
+		for _, h := range append(f.Hashes, f.HashesV3...) {
+			// RFC 5854 names algorithms like "sha-256", Metalink 3 like "sha256".
+			alg := strings.Replace(strings.ToLower(strings.TrimSpace(h.Type)), "-", "", -1)
+			if _, err := newHasher(alg); err != nil {
+				continue
+			}
+			if file.Hashes == nil {
+				file.Hashes = make(map[string]string)
+			}
+			file.Hashes[alg] = strings.ToLower(strings.TrimSpace(h.Value))
+		}
+
+		for _, u := range append(f.URLs, f.URLsV3...) {
+			mirror := MetalinkURL{URL: strings.TrimSpace(u.Value), Location: u.Location, Priority: u.Priority}
+			if u.Preference > 0 {
+				mirror.Priority = 101 - u.Preference
+			}
+			if mirror.Priority <= 0 {
+				mirror.Priority = lowestPriority
+			}
+			file.URLs = append(file.URLs, mirror)
+		}
+		sort.SliceStable(file.URLs, func(i, j int) bool {
+			return file.URLs[i].Priority < file.URLs[j].Priority
+		})
+		m.Files = append(m.Files, file)
+	}
+
+	if len(m.Files) == 0 {
+		return nil, errors.New("invalid metalink, no files described")
+	}
+	return m, nil
+}
+
+// metalinkHashes are the hashing algorithms of Metalinks, strongest first.
+var metalinkHashes = []string{"sha512", "sha256", "sha1", "md5"}
+
+// FetchMetalink downloads the files described by the Metalink at the given location, a local
+// path or a URL, into the destination directory, under their base names. Each file is fetched
+// from its mirrors in order of priority, moving on to the next mirror if one fails, resuming
+// what was downloaded from the previous ones, and is verified against its size and the
+// strongest of its hashes. Progress of all the files is reported through progressCh, which is
+// closed once done.
+func (gf *Fetcher) FetchMetalink(ctx context.Context, location string, progressCh chan<- ProgressReport) ([]*Result, error) {
+	if progressCh != nil {
+		defer close(progressCh)
+	}
+
+	data, err := gf.readLocation(ctx, location)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed reading metalink %s", location)
+	}
+	m, err := ParseMetalink(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*Result
+	for _, file := range m.Files {
+		result, err := gf.fetchMetalinkFile(ctx, file, progressCh)
+		if err != nil {
+			for _, r := range results {
+				r.File.Close()
+			}
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// fetchMetalinkFile downloads a file described by a Metalink from the first of its mirrors
+// able to serve it.
+func (gf *Fetcher) fetchMetalinkFile(ctx context.Context, file MetalinkFile, progressCh chan<- ProgressReport) (*Result, error) {
+	name := path.Base(strings.Replace(file.Name, "\\", "/", -1))
+	if name == "." || name == "/" || name == ".." {
+		return nil, fmt.Errorf("invalid metalink, file name %q", file.Name)
+	}
+
+	t := &target{name: name, size: file.Size}
+	for _, alg := range metalinkHashes {
+		if value, ok := file.Hashes[alg]; ok {
+			t.checksums = []checksum{{algorithm: alg, value: value}}
+			break
+		}
+	}
+
+	if len(file.URLs) == 0 {
+		return nil, fmt.Errorf("no mirrors of %s", file.Name)
+	}
+	for _, mirror := range file.URLs {
+		t.mirrors = append(t.mirrors, mirror.URL)
+	}
+	return gf.fetchMirrors(ctx, t.mirrors, progressCh, t)
+}
@@ -0,0 +1,156 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestParseMetalink(t *testing.T) {
+	meta4 := `<?xml version="1.0" encoding="UTF-8"?>
+<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+  <file name="example.iso">
+    <size>14471447</size>
+    <hash type="sha-256">F0AD929CD259957E160EA442EB80986B5F01</hash>
+    <hash type="sha-384">unsupported</hash>
+    <url location="de">ftp://ftp.example.com/example.iso</url>
+    <url location="us" priority="2">http://example.com/example.iso</url>
+    <url priority="1">https://example.org/example.iso</url>
+  </file>
+</metalink>`
+
+	m, err := ParseMetalink(strings.NewReader(meta4))
+	assert.Ok(t, err)
+	assert.Equals(t, []MetalinkFile{{
+		Name:   "example.iso",
+		Size:   14471447,
+		Hashes: map[string]string{"sha256": "f0ad929cd259957e160ea442eb80986b5f01"},
+		URLs: []MetalinkURL{
+			{URL: "https://example.org/example.iso", Priority: 1},
+			{URL: "http://example.com/example.iso", Location: "us", Priority: 2},
+			{URL: "ftp://ftp.example.com/example.iso", Location: "de", Priority: lowestPriority},
+		},
+	}}, m.Files)
+
+	metalink3 := `<?xml version="1.0" encoding="UTF-8"?>
+<metalink version="3.0" xmlns="http://www.metalinker.org/">
+  <files>
+    <file name="example.iso">
+      <verification>
+        <hash type="md5">a7e2b9b5d8f2b3bd2b2ab5b4f7c2ab26</hash>
+        <hash type="sha1">2b2ab5b4f7c2ab26a7e2b9b5d8f2b3bd2b2ab5b4</hash>
+      </verification>
+      <resources>
+        <url type="http" preference="90">http://example.com/example.iso</url>
+        <url type="http" location="se" preference="100">http://example.se/example.iso</url>
+      </resources>
+    </file>
+  </files>
+</metalink>`
+
+	m, err = ParseMetalink(strings.NewReader(metalink3))
+	assert.Ok(t, err)
+	assert.Equals(t, []MetalinkFile{{
+		Name: "example.iso",
+		Size: -1,
+		Hashes: map[string]string{
+			"md5":  "a7e2b9b5d8f2b3bd2b2ab5b4f7c2ab26",
+			"sha1": "2b2ab5b4f7c2ab26a7e2b9b5d8f2b3bd2b2ab5b4",
+		},
+		URLs: []MetalinkURL{
+			{URL: "http://example.se/example.iso", Location: "se", Priority: 1},
+			{URL: "http://example.com/example.iso", Priority: 11},
+		},
+	}}, m.Files)
+
+	_, err = ParseMetalink(strings.NewReader(`<metalink xmlns="urn:ietf:params:xml:ns:metalink"></metalink>`))
+	assert.Cond(t, err != nil, "metalinks without files should be rejected")
+}
+
+func TestFetchMetalink(t *testing.T) {
+	destDir, err := ioutil.TempDir(os.TempDir(), "metalink")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64<<10)
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	var brokenRequests, corruptRequests int32
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&brokenRequests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+	corrupt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&corruptRequests, 1)
+		http.ServeContent(w, r, "", modTime, bytes.NewReader(bytes.ToUpper(data)))
+	}))
+	defer corrupt.Close()
+	truncated := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", modTime, bytes.NewReader(data[:100]))
+	}))
+	defer truncated.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", modTime, bytes.NewReader(data))
+	}))
+	defer good.Close()
+
+	meta4 := fmt.Sprintf(`<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+  <file name="release/image.img">
+    <size>%d</size>
+    <hash type="sha-256">%x</hash>
+    <url priority="1">%s/image-mirror-1.img</url>
+    <url priority="2">%s/image-mirror-2.img</url>
+    <url priority="3">%s/image-mirror-3.img</url>
+    <url priority="4">%s/image-mirror-4.img</url>
+  </file>
+</metalink>`, len(data), sha256.Sum256(data), broken.URL, corrupt.URL, truncated.URL, good.URL)
+	location := filepath.Join(destDir, "image.meta4")
+	assert.Ok(t, ioutil.WriteFile(location, []byte(meta4), 0640))
+
+	gf := New(WithDestDir(destDir), WithConcurrency(4))
+	progressCh := make(chan ProgressReport)
+	var results []*Result
+	done := make(chan error)
+	go func() {
+		var err error
+		results, err = gf.FetchMetalink(context.Background(), location, progressCh)
+		done <- err
+	}()
+
+	var total int64
+	for p := range progressCh {
+		total += p.WrittenBytes
+	}
+	assert.Ok(t, <-done)
+	assert.Equals(t, 1, len(results))
+	defer results[0].File.Close()
+
+	assert.Equals(t, good.URL+"/image-mirror-4.img", results[0].URL)
+	assert.Equals(t, filepath.Join(destDir, "image.img"), results[0].File.Name())
+	got, err := ioutil.ReadAll(results[0].File)
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(data, got), "downloaded file does not match")
+	assert.Equals(t, int64(len(data)), total)
+	assert.Cond(t, atomic.LoadInt32(&brokenRequests) > 0 && atomic.LoadInt32(&corruptRequests) > 0, "mirrors should be tried in order of priority")
+
+	// Nothing of the failed mirrors is left behind.
+	_, err = os.Stat(filepath.Join(destDir, "image.img.chunks"))
+	assert.Cond(t, os.IsNotExist(err), "chunks should be removed")
+}
@@ -0,0 +1,228 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// mirrorProbeSize is the number of bytes downloaded from mirrors to measure their speed.
+	mirrorProbeSize = 64 << 10
+	// mirrorProbeTimeout is the maximum amount of time waiting for mirrors to be probed.
+	mirrorProbeTimeout = 10 * time.Second
+)
+
+// MirrorProbe is the outcome of probing a mirror.
+type MirrorProbe struct {
+	URL string
+	// Latency is the time it took the mirror to start sending the content.
+	Latency time.Duration
+	// BytesPerSecond is the speed the first bytes of the content were downloaded at,
+	// including the latency.
+	BytesPerSecond float64
+	// Err is the reason the mirror could not be probed, if it failed.
+	Err error
+}
+
+// FetchFromMirrors downloads content served identically by all the given URLs, trying them in
+// order, or from the fastest to the slowest with WithFastestMirrors. The download moves on to the
+// next URL when one fails, like when its preflight request fails, its chunks keep failing once
+// retried or, if WithMinSpeed is set, it is too slow, resuming what was downloaded from the
+// previous ones. The content is saved under the name of the first URL. Progress is reported
+// through progressCh, which is closed once done.
+func (gf *Fetcher) FetchFromMirrors(ctx context.Context, urls []string, progressCh chan<- ProgressReport) (*Result, error) {
+	if progressCh != nil {
+		defer close(progressCh)
+	}
+	if len(urls) == 0 {
+		return nil, errors.New("at least one URL is required")
+	}
+
+	t := &target{name: destFileName(urls[0]), size: -1, mirrors: urls}
+	return gf.fetchMirrors(ctx, urls, progressCh, t)
+}
+
+// fetchMirrors downloads the given target from the first of the given URLs able to serve it,
+// reporting progress through progressCh, which is left open.
+func (gf *Fetcher) fetchMirrors(ctx context.Context, urls []string, progressCh chan<- ProgressReport, t *target) (*Result, error) {
+	if gf.probeMirrors && len(urls) > 1 {
+		urls = gf.rankMirrors(ctx, urls)
+	}
+
+	var reported managedProgress
+	var lastErr error
+	for i, url := range urls {
+		if gf.mirrorChunks {
+			// Mirrors that failed already are not worth downloading chunks from.
+			t.sources = urls[i+1:]
+		}
+
+		var result *Result
+		var err error
+		reported.attempt(progressCh, func(ch chan<- ProgressReport) {
+			result, err = gf.fetchTarget(ctx, url, ch, t)
+		})
+		if err == nil {
+			return result, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		// What was downloaded from this URL is resumed from the next one.
+		reported.retried = true
+		lastErr = errors.Wrapf(err, "failed downloading from %s", url)
+	}
+	return nil, lastErr
+}
+
+// ProbeMirrors downloads the first bytes of the content served by the given mirrors, from all
+// of them at once, to measure how fast they are. Probes are sorted from the fastest mirror to
+// the slowest one, followed by the mirrors that failed, in the order given.
+func (gf *Fetcher) ProbeMirrors(ctx context.Context, urls []string) []MirrorProbe {
+	ctx, cancel := context.WithTimeout(ctx, mirrorProbeTimeout)
+	defer cancel()
+
+	probes := make([]MirrorProbe, len(urls))
+	var wg sync.WaitGroup
+	for i, url := range urls {
+		probes[i].URL = url
+		wg.Add(1)
+		go func(p *MirrorProbe) {
+			defer wg.Done()
+			p.Latency, p.BytesPerSecond, p.Err = gf.probeMirror(ctx, p.URL)
+		}(&probes[i])
+	}
+	wg.Wait()
+
+	sort.SliceStable(probes, func(i, j int) bool {
+		if (probes[i].Err == nil) != (probes[j].Err == nil) {
+			return probes[i].Err == nil
+		}
+		return probes[i].BytesPerSecond > probes[j].BytesPerSecond
+	})
+	return probes
+}
+
+// rankMirrors sorts the given mirrors from the fastest to the slowest, keeping as many as set
+// through WithFastestMirrors.
+func (gf *Fetcher) rankMirrors(ctx context.Context, urls []string) []string {
+	var ranked []string
+	for _, p := range gf.ProbeMirrors(ctx, urls) {
+		ranked = append(ranked, p.URL)
+	}
+	if gf.fastestMirrors > 0 && gf.fastestMirrors < len(ranked) {
+		ranked = ranked[:gf.fastestMirrors]
+	}
+	return ranked
+}
+
+// probeMirror downloads the first bytes of the content of the given mirror, returning its
+// latency and the speed they were downloaded at.
+func (gf *Fetcher) probeMirror(ctx context.Context, url string) (time.Duration, float64, error) {
+	start := time.Now()
+	r, err := gf.openProbe(ctx, url)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer r.Close()
+	latency := time.Since(start)
+
+	n, err := io.Copy(ioutil.Discard, io.LimitReader(r, mirrorProbeSize))
+	if err != nil {
+		return latency, 0, err
+	}
+	return latency, float64(n) / time.Since(start).Seconds(), nil
+}
+
+// openProbe opens the content of the given mirror for reading its first bytes.
+func (gf *Fetcher) openProbe(ctx context.Context, url string) (io.ReadCloser, error) {
+	// The standard input can only be read once.
+	if url == stdinURL {
+		return nil, errors.New("the standard input cannot be probed")
+	}
+
+	handler, err := schemeHandler(url)
+	if err != nil {
+		return nil, err
+	}
+	if handler != nil {
+		return handler.Open(gf.handlerContext(ctx), url, 0, mirrorProbeSize)
+	}
+
+	if gf.offline {
+		return nil, &NotCachedError{URL: url}
+	}
+
+	req, err := gf.newRequest(ctx, "GET", url)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", mirrorProbeSize-1))
+
+	res, err := gf.do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent {
+		res.Body.Close()
+		return nil, &statusError{code: res.StatusCode, status: res.Status}
+	}
+	return res.Body, nil
+}
+
+// chunkMirrors returns the sources of the given target serving content of the same size as the
+// given resource, and supporting byte ranges, for chunks to be downloaded from them too.
+func (gf *Fetcher) chunkMirrors(ctx context.Context, rsc *resource, t *target) []mirror {
+	if t == nil || len(t.sources) == 0 || rsc.size < 0 || !rsc.ranges || rsc.encoding != "" {
+		return nil
+	}
+
+	found := make([]*mirror, len(t.sources))
+	var wg sync.WaitGroup
+	for i, url := range t.sources {
+		// The standard input can only be read once.
+		if url == stdinURL {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, url string) {
+			defer wg.Done()
+			handler, err := schemeHandler(url)
+			if err != nil {
+				return
+			}
+
+			var m *resource
+			if handler != nil {
+				m, err = handlerResource(ctx, handler, url)
+			} else {
+				m, err = gf.preflight(ctx, url, nil)
+			}
+			if err != nil || m.size != rsc.size || !m.ranges || m.encoding != "" {
+				return
+			}
+			found[i] = &mirror{url: m.url, handler: handler, ranges: true, ifRange: m.validator()}
+		}(i, url)
+	}
+	wg.Wait()
+
+	var mirrors []mirror
+	for _, m := range found {
+		if m != nil {
+			mirrors = append(mirrors, *m)
+		}
+	}
+	return mirrors
+}
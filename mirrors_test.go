@@ -0,0 +1,244 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestFetchFromMirrors(t *testing.T) {
+	destDir, err := ioutil.TempDir(os.TempDir(), "mirrors")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64<<10)
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+	// Serves the first half of the content, failing the chunks of the second half.
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if start := rangeStart(r); start >= int64(len(data)/2) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeContent(w, r, "", modTime, bytes.NewReader(data))
+	}))
+	defer flaky.Close()
+	var served int64
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(countingWriter{w, &served}, r, "", modTime, bytes.NewReader(data))
+	}))
+	defer good.Close()
+
+	urls := []string{missing.URL + "/image.img", flaky.URL + "/image.img", good.URL + "/image.img"}
+	gf := New(WithDestDir(destDir), WithConcurrency(4))
+	progressCh := make(chan ProgressReport)
+	var result *Result
+	done := make(chan error)
+	go func() {
+		var err error
+		result, err = gf.FetchFromMirrors(context.Background(), urls, progressCh)
+		done <- err
+	}()
+
+	var total int64
+	for p := range progressCh {
+		total += p.WrittenBytes
+	}
+	assert.Ok(t, <-done)
+	defer result.File.Close()
+
+	assert.Equals(t, urls[2], result.URL)
+	assert.Equals(t, filepath.Join(destDir, "image.img"), result.File.Name())
+	got, err := ioutil.ReadAll(result.File)
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(data, got), "downloaded file does not match")
+	assert.Equals(t, int64(len(data)), total)
+	assert.Cond(t, served <= int64(len(data)/2), "what was downloaded from the flaky mirror should be resumed, got %d bytes from the last one", served)
+
+	_, err = gf.FetchFromMirrors(context.Background(), nil, nil)
+	assert.Cond(t, err != nil, "mirrors should be required")
+
+	_, err = New(WithDestDir(filepath.Join(destDir, "missing"))).FetchFromMirrors(context.Background(), urls[:1], nil)
+	assert.Cond(t, err != nil && strings.Contains(err.Error(), urls[0]), "the failing mirror should be reported, got %v", err)
+}
+
+func TestFetchFromMirrorsTooSlow(t *testing.T) {
+	destDir, err := ioutil.TempDir(os.TempDir(), "mirrors-slow")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4<<10)
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	// Sends headers, then stalls until the client gives up.
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			http.ServeContent(w, r, "", modTime, bytes.NewReader(data))
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer slow.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", modTime, bytes.NewReader(data))
+	}))
+	defer good.Close()
+
+	gf := New(WithDestDir(destDir), WithMinSpeed(1<<20, 300*time.Millisecond))
+	result, err := gf.FetchFromMirrors(context.Background(), []string{slow.URL + "/file", good.URL + "/file"}, nil)
+	assert.Ok(t, err)
+	defer result.File.Close()
+
+	assert.Equals(t, good.URL+"/file", result.URL)
+	got, err := ioutil.ReadAll(result.File)
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(data, got), "downloaded file does not match")
+}
+
+// countingWriter counts the bytes of the bodies of the responses it writes.
+type countingWriter struct {
+	http.ResponseWriter
+	n *int64
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	atomic.AddInt64(w.n, int64(len(p)))
+	return w.ResponseWriter.Write(p)
+}
+
+// rangeStart returns the first byte requested by the Range header of the given request.
+func rangeStart(r *http.Request) int64 {
+	spec := strings.TrimPrefix(r.Header.Get("Range"), "bytes=")
+	start, _ := strconv.ParseInt(strings.SplitN(spec, "-", 2)[0], 10, 64)
+	return start
+}
+
+func TestProbeMirrors(t *testing.T) {
+	destDir, err := ioutil.TempDir(os.TempDir(), "mirrors-probe")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 16<<10)
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	var slowRequests int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&slowRequests, 1)
+		time.Sleep(300 * time.Millisecond)
+		http.ServeContent(w, r, "", modTime, bytes.NewReader(data))
+	}))
+	defer slow.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+	var probeRange string
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if probeRange == "" {
+			probeRange = r.Header.Get("Range")
+		}
+		http.ServeContent(w, r, "", modTime, bytes.NewReader(data))
+	}))
+	defer fast.Close()
+
+	urls := []string{broken.URL + "/file", slow.URL + "/file", fast.URL + "/file"}
+	probes := New().ProbeMirrors(context.Background(), urls)
+	assert.Equals(t, 3, len(probes))
+	assert.Equals(t, urls[2], probes[0].URL)
+	assert.Equals(t, urls[1], probes[1].URL)
+	assert.Equals(t, urls[0], probes[2].URL)
+	assert.Cond(t, probes[0].Err == nil && probes[1].Err == nil && probes[2].Err != nil, "only the broken mirror should fail")
+	assert.Cond(t, probes[1].Latency >= 300*time.Millisecond, "latency of the slow mirror should be measured")
+	assert.Cond(t, probes[0].BytesPerSecond > probes[1].BytesPerSecond, "the fast mirror should be faster")
+	assert.Equals(t, "bytes=0-65535", probeRange)
+
+	// Only the fastest mirror is downloaded from.
+	gf := New(WithDestDir(destDir), WithConcurrency(4), WithFastestMirrors(1))
+	result, err := gf.FetchFromMirrors(context.Background(), urls[1:], nil)
+	assert.Ok(t, err)
+	defer result.File.Close()
+
+	assert.Equals(t, urls[2], result.URL)
+	assert.Equals(t, int32(2), atomic.LoadInt32(&slowRequests))
+	got, err := ioutil.ReadAll(result.File)
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(data, got), "downloaded file does not match")
+}
+
+func TestMirrorChunks(t *testing.T) {
+	destDir, err := ioutil.TempDir(os.TempDir(), "mirrors-chunks")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64<<10)
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	served := make([]int64, 2)
+	var servers []*httptest.Server
+	for i := range served {
+		n := &served[i]
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.ServeContent(countingWriter{w, n}, r, "", modTime, bytes.NewReader(data))
+		}))
+		defer s.Close()
+		servers = append(servers, s)
+	}
+	var otherRequests int32
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			atomic.AddInt32(&otherRequests, 1)
+		}
+		http.ServeContent(w, r, "", modTime, bytes.NewReader(data[:1000]))
+	}))
+	defer other.Close()
+	// Answers preflight requests, failing to send chunks.
+	var brokenRequests int32
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			atomic.AddInt32(&brokenRequests, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeContent(w, r, "", modTime, bytes.NewReader(data))
+	}))
+	defer broken.Close()
+
+	urls := []string{servers[0].URL + "/file", other.URL + "/file", broken.URL + "/file", servers[1].URL + "/file"}
+	gf := New(WithDestDir(destDir), WithConcurrency(8), WithMirrorChunks(), WithRetries(3, time.Millisecond))
+	result, err := gf.FetchFromMirrors(context.Background(), urls, nil)
+	assert.Ok(t, err)
+	defer result.File.Close()
+
+	assert.Equals(t, urls[0], result.URL)
+	got, err := ioutil.ReadAll(result.File)
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(data, got), "downloaded file does not match")
+
+	assert.Cond(t, served[0] > 0 && served[1] > 0, "chunks should be downloaded from both mirrors, got %v bytes", served)
+	assert.Equals(t, int64(len(data)), served[0]+served[1])
+	assert.Equals(t, int32(0), atomic.LoadInt32(&otherRequests))
+	assert.Cond(t, atomic.LoadInt32(&brokenRequests) > 0, "chunks failing on a mirror should be retried on the next one")
+}
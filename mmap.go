@@ -0,0 +1,61 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// errMmapUnsupported is returned when mapping files to memory is not supported by the platform.
+var errMmapUnsupported = errors.New("memory-mapped files are not supported on this platform")
+
+// dataFile is the file chunks are written to.
+type dataFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Truncate(size int64) error
+}
+
+// mappedFile is a file mapped to memory, so chunks are written to it by copying them
+// instead of through a system call for each write.
+type mappedFile struct {
+	*os.File
+	data []byte
+}
+
+func (m *mappedFile) WriteAt(b []byte, off int64) (int, error) {
+	if off < 0 || off > int64(len(m.data)) {
+		return 0, errors.Errorf("offset %d out of the mapped file", off)
+	}
+	n := copy(m.data[off:], b)
+	if n < len(b) {
+		return n, io.ErrShortWrite
+	}
+	return n, nil
+}
+
+func (m *mappedFile) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 || off > int64(len(m.data)) {
+		return 0, errors.Errorf("offset %d out of the mapped file", off)
+	}
+	n := copy(b, m.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// close unmaps the file, leaving it open. It is safe to call more than once.
+func (m *mappedFile) close() error {
+	if m.data == nil {
+		return nil
+	}
+	err := unmap(m.data)
+	m.data = nil
+	return err
+}
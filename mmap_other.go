@@ -0,0 +1,19 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !((darwin || dragonfly || freebsd || linux || netbsd || openbsd) && (amd64 || arm64 || loong64 || mips64 || mips64le || ppc64 || ppc64le || riscv64 || s390x))
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd !amd64,!arm64,!loong64,!mips64,!mips64le,!ppc64,!ppc64le,!riscv64,!s390x
+
+package gofetch
+
+import "os"
+
+// mapFile is not supported on this platform, files are written through regular system calls.
+func mapFile(f *os.File, size int64) (*mappedFile, error) {
+	return nil, errMmapUnsupported
+}
+
+func unmap(data []byte) error {
+	return errMmapUnsupported
+}
@@ -0,0 +1,64 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestMapFile(t *testing.T) {
+	file, err := ioutil.TempFile(os.TempDir(), "mapped")
+	assert.Ok(t, err)
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	assert.Ok(t, file.Truncate(8))
+	m, err := mapFile(file, 8)
+	if err == errMmapUnsupported {
+		t.Skip(err)
+	}
+	assert.Ok(t, err)
+
+	n, err := m.WriteAt([]byte("mapped"), 2)
+	assert.Ok(t, err)
+	assert.Equals(t, 6, n)
+
+	_, err = m.WriteAt([]byte("too long"), 4)
+	assert.Equals(t, io.ErrShortWrite, err)
+	assert.Ok(t, m.close())
+	assert.Ok(t, m.close())
+
+	data, err := ioutil.ReadFile(file.Name())
+	assert.Ok(t, err)
+	assert.Equals(t, "\x00\x00matoo ", string(data))
+}
+
+func TestWithMemoryMappedWrites(t *testing.T) {
+	ts := httptest.NewServer(http.FileServer(http.Dir("./fixtures")))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "mmap-writes")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	gf := New(WithDestDir(destDir), WithConcurrency(8), WithMemoryMappedWrites())
+	f, err := gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+	defer f.Close()
+
+	h := sha512.New()
+	_, err = io.Copy(h, f)
+	assert.Ok(t, err)
+	assert.Equals(t, "4ff6e159db38d46a665f26e9f82b98134238c0457cc82727a5258b7184773e4967068cc0eecf3928ecd079f3aea6e22aac024847c6d76c0329c4635c4b6ae327", hex.EncodeToString(h.Sum(nil)))
+}
@@ -0,0 +1,27 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build (darwin || dragonfly || freebsd || linux || netbsd || openbsd) && (amd64 || arm64 || loong64 || mips64 || mips64le || ppc64 || ppc64le || riscv64 || s390x)
+// +build darwin dragonfly freebsd linux netbsd openbsd
+// +build amd64 arm64 loong64 mips64 mips64le ppc64 ppc64le riscv64 s390x
+
+package gofetch
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps the first size bytes of the file to memory. The file must be at least that large.
+func mapFile(f *os.File, size int64) (*mappedFile, error) {
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	return &mappedFile{File: f, data: data}, nil
+}
+
+func unmap(data []byte) error {
+	return syscall.Munmap(data)
+}
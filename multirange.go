@@ -0,0 +1,206 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// batchChunks groups the chunks left to download in batches of up to n consecutive chunks, to
+// be downloaded through a single request. Chunks of content of unknown size are not grouped.
+func batchChunks(chunks []*chunk, n int) [][]*chunk {
+	var batches [][]*chunk
+	var batch []*chunk
+	for _, c := range chunks {
+		if n <= 1 || c.end() < 0 {
+			batches = append(batches, []*chunk{c})
+			continue
+		}
+		// Chunks already downloaded are still handed out, to be verified and reported.
+		batch = append(batch, c)
+		if len(batch) == n {
+			batches = append(batches, batch)
+			batch = nil
+		}
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// fetchRanges downloads the rest of the given chunks through a single request for all their
+// byte ranges, writing each part of the multipart/byteranges response to its offset. Chunks are
+// left as they are if the server responds with anything else, and partially downloaded if the
+// request fails, for them to be downloaded one by one.
+func (gf *Fetcher) fetchRanges(ctx context.Context, d *download, file dataFile, chunks []*chunk) error {
+	src := d.source()
+	if src.handler != nil || !src.ranges || d.encoding != "" || atomic.LoadInt32(&d.singleRanges) == 1 {
+		return nil
+	}
+
+	var watchdog *stallWatchdog
+	if gf.stallTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, watchdog, cancel = newStallWatchdog(ctx, gf.stallTimeout)
+		defer cancel()
+	}
+
+	var ranges []string
+	var pending []*chunk
+	resumed := false
+	for _, c := range chunks {
+		if c.done() || c.end() < 0 {
+			continue
+		}
+		min := c.Start + c.written()
+		ranges = append(ranges, fmt.Sprintf("%d-%d", min, c.end()-1))
+		pending = append(pending, c)
+		resumed = resumed || min > c.Start
+	}
+	if len(pending) < 2 {
+		return nil
+	}
+
+	req, err := gf.newRequest(ctx, "GET", src.url)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", "bytes="+strings.Join(ranges, ","))
+	if resumed && src.ifRange != "" {
+		// Makes the server send the whole content if it changed since the chunks were started,
+		// which is then told by downloading them one by one.
+		req.Header.Set("If-Range", src.ifRange)
+	}
+
+	res, err := gf.do(req)
+	if err != nil {
+		return watchdog.Err(err, 0)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusPartialContent {
+		// Servers not supporting multiple ranges send the whole content instead.
+		atomic.StoreInt32(&d.singleRanges, 1)
+		return &statusError{code: res.StatusCode, status: res.Status}
+	}
+
+	body := gf.limitRate(ctx, watchdog.Reader(res.Body))
+	mediaType, params, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if mediaType != "multipart/byteranges" {
+		// Servers may also merge the ranges into a single one.
+		start, end, err := parseContentRange(res.Header.Get("Content-Range"))
+		if err != nil {
+			return err
+		}
+		return watchdog.Err(gf.writeRange(d, file, pending, body, start, end), 0)
+	}
+
+	parts := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return watchdog.Err(err, 0)
+		}
+		start, end, err := parseContentRange(part.Header.Get("Content-Range"))
+		if err != nil {
+			return err
+		}
+		if err := gf.writeRange(d, file, pending, part, start, end); err != nil {
+			return watchdog.Err(err, 0)
+		}
+	}
+}
+
+// writeRange writes the bytes from start to end, inclusive, of the content, as read from r, to
+// the chunks resuming at their offsets. Bytes between them, which servers may send when merging
+// ranges close to each other, and bytes of chunks taken over by other goroutines, are skipped.
+func (gf *Fetcher) writeRange(d *download, file dataFile, chunks []*chunk, r io.Reader, start, end int64) error {
+	for pos := start; pos <= end; {
+		var c *chunk
+		next := end + 1
+		for _, p := range chunks {
+			if p.done() {
+				continue
+			}
+			if min := p.Start + p.written(); min == pos {
+				c = p
+				break
+			} else if min > pos && min < next {
+				next = min
+			}
+		}
+
+		if c == nil {
+			n, err := io.CopyN(ioutil.Discard, r, next-pos)
+			pos += n
+			if err == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		limit := c.end() - pos
+		if end+1-pos < limit {
+			limit = end + 1 - pos
+		}
+		writer := fetchWriter{
+			Writer:   &chunkWriter{file: file, chunk: c, hash: d.hash},
+			download: d,
+		}
+		n, err := gf.buffers.copy(&writer, io.LimitReader(r, limit))
+		pos += n
+		if err == errChunkSplit {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if n < limit {
+			return io.ErrUnexpectedEOF
+		}
+	}
+	return nil
+}
+
+// parseContentRange returns the first and last byte of a Content-Range header such as
+// "bytes 0-1023/4096".
+func parseContentRange(value string) (int64, int64, error) {
+	if !strings.HasPrefix(value, "bytes ") {
+		return 0, 0, fmt.Errorf("invalid Content-Range: %q", value)
+	}
+	spec := value[len("bytes "):]
+	if i := strings.Index(spec, "/"); i >= 0 {
+		spec = spec[:i]
+	}
+	i := strings.Index(spec, "-")
+	if i < 0 {
+		return 0, 0, fmt.Errorf("invalid Content-Range: %q", value)
+	}
+	start, err := strconv.ParseInt(spec[:i], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid Content-Range: %q", value)
+	}
+	end, err := strconv.ParseInt(spec[i+1:], 10, 64)
+	if err != nil || end < start {
+		return 0, 0, fmt.Errorf("invalid Content-Range: %q", value)
+	}
+	return start, end, nil
+}
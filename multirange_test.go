@@ -0,0 +1,97 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestMultiRange(t *testing.T) {
+	data := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(data)
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	// Each server answers requests for several ranges its own way.
+	for name, serve := range map[string]func(w http.ResponseWriter, r *http.Request){
+		"multipart": func(w http.ResponseWriter, r *http.Request) {
+			http.ServeContent(w, r, "", modTime, bytes.NewReader(data))
+		},
+		"merged": func(w http.ResponseWriter, r *http.Request) {
+			ranges := strings.Split(strings.TrimPrefix(r.Header.Get("Range"), "bytes="), ",")
+			if len(ranges) == 1 {
+				http.ServeContent(w, r, "", modTime, bytes.NewReader(data))
+				return
+			}
+			// The ranges are merged into one, from the first byte to the last one requested.
+			start, _ := strconv.Atoi(strings.Split(ranges[0], "-")[0])
+			end, _ := strconv.Atoi(strings.Split(ranges[len(ranges)-1], "-")[1])
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data[start : end+1])
+		},
+		"single": func(w http.ResponseWriter, r *http.Request) {
+			if strings.Contains(r.Header.Get("Range"), ",") {
+				r.Header.Del("Range")
+			}
+			http.ServeContent(w, r, "", modTime, bytes.NewReader(data))
+		},
+	} {
+		var requests int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "GET" {
+				atomic.AddInt32(&requests, 1)
+			}
+			serve(w, r)
+		}))
+
+		destDir, err := ioutil.TempDir(os.TempDir(), "multirange")
+		assert.Ok(t, err)
+
+		// 10 chunks, downloaded 4 at a time through 2 connections.
+		gf := New(WithDestDir(destDir), WithConcurrency(2), WithChunkSize(10000), WithMultiRange(4))
+		file, err := gf.Fetch(ts.URL+"/file.bin", nil)
+		assert.Ok(t, err)
+		got, err := ioutil.ReadAll(file)
+		file.Close()
+		assert.Ok(t, err)
+		assert.Cond(t, bytes.Equal(data, got), "%s: downloaded content does not match", name)
+
+		switch name {
+		case "multipart", "merged":
+			assert.Equals(t, int32(3), atomic.LoadInt32(&requests))
+		case "single":
+			// Chunks are downloaded one by one once the server is known not to support it.
+			assert.Cond(t, atomic.LoadInt32(&requests) <= 12, "%s: too many requests: %d", name, requests)
+		}
+
+		ts.Close()
+		os.RemoveAll(destDir)
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	start, end, err := parseContentRange("bytes 100-199/1000")
+	assert.Ok(t, err)
+	assert.Equals(t, int64(100), start)
+	assert.Equals(t, int64(199), end)
+
+	for _, value := range []string{"", "bytes */1000", "100-199/1000", "bytes 200-100/1000"} {
+		_, _, err := parseContentRange(value)
+		assert.Cond(t, err != nil, "%q should not be a valid Content-Range", value)
+	}
+}
@@ -0,0 +1,451 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// dockerHubRegistry is the host of the registry of Docker Hub, whose images are referred to
+// as docker.io/<repository>.
+const dockerHubRegistry = "registry-1.docker.io"
+
+// OCIHandler fetches blobs, like image layers or ORAS artifacts, from OCI registries through
+// oci://<registry>/<repository>@<digest> URLs, like
+// oci://ghcr.io/org/image@sha256:6c3c624b58dbbcd3c0dd82b4c53f04194d1247c6eebdaab7c610cf7d66709b3b.
+// Requests are authorized with the tokens handed out by the registry, anonymously or using the
+// credentials of the registry, which are taken from the Docker configuration, including its
+// credential helpers, by default. Blobs are always verified against their digest, and read in
+// byte ranges if the registry supports them, so downloads are resumed and split in chunks.
+// It is registered for the oci scheme by default.
+type OCIHandler struct {
+	// Credentials returns the username and password to authenticate with the given registry,
+	// or empty ones to request access anonymously. If nil, credentials are taken from
+	// config.json in DOCKER_CONFIG, or in ~/.docker.
+	Credentials func(ctx context.Context, registry string) (username, password string, err error)
+	// PlainHTTP sends requests over HTTP rather than HTTPS, for local registries.
+	PlainHTTP bool
+	// Client sends the requests, including the ones for tokens. The client of the fetcher is
+	// used if nil, with its TLS settings, proxy and timeouts, or http.DefaultClient outside a
+	// fetcher.
+	Client *http.Client
+
+	mu sync.Mutex
+	// tokens holds the authorization of the requests to each repository.
+	tokens map[string]string
+}
+
+func (h *OCIHandler) Stat(ctx context.Context, rawURL string) (*ContentInfo, error) {
+	ref, err := parseOCIURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := h.send(ctx, "HEAD", ref, nil)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, &statusError{code: res.StatusCode, status: res.Status}
+	}
+
+	// Blobs are addressed by their digest, which therefore never changes.
+	return &ContentInfo{
+		Size:    res.ContentLength,
+		Ranges:  res.Header.Get("Accept-Ranges") == "bytes",
+		ETag:    `"` + ref.digest + `"`,
+		Digests: map[string]string{ref.algorithm(): ref.hex()},
+	}, nil
+}
+
+func (h *OCIHandler) Open(ctx context.Context, rawURL string, offset, length int64) (io.ReadCloser, error) {
+	ref, err := parseOCIURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	header := http.Header{}
+	if rng := rangeHeader(offset, length); rng != "" {
+		header.Set("Range", rng)
+	}
+	res, err := h.send(ctx, "GET", ref, header)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case res.StatusCode == http.StatusPartialContent, res.StatusCode == http.StatusOK && offset == 0:
+		return res.Body, nil
+	case res.StatusCode == http.StatusOK:
+		res.Body.Close()
+		return nil, errRangesIgnored
+	default:
+		res.Body.Close()
+		return nil, &statusError{code: res.StatusCode, status: res.Status}
+	}
+}
+
+// ociRef is a blob in a repository of an OCI registry.
+type ociRef struct {
+	registry   string
+	repository string
+	digest     string
+}
+
+// ociDigest matches the digests of blobs gofetch is able to verify.
+var ociDigest = regexp.MustCompile(`^(sha256:[a-f0-9]{64}|sha512:[a-f0-9]{128})$`)
+
+// parseOCIURL returns the blob of the given oci:// URL.
+func parseOCIURL(rawURL string) (*ociRef, error) {
+	if !strings.HasPrefix(strings.ToLower(rawURL), "oci://") {
+		return nil, fmt.Errorf("invalid OCI URL %s", rawURL)
+	}
+	s := rawURL[len("oci://"):]
+
+	at := strings.LastIndex(s, "@")
+	if at < 0 {
+		return nil, fmt.Errorf("invalid OCI URL %s, the digest of the blob is required", rawURL)
+	}
+	ref := &ociRef{digest: s[at+1:]}
+	if !ociDigest.MatchString(ref.digest) {
+		return nil, fmt.Errorf("invalid OCI URL %s, unsupported digest %s", rawURL, ref.digest)
+	}
+
+	name := s[:at]
+	// Tags are meaningless once the digest is known.
+	if slash, colon := strings.LastIndex(name, "/"), strings.LastIndex(name, ":"); colon > slash && slash >= 0 {
+		name = name[:colon]
+	}
+	slash := strings.Index(name, "/")
+	if slash <= 0 || slash == len(name)-1 {
+		return nil, fmt.Errorf("invalid OCI URL %s, a registry and a repository are required", rawURL)
+	}
+	ref.registry, ref.repository = strings.ToLower(name[:slash]), name[slash+1:]
+
+	if ref.registry == "docker.io" || ref.registry == "index.docker.io" {
+		ref.registry = dockerHubRegistry
+		// Official images are in the library namespace.
+		if !strings.Contains(ref.repository, "/") {
+			ref.repository = "library/" + ref.repository
+		}
+	}
+	return ref, nil
+}
+
+// algorithm returns the hashing algorithm of the digest of the blob.
+func (r *ociRef) algorithm() string {
+	return r.digest[:strings.Index(r.digest, ":")]
+}
+
+// hex returns the hex encoded digest of the blob, without its algorithm.
+func (r *ociRef) hex() string {
+	return r.digest[strings.Index(r.digest, ":")+1:]
+}
+
+// send sends a request for the given blob, authorizing it with the token for its repository,
+// which is requested from the registry again if rejected.
+func (h *OCIHandler) send(ctx context.Context, method string, ref *ociRef, header http.Header) (*http.Response, error) {
+	scheme := "https"
+	if h.PlainHTTP {
+		scheme = "http"
+	}
+	blobURL := fmt.Sprintf("%s://%s/v2/%s/blobs/%s", scheme, ref.registry, ref.repository, ref.digest)
+	key := ref.registry + "/" + ref.repository
+
+	h.mu.Lock()
+	auth := h.tokens[key]
+	h.mu.Unlock()
+
+	res, err := h.do(ctx, method, blobURL, header, auth)
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+	res.Body.Close()
+
+	if auth, err = h.authorize(ctx, ref, res.Header.Get("WWW-Authenticate")); err != nil {
+		return nil, errors.Wrapf(err, "failed authorizing access to %s", key)
+	}
+	h.mu.Lock()
+	if h.tokens == nil {
+		h.tokens = make(map[string]string)
+	}
+	h.tokens[key] = auth
+	h.mu.Unlock()
+
+	return h.do(ctx, method, blobURL, header, auth)
+}
+
+func (h *OCIHandler) do(ctx context.Context, method, rawURL string, header http.Header, auth string) (*http.Response, error) {
+	req, err := http.NewRequest(method, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	// Registries redirect to storage services, which are not sent the authorization, since
+	// they are on other hosts.
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+
+	return h.client(ctx).Do(req)
+}
+
+// client returns the client requests are sent through.
+func (h *OCIHandler) client(ctx context.Context) *http.Client {
+	if h.Client != nil {
+		return h.Client
+	}
+	return httpClientFrom(ctx)
+}
+
+// authorize returns the authorization for requests to the repository of the given blob, as
+// challenged by the registry, either the credentials of the registry or a bearer token handed
+// out for them.
+func (h *OCIHandler) authorize(ctx context.Context, ref *ociRef, challenge string) (string, error) {
+	scheme, params := parseChallenge(challenge)
+
+	username, password, err := h.credentials(ctx, ref.registry)
+	if err != nil {
+		return "", err
+	}
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if username == "" && password == "" {
+			return "", errors.New("credentials required")
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password)), nil
+	case "bearer":
+	default:
+		return "", fmt.Errorf("unsupported authentication scheme %q", scheme)
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return "", fmt.Errorf("invalid token realm %q", params["realm"])
+	}
+	query := realm.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + ref.repository + ":pull"
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest("GET", realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	if username != "" || password != "" {
+		req.SetBasicAuth(username, password)
+	}
+
+	res, err := h.client(ctx).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", errors.Wrap(&statusError{code: res.StatusCode, status: res.Status}, "failed requesting token")
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxManifestSize)).Decode(&token); err != nil {
+		return "", errors.Wrap(err, "failed decoding token")
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return "", errors.New("registry handed out an empty token")
+	}
+	return "Bearer " + token.Token, nil
+}
+
+// parseChallenge parses a WWW-Authenticate header, like
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io", returning its
+// scheme and parameters.
+func parseChallenge(challenge string) (string, map[string]string) {
+	challenge = strings.TrimSpace(challenge)
+	scheme, rest := challenge, ""
+	if i := strings.IndexByte(challenge, ' '); i >= 0 {
+		scheme, rest = challenge[:i], challenge[i+1:]
+	}
+
+	params := make(map[string]string)
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " ,")
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			// Quoted values may contain commas, and escaped quotes.
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				b.WriteByte(rest[i])
+			}
+			if i < len(rest) {
+				i++
+			}
+			value, rest = b.String(), rest[i:]
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end < 0 {
+				end = len(rest)
+			}
+			value, rest = strings.TrimSpace(rest[:end]), rest[end:]
+		}
+		params[key] = value
+	}
+	return scheme, params
+}
+
+// credentials returns the username and password to authenticate with the given registry, if any.
+func (h *OCIHandler) credentials(ctx context.Context, registry string) (string, string, error) {
+	if h.Credentials != nil {
+		return h.Credentials(ctx, registry)
+	}
+	return dockerCredentials(ctx, registry)
+}
+
+// dockerConfig is the part of the Docker configuration holding the credentials of registries.
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth     string `json:"auth"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+// dockerCredentials returns the credentials of the given registry in the Docker configuration,
+// asking its credential helpers for them if needed.
+func dockerCredentials(ctx context.Context, registry string) (string, string, error) {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, _ := os.UserHomeDir()
+		dir = filepath.Join(home, ".docker")
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "config.json"))
+	if os.IsNotExist(err) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	var config dockerConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return "", "", errors.Wrap(err, "failed parsing Docker configuration")
+	}
+
+	// Docker Hub credentials are stored under its legacy address.
+	server := registry
+	if registry == dockerHubRegistry {
+		server = "https://index.docker.io/v1/"
+	}
+
+	helper := config.CredsStore
+	if h, ok := config.CredHelpers[registry]; ok {
+		helper = h
+	}
+
+	for key, auth := range config.Auths {
+		if key != server && dockerServerHost(key) != registry {
+			continue
+		}
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return "", "", errors.Wrapf(err, "invalid credentials of %s in Docker configuration", key)
+			}
+			if i := bytes.IndexByte(decoded, ':'); i >= 0 {
+				return string(decoded[:i]), string(decoded[i+1:]), nil
+			}
+		}
+		if auth.Username != "" {
+			return auth.Username, auth.Password, nil
+		}
+	}
+
+	if helper == "" {
+		return "", "", nil
+	}
+	return credentialHelper(ctx, helper, server)
+}
+
+// dockerServerHost returns the host of the given server address of the Docker configuration,
+// which may be a URL.
+func dockerServerHost(server string) string {
+	if u, err := url.Parse(server); err == nil && u.Host != "" {
+		server = u.Host
+	}
+	host := strings.ToLower(strings.TrimSuffix(server, "/"))
+	if host == "index.docker.io" || host == "docker.io" {
+		return dockerHubRegistry
+	}
+	return host
+}
+
+// credentialHelper asks the given Docker credential helper for the credentials of the given
+// server. Servers unknown to the helper have no credentials.
+func credentialHelper(ctx context.Context, helper, server string) (string, string, error) {
+	cmd := exec.CommandContext(ctx, "docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+	out, err := cmd.Output()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return "", "", nil
+		}
+		return "", "", errors.Wrapf(err, "failed running credential helper %s", helper)
+	}
+
+	var creds struct {
+		Username string
+		Secret   string
+	}
+	if err := json.Unmarshal(out, &creds); err != nil {
+		return "", "", errors.Wrapf(err, "invalid credentials from credential helper %s", helper)
+	}
+	return creds.Username, creds.Secret, nil
+}
@@ -0,0 +1,156 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+// newRegistry serves the given blobs, keyed by digest, from the org/image repository of a
+// registry handing out tokens to the given user.
+func newRegistry(t *testing.T, blobs map[string][]byte, username, password string) (*httptest.Server, *int32) {
+	var tokens int32
+	var registry *httptest.Server
+	registry = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			user, pass, ok := r.BasicAuth()
+			if !ok || user != username || pass != password {
+				http.Error(w, "invalid credentials", http.StatusUnauthorized)
+				return
+			}
+			if r.URL.Query().Get("scope") != "repository:org/image:pull" || r.URL.Query().Get("service") != "test-registry" {
+				http.Error(w, "invalid scope", http.StatusBadRequest)
+				return
+			}
+			atomic.AddInt32(&tokens, 1)
+			fmt.Fprint(w, `{"token": "secret-token"}`)
+			return
+		}
+
+		if r.Header.Get("Authorization") != "Bearer secret-token" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test-registry",scope="repository:org/image:pull"`, registry.URL))
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		blob, ok := blobs[strings.TrimPrefix(r.URL.Path, "/v2/org/image/blobs/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+	}))
+	return registry, &tokens
+}
+
+func TestOCI(t *testing.T) {
+	destDir, err := ioutil.TempDir(os.TempDir(), "oci")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	layer := bytes.Repeat([]byte("layer"), 100000)
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(layer))
+	corrupt := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("other")))
+	registry, tokens := newRegistry(t, map[string][]byte{digest: layer, corrupt: layer}, "user", "pass")
+	defer registry.Close()
+	host := strings.TrimPrefix(registry.URL, "http://")
+
+	RegisterScheme("oci", &OCIHandler{
+		PlainHTTP: true,
+		Credentials: func(ctx context.Context, registry string) (string, string, error) {
+			assert.Equals(t, host, registry)
+			return "user", "pass", nil
+		},
+	})
+	defer RegisterScheme("oci", &OCIHandler{})
+
+	// Tokens are requested through the client of the fetcher too.
+	var hookedTokens int32
+	gf := New(WithDestDir(destDir), WithConcurrency(4), WithRequestHook(func(r *http.Request) error {
+		if r.URL.Path == "/token" {
+			atomic.AddInt32(&hookedTokens, 1)
+		}
+		return nil
+	}))
+	file, err := gf.Fetch("oci://"+host+"/org/image:latest@"+digest, nil)
+	assert.Ok(t, err)
+	defer file.Close()
+	assert.Equals(t, int32(1), atomic.LoadInt32(&hookedTokens))
+
+	got, err := ioutil.ReadAll(file)
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(layer, got), "downloaded blob does not match")
+	assert.Equals(t, filepath.Join(destDir, "image-latest@sha256-"+digest[len("sha256:"):]), file.Name())
+	// Tokens are reused by the requests for each chunk.
+	assert.Equals(t, int32(1), atomic.LoadInt32(tokens))
+
+	// Blobs are verified against their digest even without server checksums.
+	_, err = gf.Fetch("oci://"+host+"/org/image@"+corrupt, nil)
+	assert.Cond(t, err != nil, "blobs not matching their digest should be rejected")
+
+	_, err = parseOCIURL("oci://" + host + "/org/image:latest")
+	assert.Cond(t, err != nil, "references without digest should be rejected")
+	ref, err := parseOCIURL("oci://docker.io/alpine@" + digest)
+	assert.Ok(t, err)
+	assert.Equals(t, &ociRef{registry: dockerHubRegistry, repository: "library/alpine", digest: digest}, ref)
+}
+
+func TestOCIDockerCredentials(t *testing.T) {
+	configDir, err := ioutil.TempDir(os.TempDir(), "docker-config")
+	assert.Ok(t, err)
+	defer os.RemoveAll(configDir)
+	t.Setenv("DOCKER_CONFIG", configDir)
+
+	layer := []byte("artifact")
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(layer))
+	registry, _ := newRegistry(t, map[string][]byte{digest: layer}, "docker-user", "docker-pass")
+	defer registry.Close()
+	host := strings.TrimPrefix(registry.URL, "http://")
+
+	handler := &OCIHandler{PlainHTTP: true}
+	_, err = handler.Stat(context.Background(), "oci://"+host+"/org/image@"+digest)
+	assert.Cond(t, err != nil, "anonymous access should be rejected")
+
+	auth := base64.StdEncoding.EncodeToString([]byte("docker-user:docker-pass"))
+	config := fmt.Sprintf(`{"auths": {"http://%s/": {"auth": %q}}}`, host, auth)
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(configDir, "config.json"), []byte(config), 0600))
+
+	info, err := handler.Stat(context.Background(), "oci://"+host+"/org/image@"+digest)
+	assert.Ok(t, err)
+	assert.Equals(t, int64(len(layer)), info.Size)
+	assert.Equals(t, map[string]string{"sha256": digest[len("sha256:"):]}, info.Digests)
+
+	r, err := handler.Open(context.Background(), "oci://"+host+"/org/image@"+digest, 3, -1)
+	assert.Ok(t, err)
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	assert.Ok(t, err)
+	assert.Equals(t, "ifact", string(got))
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/alpine:pull,push", error=invalid_token`)
+	assert.Equals(t, "Bearer", scheme)
+	assert.Equals(t, map[string]string{
+		"realm":   "https://auth.docker.io/token",
+		"service": "registry.docker.io",
+		"scope":   "repository:library/alpine:pull,push",
+		"error":   "invalid_token",
+	}, params)
+}
@@ -0,0 +1,88 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// PartialDownload describes an interrupted download, as recorded to resume it.
+type PartialDownload struct {
+	// URL is the location the content was being downloaded from.
+	URL string
+	// ETag and LastModified are the validators of the content when it was being downloaded.
+	ETag         string
+	LastModified string
+	// Digests are the checksums the content is going to be verified against, keyed by algorithm.
+	Digests map[string]string
+	// Size is the length of the content, or -1 if unknown.
+	Size int64
+	// Downloaded is the number of bytes already downloaded.
+	Downloaded int64
+	// Percent is the percentage of the content already downloaded, or -1 if its length is unknown.
+	Percent float64
+	// Ranges are the byte ranges already downloaded, end exclusive, sorted and merged.
+	Ranges [][2]int64
+	// Updated is the last time the progress of the download was recorded.
+	Updated time.Time
+}
+
+// Partial reports how much of the content at the given URL is already downloaded, without
+// fetching anything. It returns nil if there is no download of it to resume. Whether the
+// download is actually resumed depends on the content still being the same on the server.
+func (gf *Fetcher) Partial(url string) (*PartialDownload, error) {
+	destFilePath := filepath.Join(gf.destDir, destFileName(url))
+	chunksDir := gf.chunksDir(destFilePath)
+	stateFile := filepath.Join(chunksDir, "state")
+	s, err := readState(stateFile)
+	if err != nil || s == nil || !s.fits(s.Size) {
+		return nil, err
+	}
+
+	fi, err := os.Stat(stateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// Downloads interrupted while being moved to their destination are finished upon resuming.
+	if _, err := os.Stat(filepath.Join(chunksDir, "data")); os.IsNotExist(err) {
+		dest, err := os.Stat(destFilePath)
+		if err != nil || dest.Size() != s.Size {
+			return nil, nil
+		}
+		for _, c := range s.Chunks {
+			if !c.done() {
+				return nil, nil
+			}
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	p := &PartialDownload{
+		URL:          s.URL,
+		ETag:         s.ETag,
+		LastModified: s.LastModified,
+		Digests:      s.Digests,
+		Size:         s.Size,
+		Ranges:       completedRanges(s.Chunks),
+		Updated:      fi.ModTime(),
+	}
+	for _, r := range p.Ranges {
+		p.Downloaded += r[1] - r[0]
+	}
+
+	switch {
+	case p.Size < 0:
+		p.Percent = -1
+	case p.Size == 0:
+		p.Percent = 100
+	default:
+		p.Percent = float64(p.Downloaded) / float64(p.Size) * 100
+	}
+	return p, nil
+}
@@ -0,0 +1,46 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestPartial(t *testing.T) {
+	destDir, err := ioutil.TempDir(os.TempDir(), "partial")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	gf := New(WithDestDir(destDir))
+	p, err := gf.Partial("https://example.com/file")
+	assert.Ok(t, err)
+	assert.Cond(t, p == nil, "There should be nothing to resume")
+
+	chunksDir := filepath.Join(destDir, "file.chunks")
+	assert.Ok(t, os.MkdirAll(chunksDir, 0760))
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(chunksDir, "data"), make([]byte, 200), 0660))
+	assert.Ok(t, saveState(filepath.Join(chunksDir, "state"), downloadState{URL: "https://example.com/file", ETag: `"v1"`, Size: 200},
+		[]*chunk{{Start: 0, End: 100, Written: 100}, {Start: 100, End: 200, Written: 50}}))
+
+	p, err = gf.Partial("https://example.com/file")
+	assert.Ok(t, err)
+	assert.Cond(t, p != nil, "The partial download should be reported")
+	assert.Equals(t, `"v1"`, p.ETag)
+	assert.Equals(t, int64(200), p.Size)
+	assert.Equals(t, int64(150), p.Downloaded)
+	assert.Equals(t, float64(75), p.Percent)
+	assert.Equals(t, [][2]int64{{0, 150}}, p.Ranges)
+
+	// Downloads without their data cannot be resumed.
+	assert.Ok(t, os.Remove(filepath.Join(chunksDir, "data")))
+	p, err = gf.Partial("https://example.com/file")
+	assert.Ok(t, err)
+	assert.Cond(t, p == nil, "There should be nothing to resume without data")
+}
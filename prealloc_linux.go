@@ -0,0 +1,24 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build linux
+// +build linux
+
+package gofetch
+
+import (
+	"os"
+	"syscall"
+)
+
+// preallocate allocates disk space for the whole file upfront, so the filesystem can lay it
+// out contiguously and running out of space is detected before downloading anything.
+// Filesystems not supporting it get a sparse file instead.
+func preallocate(f *os.File, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return f.Truncate(size)
+	}
+	return err
+}
@@ -0,0 +1,16 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !linux
+// +build !linux
+
+package gofetch
+
+import "os"
+
+// preallocate gives the file its final size upfront. On Windows, this allocates the disk space
+// through SetEndOfFile. Elsewhere, the file is sparse and gets allocated as it is written.
+func preallocate(f *os.File, size int64) error {
+	return f.Truncate(size)
+}
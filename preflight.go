@@ -0,0 +1,171 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// resource describes remote content, as learned from the preflight request.
+type resource struct {
+	// url is the final location of the content, after following redirects.
+	url string
+	// size is the length of the content in bytes, or -1 if unknown.
+	size int64
+	// ranges tells whether the server supports requesting byte ranges.
+	ranges bool
+	// header holds the response headers of the preflight request.
+	header http.Header
+	// notModified is set when the content did not change since the time given
+	// to the preflight request.
+	notModified bool
+	// encoding is the encoding the content is going to be decoded from, if any.
+	encoding string
+	// handler fetches the content if it is not served over HTTP, in which case checksums are
+	// the checksums of the content it knows of, and digests the ones the content is addressed by.
+	handler   Handler
+	checksums []checksum
+	digests   []checksum
+}
+
+// preflight finds out the size of the content and whether the server supports requesting
+// byte ranges. By default it sends a HEAD request, but if the fetcher is configured to skip it,
+// or the server refuses it, a GET request for the first byte of the content is sent instead.
+// The request is made conditional using the given headers, such as If-None-Match or
+// If-Modified-Since, if any.
+func (gf *Fetcher) preflight(ctx context.Context, url string, conditions http.Header) (*resource, error) {
+	if gf.skipHEAD {
+		return gf.probe(ctx, url, conditions)
+	}
+
+	req, err := gf.newRequest(ctx, "HEAD", url)
+	if err != nil {
+		return nil, err
+	}
+	gf.requestChecksums(req)
+
+	for k, v := range conditions {
+		req.Header[k] = v
+	}
+
+	res, err := gf.do(req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusForbidden, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		// Servers like S3, when using presigned URLs, and some CDNs do not
+		// allow HEAD requests.
+		return gf.probe(ctx, url, conditions)
+	case http.StatusNotModified:
+		return &resource{url: responseURL(res.Request.URL), size: -1, header: res.Header, notModified: true}, nil
+	}
+
+	if !strings.HasPrefix(res.Status, "2") {
+		return nil, &statusError{code: res.StatusCode, status: res.Status}
+	}
+
+	return &resource{
+		url:      responseURL(res.Request.URL),
+		size:     res.ContentLength,
+		ranges:   res.Header.Get("Accept-Ranges") == "bytes",
+		header:   res.Header,
+		encoding: gf.decodedEncoding(res.Header),
+	}, nil
+}
+
+// requestChecksums asks Amazon S3 to include the checksums of the content in the response
+// headers, when checksums provided by servers are validated.
+func (gf *Fetcher) requestChecksums(req *http.Request) {
+	if gf.serverChecksums {
+		req.Header.Set("X-Amz-Checksum-Mode", "ENABLED")
+	}
+}
+
+// decodedEncoding returns the encoding of the content if gofetch is going to decode it.
+func (gf *Fetcher) decodedEncoding(header http.Header) string {
+	if gf.encoding == "gzip" && header.Get("Content-Encoding") == "gzip" {
+		return "gzip"
+	}
+	return ""
+}
+
+// probe requests the first byte of the content to learn its total size from the
+// Content-Range header. Servers not supporting byte ranges respond with the whole
+// content instead, in which case only its headers are used.
+func (gf *Fetcher) probe(ctx context.Context, url string, conditions http.Header) (*resource, error) {
+	req, err := gf.newRequest(ctx, "GET", url)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	gf.requestChecksums(req)
+
+	for k, v := range conditions {
+		req.Header[k] = v
+	}
+
+	res, err := gf.do(req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+
+	if res.StatusCode == http.StatusNotModified {
+		return &resource{url: responseURL(res.Request.URL), size: -1, header: res.Header, notModified: true}, nil
+	}
+
+	if !strings.HasPrefix(res.Status, "2") {
+		return nil, &statusError{code: res.StatusCode, status: res.Status}
+	}
+
+	rsc := &resource{
+		url:      responseURL(res.Request.URL),
+		size:     res.ContentLength,
+		header:   res.Header,
+		encoding: gf.decodedEncoding(res.Header),
+	}
+
+	if res.StatusCode == http.StatusPartialContent {
+		rsc.ranges = true
+		rsc.size = parseContentRangeSize(res.Header.Get("Content-Range"))
+	}
+	return rsc, nil
+}
+
+// parseContentRangeSize returns the complete length of the content from a
+// Content-Range header such as "bytes 0-0/1234", or -1 if it is unknown.
+func parseContentRangeSize(value string) int64 {
+	i := strings.LastIndex(value, "/")
+	if !strings.HasPrefix(value, "bytes ") || i == -1 {
+		return -1
+	}
+
+	size, err := strconv.ParseInt(value[i+1:], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+// validator returns the value to use in If-Range requests to make sure the content
+// did not change, or an empty string if the server did not provide a usable one.
+func (r *resource) validator() string {
+	return validator(r.header)
+}
+
+// validator returns the strong ETag or, if missing, the Last-Modified date in the given
+// headers. Weak ETags cannot be used with If-Range.
+func validator(header http.Header) string {
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return header.Get("Last-Modified")
+}
@@ -0,0 +1,124 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// Priority orders downloads waiting for room to run, and their chunks waiting for a
+// connection. Higher priorities go first; any value in between the predefined ones can be used.
+type Priority int
+
+const (
+	// PriorityLow is meant for bulk downloads, like prefetching.
+	PriorityLow Priority = -10
+	// PriorityNormal is the priority of downloads by default.
+	PriorityNormal Priority = 0
+	// PriorityHigh is meant for critical or interactive downloads.
+	PriorityHigh Priority = 10
+)
+
+// priorityKey is the context key of the priority of a download.
+type priorityKey struct{}
+
+// ContextWithPriority returns a context giving the downloads using it the given priority,
+// when queued by a Manager or waiting for connections limited with WithMaxConnections.
+func ContextWithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// priorityFrom returns the priority of the download using the given context.
+func priorityFrom(ctx context.Context) Priority {
+	if p, ok := ctx.Value(priorityKey{}).(Priority); ok {
+		return p
+	}
+	return PriorityNormal
+}
+
+// priorityLimit bounds the number of holders of a resource at once, granting it to waiters
+// by priority, and in order of arrival among the same priority.
+type priorityLimit struct {
+	mu      sync.Mutex
+	limit   int
+	active  int
+	waiting []*waiter
+}
+
+// waiter is waiting for a priorityLimit, ready is closed once it is granted.
+type waiter struct {
+	priority Priority
+	ready    chan struct{}
+}
+
+func newPriorityLimit(limit int) *priorityLimit {
+	return &priorityLimit{limit: limit}
+}
+
+// acquire waits until the resource is granted or the context is done.
+func (l *priorityLimit) acquire(ctx context.Context, p Priority) error {
+	l.mu.Lock()
+	if l.active < l.limit && len(l.waiting) == 0 {
+		l.active++
+		l.mu.Unlock()
+		return nil
+	}
+
+	// Waiters are kept sorted, after the ones of the same priority.
+	w := &waiter{priority: p, ready: make(chan struct{})}
+	i := sort.Search(len(l.waiting), func(i int) bool {
+		return l.waiting[i].priority < p
+	})
+	l.waiting = append(l.waiting, nil)
+	copy(l.waiting[i+1:], l.waiting[i:])
+	l.waiting[i] = w
+	l.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for i, other := range l.waiting {
+			if other == w {
+				l.waiting = append(l.waiting[:i], l.waiting[i+1:]...)
+				return ctx.Err()
+			}
+		}
+		// It was granted in the meantime, so it is handed over to someone else.
+		l.active--
+		l.grant()
+		return ctx.Err()
+	}
+}
+
+// release gives the resource back, granting it to the next waiter.
+func (l *priorityLimit) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	l.grant()
+}
+
+// set changes the limit, granting the resource to waiters if it grows.
+func (l *priorityLimit) set(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+	l.grant()
+}
+
+// grant hands the resource to as many waiters as the limit allows. The caller must hold mu.
+func (l *priorityLimit) grant() {
+	for l.active < l.limit && len(l.waiting) > 0 {
+		w := l.waiting[0]
+		l.waiting = l.waiting[1:]
+		l.active++
+		close(w.ready)
+	}
+}
@@ -0,0 +1,75 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+// waitQueued waits until the limit has n waiters.
+func waitQueued(l *priorityLimit, n int) {
+	for {
+		l.mu.Lock()
+		queued := len(l.waiting)
+		l.mu.Unlock()
+		if queued == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPriorityLimit(t *testing.T) {
+	l := newPriorityLimit(1)
+	ctx := context.Background()
+	assert.Ok(t, l.acquire(ctx, PriorityNormal))
+
+	order := make(chan Priority, 4)
+	for i, p := range []Priority{PriorityLow, PriorityNormal, PriorityHigh, PriorityNormal + 1} {
+		go func(p Priority) {
+			assert.Ok(t, l.acquire(ctx, p))
+			order <- p
+			l.release()
+		}(p)
+		waitQueued(l, i+1)
+	}
+
+	// Waiting can be given up.
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.Equals(t, context.Canceled, l.acquire(canceled, PriorityHigh))
+	waitQueued(l, 4)
+
+	l.release()
+	assert.Equals(t, PriorityHigh, <-order)
+	assert.Equals(t, PriorityNormal+1, <-order)
+	assert.Equals(t, PriorityNormal, <-order)
+	assert.Equals(t, PriorityLow, <-order)
+}
+
+func TestPriorityLimitSet(t *testing.T) {
+	l := newPriorityLimit(1)
+	ctx := context.Background()
+	assert.Ok(t, l.acquire(ctx, PriorityNormal))
+
+	acquired := make(chan struct{})
+	go func() {
+		assert.Ok(t, l.acquire(ctx, PriorityNormal))
+		close(acquired)
+	}()
+	waitQueued(l, 1)
+
+	l.set(2)
+	<-acquired
+}
+
+func TestContextWithPriority(t *testing.T) {
+	assert.Equals(t, PriorityNormal, priorityFrom(context.Background()))
+	assert.Equals(t, PriorityHigh, priorityFrom(ContextWithPriority(context.Background(), PriorityHigh)))
+}
@@ -0,0 +1,106 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket bounding the number of bytes per second transferred
+// by all the goroutines sharing it.
+type rateLimiter struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter allowing the given number of bytes per second, with
+// bursts of up to a second worth of them.
+func newRateLimiter(bytesPerSec int64) *rateLimiter {
+	return &rateLimiter{rate: float64(bytesPerSec), last: time.Now()}
+}
+
+// wait accounts for n bytes just transferred, blocking until they are within the limit or
+// the context is done.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	// Tokens go negative when the bucket is overdrawn, making everyone wait until
+	// it refills.
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// rateLimitKey is the context key of the rate limit of a download.
+type rateLimitKey struct{}
+
+// ContextWithRateLimit returns a context capping the bandwidth of the downloads using it to the
+// given number of bytes per second, shared by all of them. The limit set with WithRateLimit, if
+// any, still applies, so downloads sharing a Fetcher can be given different parts of it, like
+// giving background downloads a small share of the bandwidth.
+func ContextWithRateLimit(ctx context.Context, bytesPerSec int64) context.Context {
+	if bytesPerSec <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, rateLimitKey{}, newRateLimiter(bytesPerSec))
+}
+
+// limitRate wraps r so it reads no faster than the rate limits of the Fetcher and of the
+// context allow.
+func (gf *Fetcher) limitRate(ctx context.Context, r io.Reader) io.Reader {
+	if l, ok := ctx.Value(rateLimitKey{}).(*rateLimiter); ok {
+		r = &rateLimitedReader{ctx: ctx, reader: r, limiter: l}
+	}
+	if gf.rateLimiter != nil {
+		r = &rateLimitedReader{ctx: ctx, reader: r, limiter: gf.rateLimiter}
+	}
+	return r
+}
+
+// rateLimitedReader reads no faster than its limiter allows.
+type rateLimitedReader struct {
+	ctx     context.Context
+	reader  io.Reader
+	limiter *rateLimiter
+}
+
+func (r *rateLimitedReader) Read(b []byte) (int, error) {
+	// Reads are kept small enough for the limit to be applied smoothly.
+	if max := int(r.limiter.rate / 10); max > 0 && len(b) > max {
+		b = b[:max]
+	}
+
+	n, err := r.reader.Read(b)
+	if n > 0 {
+		if werr := r.limiter.wait(r.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
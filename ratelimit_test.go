@@ -0,0 +1,68 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(1000)
+	assert.Ok(t, l.wait(context.Background(), 0))
+
+	// Overdrawing the bucket makes the next transfer wait until it refills.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Equals(t, context.DeadlineExceeded, l.wait(ctx, 2000))
+}
+
+func TestWithRateLimit(t *testing.T) {
+	ts := httptest.NewServer(http.FileServer(http.Dir("./fixtures")))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "rate-limit")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	// The limit is shared by all the goroutines.
+	gf := New(WithDestDir(destDir), WithConcurrency(4), WithRateLimit(1<<20))
+	start := time.Now()
+	f, err := gf.Fetch(ts.URL+"/test-resume", nil)
+	assert.Ok(t, err)
+	defer f.Close()
+
+	// Downloading 200 KiB at 1 MiB per second takes about 200ms.
+	elapsed := time.Since(start)
+	assert.Cond(t, elapsed >= 150*time.Millisecond, "download took %s, faster than the rate limit", elapsed)
+}
+
+func TestContextWithRateLimit(t *testing.T) {
+	ts := httptest.NewServer(http.FileServer(http.Dir("./fixtures")))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "context-rate-limit")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	gf := New(WithDestDir(destDir), WithConcurrency(4))
+	ctx := ContextWithRateLimit(context.Background(), 1<<20)
+	assert.Cond(t, ContextWithRateLimit(ctx, 0) == ctx, "No limit should be set")
+
+	start := time.Now()
+	result, err := gf.FetchContext(ctx, ts.URL+"/test-resume", nil)
+	assert.Ok(t, err)
+	defer result.File.Close()
+
+	elapsed := time.Since(start)
+	assert.Cond(t, elapsed >= 150*time.Millisecond, "download took %s, faster than the rate limit", elapsed)
+}
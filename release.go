@@ -0,0 +1,338 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Release is a release of a repository hosted on GitHub or GitLab.
+type Release struct {
+	Tag    string
+	Name   string
+	Assets []ReleaseAsset
+}
+
+// ReleaseAsset is a file attached to a release.
+type ReleaseAsset struct {
+	Name string
+	// URL is the location the asset is downloaded from.
+	URL string
+	// Size is the size of the asset in bytes, or -1 if unknown.
+	Size int64
+	// Digest is the digest of the asset published by the hosting service, like
+	// "sha256:<hex>", if any.
+	Digest string
+
+	// header is sent along the requests for the asset, like the credentials of the API.
+	header http.Header
+}
+
+// releaseRef is a release of a repository, as given to ResolveRelease.
+type releaseRef struct {
+	host    string
+	project string
+	// tag is the tag of the release, or empty for the latest release.
+	tag string
+}
+
+// parseReleaseRef parses references to releases, like github.com/owner/repo@v1.2.3.
+func parseReleaseRef(ref string) (*releaseRef, error) {
+	s := ref
+	if i := strings.Index(s, "://"); i >= 0 {
+		s = s[i+3:]
+	}
+
+	r := &releaseRef{}
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		s, r.tag = s[:i], s[i+1:]
+	}
+	if r.tag == "latest" {
+		r.tag = ""
+	}
+
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "/"), ".git")
+	i := strings.Index(s, "/")
+	if i <= 0 || strings.Count(s[i+1:], "/") < 1 || strings.Contains(s, "//") {
+		return nil, fmt.Errorf("invalid release %s, expected host/owner/repository@tag", ref)
+	}
+	r.host, r.project = strings.ToLower(s[:i]), s[i+1:]
+	return r, nil
+}
+
+// githubServer tells whether the given host serves GitHub, which is github.com, or the GitHub
+// Enterprise server in GITHUB_SERVER_URL. Other hosts are taken as GitLab instances.
+func githubServer(host string) bool {
+	if host == "github.com" || host == "www.github.com" {
+		return true
+	}
+	server, err := url.Parse(os.Getenv("GITHUB_SERVER_URL"))
+	return err == nil && server.Host != "" && strings.EqualFold(server.Host, host)
+}
+
+// ResolveRelease looks up the given release, like github.com/owner/repo@latest,
+// github.com/owner/repo@v1.2.3 or gitlab.com/group/project@v1.2.3, through the releases API of
+// GitHub, or of GitLab for any other host. The latest release is looked up if no tag is given.
+// Requests are authorized with the token in GITHUB_TOKEN, or GH_TOKEN, or in GITLAB_TOKEN,
+// if set. The API of GitHub Enterprise servers is used for releases hosted at GITHUB_SERVER_URL,
+// and the API of GitLab instances is looked up in CI_API_V4_URL when on the same host, like
+// GitHub Actions and GitLab CI/CD set them.
+func (gf *Fetcher) ResolveRelease(ctx context.Context, ref string) (*Release, error) {
+	r, err := parseReleaseRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	if githubServer(r.host) {
+		return gf.githubRelease(ctx, r)
+	}
+	return gf.gitlabRelease(ctx, r)
+}
+
+// githubRelease looks up a release through the API of GitHub.
+func (gf *Fetcher) githubRelease(ctx context.Context, r *releaseRef) (*Release, error) {
+	api := os.Getenv("GITHUB_API_URL")
+	if api == "" {
+		api = "https://api.github.com"
+		if r.host != "github.com" && r.host != "www.github.com" {
+			api = "https://" + r.host + "/api/v3"
+		}
+	}
+
+	endpoint := fmt.Sprintf("%s/repos/%s/releases/latest", strings.TrimSuffix(api, "/"), r.project)
+	if r.tag != "" {
+		endpoint = fmt.Sprintf("%s/repos/%s/releases/tags/%s", strings.TrimSuffix(api, "/"), r.project, url.PathEscape(r.tag))
+	}
+
+	header := http.Header{}
+	header.Set("X-GitHub-Api-Version", "2022-11-28")
+	token := os.Getenv("GITHUB_TOKEN")
+	if token == "" {
+		token = os.Getenv("GH_TOKEN")
+	}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+
+	var doc struct {
+		TagName string `json:"tag_name"`
+		Name    string `json:"name"`
+		Assets  []struct {
+			Name               string `json:"name"`
+			URL                string `json:"url"`
+			BrowserDownloadURL string `json:"browser_download_url"`
+			Size               int64  `json:"size"`
+			Digest             string `json:"digest"`
+		} `json:"assets"`
+	}
+	if err := gf.releaseAPI(ctx, endpoint, header, "application/vnd.github+json", &doc); err != nil {
+		return nil, err
+	}
+
+	release := &Release{Tag: doc.TagName, Name: doc.Name}
+	for _, a := range doc.Assets {
+		asset := ReleaseAsset{Name: a.Name, URL: a.BrowserDownloadURL, Size: a.Size, Digest: a.Digest}
+		if token != "" {
+			// Assets of private repositories are only downloaded through the API, which
+			// redirects to their storage once authorized. The token is not sent along
+			// the redirect, since it is to another host.
+			asset.URL = a.URL
+			asset.header = http.Header{}
+			asset.header.Set("Authorization", header.Get("Authorization"))
+			asset.header.Set("Accept", "application/octet-stream")
+		}
+		release.Assets = append(release.Assets, asset)
+	}
+	return release, nil
+}
+
+// gitlabRelease looks up a release through the API of GitLab.
+func (gf *Fetcher) gitlabRelease(ctx context.Context, r *releaseRef) (*Release, error) {
+	api := "https://" + r.host + "/api/v4"
+	if ci, err := url.Parse(os.Getenv("CI_API_V4_URL")); err == nil && ci.Host != "" && strings.EqualFold(ci.Host, r.host) {
+		api = strings.TrimSuffix(ci.String(), "/")
+	}
+
+	project := api + "/projects/" + url.PathEscape(r.project)
+	endpoint := project + "/releases/permalink/latest"
+	if r.tag != "" {
+		endpoint = project + "/releases/" + url.PathEscape(r.tag)
+	}
+
+	header := http.Header{}
+	if token := os.Getenv("GITLAB_TOKEN"); token != "" {
+		header.Set("PRIVATE-TOKEN", token)
+	}
+
+	var doc struct {
+		TagName string `json:"tag_name"`
+		Name    string `json:"name"`
+		Assets  struct {
+			Links []struct {
+				Name           string `json:"name"`
+				URL            string `json:"url"`
+				DirectAssetURL string `json:"direct_asset_url"`
+			} `json:"links"`
+		} `json:"assets"`
+	}
+	if err := gf.releaseAPI(ctx, endpoint, header, "application/json", &doc); err != nil {
+		return nil, err
+	}
+
+	release := &Release{Tag: doc.TagName, Name: doc.Name}
+	for _, l := range doc.Assets.Links {
+		asset := ReleaseAsset{Name: l.Name, URL: l.DirectAssetURL, Size: -1}
+		if asset.URL == "" {
+			asset.URL = l.URL
+		}
+		// Links may point anywhere, the token is only sent to the GitLab instance itself.
+		if u, err := url.Parse(asset.URL); err == nil && strings.EqualFold(u.Host, r.host) && len(header) > 0 {
+			asset.header = header
+		}
+		release.Assets = append(release.Assets, asset)
+	}
+	return release, nil
+}
+
+// releaseAPI requests the given endpoint of a releases API, decoding its response into v.
+func (gf *Fetcher) releaseAPI(ctx context.Context, endpoint string, header http.Header, accept string, v interface{}) error {
+	if gf.offline {
+		return &NotCachedError{URL: endpoint}
+	}
+
+	return gf.retry(ctx, func() error {
+		req, err := gf.newRequest(ctx, "GET", endpoint)
+		if err != nil {
+			return err
+		}
+		for k, values := range header {
+			req.Header[k] = values
+		}
+		req.Header.Set("Accept", accept)
+		req.Header.Del("Accept-Encoding")
+
+		res, err := gf.do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			return errors.Wrapf(&statusError{code: res.StatusCode, status: res.Status}, "failed looking up release at %s", endpoint)
+		}
+		return errors.Wrapf(json.NewDecoder(io.LimitReader(res.Body, maxManifestSize)).Decode(v), "failed decoding release at %s", endpoint)
+	})
+}
+
+// asset returns the asset of the release whose name matches the given pattern, with the syntax
+// of path.Match, which must match only one of them.
+func (r *Release) asset(pattern string) (*ReleaseAsset, error) {
+	var found *ReleaseAsset
+	for i, a := range r.Assets {
+		ok, err := path.Match(pattern, a.Name)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("assets %s and %s of release %s both match %q", found.Name, a.Name, r.Tag, pattern)
+		}
+		found = &r.Assets[i]
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no asset of release %s matches %q", r.Tag, pattern)
+	}
+	return found, nil
+}
+
+// releaseChecksum looks for the checksum of the given asset in the checksum files published
+// along with it: <asset>.sha256, <asset>.sha512, or files like SHA256SUMS or checksums.txt.
+// It returns nil if none of them lists the asset.
+func (gf *Fetcher) releaseChecksum(ctx context.Context, r *Release, asset *ReleaseAsset) (*checksum, error) {
+	var candidates []ReleaseAsset
+	for _, suffix := range []string{".sha256", ".sha512"} {
+		for _, a := range r.Assets {
+			if a.Name == asset.Name+suffix {
+				candidates = append(candidates, a)
+			}
+		}
+	}
+	for _, a := range r.Assets {
+		name := strings.ToLower(a.Name)
+		if strings.HasSuffix(name, ".sig") || strings.HasSuffix(name, ".asc") || strings.HasSuffix(name, ".pem") {
+			continue
+		}
+		if strings.Contains(name, "checksums") || strings.Contains(name, "sha256sums") || strings.Contains(name, "sha512sums") {
+			candidates = append(candidates, a)
+		}
+	}
+
+	for _, a := range candidates {
+		c, err := gf.manifestChecksum(withRequestHeader(ctx, a.header), checksumFile{location: a.URL}, asset.Name)
+		if err == nil {
+			return &c, nil
+		}
+		if errors.Cause(err) == errNoChecksum {
+			continue
+		}
+		return nil, err
+	}
+	return nil, nil
+}
+
+// FetchRelease downloads the asset whose name matches the given pattern, with the syntax of
+// path.Match, like "tool_*_linux_amd64.tar.gz", of the given release, as looked up by
+// ResolveRelease, into the destination directory, under its name. The asset is verified
+// against the digest published by the hosting service, if any, and, with
+// WithChecksumDiscovery, against the checksum files published along with it, like
+// <asset>.sha256, SHA256SUMS or checksums.txt. Progress is reported through progressCh,
+// which is closed once done.
+func (gf *Fetcher) FetchRelease(ctx context.Context, ref, pattern string, progressCh chan<- ProgressReport) (*Result, error) {
+	if progressCh != nil {
+		defer close(progressCh)
+	}
+
+	release, err := gf.ResolveRelease(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	asset, err := release.asset(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if strings.ContainsAny(asset.Name, `/\`) || asset.Name == "." || asset.Name == ".." {
+		return nil, fmt.Errorf("invalid asset name %q", asset.Name)
+	}
+
+	t := &target{name: asset.Name, size: asset.Size}
+	if asset.Size <= 0 {
+		t.size = -1
+	}
+	if i := strings.Index(asset.Digest, ":"); i > 0 {
+		t.checksums = append(t.checksums, checksum{algorithm: asset.Digest[:i], value: asset.Digest[i+1:]})
+	}
+	if gf.discover && len(gf.checksums) == 0 {
+		c, err := gf.releaseChecksum(ctx, release, asset)
+		if err != nil {
+			return nil, err
+		}
+		if c != nil {
+			t.checksums = append(t.checksums, *c)
+		}
+	}
+
+	return gf.fetchMirrors(withRequestHeader(ctx, asset.header), []string{asset.URL}, progressCh, t)
+}
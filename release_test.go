@@ -0,0 +1,171 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestParseReleaseRef(t *testing.T) {
+	r, err := parseReleaseRef("github.com/owner/repo@latest")
+	assert.Ok(t, err)
+	assert.Equals(t, &releaseRef{host: "github.com", project: "owner/repo"}, r)
+
+	r, err = parseReleaseRef("https://gitlab.com/group/sub/project.git@v1.2.3")
+	assert.Ok(t, err)
+	assert.Equals(t, &releaseRef{host: "gitlab.com", project: "group/sub/project", tag: "v1.2.3"}, r)
+
+	_, err = parseReleaseRef("github.com/owner@v1")
+	assert.Cond(t, err != nil, "references without repository should be rejected")
+}
+
+func TestFetchReleaseGitHub(t *testing.T) {
+	destDir, err := ioutil.TempDir(os.TempDir(), "release-github")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	data := bytes.Repeat([]byte("release"), 100000)
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	// Private assets are redirected to their storage, which is not sent the token.
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			http.Error(w, "token leaked", http.StatusBadRequest)
+			return
+		}
+		http.ServeContent(w, r, "", modTime, bytes.NewReader(data))
+	}))
+	defer storage.Close()
+
+	var api *httptest.Server
+	api = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get("Authorization")
+		switch r.URL.Path {
+		case "/repos/owner/tool/releases/latest", "/repos/owner/tool/releases/tags/v1.0.0":
+			if r.Header.Get("Accept") != "application/vnd.github+json" {
+				http.Error(w, "unexpected Accept header", http.StatusBadRequest)
+				return
+			}
+			fmt.Fprintf(w, `{"tag_name": "v1.0.0", "name": "Tool 1.0.0", "assets": [
+				{"name": "tool_1.0.0_linux_amd64.tar.gz", "size": %d, "digest": "sha256:%x",
+				 "url": "%[3]s/assets/1", "browser_download_url": "%[3]s/download/tool_1.0.0_linux_amd64.tar.gz"},
+				{"name": "tool_1.0.0_darwin_arm64.tar.gz", "size": 6,
+				 "url": "%[3]s/assets/2", "browser_download_url": "%[3]s/download/tool_1.0.0_darwin_arm64.tar.gz"},
+				{"name": "checksums.txt", "size": 100,
+				 "url": "%[3]s/assets/3", "browser_download_url": "%[3]s/download/checksums.txt"}
+			]}`, len(data), sha256.Sum256(data), api.URL)
+		case "/download/tool_1.0.0_linux_amd64.tar.gz":
+			http.ServeContent(w, r, "", modTime, bytes.NewReader(data))
+		case "/download/tool_1.0.0_darwin_arm64.tar.gz":
+			http.ServeContent(w, r, "", modTime, strings.NewReader("darwin"))
+		case "/download/checksums.txt":
+			fmt.Fprintf(w, "%x  tool_1.0.0_linux_amd64.tar.gz\n%x  tool_1.0.0_darwin_arm64.tar.gz\n",
+				sha256.Sum256(data), sha256.Sum256([]byte("other")))
+		case "/assets/1":
+			if token != "Bearer secret" || r.Header.Get("Accept") != "application/octet-stream" {
+				http.Error(w, "unauthorized", http.StatusNotFound)
+				return
+			}
+			// Tokens are only forwarded to the same host.
+			location := strings.Replace(storage.URL, "127.0.0.1", "localhost", 1)
+			http.Redirect(w, r, location+"/tool.tar.gz?signature=abc", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer api.Close()
+
+	t.Setenv("GITHUB_API_URL", api.URL)
+	t.Setenv("GITHUB_TOKEN", "")
+	t.Setenv("GH_TOKEN", "")
+
+	gf := New(WithDestDir(destDir), WithConcurrency(4), WithChecksumDiscovery())
+	release, err := gf.ResolveRelease(context.Background(), "github.com/owner/tool@v1.0.0")
+	assert.Ok(t, err)
+	assert.Equals(t, "v1.0.0", release.Tag)
+	assert.Equals(t, 3, len(release.Assets))
+
+	result, err := gf.FetchRelease(context.Background(), "github.com/owner/tool", "tool_*_linux_amd64.tar.gz", nil)
+	assert.Ok(t, err)
+	got, err := ioutil.ReadAll(result.File)
+	result.File.Close()
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(data, got), "downloaded asset does not match")
+	assert.Equals(t, filepath.Join(destDir, "tool_1.0.0_linux_amd64.tar.gz"), result.File.Name())
+	assert.Equals(t, fmt.Sprintf("%x", sha256.Sum256(data)), result.Digests["sha256"])
+
+	// The published checksums are verified.
+	_, err = gf.FetchRelease(context.Background(), "github.com/owner/tool", "tool_*_darwin_arm64.tar.gz", nil)
+	assert.Cond(t, err != nil && strings.Contains(err.Error(), "integrity"), "assets not matching their checksums should be rejected, got %v", err)
+
+	_, err = gf.FetchRelease(context.Background(), "github.com/owner/tool", "tool_*.tar.gz", nil)
+	assert.Cond(t, err != nil && strings.Contains(err.Error(), "both match"), "ambiguous patterns should be rejected, got %v", err)
+
+	// Assets of private repositories are downloaded through the API.
+	t.Setenv("GITHUB_TOKEN", "secret")
+	assert.Ok(t, os.Remove(filepath.Join(destDir, "tool_1.0.0_linux_amd64.tar.gz")))
+	result, err = New(WithDestDir(destDir)).FetchRelease(context.Background(), "github.com/owner/tool@latest", "*linux*", nil)
+	assert.Ok(t, err)
+	got, err = ioutil.ReadAll(result.File)
+	result.File.Close()
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(data, got), "downloaded private asset does not match")
+}
+
+func TestFetchReleaseGitLab(t *testing.T) {
+	destDir, err := ioutil.TempDir(os.TempDir(), "release-gitlab")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	data := bytes.Repeat([]byte("gitlab"), 10000)
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	var gitlab *httptest.Server
+	gitlab = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("PRIVATE-TOKEN") != "secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.EscapedPath() {
+		case "/api/v4/projects/group%2Fproject/releases/permalink/latest":
+			http.Redirect(w, r, "/api/v4/projects/group%2Fproject/releases/v2.0", http.StatusFound)
+		case "/api/v4/projects/group%2Fproject/releases/v2.0":
+			fmt.Fprintf(w, `{"tag_name": "v2.0", "name": "2.0", "assets": {"links": [
+				{"name": "project.zip", "url": "%[1]s/uploads/project.zip",
+				 "direct_asset_url": "%[1]s/group/project/-/releases/v2.0/downloads/project.zip"}
+			]}}`, gitlab.URL)
+		case "/group/project/-/releases/v2.0/downloads/project.zip":
+			http.ServeContent(w, r, "", modTime, bytes.NewReader(data))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer gitlab.Close()
+
+	host := strings.TrimPrefix(gitlab.URL, "http://")
+	t.Setenv("CI_API_V4_URL", gitlab.URL+"/api/v4")
+	t.Setenv("GITLAB_TOKEN", "secret")
+	t.Setenv("GITHUB_SERVER_URL", "")
+
+	result, err := New(WithDestDir(destDir)).FetchRelease(context.Background(), host+"/group/project@latest", "project.zip", nil)
+	assert.Ok(t, err)
+	defer result.File.Close()
+	got, err := ioutil.ReadAll(result.File)
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(data, got), "downloaded asset does not match")
+}
@@ -0,0 +1,275 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// dohTimeout is the maximum amount of time waiting for the answer of a DNS-over-HTTPS server.
+	dohTimeout = 10 * time.Second
+	// dohMaxMessage is the maximum size of DNS messages, as sent over HTTPS.
+	dohMaxMessage = 65535
+	// dohMinTTL is the minimum amount of time answers are cached, whatever their TTL.
+	dohMinTTL = 5 * time.Second
+)
+
+// normalizeHost returns the given host name as looked up, in lower case and without the
+// trailing dot of fully qualified names.
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// lookupHost returns the addresses the given host name resolves to, as told by the static
+// overrides or the DNS-over-HTTPS server given as options, in this order, or nil if neither
+// knows of the host, which is then resolved by the dialer, through the resolver given as
+// option, if any.
+func (gf *Fetcher) lookupHost(ctx context.Context, host string) ([]string, error) {
+	if ips := gf.lookupOverride(host); ips != nil {
+		return ips, nil
+	}
+	if gf.doh != nil && net.ParseIP(host) == nil {
+		return gf.doh.lookup(ctx, host)
+	}
+	return nil, nil
+}
+
+// lookupOverride returns the addresses the given host name is statically resolved to, if any.
+func (gf *Fetcher) lookupOverride(host string) []string {
+	return gf.hosts[normalizeHost(host)]
+}
+
+// dialResolved dials the given address through the dialer, connecting to the addresses its host
+// resolves to, as told by lookup, one after another until one of them accepts.
+func dialResolved(ctx context.Context, dialer *net.Dialer, lookup func(context.Context, string) ([]string, error),
+	network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || network == "unix" {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	ips, err := lookup(ctx, host)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	if ips == nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	var firstErr error
+	for _, ip := range ips {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if firstErr == nil {
+		firstErr = &net.OpError{Op: "dial", Net: network, Err: fmt.Errorf("no addresses for %s", host)}
+	}
+	return nil, firstErr
+}
+
+// newDoHResolver returns a resolver querying the given DNS-over-HTTPS server, whose own host is
+// resolved through the static overrides, or through the resolver given as option, if any.
+func newDoHResolver(gf *Fetcher, endpoint string) *dohResolver {
+	dialer := &net.Dialer{
+		Timeout:   gf.connectTimeout,
+		KeepAlive: gf.keepAlive,
+		Resolver:  gf.resolver,
+	}
+	lookup := func(ctx context.Context, host string) ([]string, error) {
+		return gf.lookupOverride(host), nil
+	}
+
+	return &dohResolver{
+		endpoint: endpoint,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return dialResolved(ctx, dialer, lookup, network, addr)
+				},
+				TLSClientConfig:     gf.tlsConfig,
+				TLSHandshakeTimeout: tlsHandshakeTimeout,
+				ForceAttemptHTTP2:   true,
+			},
+		},
+	}
+}
+
+// dohResolver resolves host names through a DNS-over-HTTPS server (RFC 8484), caching its
+// answers as long as their TTL tells.
+type dohResolver struct {
+	endpoint string
+	// client sends the queries, it resolves the host of the server through the static overrides
+	// or the system resolver.
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]dohAnswer
+}
+
+// dohAnswer is the answer of a DNS-over-HTTPS server to a query.
+type dohAnswer struct {
+	ips     []string
+	expires time.Time
+}
+
+// lookup returns the IPv4 and IPv6 addresses of the given host name.
+func (r *dohResolver) lookup(ctx context.Context, host string) ([]string, error) {
+	host = normalizeHost(host)
+	types := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	answers := make([][]string, len(types))
+	errs := make([]error, len(types))
+
+	var wg sync.WaitGroup
+	for i, t := range types {
+		wg.Add(1)
+		go func(i int, t dnsmessage.Type) {
+			defer wg.Done()
+			answers[i], errs[i] = r.cached(ctx, host, t)
+		}(i, t)
+	}
+	wg.Wait()
+
+	// Hosts with addresses of only one family are common.
+	var ips []string
+	for _, a := range answers {
+		ips = append(ips, a...)
+	}
+	if len(ips) > 0 {
+		return ips, nil
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, Server: r.endpoint, IsNotFound: true}
+}
+
+// cached returns the cached answer to the given query, querying the server if it expired.
+func (r *dohResolver) cached(ctx context.Context, host string, t dnsmessage.Type) ([]string, error) {
+	key := t.String() + " " + host
+	r.mu.Lock()
+	a, ok := r.cache[key]
+	r.mu.Unlock()
+	if ok && time.Now().Before(a.expires) {
+		return a.ips, nil
+	}
+
+	ips, ttl, err := r.query(ctx, host, t)
+	if err != nil {
+		return nil, err
+	}
+	if ttl < dohMinTTL {
+		ttl = dohMinTTL
+	}
+
+	r.mu.Lock()
+	if r.cache == nil {
+		r.cache = make(map[string]dohAnswer)
+	}
+	r.cache[key] = dohAnswer{ips: ips, expires: time.Now().Add(ttl)}
+	r.mu.Unlock()
+	return ips, nil
+}
+
+// query asks the server for the records of the given type of the host name, returning the
+// addresses they hold and how long they can be cached.
+func (r *dohResolver) query(ctx context.Context, host string, t dnsmessage.Type) ([]string, time.Duration, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	// The ID is 0 for answers to be cacheable by HTTP caches.
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: t, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dohTimeout)
+	defer cancel()
+	req, err := http.NewRequest("POST", r.endpoint, bytes.NewReader(packed))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	res, err := r.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "failed looking up %s", host)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, 0, errors.Wrapf(&statusError{code: res.StatusCode, status: res.Status}, "failed looking up %s", host)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, dohMaxMessage))
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "failed looking up %s", host)
+	}
+
+	var answer dnsmessage.Message
+	if err := answer.Unpack(body); err != nil {
+		return nil, 0, errors.Wrapf(err, "invalid answer looking up %s", host)
+	}
+	switch answer.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host, Server: r.endpoint, IsNotFound: true}
+	default:
+		return nil, 0, &net.DNSError{Err: "server failure: " + answer.RCode.String(), Name: host, Server: r.endpoint, IsTemporary: true}
+	}
+
+	var ips []string
+	ttl := time.Duration(-1)
+	for _, rr := range answer.Answers {
+		var ip net.IP
+		switch b := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			ip = net.IP(b.A[:])
+		case *dnsmessage.AAAAResource:
+			ip = net.IP(b.AAAA[:])
+		default:
+			// CNAME records are followed by the server, which sends their addresses along.
+			continue
+		}
+		if rr.Header.Type != t {
+			continue
+		}
+		ips = append(ips, ip.String())
+		if d := time.Duration(rr.Header.TTL) * time.Second; ttl < 0 || d < ttl {
+			ttl = d
+		}
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+	return ips, ttl, nil
+}
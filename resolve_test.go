@@ -0,0 +1,172 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsAnswer answers the given DNS query with the IPv4 addresses of the given hosts, and with
+// NXDOMAIN for any other host.
+func dnsAnswer(query []byte, hosts map[string]string) ([]byte, error) {
+	var q dnsmessage.Message
+	if err := q.Unpack(query); err != nil {
+		return nil, err
+	}
+
+	answer := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: q.ID, Response: true, RecursionAvailable: true},
+		Questions: q.Questions,
+	}
+	question := q.Questions[0]
+	ip, ok := hosts[strings.TrimSuffix(question.Name.String(), ".")]
+	if !ok {
+		answer.RCode = dnsmessage.RCodeNameError
+	} else if question.Type == dnsmessage.TypeA {
+		var a [4]byte
+		copy(a[:], net.ParseIP(ip).To4())
+		answer.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   &dnsmessage.AResource{A: a},
+		}}
+	}
+	return answer.Pack()
+}
+
+func TestHostOverride(t *testing.T) {
+	destDir, err := ioutil.TempDir(os.TempDir(), "resolve-override")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	data := bytes.Repeat([]byte("pinned"), 10000)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer ts.Close()
+	_, port, err := net.SplitHostPort(ts.Listener.Addr().String())
+	assert.Ok(t, err)
+
+	// Addresses are tried in turn, nothing listens on the first one.
+	gf := New(WithDestDir(destDir), WithHostOverride("Mirror.Invalid.", "127.0.0.2", "127.0.0.1"))
+	file, err := gf.Fetch("http://mirror.invalid:"+port+"/file.bin", nil)
+	assert.Ok(t, err)
+	got, err := ioutil.ReadAll(file)
+	file.Close()
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(data, got), "content of the overridden host does not match")
+}
+
+func TestDNSOverHTTPS(t *testing.T) {
+	destDir, err := ioutil.TempDir(os.TempDir(), "resolve-doh")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	data := bytes.Repeat([]byte("resolved"), 10000)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer ts.Close()
+	_, port, err := net.SplitHostPort(ts.Listener.Addr().String())
+	assert.Ok(t, err)
+
+	var queries int32
+	doh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		atomic.AddInt32(&queries, 1)
+		query, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		answer, err := dnsAnswer(query, map[string]string{"files.internal": "127.0.0.1"})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(answer)
+	}))
+	defer doh.Close()
+	_, dohPort, err := net.SplitHostPort(doh.Listener.Addr().String())
+	assert.Ok(t, err)
+
+	// The host of the DNS-over-HTTPS server is not looked up through itself.
+	gf := New(WithDestDir(destDir),
+		WithDNSOverHTTPS("http://doh.internal:"+dohPort+"/dns-query"),
+		WithHostOverride("doh.internal", "127.0.0.1"))
+	for i := 0; i < 2; i++ {
+		file, err := gf.Fetch("http://files.internal:"+port+"/file.bin", nil)
+		assert.Ok(t, err)
+		got, err := ioutil.ReadAll(file)
+		file.Close()
+		assert.Ok(t, err)
+		assert.Cond(t, bytes.Equal(data, got), "content of the resolved host does not match")
+	}
+	// Answers are cached.
+	assert.Equals(t, int32(2), atomic.LoadInt32(&queries))
+
+	_, err = gf.doh.lookup(context.Background(), "missing.internal")
+	dnsErr, ok := err.(*net.DNSError)
+	assert.Cond(t, ok && dnsErr.IsNotFound, "unknown hosts should not be found, got %v", err)
+}
+
+func TestResolver(t *testing.T) {
+	destDir, err := ioutil.TempDir(os.TempDir(), "resolve-resolver")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	data := bytes.Repeat([]byte("split"), 10000)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer ts.Close()
+	_, port, err := net.SplitHostPort(ts.Listener.Addr().String())
+	assert.Ok(t, err)
+
+	// A DNS server only the resolver knows of, like the ones of private networks.
+	dns, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Ok(t, err)
+	defer dns.Close()
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, addr, err := dns.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			if answer, err := dnsAnswer(b[:n], map[string]string{"artifacts.corp": "127.0.0.1"}); err == nil {
+				dns.WriteTo(answer, addr)
+			}
+		}
+	}()
+
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "udp", dns.LocalAddr().String())
+		},
+	}
+	file, err := New(WithDestDir(destDir), WithResolver(resolver)).Fetch("http://artifacts.corp:"+port+"/file.bin", nil)
+	assert.Ok(t, err)
+	got, err := ioutil.ReadAll(file)
+	file.Close()
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(data, got), "content of the host resolved by the resolver does not match")
+}
@@ -0,0 +1,111 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxBackoff caps the amount of time waited between retries.
+const maxBackoff = 1 * time.Minute
+
+// statusError is returned when a server responds with an unexpected HTTP status code.
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("HTTP requests returned a non 2xx status code: %s", e.status)
+}
+
+// retry runs fn until it succeeds, fails with a permanent error or the
+// maximum number of retries is reached, sleeping with jittered exponential
+// backoff between attempts.
+func (gf *Fetcher) retry(ctx context.Context, fn func() error) error {
+	return retryTimes(ctx, gf.retries, gf.backoff, fn)
+}
+
+// retryChunk is like retry but it follows the retry policy for chunks, see WithChunkRetries.
+func (gf *Fetcher) retryChunk(ctx context.Context, fn func() error) error {
+	if gf.chunkRetries < 0 {
+		return gf.retry(ctx, fn)
+	}
+	return retryTimes(ctx, gf.chunkRetries, gf.chunkBackoff, fn)
+}
+
+// retryTimes runs fn until it succeeds, fails with a permanent error or it was retried
+// max times, sleeping with jittered exponential backoff between attempts.
+func retryTimes(ctx context.Context, max int, base time.Duration, fn func() error) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = fn()
+		if err == nil || attempt >= max || !isTransient(err) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff(base, attempt)):
+		}
+	}
+}
+
+// backoff returns the time to wait before the given retry attempt. The delay
+// doubles on every attempt and is randomized by ±50% so that concurrent chunks
+// do not hit the server in lockstep.
+func backoff(base time.Duration, attempt int) time.Duration {
+	delay := base << uint(attempt)
+	if delay <= 0 || delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay)+1))
+}
+
+// isTransient tells whether an error is likely to go away by retrying the request.
+func isTransient(err error) bool {
+	err = errors.Cause(err)
+
+	if se, ok := err.(*statusError); ok {
+		switch se.code {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+
+	if _, ok := err.(*stallError); ok {
+		return true
+	}
+
+	if _, ok := err.(*blockError); ok {
+		return true
+	}
+
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return true
+	}
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,414 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// S3Handler fetches objects from Amazon S3, or S3 compatible services, through s3://bucket/key
+// URLs. Requests are signed with AWS Signature Version 4 using the credentials found in the
+// environment, the shared credentials file or the EC2 instance metadata service, in that
+// order, and sent unsigned, for public buckets, if there are none. Objects are read in byte
+// ranges, so downloads are resumed and split in chunks, resumed chunks being requested only
+// if the ETag of the object did not change. The MD5 digest of objects uploaded in a single
+// part, and any checksum stored along with objects, are verified when WithServerChecksums is
+// set. It is registered for the s3 scheme by default.
+type S3Handler struct {
+	// Endpoint is the URL of an S3 compatible service, like MinIO, addressing buckets in its
+	// path. Amazon S3 is used if empty.
+	Endpoint string
+	// Region is the region of buckets. It is taken from AWS_REGION, AWS_DEFAULT_REGION or the
+	// shared config file if empty, and defaults to us-east-1. Amazon S3 buckets in other
+	// regions are found anyway, at the cost of an extra request.
+	Region string
+	// Credentials returns the credentials to sign requests with, or nil to send them unsigned.
+	// The credentials are looked up as described above if nil.
+	Credentials func(ctx context.Context) (*AWSCredentials, error)
+	// Client sends the requests. The client of the fetcher is used if nil, with its TLS
+	// settings, proxy and timeouts, or http.DefaultClient outside a fetcher.
+	Client *http.Client
+
+	mu sync.Mutex
+	// regions holds the regions buckets were found in, keyed by bucket.
+	regions map[string]string
+	// imds holds the credentials obtained from the instance metadata service, if imdsChecked.
+	imds        *AWSCredentials
+	imdsChecked bool
+}
+
+// AWSCredentials are the credentials requests to AWS are signed with.
+type AWSCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is only set for temporary credentials.
+	SessionToken string
+	// Expires is the time temporary credentials expire at.
+	Expires time.Time
+}
+
+func (h *S3Handler) Stat(ctx context.Context, rawURL string) (*ContentInfo, error) {
+	header := http.Header{}
+	// Checksums stored along with objects are only sent back if asked for.
+	header.Set("X-Amz-Checksum-Mode", "ENABLED")
+	res, err := h.send(ctx, "HEAD", rawURL, header)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, &statusError{code: res.StatusCode, status: res.Status}
+	}
+
+	info := &ContentInfo{
+		Size:   res.ContentLength,
+		Ranges: true,
+		ETag:   res.Header.Get("ETag"),
+	}
+	if modTime, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = modTime
+	}
+
+	checksums := serverChecksums(res.Header)
+	// The ETag of objects uploaded in a single part is their MD5 digest, unless they are
+	// encrypted with KMS or customer keys.
+	etag := strings.Trim(info.ETag, `"`)
+	if _, err := hex.DecodeString(etag); err == nil && len(etag) == 32 &&
+		!strings.HasPrefix(res.Header.Get("X-Amz-Server-Side-Encryption"), "aws:kms") &&
+		res.Header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") == "" {
+		checksums = append(checksums, checksum{algorithm: "md5", value: etag})
+	}
+	for _, c := range checksums {
+		if info.Checksums == nil {
+			info.Checksums = make(map[string]string)
+		}
+		info.Checksums[c.algorithm] = c.value
+	}
+	return info, nil
+}
+
+func (h *S3Handler) Open(ctx context.Context, rawURL string, offset, length int64) (io.ReadCloser, error) {
+	return h.OpenIfMatch(ctx, rawURL, offset, length, "")
+}
+
+func (h *S3Handler) OpenIfMatch(ctx context.Context, rawURL string, offset, length int64, etag string) (io.ReadCloser, error) {
+	header := http.Header{}
+	if rng := rangeHeader(offset, length); rng != "" {
+		header.Set("Range", rng)
+	}
+	if etag != "" {
+		header.Set("If-Match", etag)
+	}
+
+	res, err := h.send(ctx, "GET", rawURL, header)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case res.StatusCode == http.StatusPreconditionFailed:
+		res.Body.Close()
+		return nil, ErrContentChanged
+	// Servers may send the whole content when asked for a range of it from its beginning.
+	case res.StatusCode != http.StatusPartialContent && (offset > 0 || res.StatusCode != http.StatusOK):
+		res.Body.Close()
+		return nil, &statusError{code: res.StatusCode, status: res.Status}
+	}
+	return res.Body, nil
+}
+
+// send sends a signed request for the object of the given URL, retrying it in the region the
+// bucket is in if it is not the one expected.
+func (h *S3Handler) send(ctx context.Context, method, rawURL string, header http.Header) (*http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	bucket, key := u.Host, strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" {
+		return nil, fmt.Errorf("invalid S3 URL, expected s3://bucket/key: %s", rawURL)
+	}
+
+	creds, err := h.credentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	client := h.Client
+	if client == nil {
+		client = httpClientFrom(ctx)
+	}
+
+	region := h.region(bucket)
+	for redirected := false; ; redirected = true {
+		req, err := http.NewRequest(method, h.objectURL(bucket, key, region), nil)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+
+		if creds != nil {
+			signer := &AWSSigner{
+				AccessKeyID:     creds.AccessKeyID,
+				SecretAccessKey: creds.SecretAccessKey,
+				SessionToken:    creds.SessionToken,
+				Region:          region,
+			}
+			if err := signer.Sign(req); err != nil {
+				return nil, err
+			}
+		}
+
+		res, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		// Requests sent to the wrong region are answered with the region of the bucket.
+		actual := res.Header.Get("X-Amz-Bucket-Region")
+		if redirected || h.Endpoint != "" || actual == "" || actual == region ||
+			(res.StatusCode != http.StatusMovedPermanently && res.StatusCode != http.StatusBadRequest) {
+			return res, nil
+		}
+		res.Body.Close()
+
+		h.mu.Lock()
+		if h.regions == nil {
+			h.regions = make(map[string]string)
+		}
+		h.regions[bucket] = actual
+		h.mu.Unlock()
+		region = actual
+	}
+}
+
+// objectURL returns the HTTPS URL of the given object.
+func (h *S3Handler) objectURL(bucket, key, region string) string {
+	u := &url.URL{Scheme: "https", Host: "s3." + region + ".amazonaws.com", Path: "/" + bucket + "/" + key}
+	if h.Endpoint != "" {
+		endpoint, err := url.Parse(h.Endpoint)
+		if err == nil {
+			u.Scheme, u.Host = endpoint.Scheme, endpoint.Host
+			u.Path = strings.TrimSuffix(endpoint.Path, "/") + u.Path
+		}
+	} else if !strings.Contains(bucket, ".") {
+		// Buckets are addressed in the host name, unless their name would not match the
+		// wildcard certificate of S3.
+		u.Host = bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	// Paths are sent encoded the same as they are signed.
+	u.RawPath = awsURIEncode(u.Path, false)
+	return u.String()
+}
+
+// region returns the region of the given bucket.
+func (h *S3Handler) region(bucket string) string {
+	h.mu.Lock()
+	region := h.regions[bucket]
+	h.mu.Unlock()
+
+	switch {
+	case region != "":
+		return region
+	case h.Region != "":
+		return h.Region
+	case os.Getenv("AWS_REGION") != "":
+		return os.Getenv("AWS_REGION")
+	case os.Getenv("AWS_DEFAULT_REGION") != "":
+		return os.Getenv("AWS_DEFAULT_REGION")
+	}
+
+	path := os.Getenv("AWS_CONFIG_FILE")
+	if path == "" {
+		home, _ := os.UserHomeDir()
+		path = filepath.Join(home, ".aws", "config")
+	}
+	section := "default"
+	if profile := awsProfile(); profile != "default" {
+		section = "profile " + profile
+	}
+	if region := readINI(path, section)["region"]; region != "" {
+		return region
+	}
+	return "us-east-1"
+}
+
+// credentials returns the credentials to sign requests with, or nil if there are none.
+func (h *S3Handler) credentials(ctx context.Context) (*AWSCredentials, error) {
+	if h.Credentials != nil {
+		return h.Credentials(ctx)
+	}
+
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		return &AWSCredentials{AccessKeyID: id, SecretAccessKey: secret, SessionToken: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, _ := os.UserHomeDir()
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := readINI(path, awsProfile())
+	if id, secret := profile["aws_access_key_id"], profile["aws_secret_access_key"]; id != "" && secret != "" {
+		return &AWSCredentials{AccessKeyID: id, SecretAccessKey: secret, SessionToken: profile["aws_session_token"]}, nil
+	}
+
+	// Credentials of the instance are temporary, they are renewed before they expire.
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.imdsChecked && (h.imds == nil || time.Until(h.imds.Expires) > 5*time.Minute) {
+		return h.imds, nil
+	}
+	creds, err := imdsCredentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+	h.imds, h.imdsChecked = creds, true
+	return creds, nil
+}
+
+// awsProfile returns the name of the profile of the shared config and credentials files in use.
+func awsProfile() string {
+	if profile := os.Getenv("AWS_PROFILE"); profile != "" {
+		return profile
+	}
+	return "default"
+}
+
+// readINI returns the keys of the given section of an INI file, like the AWS shared config
+// and credentials files. It returns nil if the file cannot be read.
+func readINI(path, section string) map[string]string {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var keys map[string]string
+	var current string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			current = strings.TrimSpace(line[1 : len(line)-1])
+		case current == section:
+			parts := strings.SplitN(line, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			if keys == nil {
+				keys = make(map[string]string)
+			}
+			keys[strings.ToLower(strings.TrimSpace(parts[0]))] = strings.TrimSpace(parts[1])
+		}
+	}
+	return keys
+}
+
+// imdsCredentials returns the credentials of the role of the EC2 instance, obtained from the
+// instance metadata service, version 2. It returns nil if the service cannot be reached, as
+// when not running on EC2.
+func imdsCredentials(ctx context.Context) (*AWSCredentials, error) {
+	if strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true") {
+		return nil, nil
+	}
+	endpoint := os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "http://169.254.169.254"
+	}
+	endpoint = strings.TrimSuffix(endpoint, "/")
+
+	// The service answers right away, if it is there at all.
+	client := &http.Client{Timeout: 2 * time.Second}
+	get := func(method, path string, header http.Header) (*http.Response, error) {
+		req, err := http.NewRequest(method, endpoint+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		req.Header = header
+		return client.Do(req)
+	}
+
+	res, err := get("PUT", "/latest/api/token", http.Header{"X-Aws-Ec2-Metadata-Token-Ttl-Seconds": {"21600"}})
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, nil
+	}
+	token, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, nil
+	}
+
+	header := http.Header{"X-Aws-Ec2-Metadata-Token": {string(token)}}
+	res, err = get("GET", "/latest/meta-data/iam/security-credentials/", header)
+	if err != nil {
+		return nil, err
+	}
+	roles, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	role := strings.TrimSpace(strings.SplitN(string(roles), "\n", 2)[0])
+	if res.StatusCode == http.StatusNotFound || role == "" {
+		// The instance has no role attached.
+		return nil, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, &statusError{code: res.StatusCode, status: res.Status}
+	}
+
+	res, err = get("GET", "/latest/meta-data/iam/security-credentials/"+role, header)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, &statusError{code: res.StatusCode, status: res.Status}
+	}
+
+	var creds struct {
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	if err := json.NewDecoder(res.Body).Decode(&creds); err != nil {
+		return nil, fmt.Errorf("invalid credentials from the instance metadata service: %s", err)
+	}
+	return &AWSCredentials{
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.Token,
+		Expires:         creds.Expiration,
+	}, nil
+}
@@ -0,0 +1,209 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Handler fetches content from URLs of a scheme other than HTTP(S), once registered with
+// RegisterScheme. Content fetched through handlers is resumed, verified and reported on
+// like content fetched over HTTP.
+type Handler interface {
+	// Stat returns details about the content at the given URL.
+	Stat(ctx context.Context, url string) (*ContentInfo, error)
+	// Open returns length bytes of the content at the given URL from the given offset on, or
+	// the rest of it if length is -1. The offset is only other than zero if Stat reported that
+	// the content can be read from any offset. Readers may go past length, the bytes after it
+	// are not read, but sources charging for transfers or sending whole ranges at once should
+	// only be asked for length bytes.
+	Open(ctx context.Context, url string, offset, length int64) (io.ReadCloser, error)
+}
+
+// ContentInfo describes content fetched through a Handler.
+type ContentInfo struct {
+	// Size is the length of the content in bytes, or -1 if unknown.
+	Size int64
+	// Ranges tells whether the content can be read from any offset, so it can be downloaded
+	// in several chunks at once and resumed if interrupted.
+	Ranges bool
+	// ETag identifies the version of the content, if known.
+	ETag string
+	// ModTime is the time the content was last modified, if known.
+	ModTime time.Time
+	// Checksums are the hex encoded checksums of the content known to the source, keyed by
+	// hashing algorithm. The content is verified against them when WithServerChecksums is set.
+	Checksums map[string]string
+	// Digests are the hex encoded digests the content is addressed by, keyed by hashing
+	// algorithm, like the digests of OCI blobs. Unlike Checksums, the content is always
+	// verified against them.
+	Digests map[string]string
+}
+
+// ConditionalHandler is a Handler able to make sure the content it opens did not change
+// since it was described by Stat, so resumed downloads are not made of different versions
+// of the content.
+type ConditionalHandler interface {
+	Handler
+	// OpenIfMatch is like Open, but fails with ErrContentChanged if the ETag of the content
+	// is no longer the given one.
+	OpenIfMatch(ctx context.Context, url string, offset, length int64, etag string) (io.ReadCloser, error)
+}
+
+var (
+	schemesMu sync.RWMutex
+	schemes   = map[string]Handler{
+		"file":   fileHandler{},
+		"data":   dataHandler{},
+		"ftp":    &FTPHandler{},
+		"ftps":   &FTPHandler{},
+		"sftp":   &SFTPHandler{},
+		"scp":    &SFTPHandler{},
+		"s3":     &S3Handler{},
+		"gs":     &GCSHandler{},
+		"azblob": &AzureBlobHandler{},
+		"ipfs":   &IPFSHandler{},
+		"oci":    &OCIHandler{},
+	}
+)
+
+// RegisterScheme fetches URLs of the given scheme, like "hdfs", through the given handler,
+// replacing the handler registered before for the scheme, if any. HTTP and HTTPS are built-in,
+// registering them has no effect. Local files, FTP servers, SSH servers, S3 buckets, Cloud
+// Storage buckets, Azure Blob Storage containers, IPFS and OCI registries are supported out of
+// the box, through file://, ftp://, ftps://, sftp://, scp://, s3://, gs://, azblob://, ipfs://
+// and oci:// URLs, as well as data: URIs and the standard input, through "-".
+func RegisterScheme(scheme string, handler Handler) {
+	scheme = strings.ToLower(scheme)
+	if scheme == "http" || scheme == "https" {
+		return
+	}
+
+	schemesMu.Lock()
+	defer schemesMu.Unlock()
+	if handler == nil {
+		delete(schemes, scheme)
+		return
+	}
+	schemes[scheme] = handler
+}
+
+// schemeHandler returns the handler of the scheme of the given URL, or of the standard input
+// for "-". It returns nil for HTTP(S) URLs, including http+unix:// ones, and URLs without
+// scheme, and an error if the scheme is not supported.
+func schemeHandler(rawURL string) (Handler, error) {
+	if rawURL == stdinURL {
+		return stdinHandler{}, nil
+	}
+	// Unix domain sockets are spoken to over HTTP, their URLs cannot be parsed as is though.
+	if isUnixURL(rawURL) {
+		return nil, nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	if scheme == "" || scheme == "http" || scheme == "https" {
+		return nil, nil
+	}
+
+	schemesMu.RLock()
+	defer schemesMu.RUnlock()
+	handler, ok := schemes[scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported URL scheme: %s", u.Scheme)
+	}
+	return handler, nil
+}
+
+// httpClientKey is the context key of the client handlers send their HTTP requests through.
+type httpClientKey struct{}
+
+// newHandlerClient returns the client the built-in handlers send their HTTP requests through,
+// which is the client of the fetcher, running its request hooks and sending its user agent.
+func newHandlerClient(gf *Fetcher) *http.Client {
+	client := *gf.httpClient
+	client.Transport = &hookTransport{gf: gf, base: client.Transport}
+	return &client
+}
+
+// handlerContext returns a context for handlers to send their HTTP requests through the client
+// of the fetcher, with its TLS settings, proxy, resolver and timeouts.
+func (gf *Fetcher) handlerContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, httpClientKey{}, gf.handlerHTTP)
+}
+
+// httpClientFrom returns the client handlers send their HTTP requests through when using the
+// given context, which is http.DefaultClient outside a fetcher.
+func httpClientFrom(ctx context.Context) *http.Client {
+	if client, ok := ctx.Value(httpClientKey{}).(*http.Client); ok && client != nil {
+		return client
+	}
+	return http.DefaultClient
+}
+
+// handlerResource finds out the size of the content at the given URL through its handler, and
+// whether it can be read from any offset. Its version is described through the headers HTTP
+// servers would send, so it is validated the same.
+func handlerResource(ctx context.Context, handler Handler, rawURL string) (*resource, error) {
+	info, err := handler.Stat(ctx, rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	header := http.Header{}
+	if info.ETag != "" {
+		header.Set("ETag", info.ETag)
+	}
+	if !info.ModTime.IsZero() {
+		header.Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	}
+
+	return &resource{
+		url:       rawURL,
+		size:      info.Size,
+		ranges:    info.Ranges,
+		header:    header,
+		handler:   handler,
+		checksums: sortedChecksums(info.Checksums),
+		digests:   sortedChecksums(info.Digests),
+	}, nil
+}
+
+// sortedChecksums returns the given checksums, keyed by hashing algorithm, sorted by algorithm.
+func sortedChecksums(sums map[string]string) []checksum {
+	var checksums []checksum
+	for alg, value := range sums {
+		checksums = append(checksums, checksum{algorithm: alg, value: value})
+	}
+	sort.Slice(checksums, func(i, j int) bool {
+		return checksums[i].algorithm < checksums[j].algorithm
+	})
+	return checksums
+}
+
+// rangeHeader returns the Range header asking for length bytes from the given offset on, or
+// for the rest of the content if length is -1. It is empty if the whole content is asked for.
+func rangeHeader(offset, length int64) string {
+	switch {
+	case length >= 0:
+		return fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+	case offset > 0:
+		return fmt.Sprintf("bytes=%d-", offset)
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,142 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+// memoryHandler serves the same content for every URL, recording the offsets it is read from
+// and the number of bytes it serves.
+type memoryHandler struct {
+	data   []byte
+	ranges bool
+
+	mu      sync.Mutex
+	offsets []int64
+	served  int64
+}
+
+func (h *memoryHandler) Stat(ctx context.Context, url string) (*ContentInfo, error) {
+	return &ContentInfo{Size: int64(len(h.data)), Ranges: h.ranges, ETag: `"v1"`, ModTime: time.Unix(1500000000, 0)}, nil
+}
+
+func (h *memoryHandler) Open(ctx context.Context, url string, offset, length int64) (io.ReadCloser, error) {
+	data := h.data[offset:]
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+	h.mu.Lock()
+	h.offsets = append(h.offsets, offset)
+	h.served += int64(len(data))
+	h.mu.Unlock()
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func TestRegisterScheme(t *testing.T) {
+	data, err := ioutil.ReadFile("./fixtures/test")
+	assert.Ok(t, err)
+
+	h := &memoryHandler{data: data, ranges: true}
+	RegisterScheme("mem", h)
+	defer RegisterScheme("mem", nil)
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "register-scheme")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	gf := New(WithDestDir(destDir), WithConcurrency(3), WithChecksum("sha256", fmt.Sprintf("%x", sha256.Sum256(data))))
+	progressCh := make(chan ProgressReport)
+	var result *Result
+	done := make(chan error)
+	go func() {
+		var err error
+		result, err = gf.FetchContext(context.Background(), "mem://bucket/test", progressCh)
+		done <- err
+	}()
+
+	var total int64
+	for p := range progressCh {
+		total += p.WrittenBytes
+	}
+	assert.Ok(t, <-done)
+	defer result.File.Close()
+	assert.Equals(t, int64(len(data)), total)
+
+	got, err := ioutil.ReadAll(result.File)
+	assert.Ok(t, err)
+	assert.Equals(t, data, got)
+
+	// The content was downloaded in chunks.
+	h.mu.Lock()
+	sort.Slice(h.offsets, func(i, j int) bool { return h.offsets[i] < h.offsets[j] })
+	assert.Equals(t, []int64{0, 3495253, 6990506}, h.offsets)
+	// Chunks are only opened for their own bytes.
+	assert.Equals(t, int64(len(data)), h.served)
+	h.mu.Unlock()
+
+	_, err = gf.Fetch("unknown://bucket/test", nil)
+	assert.Cond(t, err != nil, "Fetch should fail for unsupported schemes")
+}
+
+func TestSchemeResume(t *testing.T) {
+	data, err := ioutil.ReadFile("./fixtures/test-resume")
+	assert.Ok(t, err)
+	size := int64(len(data))
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "scheme-resume")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	for _, ranges := range []bool{true, false} {
+		h := &memoryHandler{data: data, ranges: ranges}
+		RegisterScheme("mem", h)
+
+		chunksDir := filepath.Join(destDir, "test-resume.chunks")
+		assert.Ok(t, os.MkdirAll(chunksDir, 0760))
+		assert.Ok(t, ioutil.WriteFile(filepath.Join(chunksDir, "data"), data[:1024], 0660))
+		rsc, err := handlerResource(context.Background(), h, "mem://bucket/test-resume")
+		assert.Ok(t, err)
+		assert.Ok(t, saveState(filepath.Join(chunksDir, "state"), newDownloadState("mem://bucket/test-resume", rsc, nil),
+			[]*chunk{{Start: 0, End: size, Written: 1024, crc: crc32.Checksum(data[:1024], crc32c)}}))
+
+		gf := New(WithDestDir(destDir))
+		file, err := gf.Fetch("mem://bucket/test-resume", nil)
+		assert.Ok(t, err)
+		got, err := ioutil.ReadAll(file)
+		file.Close()
+		assert.Ok(t, err)
+		assert.Equals(t, data, got)
+
+		// Content that cannot be read from any offset is downloaded again.
+		offset := int64(1024)
+		if !ranges {
+			offset = 0
+		}
+		assert.Equals(t, []int64{offset}, h.offsets)
+	}
+	RegisterScheme("mem", nil)
+}
+
+func TestRangeHeader(t *testing.T) {
+	assert.Equals(t, "", rangeHeader(0, -1))
+	assert.Equals(t, "bytes=10-", rangeHeader(10, -1))
+	assert.Equals(t, "bytes=0-99", rangeHeader(0, 100))
+	assert.Equals(t, "bytes=10-29", rangeHeader(10, 20))
+}
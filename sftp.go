@@ -0,0 +1,226 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTPHandler fetches files over SSH through sftp:// and scp:// URLs, both transferred with
+// the SFTP protocol. Paths are absolute, unless they start with /~/, in which case they are
+// relative to the home directory of the user. It authenticates as the user of the URL, or the
+// current user if there is none, with the password of the URL, the keys of an SSH agent and
+// the private keys given. Files are read from any offset, so downloads are resumed and split
+// in chunks, each chunk using a connection of its own. It is registered for both schemes by
+// default, using the running SSH agent, the unencrypted keys in ~/.ssh and ~/.ssh/known_hosts.
+type SFTPHandler struct {
+	// Signers are the private keys to authenticate with. The unencrypted id_ed25519, id_ecdsa
+	// and id_rsa keys in ~/.ssh are used if nil.
+	Signers []ssh.Signer
+	// Agent holds keys to authenticate with. The agent listening at SSH_AUTH_SOCK is used if
+	// nil, if any.
+	Agent agent.Agent
+	// HostKeyCallback verifies the keys of servers. Keys are checked against
+	// ~/.ssh/known_hosts if nil.
+	HostKeyCallback ssh.HostKeyCallback
+	// Timeout is the timeout for connecting to servers. It is 30 seconds if zero.
+	Timeout time.Duration
+}
+
+func (h *SFTPHandler) Stat(ctx context.Context, rawURL string) (*ContentInfo, error) {
+	conn, err := h.dial(ctx, rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	fi, err := conn.client.Stat(conn.path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", conn.path)
+	}
+	return &ContentInfo{Size: fi.Size(), Ranges: true, ModTime: fi.ModTime()}, nil
+}
+
+func (h *SFTPHandler) Open(ctx context.Context, rawURL string, offset, length int64) (io.ReadCloser, error) {
+	conn, err := h.dial(ctx, rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := conn.client.Open(conn.path)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	r := &sftpReader{File: file, conn: conn, done: make(chan struct{})}
+	go func() {
+		// Reads are not bound to the context, so they are unblocked by closing the connection.
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-r.done:
+		}
+	}()
+	return r, nil
+}
+
+// sftpConn is an SFTP session opened for the file at path.
+type sftpConn struct {
+	ssh    *ssh.Client
+	client *sftp.Client
+	path   string
+}
+
+func (c *sftpConn) Close() error {
+	c.client.Close()
+	return c.ssh.Close()
+}
+
+// dial connects and authenticates to the server of the given URL, starting an SFTP session.
+func (h *SFTPHandler) dial(ctx context.Context, rawURL string) (*sftpConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	keyring := h.Agent
+	if keyring == nil {
+		if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+			if conn, err := net.Dial("unix", sock); err == nil {
+				// The agent is only needed while authenticating.
+				defer conn.Close()
+				keyring = agent.NewClient(conn)
+			}
+		}
+	}
+
+	config, err := h.clientConfig(u, keyring)
+	if err != nil {
+		return nil, err
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "22")
+	}
+
+	dialer := net.Dialer{Timeout: config.Timeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	// The handshake is bound to the timeout, as it is not to the context.
+	netConn.SetDeadline(time.Now().Add(config.Timeout))
+	c, chans, reqs, err := ssh.NewClientConn(netConn, host, config)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	netConn.SetDeadline(time.Time{})
+	sshClient := ssh.NewClient(c, chans, reqs)
+
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, err
+	}
+
+	path := u.Path
+	if strings.HasPrefix(path, "/~/") {
+		// SFTP servers resolve relative paths from the home directory.
+		path = path[len("/~/"):]
+	}
+	return &sftpConn{ssh: sshClient, client: client, path: path}, nil
+}
+
+// clientConfig returns the configuration to connect as the user of the given URL, authenticating
+// with the keys of keyring, if set, among others.
+func (h *SFTPHandler) clientConfig(u *url.URL, keyring agent.Agent) (*ssh.ClientConfig, error) {
+	config := &ssh.ClientConfig{
+		HostKeyCallback: h.HostKeyCallback,
+		Timeout:         h.Timeout,
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 30 * time.Second
+	}
+
+	if u.User != nil {
+		config.User = u.User.Username()
+	} else if current, err := user.Current(); err == nil {
+		config.User = current.Username
+	}
+
+	home, _ := os.UserHomeDir()
+	if config.HostKeyCallback == nil {
+		callback, err := knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+		if err != nil {
+			return nil, fmt.Errorf("unable to verify host keys: %s", err)
+		}
+		config.HostKeyCallback = callback
+	}
+
+	if password, ok := u.User.Password(); ok {
+		config.Auth = append(config.Auth, ssh.Password(password))
+	}
+
+	if keyring != nil {
+		config.Auth = append(config.Auth, ssh.PublicKeysCallback(keyring.Signers))
+	}
+
+	signers := h.Signers
+	if signers == nil {
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			key, err := ioutil.ReadFile(filepath.Join(home, ".ssh", name))
+			if err != nil {
+				continue
+			}
+			if signer, err := ssh.ParsePrivateKey(key); err == nil {
+				signers = append(signers, signer)
+			}
+		}
+	}
+	if len(signers) > 0 {
+		config.Auth = append(config.Auth, ssh.PublicKeys(signers...))
+	}
+	return config, nil
+}
+
+// sftpReader reads a remote file, closing its connection when done.
+type sftpReader struct {
+	*sftp.File
+	conn *sftpConn
+	done chan struct{}
+}
+
+func (r *sftpReader) Close() error {
+	close(r.done)
+	r.File.Close()
+	return r.conn.Close()
+}
@@ -0,0 +1,147 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hooklift/assert"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func newSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.Ok(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	assert.Ok(t, err)
+	return signer
+}
+
+// newSSHServer starts an SSH server with the SFTP subsystem, letting in the given user key.
+// It returns its address and host key.
+func newSSHServer(t *testing.T, userKey ssh.PublicKey) (net.Listener, ssh.PublicKey) {
+	hostKey := newSigner(t)
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "deploy" && bytes.Equal(key.Marshal(), userKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown key for %s", conn.User())
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Ok(t, err)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(conn, config)
+		}
+	}()
+	return ln, hostKey.PublicKey()
+}
+
+func serveSSH(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				server, err := sftp.NewServer(channel, sftp.ReadOnly())
+				if err != nil {
+					channel.Close()
+					return
+				}
+				server.Serve()
+				server.Close()
+			}
+		}()
+	}
+}
+
+func TestSFTP(t *testing.T) {
+	destDir, err := ioutil.TempDir(os.TempDir(), "sftp")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64<<10)
+	srcPath, err := filepath.Abs(filepath.Join(destDir, "artifact.tar"))
+	assert.Ok(t, err)
+	assert.Ok(t, ioutil.WriteFile(srcPath, data, 0640))
+
+	userKey := newSigner(t)
+	ln, hostKey := newSSHServer(t, userKey.PublicKey())
+	defer ln.Close()
+
+	RegisterScheme("sftp", &SFTPHandler{Signers: []ssh.Signer{userKey}, HostKeyCallback: ssh.FixedHostKey(hostKey)})
+	defer RegisterScheme("sftp", &SFTPHandler{})
+
+	gf := New(WithDestDir(filepath.Join(destDir, "out")), WithConcurrency(4),
+		WithChecksum("sha256", fmt.Sprintf("%x", sha256.Sum256(data))))
+	file, err := gf.Fetch("sftp://deploy@"+ln.Addr().String()+filepath.ToSlash(srcPath), nil)
+	assert.Ok(t, err)
+	defer file.Close()
+
+	got, err := ioutil.ReadAll(file)
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(data, got), "downloaded file does not match")
+
+	// Keys held by an agent are used as well.
+	keyring := agent.NewKeyring()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.Ok(t, err)
+	assert.Ok(t, keyring.Add(agent.AddedKey{PrivateKey: key}))
+	RegisterScheme("sftp", &SFTPHandler{Signers: []ssh.Signer{}, Agent: keyring, HostKeyCallback: ssh.FixedHostKey(hostKey)})
+
+	_, err = New(WithDestDir(filepath.Join(destDir, "agent"))).Fetch("sftp://deploy@"+ln.Addr().String()+filepath.ToSlash(srcPath), nil)
+	assert.Cond(t, err != nil, "unknown agent keys should be rejected")
+
+	signer, err := ssh.NewSignerFromKey(key)
+	assert.Ok(t, err)
+	ln2, hostKey2 := newSSHServer(t, signer.PublicKey())
+	defer ln2.Close()
+	RegisterScheme("sftp", &SFTPHandler{Signers: []ssh.Signer{}, Agent: keyring, HostKeyCallback: ssh.FixedHostKey(hostKey2)})
+
+	file2, err := New(WithDestDir(filepath.Join(destDir, "agent"))).Fetch("sftp://deploy@"+ln2.Addr().String()+filepath.ToSlash(srcPath), nil)
+	assert.Ok(t, err)
+	defer file2.Close()
+	got, err = ioutil.ReadAll(file2)
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(data, got), "file downloaded with agent keys does not match")
+}
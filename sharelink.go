@@ -0,0 +1,175 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// driveDownloadURL is where Google Drive serves the content of files.
+const driveDownloadURL = "https://drive.usercontent.google.com/download"
+
+// maxConfirmations is the number of interstitial pages of Google Drive gofetch goes through
+// before giving up.
+const maxConfirmations = 3
+
+// shareLink is the location of the content of a file shared through a share link.
+type shareLink struct {
+	url string
+	// name is the name of the file, if known before downloading it.
+	name string
+	// drive tells whether the file is shared through Google Drive, whose downloads may need
+	// to be confirmed.
+	drive bool
+}
+
+// driveFilePath matches the paths of Google Drive share links, like /file/d/<id>/view.
+var driveFilePath = regexp.MustCompile(`^/file/d/([\w-]+)`)
+
+// parseShareLink rewrites share links of Google Drive and Dropbox, which lead to web pages
+// previewing files, to the locations of the files themselves. It returns nil for any other URL.
+func parseShareLink(rawURL string) *shareLink {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil
+	}
+
+	query := u.Query()
+	switch strings.ToLower(u.Hostname()) {
+	case "drive.google.com", "docs.google.com", "drive.usercontent.google.com":
+		var id string
+		if m := driveFilePath.FindStringSubmatch(u.Path); m != nil {
+			id = m[1]
+		} else if u.Path == "/open" || u.Path == "/uc" || u.Path == "/download" {
+			id = query.Get("id")
+		}
+		if id == "" {
+			return nil
+		}
+
+		// Confirming upfront skips the warning about files too large to be scanned for viruses.
+		download := url.Values{"id": {id}, "export": {"download"}, "confirm": {"t"}}
+		if key := query.Get("resourcekey"); key != "" {
+			download.Set("resourcekey", key)
+		}
+		return &shareLink{url: driveDownloadURL + "?" + download.Encode(), name: id, drive: true}
+
+	case "www.dropbox.com", "dropbox.com":
+		if !strings.HasPrefix(u.Path, "/s/") && !strings.HasPrefix(u.Path, "/scl/fi/") {
+			return nil
+		}
+		// Files are served instead of previewed when asked to be downloaded.
+		query.Del("raw")
+		query.Set("dl", "1")
+		u.RawQuery = query.Encode()
+		return &shareLink{url: u.String(), name: path.Base(u.Path)}
+	}
+	return nil
+}
+
+// driveForm matches the forms of the interstitial pages of Google Drive, and driveInput their
+// fields.
+var (
+	driveForm  = regexp.MustCompile(`(?is)<form[^>]*\baction="([^"]+)"[^>]*>(.*?)</form>`)
+	driveInput = regexp.MustCompile(`(?is)<input[^>]*>`)
+	htmlAttr   = regexp.MustCompile(`(?is)\b(name|value)="([^"]*)"`)
+	driveHref  = regexp.MustCompile(`(?i)href="([^"]*confirm=[^"]*)"`)
+)
+
+// confirmDrive goes through the interstitial pages Google Drive shows before downloading some
+// files, like the ones too large to be scanned for viruses, updating the link with the location
+// the file is finally served from, and with its name, as given by Content-Disposition.
+func (gf *Fetcher) confirmDrive(ctx context.Context, link *shareLink) error {
+	location := link.url
+	for i := 0; i < maxConfirmations; i++ {
+		req, err := gf.newRequest(ctx, "GET", location)
+		if err != nil {
+			return err
+		}
+		// Only the first byte is needed to tell the file from a web page.
+		req.Header.Set("Range", "bytes=0-0")
+
+		res, err := gf.do(req)
+		if err != nil {
+			return err
+		}
+		page, err := ioutil.ReadAll(io.LimitReader(res.Body, maxManifestSize))
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent {
+			return &statusError{code: res.StatusCode, status: res.Status}
+		}
+
+		mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+		if mediaType != "text/html" {
+			link.url = location
+			if _, params, err := mime.ParseMediaType(res.Header.Get("Content-Disposition")); err == nil {
+				if name := path.Base(strings.Replace(params["filename"], "\\", "/", -1)); name != "." && name != "/" && name != ".." {
+					link.name = name
+				}
+			}
+			return nil
+		}
+
+		next, err := confirmationURL(res.Request.URL, string(page))
+		if err != nil {
+			return err
+		}
+		location = next
+	}
+	return fmt.Errorf("too many confirmation pages downloading %s", link.url)
+}
+
+// confirmationURL returns the location an interstitial page of Google Drive confirms the
+// download to, through either its download form or a link.
+func confirmationURL(base *url.URL, page string) (string, error) {
+	if m := driveForm.FindStringSubmatch(page); m != nil {
+		action, err := base.Parse(html.UnescapeString(m[1]))
+		if err != nil {
+			return "", err
+		}
+		query := action.Query()
+		for _, input := range driveInput.FindAllString(m[2], -1) {
+			var name, value string
+			for _, attr := range htmlAttr.FindAllStringSubmatch(input, -1) {
+				if strings.EqualFold(attr[1], "name") {
+					name = html.UnescapeString(attr[2])
+				} else {
+					value = html.UnescapeString(attr[2])
+				}
+			}
+			if name != "" {
+				query.Set(name, value)
+			}
+		}
+		action.RawQuery = query.Encode()
+		return action.String(), nil
+	}
+
+	if m := driveHref.FindStringSubmatch(page); m != nil {
+		u, err := base.Parse(html.UnescapeString(m[1]))
+		if err != nil {
+			return "", err
+		}
+		return u.String(), nil
+	}
+	// Pages without confirmation are the ones telling the file cannot be downloaded.
+	return "", errors.New("Google Drive responded with a web page instead of the file, it may not be shared publicly or its download quota may be exceeded")
+}
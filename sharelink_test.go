@@ -0,0 +1,104 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestParseShareLink(t *testing.T) {
+	drive := driveDownloadURL + "?confirm=t&export=download&id=1AbC-d_E"
+	for link, expected := range map[string]*shareLink{
+		"https://drive.google.com/file/d/1AbC-d_E/view?usp=sharing": {url: drive, name: "1AbC-d_E", drive: true},
+		"https://drive.google.com/open?id=1AbC-d_E":                 {url: drive, name: "1AbC-d_E", drive: true},
+		"https://docs.google.com/uc?export=download&id=1AbC-d_E":    {url: drive, name: "1AbC-d_E", drive: true},
+		"https://drive.google.com/file/d/1AbC-d_E/view?resourcekey=0-key": {
+			url: drive + "&resourcekey=0-key", name: "1AbC-d_E", drive: true,
+		},
+		"https://www.dropbox.com/s/abc123/report.pdf?dl=0": {
+			url: "https://www.dropbox.com/s/abc123/report.pdf?dl=1", name: "report.pdf",
+		},
+		"https://www.dropbox.com/scl/fi/abc123/image.iso?rlkey=xyz&dl=0": {
+			url: "https://www.dropbox.com/scl/fi/abc123/image.iso?dl=1&rlkey=xyz", name: "image.iso",
+		},
+		"https://drive.google.com/drive/folders/1AbC": nil,
+		"https://example.com/file/d/1AbC/view":        nil,
+	} {
+		assert.Equals(t, expected, parseShareLink(link))
+	}
+}
+
+func TestShareLinks(t *testing.T) {
+	destDir, err := ioutil.TempDir(os.TempDir(), "sharelinks")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	data := bytes.Repeat([]byte("shared"), 100000)
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	// Serves Google Drive and Dropbox, whatever the host requested.
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Host == "www.dropbox.com" && r.URL.Path == "/s/abc123/report.pdf" && r.URL.Query().Get("dl") == "1":
+			http.ServeContent(w, r, "", modTime, bytes.NewReader(data))
+		case r.Host == "drive.usercontent.google.com" && r.URL.Path == "/download" && r.URL.Query().Get("uuid") == "42":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", `attachment; filename="image.iso"`)
+			http.ServeContent(w, r, "", modTime, bytes.NewReader(data))
+		case r.Host == "drive.usercontent.google.com" && r.URL.Path == "/download" && r.URL.Query().Get("id") == "1AbC":
+			// Files too large to be scanned for viruses are confirmed through a form.
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprint(w, `<html><body><p>Google Drive can't scan this file for viruses.</p>
+				<form id="download-form" action="https://drive.usercontent.google.com/download" method="get">
+				<input type="submit" id="uc-download-link" value="Download anyway">
+				<input type="hidden" name="id" value="1AbC"><input type="hidden" name="export" value="download">
+				<input type="hidden" name="confirm" value="t"><input type="hidden" name="uuid" value="42">
+				</form></body></html>`)
+		case r.Host == "drive.usercontent.google.com":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprint(w, `<html><body>Sorry, you can't view or download this file at this time.</body></html>`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, ts.Listener.Addr().String())
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	gf := New(WithDestDir(destDir), WithHTTPClient(client), WithConcurrency(4))
+
+	for link, name := range map[string]string{
+		"https://www.dropbox.com/s/abc123/report.pdf?dl=0":      "report.pdf",
+		"https://drive.google.com/file/d/1AbC/view?usp=sharing": "image.iso",
+	} {
+		file, err := gf.Fetch(link, nil)
+		assert.Ok(t, err)
+		got, err := ioutil.ReadAll(file)
+		file.Close()
+		assert.Ok(t, err)
+		assert.Cond(t, bytes.Equal(data, got), "file shared through %s does not match", link)
+		assert.Equals(t, filepath.Join(destDir, name), file.Name())
+	}
+
+	_, err = gf.Fetch("https://drive.google.com/file/d/private/view", nil)
+	assert.Cond(t, err != nil, "web pages should not be downloaded as the shared file")
+}
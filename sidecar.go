@@ -0,0 +1,74 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// sidecarExt is the extension of the files recording how downloaded files were verified.
+const sidecarExt = ".gofetch.json"
+
+// sidecar records the verification of a downloaded file, so it can be
+// trusted later on without hashing it again.
+type sidecar struct {
+	URL       string            `json:"url"`
+	ETag      string            `json:"etag,omitempty"`
+	Size      int64             `json:"size"`
+	ModTime   time.Time         `json:"mod_time"`
+	Checksums map[string]string `json:"checksums"`
+}
+
+// writeSidecar records the digests of the given file, once verified.
+func writeSidecar(file *os.File, url, etag string, digests map[string]string) error {
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	s := sidecar{
+		URL:       url,
+		ETag:      etag,
+		Size:      fi.Size(),
+		ModTime:   fi.ModTime(),
+		Checksums: digests,
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file.Name()+sidecarExt, data, 0660)
+}
+
+// trustSidecar tells whether the file was already verified against all the given checksums,
+// according to its sidecar, and was not modified since then.
+func trustSidecar(file *os.File, checksums []checksum) bool {
+	data, err := ioutil.ReadFile(file.Name() + sidecarExt)
+	if err != nil {
+		return false
+	}
+
+	var s sidecar
+	if err := json.Unmarshal(data, &s); err != nil {
+		return false
+	}
+
+	fi, err := file.Stat()
+	if err != nil || fi.Size() != s.Size || !fi.ModTime().Equal(s.ModTime) {
+		return false
+	}
+
+	for _, c := range checksums {
+		if s.Checksums[strings.ToLower(c.algorithm)] != strings.ToLower(c.value) {
+			return false
+		}
+	}
+	return true
+}
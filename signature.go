@@ -0,0 +1,31 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/pkg/errors"
+)
+
+// gpgSignature is a detached OpenPGP signature and the keys trusted to have made it.
+type gpgSignature struct {
+	location string
+	keyring  openpgp.KeyRing
+}
+
+// verifySignature checks that signature, armored or binary, is a valid
+// signature of signed made by one of the keys in keyring.
+func verifySignature(keyring openpgp.KeyRing, signed io.Reader, signature []byte) error {
+	var err error
+	if bytes.HasPrefix(bytes.TrimSpace(signature), []byte("-----BEGIN PGP")) {
+		_, err = openpgp.CheckArmoredDetachedSignature(keyring, signed, bytes.NewReader(signature), nil)
+	} else {
+		_, err = openpgp.CheckDetachedSignature(keyring, signed, bytes.NewReader(signature), nil)
+	}
+	return errors.Wrap(err, "invalid signature")
+}
@@ -0,0 +1,114 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/hooklift/assert"
+)
+
+func TestWithGPGSignature(t *testing.T) {
+	signer, err := openpgp.NewEntity("gofetch", "", "gofetch@example.com", nil)
+	assert.Ok(t, err)
+	stranger, err := openpgp.NewEntity("stranger", "", "stranger@example.com", nil)
+	assert.Ok(t, err)
+
+	data, err := ioutil.ReadFile("./fixtures/test")
+	assert.Ok(t, err)
+
+	armored := new(bytes.Buffer)
+	err = openpgp.ArmoredDetachSign(armored, signer, bytes.NewReader(data), nil)
+	assert.Ok(t, err)
+
+	binary := new(bytes.Buffer)
+	err = openpgp.DetachSign(binary, signer, bytes.NewReader(data), nil)
+	assert.Ok(t, err)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/test.asc":
+			w.Write(armored.Bytes())
+		case "/test.sig":
+			w.Write(binary.Bytes())
+		case "/test":
+			http.ServeContent(w, r, "test", time.Time{}, bytes.NewReader(data))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "gpg-signature")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	for _, sig := range []string{"/test.asc", "/test.sig"} {
+		gf := New(WithDestDir(destDir), WithConcurrency(2), WithGPGSignature(ts.URL+sig, openpgp.EntityList{signer}))
+		f, err := gf.Fetch(ts.URL+"/test", nil)
+		assert.Ok(t, err)
+
+		got, err := ioutil.ReadAll(f)
+		assert.Ok(t, err)
+		assert.Equals(t, data, got)
+		f.Close()
+	}
+
+	gf := New(WithDestDir(destDir), WithGPGSignature(ts.URL+"/test.asc", openpgp.EntityList{stranger}))
+	_, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Cond(t, err != nil, "Fetch should fail if the signature was not made by a trusted key")
+
+	gf = New(WithDestDir(destDir), WithGPGSignature(ts.URL+"/missing.asc", openpgp.EntityList{signer}))
+	_, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Cond(t, err != nil, "Fetch should fail if the signature cannot be found")
+}
+
+func TestWithSignedChecksumFile(t *testing.T) {
+	signer, err := openpgp.NewEntity("gofetch", "", "gofetch@example.com", nil)
+	assert.Ok(t, err)
+
+	manifest := []byte(fixtureSHA256 + "  test\n")
+	tampered := []byte(strings.Repeat("0", 64) + "  test\n")
+
+	signature := new(bytes.Buffer)
+	err = openpgp.DetachSign(signature, signer, bytes.NewReader(manifest), nil)
+	assert.Ok(t, err)
+
+	served := manifest
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/SHA256SUMS":
+			w.Write(served)
+		case "/SHA256SUMS.gpg":
+			w.Write(signature.Bytes())
+		case "/test":
+			http.ServeFile(w, r, "./fixtures/test")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "signed-checksum-file")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	gf := New(WithDestDir(destDir), WithSignedChecksumFile("sha256", ts.URL+"/SHA256SUMS", "", openpgp.EntityList{signer}))
+	_, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Ok(t, err)
+
+	// A manifest modified after being signed must not be trusted.
+	served = tampered
+	_, err = gf.Fetch(ts.URL+"/test", nil)
+	assert.Cond(t, err != nil, "Fetch should fail if the checksum file signature is not valid")
+}
@@ -0,0 +1,84 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// stallError is returned when a connection stops producing data for longer
+// than the configured stall timeout.
+type stallError struct {
+	timeout time.Duration
+	// written is the number of bytes received before the connection stalled.
+	written int64
+}
+
+func (e *stallError) Error() string {
+	return fmt.Sprintf("connection stalled, no data received in %s", e.timeout)
+}
+
+// stallWatchdog cancels a request if no data is read from it within the
+// given timeout.
+type stallWatchdog struct {
+	timeout time.Duration
+	timer   *time.Timer
+	stalled int32
+}
+
+// newStallWatchdog returns a context derived from ctx that is canceled once the watchdog fires.
+// The watchdog starts right away, so it also covers the time waiting for the response headers.
+func newStallWatchdog(ctx context.Context, timeout time.Duration) (context.Context, *stallWatchdog, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	w := &stallWatchdog{timeout: timeout}
+	w.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&w.stalled, 1)
+		cancel()
+	})
+
+	return ctx, w, func() {
+		w.timer.Stop()
+		cancel()
+	}
+}
+
+// Reader wraps r so that the watchdog is reset every time data is read.
+// It is safe to call on a nil watchdog.
+func (w *stallWatchdog) Reader(r io.Reader) io.Reader {
+	if w == nil {
+		return r
+	}
+	return &stallReader{Reader: r, watchdog: w}
+}
+
+// Err converts err into a stallError if the watchdog fired.
+// It is safe to call on a nil watchdog.
+func (w *stallWatchdog) Err(err error, written int64) error {
+	if w == nil {
+		return err
+	}
+
+	if err != nil && atomic.LoadInt32(&w.stalled) == 1 {
+		return &stallError{timeout: w.timeout, written: written}
+	}
+	return err
+}
+
+type stallReader struct {
+	io.Reader
+	watchdog *stallWatchdog
+}
+
+func (r *stallReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		r.watchdog.timer.Reset(r.watchdog.timeout)
+	}
+	return n, err
+}
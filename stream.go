@@ -0,0 +1,307 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// segment is a part of a segmented stream, like an HLS or DASH media segment, which is either
+// a whole file or a byte range of it.
+type segment struct {
+	url string
+	// offset is where the segment starts in the file.
+	offset int64
+	// size is the length of the segment, or -1 if it is the rest of the file and its length
+	// is unknown.
+	size int64
+}
+
+// FetchStream downloads the media segments of the HLS playlist or DASH manifest at the given
+// location, a local path or a URL, concatenating them, along with their initialization
+// segment, into a single file in the destination directory, named after the playlist with the
+// extension of the segments, like video.ts or video.mp4. The variant of HLS master playlists
+// with the highest bandwidth is downloaded, and so is the representation of DASH manifests with
+// the highest bandwidth, among the video ones if any. Audio and video downloaded separately are
+// not multiplexed. The stream is downloaded like any other content, in chunks spanning several
+// segments, downloaded in parallel, retried and resumed. Segments of live streams are downloaded
+// as listed when the download starts. Encrypted streams are not supported. Progress is reported
+// through progressCh, which is closed once done.
+func (gf *Fetcher) FetchStream(ctx context.Context, location string, progressCh chan<- ProgressReport) (*Result, error) {
+	if progressCh != nil {
+		defer close(progressCh)
+	}
+
+	data, err := gf.readLocation(ctx, location)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed reading playlist %s", location)
+	}
+
+	var segments []segment
+	var ext string
+	switch trimmed := bytes.TrimSpace(data); {
+	case bytes.HasPrefix(trimmed, []byte("#EXTM3U")):
+		segments, ext, err = gf.hlsSegments(ctx, location, data)
+	case bytes.Contains(trimmed, []byte("<MPD")):
+		segments, ext, err = parseDASH(location, data)
+	default:
+		return nil, fmt.Errorf("%s is neither an HLS playlist nor a DASH manifest", location)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("no segments in %s", location)
+	}
+
+	if err := gf.segmentSizes(ctx, segments); err != nil {
+		return nil, err
+	}
+	handler := newSegmentsHandler(gf, segments)
+
+	name := destFileName(location)
+	if i := strings.IndexAny(name, "?#"); i >= 0 {
+		name = name[:i]
+	}
+	name = strings.TrimSuffix(name, path.Ext(name)) + ext
+
+	t := &target{name: name, size: handler.size, handler: handler}
+	return gf.fetchMirrors(ctx, []string{location}, progressCh, t)
+}
+
+// segmentSizes finds out the size of the segments whose size is unknown, through preflight
+// requests sent in parallel. Segments of servers not telling their size are left unknown.
+func (gf *Fetcher) segmentSizes(ctx context.Context, segments []segment) error {
+	workers := gf.concurrency
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	work := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				s := &segments[i]
+				var rsc *resource
+				err := gf.retry(ctx, func() error {
+					var err error
+					rsc, err = gf.segmentResource(ctx, s.url)
+					return err
+				})
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = errors.Wrapf(err, "failed requesting segment %s", s.url)
+					}
+					mu.Unlock()
+					continue
+				}
+				// Compressed segments could not be told apart by their offsets.
+				if rsc.size >= 0 && rsc.encoding == "" {
+					s.size = rsc.size - s.offset
+				}
+			}
+		}()
+	}
+
+	for i, s := range segments {
+		if s.size < 0 {
+			work <- i
+		}
+	}
+	close(work)
+	wg.Wait()
+	return firstErr
+}
+
+// segmentResource describes the file of a segment, which is either a local file, a URL of a
+// registered scheme or an HTTP(S) URL.
+func (gf *Fetcher) segmentResource(ctx context.Context, location string) (*resource, error) {
+	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") && !isUnixURL(location) {
+		if handler, err := schemeHandler(location); err == nil && handler != nil {
+			return handlerResource(gf.handlerContext(ctx), handler, location)
+		}
+		fi, err := os.Stat(location)
+		if err != nil {
+			return nil, err
+		}
+		return &resource{url: location, size: fi.Size(), ranges: true}, nil
+	}
+	return gf.preflight(ctx, location, nil)
+}
+
+// segmentsHandler reads the segments of a stream one after another, as if they were a single
+// file, which can be read from any offset as long as the size of all the segments is known.
+type segmentsHandler struct {
+	gf       *Fetcher
+	segments []segment
+	// starts are the offsets of the segments in the stream.
+	starts []int64
+	// size is the length of the stream, or -1 if unknown.
+	size int64
+}
+
+func newSegmentsHandler(gf *Fetcher, segments []segment) *segmentsHandler {
+	h := &segmentsHandler{gf: gf, segments: segments, starts: make([]int64, len(segments))}
+	for i, s := range segments {
+		h.starts[i] = h.size
+		if s.size < 0 || h.size < 0 {
+			h.size = -1
+			continue
+		}
+		h.size += s.size
+	}
+	return h
+}
+
+func (h *segmentsHandler) Stat(ctx context.Context, url string) (*ContentInfo, error) {
+	return &ContentInfo{Size: h.size, Ranges: h.size >= 0}, nil
+}
+
+func (h *segmentsHandler) Open(ctx context.Context, url string, offset, length int64) (io.ReadCloser, error) {
+	if offset > 0 && h.size < 0 {
+		return nil, errors.New("stream can only be read from its beginning")
+	}
+	i := sort.Search(len(h.segments), func(i int) bool {
+		return h.starts[i]+h.segments[i].size > offset
+	})
+	if offset == 0 {
+		i = 0
+	}
+	if i == len(h.segments) {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	return &segmentsReader{ctx: ctx, h: h, i: i, skip: offset - h.starts[i]}, nil
+}
+
+// segmentsReader reads the segments of a stream from the given one on, opening them as it
+// goes.
+type segmentsReader struct {
+	ctx context.Context
+	h   *segmentsHandler
+	// i is the segment being read, and skip the number of bytes of it not to read.
+	i    int
+	skip int64
+	body io.ReadCloser
+	// left is the number of bytes of the segment left to read, or -1 if unknown.
+	left int64
+}
+
+func (r *segmentsReader) Read(b []byte) (int, error) {
+	for {
+		if r.body == nil {
+			if r.i >= len(r.h.segments) {
+				return 0, io.EOF
+			}
+			var err error
+			if r.body, err = r.h.open(r.ctx, r.h.segments[r.i], r.skip); err != nil {
+				return 0, err
+			}
+			r.left = r.h.segments[r.i].size
+			if r.left >= 0 {
+				r.left -= r.skip
+			}
+		}
+
+		if r.left >= 0 && int64(len(b)) > r.left {
+			b = b[:r.left]
+		}
+		n, err := r.body.Read(b)
+		if r.left >= 0 {
+			r.left -= int64(n)
+		}
+		if r.left == 0 || err == io.EOF {
+			if r.left > 0 {
+				return n, errors.Wrapf(io.ErrUnexpectedEOF, "segment %s", r.h.segments[r.i].url)
+			}
+			r.body.Close()
+			r.body, r.i, r.skip = nil, r.i+1, 0
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (r *segmentsReader) Close() error {
+	if r.body != nil {
+		return r.body.Close()
+	}
+	return nil
+}
+
+// open opens the given segment, without its first skip bytes.
+func (h *segmentsHandler) open(ctx context.Context, s segment, skip int64) (io.ReadCloser, error) {
+	start := s.offset + skip
+	if !strings.HasPrefix(s.url, "http://") && !strings.HasPrefix(s.url, "https://") && !isUnixURL(s.url) {
+		if handler, err := schemeHandler(s.url); err == nil && handler != nil {
+			length := int64(-1)
+			if s.size >= 0 {
+				length = s.size - skip
+			}
+			return handler.Open(h.gf.handlerContext(ctx), s.url, start, length)
+		}
+		f, err := os.Open(s.url)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Seek(start, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return f, nil
+	}
+
+	req, err := h.gf.newRequest(ctx, "GET", s.url)
+	if err != nil {
+		return nil, err
+	}
+	// Segments are already compressed, and their ranges refer to them as stored.
+	req.Header.Del("Accept-Encoding")
+
+	if s.size >= 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, s.offset+s.size-1))
+	} else if start > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", start))
+	}
+
+	res, err := h.gf.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case res.StatusCode == http.StatusPartialContent:
+		return res.Body, nil
+	case res.StatusCode == http.StatusOK:
+		// The server ignored the range, the bytes before it are skipped.
+		if _, err := io.CopyN(ioutil.Discard, res.Body, start); err != nil {
+			res.Body.Close()
+			return nil, err
+		}
+		return res.Body, nil
+	default:
+		res.Body.Close()
+		return nil, &statusError{code: res.StatusCode, status: res.Status}
+	}
+}
@@ -0,0 +1,144 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestFetchStreamHLS(t *testing.T) {
+	destDir, err := ioutil.TempDir(os.TempDir(), "stream-hls")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	rnd := rand.New(rand.NewSource(1))
+	segments := make([][]byte, 12)
+	for i := range segments {
+		segments[i] = make([]byte, 30000+rnd.Intn(20000))
+		rnd.Read(segments[i])
+	}
+	// The last segments are byte ranges of a single file.
+	packed := bytes.Join(segments[8:], nil)
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	var media bytes.Buffer
+	fmt.Fprint(&media, "#EXTM3U\n#EXT-X-TARGETDURATION:4\n")
+	for i := 0; i < 8; i++ {
+		fmt.Fprintf(&media, "#EXTINF:4.0,\nsegment%d.ts\n", i)
+	}
+	offset := 0
+	for _, s := range segments[8:] {
+		fmt.Fprintf(&media, "#EXTINF:4.0,\n#EXT-X-BYTERANGE:%d@%d\n/packed.ts\n", len(s), offset)
+		offset += len(s)
+	}
+	fmt.Fprint(&media, "#EXT-X-ENDLIST\n")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/live/master.m3u8":
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=100000\nlow.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=900000\nhigh/index.m3u8\n")
+		case r.URL.Path == "/live/high/index.m3u8":
+			w.Write(media.Bytes())
+		case r.URL.Path == "/packed.ts":
+			http.ServeContent(w, r, "", modTime, bytes.NewReader(packed))
+		case strings.HasPrefix(r.URL.Path, "/live/high/segment"):
+			i, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/live/high/segment"), ".ts"))
+			if err != nil || i >= 8 {
+				http.NotFound(w, r)
+				return
+			}
+			if i%2 == 0 {
+				http.ServeContent(w, r, "", modTime, bytes.NewReader(segments[i]))
+				return
+			}
+			// Some servers do not support byte ranges.
+			w.Header().Set("Content-Length", strconv.Itoa(len(segments[i])))
+			if r.Method != "HEAD" {
+				w.Write(segments[i])
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	gf := New(WithDestDir(destDir), WithConcurrency(4), WithMinChunkSize(1024))
+	result, err := gf.FetchStream(context.Background(), ts.URL+"/live/master.m3u8?session=1", nil)
+	assert.Ok(t, err)
+	got, err := ioutil.ReadAll(result.File)
+	result.File.Close()
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(bytes.Join(segments, nil), got), "downloaded stream does not match its segments")
+	assert.Equals(t, filepath.Join(destDir, "master.ts"), result.File.Name())
+
+	_, err = gf.FetchStream(context.Background(), ts.URL+"/packed.ts", nil)
+	assert.Cond(t, err != nil, "files other than playlists should be rejected")
+}
+
+func TestFetchStreamDASH(t *testing.T) {
+	destDir, err := ioutil.TempDir(os.TempDir(), "stream-dash")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+	srcDir, err := ioutil.TempDir(os.TempDir(), "stream-dash-src")
+	assert.Ok(t, err)
+	defer os.RemoveAll(srcDir)
+
+	var expected []byte
+	write := func(name string, data []byte) {
+		assert.Ok(t, os.MkdirAll(filepath.Dir(filepath.Join(srcDir, name)), 0755))
+		assert.Ok(t, ioutil.WriteFile(filepath.Join(srcDir, name), data, 0644))
+		expected = append(expected, data...)
+	}
+	write("video/init.mp4", []byte("init"))
+	for i := 1; i <= 5; i++ {
+		write(fmt.Sprintf("video/%d.m4s", i), bytes.Repeat([]byte{byte(i)}, 10000*i))
+	}
+
+	manifest := `<MPD type="static" mediaPresentationDuration="PT10S">
+  <Period>
+    <AdaptationSet mimeType="video/mp4">
+      <SegmentTemplate timescale="1" duration="2" initialization="$RepresentationID$/init.mp4" media="$RepresentationID$/$Number$.m4s"/>
+      <Representation id="video" bandwidth="1000000"/>
+      <Representation id="missing" bandwidth="10"/>
+    </AdaptationSet>
+  </Period>
+</MPD>`
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(srcDir, "stream.mpd"), []byte(manifest), 0644))
+
+	ts := httptest.NewServer(http.FileServer(http.Dir(srcDir)))
+	defer ts.Close()
+
+	gf := New(WithDestDir(destDir), WithConcurrency(3), WithMinChunkSize(1024))
+	result, err := gf.FetchStream(context.Background(), ts.URL+"/stream.mpd", nil)
+	assert.Ok(t, err)
+	got, err := ioutil.ReadAll(result.File)
+	result.File.Close()
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(expected, got), "downloaded stream does not match its segments")
+	assert.Equals(t, filepath.Join(destDir, "stream.mp4"), result.File.Name())
+
+	// Local manifests list local segments.
+	assert.Ok(t, os.Remove(result.File.Name()))
+	result, err = gf.FetchStream(context.Background(), filepath.Join(srcDir, "stream.mpd"), nil)
+	assert.Ok(t, err)
+	got, err = ioutil.ReadAll(result.File)
+	result.File.Close()
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(expected, got), "stream of local segments does not match them")
+}
@@ -0,0 +1,11 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+// syncDir does nothing on Windows, where directories cannot be flushed, and renames are
+// flushed along with the file system metadata.
+func syncDir(dir string) error {
+	return nil
+}
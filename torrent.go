@@ -0,0 +1,442 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Torrent describes the content of a BitTorrent v1 torrent file, along with the web seeds
+// (BEP 19) serving it over HTTP.
+type Torrent struct {
+	Name string
+	// InfoHash is the hex encoded SHA-1 digest of the info dictionary of the torrent.
+	InfoHash string
+	// PieceLength is the size of the pieces the content is split into, the last one
+	// may be shorter.
+	PieceLength int64
+	// Pieces are the hex encoded SHA-1 digests of the pieces of the content.
+	Pieces []string
+	// Files are the files of the content, in the order their data is laid out in pieces.
+	Files []TorrentFile
+	// WebSeeds are the URLs of the web seeds of the torrent.
+	WebSeeds []string
+
+	// multiFile is set if the files are in a directory named after the torrent.
+	multiFile bool
+	// size is the size of the content, the sum of the sizes of its files.
+	size int64
+}
+
+// TorrentFile is a file of the content of a torrent.
+type TorrentFile struct {
+	// Path is the slash-separated path of the file, starting with the name of the torrent
+	// if it has several files.
+	Path string
+	Size int64
+}
+
+// ParseTorrent parses a BitTorrent v1 torrent file.
+func ParseTorrent(r io.Reader) (*Torrent, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed reading torrent")
+	}
+
+	dec := &bdecoder{data: data}
+	v, err := dec.decode()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed parsing torrent")
+	}
+	root, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid torrent, it is not a dictionary")
+	}
+	info, ok := root["info"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid torrent, info dictionary missing")
+	}
+
+	digest := sha1.Sum(dec.info)
+	tr := &Torrent{InfoHash: hex.EncodeToString(digest[:])}
+	tr.Name, _ = info["name"].(string)
+	if err := checkPathElement(tr.Name); err != nil {
+		return nil, errors.Wrap(err, "invalid torrent name")
+	}
+	tr.PieceLength, _ = info["piece length"].(int64)
+	if tr.PieceLength <= 0 {
+		return nil, fmt.Errorf("invalid torrent, piece length is %d", tr.PieceLength)
+	}
+	pieces, _ := info["pieces"].(string)
+	if pieces == "" || len(pieces)%sha1.Size != 0 {
+		return nil, errors.New("invalid torrent, only BitTorrent v1 pieces are supported")
+	}
+	for i := 0; i < len(pieces); i += sha1.Size {
+		tr.Pieces = append(tr.Pieces, hex.EncodeToString([]byte(pieces[i:i+sha1.Size])))
+	}
+
+	if files, ok := info["files"].([]interface{}); ok {
+		tr.multiFile = true
+		for _, f := range files {
+			file, err := parseTorrentFile(tr.Name, f)
+			if err != nil {
+				return nil, err
+			}
+			tr.Files = append(tr.Files, file)
+			tr.size += file.Size
+		}
+	} else {
+		size, ok := info["length"].(int64)
+		if !ok || size < 0 {
+			return nil, errors.New("invalid torrent, length missing")
+		}
+		tr.Files = []TorrentFile{{Path: tr.Name, Size: size}}
+		tr.size = size
+	}
+	if pieces := (tr.size + tr.PieceLength - 1) / tr.PieceLength; pieces != int64(len(tr.Pieces)) {
+		return nil, fmt.Errorf("invalid torrent, expected %d pieces for %d bytes, got %d", pieces, tr.size, len(tr.Pieces))
+	}
+
+	// The list of web seeds can also be a single URL.
+	switch seeds := root["url-list"].(type) {
+	case string:
+		tr.WebSeeds = []string{seeds}
+	case []interface{}:
+		for _, seed := range seeds {
+			if s, ok := seed.(string); ok && s != "" {
+				tr.WebSeeds = append(tr.WebSeeds, s)
+			}
+		}
+	}
+	return tr, nil
+}
+
+// parseTorrentFile parses a file of a multi-file torrent.
+func parseTorrentFile(name string, v interface{}) (TorrentFile, error) {
+	f, ok := v.(map[string]interface{})
+	if !ok {
+		return TorrentFile{}, errors.New("invalid torrent, file is not a dictionary")
+	}
+	size, ok := f["length"].(int64)
+	if !ok || size < 0 {
+		return TorrentFile{}, errors.New("invalid torrent, file length missing")
+	}
+
+	elems, _ := f["path"].([]interface{})
+	if len(elems) == 0 {
+		return TorrentFile{}, errors.New("invalid torrent, file path missing")
+	}
+	path := []string{name}
+	for _, e := range elems {
+		s, _ := e.(string)
+		if err := checkPathElement(s); err != nil {
+			return TorrentFile{}, errors.Wrap(err, "invalid torrent file path")
+		}
+		path = append(path, s)
+	}
+	return TorrentFile{Path: strings.Join(path, "/"), Size: size}, nil
+}
+
+// checkPathElement makes sure the given element of the path of a file cannot be used to save
+// it outside of the destination directory.
+func checkPathElement(elem string) error {
+	if elem == "" || elem == "." || elem == ".." || strings.ContainsAny(elem, "/\\\x00") {
+		return fmt.Errorf("%q is not allowed", elem)
+	}
+	return nil
+}
+
+// FetchTorrent downloads the content of the torrent at the given location, a local path or a
+// URL, into the destination directory from its web seeds (BEP 19), trying them in order,
+// or from the fastest to the slowest with WithFastestMirrors. Files of torrents with several
+// files are saved in a directory named after the torrent. Pieces are verified as soon as the
+// files holding them are downloaded, moving on to the next web seed if a file is corrupt.
+// Peers are not downloaded from, so neither magnet links nor torrents without web seeds are
+// supported. Progress of all the files is reported through progressCh, which is closed once
+// done.
+func (gf *Fetcher) FetchTorrent(ctx context.Context, location string, progressCh chan<- ProgressReport) ([]*Result, error) {
+	if progressCh != nil {
+		defer close(progressCh)
+	}
+
+	if strings.HasPrefix(strings.ToLower(location), "magnet:") {
+		return nil, errors.New("magnet links are not supported, their content is only available from peers")
+	}
+
+	data, err := gf.readLocation(ctx, location)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed reading torrent %s", location)
+	}
+	tr, err := ParseTorrent(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if len(tr.WebSeeds) == 0 {
+		return nil, fmt.Errorf("torrent %s has no web seeds, downloading from peers is not supported", tr.Name)
+	}
+
+	var results []*Result
+	closeAll := func() {
+		for _, r := range results {
+			r.File.Close()
+		}
+	}
+
+	var offset int64
+	for _, file := range tr.Files {
+		result, err := gf.fetchTorrentFile(ctx, tr, file, offset, progressCh)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		results = append(results, result)
+		offset += file.Size
+	}
+
+	// Pieces spanning several files can only be verified once all of them are downloaded.
+	if err := tr.verifySpanningPieces(results); err != nil {
+		closeAll()
+		return nil, err
+	}
+	return results, nil
+}
+
+// fetchTorrentFile downloads a file of the given torrent, whose data starts at the given
+// offset of the content, from the first of its web seeds able to serve it.
+func (gf *Fetcher) fetchTorrentFile(ctx context.Context, tr *Torrent, file TorrentFile, offset int64, progressCh chan<- ProgressReport) (*Result, error) {
+	t := &target{
+		name:      filepath.FromSlash(file.Path),
+		size:      file.Size,
+		verifiers: []Verifier{&pieceVerifier{torrent: tr, offset: offset, size: file.Size}},
+	}
+	for _, seed := range tr.WebSeeds {
+		t.mirrors = append(t.mirrors, tr.webSeedURL(seed, file))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filepath.Join(gf.destDir, t.name)), 0760); err != nil {
+		return nil, err
+	}
+	return gf.fetchMirrors(ctx, t.mirrors, progressCh, t)
+}
+
+// webSeedURL returns the URL the given web seed serves the given file at. Web seeds of
+// multi-file torrents, or ending in a slash, are the directories holding the content.
+func (tr *Torrent) webSeedURL(seed string, file TorrentFile) string {
+	if !tr.multiFile && !strings.HasSuffix(seed, "/") {
+		return seed
+	}
+
+	elems := strings.Split(file.Path, "/")
+	for i, e := range elems {
+		elems[i] = url.PathEscape(e)
+	}
+	return strings.TrimSuffix(seed, "/") + "/" + strings.Join(elems, "/")
+}
+
+// pieceVerifier verifies the pieces of a torrent lying entirely within one of its files.
+type pieceVerifier struct {
+	torrent *Torrent
+	// offset and size are the position and size of the file in the content of the torrent.
+	offset int64
+	size   int64
+}
+
+func (v *pieceVerifier) Verify(r io.Reader) error {
+	length := v.torrent.PieceLength
+	// Pieces starting in the previous files are skipped.
+	first := (v.offset + length - 1) / length
+	if _, err := io.CopyN(ioutil.Discard, r, first*length-v.offset); err != nil && err != io.EOF {
+		return err
+	}
+
+	for i := first; i < int64(len(v.torrent.Pieces)); i++ {
+		start, end := v.torrent.pieceRange(int(i))
+		if end > v.offset+v.size {
+			break
+		}
+		if err := v.torrent.verifyPiece(int(i), io.LimitReader(r, end-start)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pieceRange returns the offsets of the first byte of the given piece and of the one
+// right after it.
+func (tr *Torrent) pieceRange(i int) (int64, int64) {
+	start := int64(i) * tr.PieceLength
+	end := start + tr.PieceLength
+	if end > tr.size {
+		end = tr.size
+	}
+	return start, end
+}
+
+// verifyPiece verifies the given piece, read from r.
+func (tr *Torrent) verifyPiece(i int, r io.Reader) error {
+	hasher := sha1.New()
+	if _, err := io.Copy(hasher, r); err != nil {
+		return err
+	}
+	if err := verifyChecksum(hasher, tr.Pieces[i]); err != nil {
+		return errors.Wrapf(err, "piece %d is corrupt", i)
+	}
+	return nil
+}
+
+// verifySpanningPieces verifies the pieces of the torrent spanning several of its files,
+// given the downloaded files. Files holding corrupt pieces are removed.
+func (tr *Torrent) verifySpanningPieces(results []*Result) error {
+	var offset int64
+	// starts holds the offset each file starts at.
+	starts := make([]int64, len(tr.Files))
+	for i, f := range tr.Files {
+		starts[i] = offset
+		offset += f.Size
+	}
+
+	for i := range tr.Pieces {
+		start, end := tr.pieceRange(i)
+		var files []int
+		for j, f := range tr.Files {
+			if f.Size > 0 && starts[j] < end && starts[j]+f.Size > start {
+				files = append(files, j)
+			}
+		}
+		if len(files) < 2 {
+			continue
+		}
+
+		var readers []io.Reader
+		for _, j := range files {
+			from, to := start-starts[j], end-starts[j]
+			if from < 0 {
+				from = 0
+			}
+			if to > tr.Files[j].Size {
+				to = tr.Files[j].Size
+			}
+			readers = append(readers, io.NewSectionReader(results[j].File, from, to-from))
+		}
+		if err := tr.verifyPiece(i, io.MultiReader(readers...)); err != nil {
+			var paths []string
+			for _, j := range files {
+				paths = append(paths, tr.Files[j].Path)
+				os.Remove(results[j].File.Name())
+			}
+			return errors.Wrapf(err, "failed verifying %s", strings.Join(paths, ", "))
+		}
+	}
+	return nil
+}
+
+// bdecoder decodes bencoded data, as found in torrent files, into int64, string,
+// []interface{} and map[string]interface{} values.
+type bdecoder struct {
+	data []byte
+	pos  int
+	// depth is the number of dictionaries and lists being decoded.
+	depth int
+	// info holds the encoded info dictionary of the top-level dictionary, if any.
+	info []byte
+}
+
+func (d *bdecoder) decode() (interface{}, error) {
+	if d.pos >= len(d.data) {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	switch c := d.data[d.pos]; {
+	case c == 'i':
+		end := bytes.IndexByte(d.data[d.pos:], 'e')
+		if end < 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		n, err := strconv.ParseInt(string(d.data[d.pos+1:d.pos+end]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer at %d", d.pos)
+		}
+		d.pos += end + 1
+		return n, nil
+	case c >= '0' && c <= '9':
+		sep := bytes.IndexByte(d.data[d.pos:], ':')
+		if sep < 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		n, err := strconv.Atoi(string(d.data[d.pos : d.pos+sep]))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid string length at %d", d.pos)
+		}
+		start := d.pos + sep + 1
+		if n > len(d.data)-start {
+			return nil, io.ErrUnexpectedEOF
+		}
+		d.pos = start + n
+		return string(d.data[start:d.pos]), nil
+	case c == 'l':
+		d.pos++
+		d.depth++
+		list := []interface{}{}
+		for d.pos < len(d.data) && d.data[d.pos] != 'e' {
+			v, err := d.decode()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		d.depth--
+		return list, d.end()
+	case c == 'd':
+		d.pos++
+		d.depth++
+		dict := make(map[string]interface{})
+		for d.pos < len(d.data) && d.data[d.pos] != 'e' {
+			k, err := d.decode()
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid dictionary key at %d", d.pos)
+			}
+
+			start := d.pos
+			v, err := d.decode()
+			if err != nil {
+				return nil, err
+			}
+			if key == "info" && d.depth == 1 {
+				d.info = d.data[start:d.pos]
+			}
+			dict[key] = v
+		}
+		d.depth--
+		return dict, d.end()
+	default:
+		return nil, fmt.Errorf("invalid value at %d", d.pos)
+	}
+}
+
+// end consumes the end of a list or dictionary.
+func (d *bdecoder) end() error {
+	if d.pos >= len(d.data) {
+		return io.ErrUnexpectedEOF
+	}
+	d.pos++
+	return nil
+}
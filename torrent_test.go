@@ -0,0 +1,229 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+// bencode encodes int, string, []interface{} and map[string]interface{} values.
+func bencode(v interface{}) string {
+	switch v := v.(type) {
+	case int:
+		return fmt.Sprintf("i%de", v)
+	case string:
+		return fmt.Sprintf("%d:%s", len(v), v)
+	case []interface{}:
+		s := "l"
+		for _, e := range v {
+			s += bencode(e)
+		}
+		return s + "e"
+	case map[string]interface{}:
+		var keys []string
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		s := "d"
+		for _, k := range keys {
+			s += bencode(k) + bencode(v[k])
+		}
+		return s + "e"
+	}
+	panic(fmt.Sprintf("cannot bencode %T", v))
+}
+
+// pieces returns the concatenated SHA-1 digests of the pieces of data.
+func pieces(data []byte, length int) string {
+	var s string
+	for i := 0; i < len(data); i += length {
+		end := i + length
+		if end > len(data) {
+			end = len(data)
+		}
+		sum := sha1.Sum(data[i:end])
+		s += string(sum[:])
+	}
+	return s
+}
+
+func TestParseTorrent(t *testing.T) {
+	data := bytes.Repeat([]byte("torrent"), 1000)
+	info := map[string]interface{}{
+		"name":         "image.iso",
+		"length":       len(data),
+		"piece length": 1024,
+		"pieces":       pieces(data, 1024),
+	}
+	torrent := bencode(map[string]interface{}{
+		"announce": "http://tracker.example.com/announce",
+		"info":     info,
+		"url-list": "http://example.com/image.iso",
+	})
+
+	tr, err := ParseTorrent(strings.NewReader(torrent))
+	assert.Ok(t, err)
+	assert.Equals(t, "image.iso", tr.Name)
+	assert.Equals(t, fmt.Sprintf("%x", sha1.Sum([]byte(bencode(info)))), tr.InfoHash)
+	assert.Equals(t, int64(1024), tr.PieceLength)
+	assert.Equals(t, 7, len(tr.Pieces))
+	assert.Equals(t, fmt.Sprintf("%x", sha1.Sum(data[:1024])), tr.Pieces[0])
+	assert.Equals(t, []TorrentFile{{Path: "image.iso", Size: int64(len(data))}}, tr.Files)
+	assert.Equals(t, []string{"http://example.com/image.iso"}, tr.WebSeeds)
+
+	info = map[string]interface{}{
+		"name":         "release",
+		"piece length": 1024,
+		"pieces":       pieces(data, 1024),
+		"files": []interface{}{
+			map[string]interface{}{"length": 3000, "path": []interface{}{"image.iso"}},
+			map[string]interface{}{"length": len(data) - 3000, "path": []interface{}{"docs", "README"}},
+		},
+	}
+	tr, err = ParseTorrent(strings.NewReader(bencode(map[string]interface{}{"info": info})))
+	assert.Ok(t, err)
+	assert.Equals(t, []TorrentFile{
+		{Path: "release/image.iso", Size: 3000},
+		{Path: "release/docs/README", Size: int64(len(data) - 3000)},
+	}, tr.Files)
+	assert.Equals(t, "http://example.com/files/release/docs/README", tr.webSeedURL("http://example.com/files", tr.Files[1]))
+
+	info["files"] = []interface{}{
+		map[string]interface{}{"length": len(data), "path": []interface{}{"..", "escape"}},
+	}
+	_, err = ParseTorrent(strings.NewReader(bencode(map[string]interface{}{"info": info})))
+	assert.Cond(t, err != nil, "paths escaping the destination directory should be rejected")
+
+	info["files"] = []interface{}{
+		map[string]interface{}{"length": 100, "path": []interface{}{"short"}},
+	}
+	_, err = ParseTorrent(strings.NewReader(bencode(map[string]interface{}{"info": info})))
+	assert.Cond(t, err != nil, "torrents with more pieces than content should be rejected")
+}
+
+func TestFetchTorrent(t *testing.T) {
+	destDir, err := ioutil.TempDir(os.TempDir(), "torrent")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 16<<10)
+	files := map[string][]byte{
+		"/release/image.iso":   data[:100000],
+		"/release/docs/README": data[100000:],
+	}
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	// Serves a corrupt image.
+	corrupt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, ".iso") {
+			content = bytes.ToUpper(content)
+		}
+		http.ServeContent(w, r, "", modTime, bytes.NewReader(content))
+	}))
+	defer corrupt.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", modTime, bytes.NewReader(content))
+	}))
+	defer good.Close()
+
+	torrent := bencode(map[string]interface{}{
+		"info": map[string]interface{}{
+			"name":         "release",
+			"piece length": 16 << 10,
+			"pieces":       pieces(data, 16<<10),
+			"files": []interface{}{
+				map[string]interface{}{"length": 100000, "path": []interface{}{"image.iso"}},
+				map[string]interface{}{"length": len(data) - 100000, "path": []interface{}{"docs", "README"}},
+			},
+		},
+		"url-list": []interface{}{corrupt.URL, good.URL + "/"},
+	})
+	location := filepath.Join(destDir, "release.torrent")
+	assert.Ok(t, ioutil.WriteFile(location, []byte(torrent), 0640))
+
+	gf := New(WithDestDir(destDir), WithConcurrency(4))
+	results, err := gf.FetchTorrent(context.Background(), location, nil)
+	assert.Ok(t, err)
+	assert.Equals(t, 2, len(results))
+	defer results[0].File.Close()
+	defer results[1].File.Close()
+
+	// The corrupt image is downloaded from the next web seed.
+	assert.Equals(t, good.URL+"/release/image.iso", results[0].URL)
+	assert.Equals(t, corrupt.URL+"/release/docs/README", results[1].URL)
+	assert.Equals(t, filepath.Join(destDir, "release", "docs", "README"), results[1].File.Name())
+	for i, path := range []string{"/release/image.iso", "/release/docs/README"} {
+		got, err := ioutil.ReadAll(results[i].File)
+		assert.Ok(t, err)
+		assert.Cond(t, bytes.Equal(files[path], got), "%s does not match", path)
+	}
+
+	_, err = gf.FetchTorrent(context.Background(), "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a", nil)
+	assert.Cond(t, err != nil, "magnet links should be rejected")
+}
+
+func TestFetchTorrentSpanningPieces(t *testing.T) {
+	destDir, err := ioutil.TempDir(os.TempDir(), "torrent-spanning")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1<<10)
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	// The first file is corrupt in its last bytes, which belong to a piece spanning both
+	// files, so it cannot be told apart until both are downloaded.
+	files := map[string][]byte{
+		"/set/a": append(append([]byte{}, data[:5000]...), 'X'),
+		"/set/b": data[5001:],
+	}
+	seed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", modTime, bytes.NewReader(files[r.URL.Path]))
+	}))
+	defer seed.Close()
+
+	torrent := bencode(map[string]interface{}{
+		"info": map[string]interface{}{
+			"name":         "set",
+			"piece length": 4096,
+			"pieces":       pieces(data, 4096),
+			"files": []interface{}{
+				map[string]interface{}{"length": 5001, "path": []interface{}{"a"}},
+				map[string]interface{}{"length": len(data) - 5001, "path": []interface{}{"b"}},
+			},
+		},
+		"url-list": seed.URL,
+	})
+	location := filepath.Join(destDir, "set.torrent")
+	assert.Ok(t, ioutil.WriteFile(location, []byte(torrent), 0640))
+
+	_, err = New(WithDestDir(destDir)).FetchTorrent(context.Background(), location, nil)
+	assert.Cond(t, err != nil && strings.Contains(err.Error(), "piece 1 is corrupt"), "corrupt spanning piece should be detected, got %v", err)
+	_, err = os.Stat(filepath.Join(destDir, "set", "a"))
+	assert.Cond(t, os.IsNotExist(err), "files of corrupt pieces should be removed")
+}
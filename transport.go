@@ -0,0 +1,325 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
+)
+
+const (
+	// defaultConnectTimeout is the maximum amount of time a dial will wait for a connect to complete.
+	defaultConnectTimeout = 30 * time.Second
+	// defaultIdleTimeout is the maximum amount of time a connection may stay
+	// idle, without reading or writing any data, before being closed.
+	defaultIdleTimeout = 30 * time.Second
+	// tlsHandshakeTimeout is the maximum amount of time waiting for a TLS handshake to complete.
+	tlsHandshakeTimeout = 10 * time.Second
+	// defaultKeepAlive is the interval between TCP keep-alive probes.
+	defaultKeepAlive = 30 * time.Second
+)
+
+// HTTP protocol versions that can be forced through options.
+const (
+	protoAuto = iota
+	protoHTTP2
+	protoHTTP3
+)
+
+// newHTTP3Transport is set when gofetch is built with the http3 build tag.
+var newHTTP3Transport func(gf *Fetcher) http.RoundTripper
+
+// newHTTPClient returns the default HTTP client used by gofetch, configured
+// according to the options set on the given fetcher.
+func newHTTPClient(gf *Fetcher) *http.Client {
+	var transport http.RoundTripper
+	switch gf.protocol {
+	case protoHTTP2:
+		transport = newHTTP2Transport(gf)
+	case protoHTTP3:
+		if newHTTP3Transport == nil {
+			transport = errTransport{errors.New("HTTP/3 support requires building gofetch with the http3 build tag")}
+		} else {
+			transport = newHTTP3Transport(gf)
+		}
+	default:
+		transport = newTransport(gf)
+	}
+
+	return &http.Client{
+		Transport: transport,
+	}
+}
+
+// newTransport returns an HTTP transport with support for connect and read/write
+// timeouts. Read/write timeouts are reset on every operation, so large downloads
+// are not interrupted as long as data keeps flowing.
+func newTransport(gf *Fetcher) *http.Transport {
+	// Connections used by chunks are kept for the next download, instead of closing
+	// all but two of them.
+	idle := gf.maxIdleConnsPerHost
+	if idle == 0 && gf.concurrency > http.DefaultMaxIdleConnsPerHost {
+		idle = gf.concurrency
+	}
+
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialContext(gf),
+		TLSClientConfig:       tlsConfig(gf),
+		TLSHandshakeTimeout:   tlsHandshakeTimeout,
+		ResponseHeaderTimeout: gf.responseHeaderTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+		MaxConnsPerHost:       gf.maxConnsPerHost,
+		MaxIdleConnsPerHost:   idle,
+		DisableKeepAlives:     gf.keepAlive < 0,
+	}
+
+	if gf.multiplex {
+		// HTTP/2 is negotiated with servers, and requests wait for a stream to be available
+		// on the existing connection instead of opening new ones.
+		if h2, err := http2.ConfigureTransports(t); err == nil {
+			h2.StrictMaxConcurrentStreams = true
+		}
+	}
+	return t
+}
+
+// newHTTP2Transport returns a transport that speaks HTTP/2 without negotiating it first.
+// Plain HTTP URLs use HTTP/2 over cleartext TCP (h2c), whereas HTTPS URLs fail if the
+// server does not agree to use HTTP/2 during the TLS handshake.
+func newHTTP2Transport(gf *Fetcher) http.RoundTripper {
+	dial := dialContext(gf)
+	config := tlsConfig(gf)
+
+	return &schemeTransport{
+		http: &http2.Transport{
+			AllowHTTP:                  true,
+			StrictMaxConcurrentStreams: gf.multiplex,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(ctx, network, addr)
+			},
+		},
+		https: &http2.Transport{
+			TLSClientConfig:            config,
+			StrictMaxConcurrentStreams: gf.multiplex,
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				conn, err := dial(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+
+				tlsConn := tls.Client(conn, cfg)
+				ctx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+				defer cancel()
+				if err := tlsConn.HandshakeContext(ctx); err != nil {
+					conn.Close()
+					return nil, err
+				}
+				return tlsConn, nil
+			},
+		},
+	}
+}
+
+// dialContext returns a dial function with support for connect and read/write timeouts, which
+// resolves host names as told by the resolver options.
+func dialContext(gf *Fetcher) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   gf.connectTimeout,
+		KeepAlive: gf.keepAlive,
+		Resolver:  gf.resolver,
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialResolved(ctx, dialer, gf.lookupHost, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		if gf.idleTimeout <= 0 {
+			return conn, nil
+		}
+		return &deadlineConn{Conn: conn, timeout: gf.idleTimeout}, nil
+	}
+}
+
+// schemeTransport routes requests to a different transport depending on the URL scheme.
+type schemeTransport struct {
+	http  http.RoundTripper
+	https http.RoundTripper
+}
+
+func (t *schemeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "http" {
+		return t.http.RoundTrip(req)
+	}
+	return t.https.RoundTrip(req)
+}
+
+// errTransport is a transport that always fails with the given error.
+type errTransport struct {
+	err error
+}
+
+func (t errTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, t.err
+}
+
+// hookTransport runs the request hooks of the fetcher on the requests it sends, and sends its
+// user agent along, for requests not created through newRequest, like the ones of handlers.
+type hookTransport struct {
+	gf   *Fetcher
+	base http.RoundTripper
+}
+
+func (t *hookTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if t.gf.userAgent == "" && len(t.gf.requestHooks) == 0 {
+		return base.RoundTrip(req)
+	}
+
+	// Round trippers must not modify the requests they are given.
+	req = req.Clone(req.Context())
+	if t.gf.userAgent != "" && req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", t.gf.userAgent)
+	}
+	for _, hook := range t.gf.requestHooks {
+		if err := hook(req); err != nil {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, err
+		}
+	}
+	return base.RoundTrip(req)
+}
+
+// tlsConfig returns the TLS configuration to use, including certificate pinning if requested.
+func tlsConfig(gf *Fetcher) *tls.Config {
+	if len(gf.certPins) == 0 && len(gf.spkiPins) == 0 {
+		return gf.tlsConfig
+	}
+
+	config := &tls.Config{}
+	if gf.tlsConfig != nil {
+		config = gf.tlsConfig.Clone()
+	}
+
+	// Unlike VerifyPeerCertificate, VerifyConnection is also called when resuming TLS sessions.
+	verify := config.VerifyConnection
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(cs); err != nil {
+				return err
+			}
+		}
+		return verifyPins(cs.PeerCertificates, gf.certPins, gf.spkiPins)
+	}
+	return config
+}
+
+// verifyPins checks that the certificates presented by the server match at
+// least one of the pinned certificates or public keys.
+func verifyPins(certs []*x509.Certificate, certPins, spkiPins []string) error {
+	if len(certs) == 0 {
+		return errors.New("server did not present any certificate")
+	}
+
+	fingerprint := sha256.Sum256(certs[0].Raw)
+	leafPin := hex.EncodeToString(fingerprint[:])
+	for _, pin := range certPins {
+		if pin == leafPin {
+			return nil
+		}
+	}
+
+	for _, cert := range certs {
+		spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		spkiPin := base64.StdEncoding.EncodeToString(spki[:])
+		for _, pin := range spkiPins {
+			if pin == spkiPin {
+				return nil
+			}
+		}
+	}
+
+	return errors.New("server certificate does not match any pinned certificate or public key")
+}
+
+// redirectPolicy holds the rules applied when following redirects.
+type redirectPolicy struct {
+	max       int
+	sameHost  bool
+	stripAuth bool
+}
+
+// redirectPolicy returns the fetcher's redirect policy, creating it with Go's
+// defaults if it does not exist yet.
+func (gf *Fetcher) redirectPolicy() *redirectPolicy {
+	if gf.redirects == nil {
+		gf.redirects = &redirectPolicy{max: 10}
+	}
+	return gf.redirects
+}
+
+// check implements http.Client's CheckRedirect.
+func (p *redirectPolicy) check(req *http.Request, via []*http.Request) error {
+	if len(via) > p.max {
+		return fmt.Errorf("stopped after %d redirects", p.max)
+	}
+
+	orig := via[0].URL
+	if p.sameHost && req.URL.Host != orig.Host {
+		return fmt.Errorf("redirect from %s to a different host is not allowed: %s", orig.Host, req.URL.Host)
+	}
+
+	if p.stripAuth && !sameOrigin(orig, req.URL) {
+		req.Header.Del("Authorization")
+		req.Header.Del("Proxy-Authorization")
+		req.Header.Del("Cookie")
+	}
+	return nil
+}
+
+// sameOrigin tells whether both URLs have the same scheme, host and port.
+func sameOrigin(a, b *url.URL) bool {
+	return a.Scheme == b.Scheme && a.Host == b.Host
+}
+
+// deadlineConn extends the deadline of the underlying connection every time
+// data is read or written.
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
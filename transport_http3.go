@@ -0,0 +1,22 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build http3
+// +build http3
+
+package gofetch
+
+import (
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+func init() {
+	newHTTP3Transport = func(gf *Fetcher) http.RoundTripper {
+		return &http3.Transport{
+			TLSClientConfig: tlsConfig(gf),
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// unixScheme is the scheme of the URLs of HTTP servers listening on Unix domain sockets, whose
+// host is the path of the socket, percent-encoded, like http+unix://%2Frun%2Fcache.sock/file.
+const unixScheme = "http+unix://"
+
+// unixHostSuffix ends the hosts requests are sent to for them to reach Unix domain sockets.
+// Those hosts are the hex-encoded path of the socket, so connections are pooled per socket.
+const unixHostSuffix = ".unix"
+
+// isUnixURL tells whether the given URL is the one of an HTTP server listening on a Unix
+// domain socket.
+func isUnixURL(rawURL string) bool {
+	return len(rawURL) >= len(unixScheme) && strings.EqualFold(rawURL[:len(unixScheme)], unixScheme)
+}
+
+// requestURL returns the URL requests for the given one are sent to, which is the URL itself
+// unless it is the one of a Unix domain socket.
+func requestURL(rawURL string) (string, error) {
+	if !isUnixURL(rawURL) {
+		return rawURL, nil
+	}
+
+	rest := rawURL[len(unixScheme):]
+	i := strings.IndexAny(rest, "/?#")
+	if i < 0 {
+		i = len(rest)
+	}
+	socket, err := url.PathUnescape(rest[:i])
+	if err != nil || socket == "" {
+		return "", fmt.Errorf("invalid Unix domain socket in %s", rawURL)
+	}
+	return "http://" + hex.EncodeToString([]byte(socket)) + unixHostSuffix + rest[i:], nil
+}
+
+// unixSocket returns the path of the Unix domain socket requests to the given host are sent
+// to, if any.
+func unixSocket(host string) (string, bool) {
+	if !strings.HasSuffix(host, unixHostSuffix) {
+		return "", false
+	}
+	socket, err := hex.DecodeString(strings.TrimSuffix(host, unixHostSuffix))
+	if err != nil || len(socket) == 0 {
+		return "", false
+	}
+	return string(socket), true
+}
+
+// responseURL returns the URL a response came from, as an http+unix:// URL if it came from a
+// Unix domain socket.
+func responseURL(u *url.URL) string {
+	socket, ok := unixSocket(u.Host)
+	if !ok {
+		return u.String()
+	}
+	rel := *u
+	rel.Scheme, rel.Host = "", ""
+	return unixScheme + url.PathEscape(socket) + rel.String()
+}
+
+// unixClient returns the client requests to Unix domain sockets are sent through, which is the
+// client of the fetcher with its transport dialing the sockets, and not going through proxies.
+func (gf *Fetcher) unixClient() *http.Client {
+	gf.unixOnce.Do(func() {
+		dial := dialContext(gf)
+		t := newTransport(gf)
+		t.Proxy = func(req *http.Request) (*url.URL, error) {
+			if _, ok := unixSocket(req.URL.Host); ok {
+				return nil, nil
+			}
+			return http.ProxyFromEnvironment(req)
+		}
+		t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if host, _, err := net.SplitHostPort(addr); err == nil {
+				if socket, ok := unixSocket(host); ok {
+					return dial(ctx, "unix", socket)
+				}
+			}
+			// Servers may redirect elsewhere.
+			return dial(ctx, network, addr)
+		}
+
+		client := *gf.httpClient
+		client.Transport = t
+		gf.unixHTTP = &client
+	})
+	return gf.unixHTTP
+}
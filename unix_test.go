@@ -0,0 +1,92 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestRequestURL(t *testing.T) {
+	u, err := requestURL("http+unix://%2Frun%2Fcache.sock/files/a.tar?v=1")
+	assert.Ok(t, err)
+	assert.Equals(t, "http://2f72756e2f63616368652e736f636b.unix/files/a.tar?v=1", u)
+
+	parsed, err := url.Parse(u)
+	assert.Ok(t, err)
+	socket, ok := unixSocket(parsed.Host)
+	assert.Cond(t, ok, "host should name the socket")
+	assert.Equals(t, "/run/cache.sock", socket)
+	assert.Equals(t, "http+unix://%2Frun%2Fcache.sock/files/a.tar?v=1", responseURL(parsed))
+
+	u, err = requestURL("https://example.com/a.tar")
+	assert.Ok(t, err)
+	assert.Equals(t, "https://example.com/a.tar", u)
+
+	_, err = requestURL("http+unix:///files/a.tar")
+	assert.Cond(t, err != nil, "URLs without socket should be rejected")
+}
+
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "unix")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "daemon.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("Unix domain sockets are not supported: %v", err)
+	}
+
+	data := make([]byte, 200000)
+	rand.New(rand.NewSource(1)).Read(data)
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/latest/artifact.bin":
+			http.Redirect(w, r, "/v1/artifact.bin", http.StatusFound)
+		case "/v1/artifact.bin":
+			if r.Host != "localhost" {
+				http.Error(w, "unexpected host "+r.Host, http.StatusBadRequest)
+				return
+			}
+			http.ServeContent(w, r, "", modTime, bytes.NewReader(data))
+		default:
+			http.NotFound(w, r)
+		}
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	// Proxies are not used to reach sockets.
+	t.Setenv("HTTP_PROXY", "http://127.0.0.1:1")
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "unix-dest")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	location := "http+unix://" + url.PathEscape(socket) + "/latest/artifact.bin"
+	gf := New(WithDestDir(destDir), WithConcurrency(4), WithMinChunkSize(1024))
+	result, err := gf.FetchContext(context.Background(), location, nil)
+	assert.Ok(t, err)
+	got, err := ioutil.ReadAll(result.File)
+	result.File.Close()
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(data, got), "content downloaded through the socket does not match")
+	assert.Equals(t, filepath.Join(destDir, "artifact.bin"), result.File.Name())
+	assert.Equals(t, "http+unix://"+url.PathEscape(socket)+"/v1/artifact.bin", result.URL)
+}
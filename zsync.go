@@ -0,0 +1,429 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/md4"
+)
+
+const (
+	// maxZsyncBlockSize is the largest block size of zsync control files gofetch accepts.
+	maxZsyncBlockSize = 1 << 24
+	// seedBufferSize is the number of bytes of the previous version of a file read at once
+	// while looking for the blocks that did not change.
+	seedBufferSize = 1 << 20
+	// zsyncFilterBits is the size of the filter telling upfront whether a rolling checksum
+	// may match any block, which most of them do not.
+	zsyncFilterBits = 1 << 20
+)
+
+// Zsync describes a file as published in a zsync control file: the checksums of each of its
+// blocks, which tell the blocks of an older version of the file that did not change.
+type Zsync struct {
+	// Filename is the name of the file, if given.
+	Filename string
+	// MTime is the modification time of the file, if given.
+	MTime time.Time
+	// Length is the size of the file in bytes.
+	Length int64
+	// BlockSize is the size of the blocks the file is split in.
+	BlockSize int
+	// URLs are the locations of the file, relative to the control file.
+	URLs []string
+	// SHA1 is the hex encoded SHA-1 digest of the file, if given.
+	SHA1 string
+
+	// seqMatches is the number of consecutive blocks that must match for any of them to be
+	// trusted, since checksums are truncated.
+	seqMatches int
+	// rsumBytes and checksumBytes are the number of bytes kept of the rolling checksum and
+	// of the MD4 digest of each block.
+	rsumBytes     int
+	checksumBytes int
+	// rsums are the truncated rolling checksums of the blocks, and checksums their truncated
+	// MD4 digests, one after another.
+	rsums     []uint32
+	checksums []byte
+}
+
+// ParseZsync parses a zsync control file, as written by zsyncmake.
+func ParseZsync(r io.Reader) (*Zsync, error) {
+	br := bufio.NewReader(r)
+	z := &Zsync{Length: -1}
+	var hashLengths string
+	var headerSize int
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid zsync control file, truncated header")
+		}
+		if headerSize += len(line); headerSize > maxManifestSize {
+			return nil, errors.New("invalid zsync control file, header too long")
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+
+		i := strings.Index(line, ": ")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid zsync control file, header line %q", line)
+		}
+		value := strings.TrimSpace(line[i+2:])
+		switch strings.ToLower(line[:i]) {
+		case "filename":
+			z.Filename = value
+		case "mtime":
+			z.MTime, _ = time.Parse(time.RFC1123Z, value)
+		case "length":
+			if z.Length, err = strconv.ParseInt(value, 10, 64); err != nil || z.Length < 0 {
+				return nil, fmt.Errorf("invalid zsync control file, length %q", value)
+			}
+		case "blocksize":
+			if z.BlockSize, err = strconv.Atoi(value); err != nil || z.BlockSize <= 0 || z.BlockSize > maxZsyncBlockSize {
+				return nil, fmt.Errorf("invalid zsync control file, block size %q", value)
+			}
+		case "url":
+			z.URLs = append(z.URLs, value)
+		case "sha-1":
+			z.SHA1 = strings.ToLower(value)
+		case "hash-lengths":
+			hashLengths = value
+		}
+	}
+
+	if z.Length < 0 || z.BlockSize == 0 {
+		return nil, errors.New("invalid zsync control file, length and block size are required")
+	}
+
+	z.seqMatches, z.rsumBytes, z.checksumBytes = 1, 4, 16
+	if hashLengths != "" {
+		n, err := fmt.Sscanf(hashLengths, "%d,%d,%d", &z.seqMatches, &z.rsumBytes, &z.checksumBytes)
+		if err != nil || n != 3 || z.seqMatches < 1 || z.seqMatches > 2 || z.rsumBytes < 1 || z.rsumBytes > 4 ||
+			z.checksumBytes < 3 || z.checksumBytes > md4.Size {
+			return nil, fmt.Errorf("invalid zsync control file, hash lengths %q", hashLengths)
+		}
+	}
+
+	// The checksums are read as they come, so a bogus length does not make us allocate them
+	// all upfront.
+	blocks := z.blocks()
+	var sums bytes.Buffer
+	size := int64(blocks) * int64(z.rsumBytes+z.checksumBytes)
+	if n, err := io.CopyN(&sums, br, size); err != nil {
+		return nil, fmt.Errorf("invalid zsync control file, expected %d bytes of block checksums, got %d", size, n)
+	}
+
+	data := sums.Bytes()
+	z.rsums = make([]uint32, blocks)
+	z.checksums = make([]byte, 0, blocks*z.checksumBytes)
+	for i := range z.rsums {
+		// Rolling checksums are kept big endian, truncated to their last bytes.
+		for _, b := range data[:z.rsumBytes] {
+			z.rsums[i] = z.rsums[i]<<8 | uint32(b)
+		}
+		z.checksums = append(z.checksums, data[z.rsumBytes:z.rsumBytes+z.checksumBytes]...)
+		data = data[z.rsumBytes+z.checksumBytes:]
+	}
+	return z, nil
+}
+
+// blocks returns the number of blocks of the file.
+func (z *Zsync) blocks() int {
+	return int((z.Length + int64(z.BlockSize) - 1) / int64(z.BlockSize))
+}
+
+// rsum returns the rolling checksum of a block, as computed by zsync.
+func rsum(block []byte) (uint16, uint16) {
+	var a, b uint16
+	for i, c := range block {
+		a += uint16(c)
+		b += uint16(len(block)-i) * uint16(c)
+	}
+	return a, b
+}
+
+// rsumKey returns the rolling checksum made of a and b, truncated like in the control file.
+func (z *Zsync) rsumKey(a, b uint16) uint32 {
+	key := uint32(a)<<16 | uint32(b)
+	if z.rsumBytes < 4 {
+		key &= 1<<(8*uint(z.rsumBytes)) - 1
+	}
+	return key
+}
+
+// checksum returns the truncated MD4 digest of the given block of the file.
+func (z *Zsync) checksum(i int) []byte {
+	return z.checksums[i*z.checksumBytes : (i+1)*z.checksumBytes]
+}
+
+// matchesBlock tells whether data has the checksums of the given block of the file.
+func (z *Zsync) matchesBlock(i int, data []byte) bool {
+	if z.rsumKey(rsum(data)) != z.rsums[i] {
+		return false
+	}
+	sum := md4.New()
+	sum.Write(data)
+	return bytes.Equal(sum.Sum(nil)[:z.checksumBytes], z.checksum(i))
+}
+
+// reuse looks for the blocks of the file in seed, an older version of it of the given size,
+// copying the ones found to out, at their offset in the file. It returns the blocks found.
+func (z *Zsync) reuse(seed io.ReaderAt, seedSize int64, out io.WriterAt) ([]bool, error) {
+	blocks := z.blocks()
+	size := int64(z.BlockSize)
+
+	index := make(map[uint32][]int)
+	filter := make([]uint64, zsyncFilterBits/64)
+	for i, key := range z.rsums {
+		index[key] = append(index[key], i)
+		bit := (key ^ key>>20) % zsyncFilterBits
+		filter[bit/64] |= 1 << (bit % 64)
+	}
+
+	found := make([]bool, blocks)
+	window := &seedWindow{r: seed}
+	// Two blocks are looked at from each position, since the block following a candidate
+	// has to match too when checksums are truncated.
+	lookahead := 2 * size
+
+	data, err := window.at(0, lookahead)
+	if err != nil {
+		return nil, err
+	}
+	a, b := rsum(data[:size])
+	next := -1
+	for pos := int64(0); pos < seedSize; {
+		if data, err = window.at(pos, lookahead); err != nil {
+			return nil, err
+		}
+
+		matched := false
+		key := z.rsumKey(a, b)
+		if bit := (key ^ key>>20) % zsyncFilterBits; filter[bit/64]&(1<<(bit%64)) != 0 {
+			var sum []byte
+			for _, i := range index[key] {
+				if sum == nil {
+					h := md4.New()
+					h.Write(data[:size])
+					sum = h.Sum(nil)[:z.checksumBytes]
+				}
+				if !bytes.Equal(sum, z.checksum(i)) {
+					continue
+				}
+				// Truncated checksums are only trusted when the next block matches too,
+				// or when following a match.
+				if z.seqMatches > 1 && i != next && i+1 < blocks && !z.matchesBlock(i+1, data[size:]) {
+					continue
+				}
+
+				matched = true
+				if !found[i] {
+					block := data[:size]
+					if end := int64(i+1) * size; end > z.Length {
+						block = block[:size-(end-z.Length)]
+					}
+					if _, err := out.WriteAt(block, int64(i)*size); err != nil {
+						return nil, err
+					}
+					found[i] = true
+				}
+				next = i + 1
+			}
+		}
+
+		if matched {
+			pos += size
+			if data, err = window.at(pos, lookahead); err != nil {
+				return nil, err
+			}
+			a, b = rsum(data[:size])
+			continue
+		}
+
+		// The window moves one byte forward.
+		next = -1
+		oldc, newc := uint16(data[0]), uint16(data[size])
+		a += newc - oldc
+		b += a - uint16(size)*oldc
+		pos++
+	}
+	return found, nil
+}
+
+// seedWindow reads a file sequentially through a window of it, reading zeros past its end,
+// like zsync does.
+type seedWindow struct {
+	r   io.ReaderAt
+	buf []byte
+	off int64
+}
+
+// at returns n bytes of the file from pos.
+func (w *seedWindow) at(pos, n int64) ([]byte, error) {
+	if pos < w.off || pos+n > w.off+int64(len(w.buf)) {
+		size := n
+		if size < seedBufferSize {
+			size = seedBufferSize
+		}
+		if int64(cap(w.buf)) < size {
+			w.buf = make([]byte, size)
+		}
+		w.buf = w.buf[:size]
+
+		read, err := w.r.ReadAt(w.buf, pos)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		for i := read; i < len(w.buf); i++ {
+			w.buf[i] = 0
+		}
+		w.off = pos
+	}
+	return w.buf[pos-w.off : pos-w.off+n], nil
+}
+
+// deltaChunks returns the chunks of content of the given length made of the given blocks,
+// the ones found being already on disk. Missing blocks next to each other are downloaded
+// together, split so the given concurrency is used.
+func deltaChunks(found []bool, blockSize, length int64, concurrency int) []*chunk {
+	var missing int64
+	var chunks []*chunk
+	for i := 0; i < len(found); {
+		j := i
+		for j < len(found) && found[j] == found[i] {
+			j++
+		}
+		start, end := int64(i)*blockSize, int64(j)*blockSize
+		if end > length {
+			end = length
+		}
+		c := &chunk{Start: start, End: end}
+		if found[i] {
+			c.Written = end - start
+		} else {
+			missing += end - start
+		}
+		chunks = append(chunks, c)
+		i = j
+	}
+
+	maxSize := (missing + int64(concurrency) - 1) / int64(concurrency)
+	if maxSize < defaultMinChunkSize {
+		maxSize = defaultMinChunkSize
+	}
+	var split []*chunk
+	for _, c := range chunks {
+		for c.Written == 0 && c.End-c.Start > maxSize {
+			split = append(split, &chunk{Start: c.Start, End: c.Start + maxSize})
+			c.Start += maxSize
+		}
+		split = append(split, c)
+	}
+	return split
+}
+
+// readZsync reads the zsync control file at the given location.
+func (gf *Fetcher) readZsync(ctx context.Context, location string) (*Zsync, error) {
+	var z *Zsync
+	err := gf.retry(ctx, func() error {
+		r, err := gf.openLocation(ctx, location)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		z, err = ParseZsync(r)
+		return err
+	})
+	return z, err
+}
+
+// discoverZsync looks for the zsync control file of the content of the given URL, published
+// next to it with the .zsync extension. It returns nil if there is none, or if it describes
+// content of another size than the given one, like an older version of it.
+func (gf *Fetcher) discoverZsync(ctx context.Context, rawURL string, size int64) (*Zsync, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = ""
+	u.Fragment = ""
+
+	z, err := gf.readZsync(ctx, u.String()+".zsync")
+	if err != nil {
+		// The content is downloaded as a whole when the control file cannot be read.
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+	if z.Length != size {
+		return nil, nil
+	}
+	return z, nil
+}
+
+// FetchZsync downloads the file described by the zsync control file at the given location,
+// a local path or a URL, into the destination directory, under the name given by the control
+// file. Only the blocks that changed since the version of the file already in the destination
+// directory, if any, are downloaded, the others are copied from it. The file is fetched from
+// the URLs listed in the control file, in order, moving on to the next one if one fails, and
+// is verified against its size and SHA-1 digest. Progress is reported through progressCh,
+// which is closed once done, with the bytes copied from the older version reported as
+// ResumedBytes.
+func (gf *Fetcher) FetchZsync(ctx context.Context, location string, progressCh chan<- ProgressReport) (*Result, error) {
+	if progressCh != nil {
+		defer close(progressCh)
+	}
+
+	z, err := gf.readZsync(ctx, location)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed reading zsync control file %s", location)
+	}
+	// Compressed content, listed as Z-URL, is not supported.
+	if len(z.URLs) == 0 {
+		return nil, fmt.Errorf("no URLs of uncompressed content in zsync control file %s", location)
+	}
+
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	urls := make([]string, len(z.URLs))
+	for i, rawURL := range z.URLs {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid URL in zsync control file %s", location)
+		}
+		urls[i] = base.ResolveReference(u).String()
+	}
+
+	name := destFileName(urls[0])
+	if z.Filename != "" {
+		name = path.Base(strings.Replace(z.Filename, "\\", "/", -1))
+		if name == "." || name == "/" || name == ".." {
+			return nil, fmt.Errorf("invalid zsync control file, file name %q", z.Filename)
+		}
+	}
+
+	t := &target{name: name, size: z.Length, mirrors: urls, delta: z}
+	if z.SHA1 != "" {
+		t.checksums = []checksum{{algorithm: "sha1", value: z.SHA1}}
+	}
+	return gf.fetchMirrors(ctx, urls, progressCh, t)
+}
@@ -0,0 +1,179 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package gofetch
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+	"golang.org/x/crypto/md4"
+)
+
+// zsyncmake returns the zsync control file of data, like zsyncmake does.
+func zsyncmake(data []byte, name string, blockSize, seqMatches, rsumBytes, checksumBytes int) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "zsync: 0.6.2\nFilename: %s\nMTime: Thu, 02 Jan 2020 03:04:05 +0000\n", name)
+	fmt.Fprintf(&buf, "Blocksize: %d\nLength: %d\n", blockSize, len(data))
+	fmt.Fprintf(&buf, "Hash-Lengths: %d,%d,%d\nURL: %s\nSHA-1: %x\n\n", seqMatches, rsumBytes, checksumBytes, name, sha1.Sum(data))
+	for i := 0; i < len(data); i += blockSize {
+		block := make([]byte, blockSize)
+		copy(block, data[i:])
+		a, b := rsum(block)
+		r := []byte{byte(a >> 8), byte(a), byte(b >> 8), byte(b)}
+		buf.Write(r[4-rsumBytes:])
+		h := md4.New()
+		h.Write(block)
+		buf.Write(h.Sum(nil)[:checksumBytes])
+	}
+	return buf.Bytes()
+}
+
+// newVersions returns the content of a file, and the content of an older version of it, with
+// a few bytes changed, inserted and removed here and there.
+func newVersions(size int) ([]byte, []byte) {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	old := append([]byte{}, data[:50000]...)
+	old = append(old, bytes.Repeat([]byte("inserted"), 100)...)
+	old = append(old, data[50000:200000]...)
+	old = append(old, bytes.Repeat([]byte{0}, 100)...)
+	old = append(old, data[200100:size-30000]...)
+	return data, old
+}
+
+func TestParseZsync(t *testing.T) {
+	data := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(data)
+	control := zsyncmake(data, "image.iso", 1024, 2, 3, 5)
+
+	z, err := ParseZsync(bytes.NewReader(control))
+	assert.Ok(t, err)
+	assert.Equals(t, "image.iso", z.Filename)
+	assert.Equals(t, time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), z.MTime.UTC())
+	assert.Equals(t, int64(10000), z.Length)
+	assert.Equals(t, 1024, z.BlockSize)
+	assert.Equals(t, []string{"image.iso"}, z.URLs)
+	assert.Equals(t, fmt.Sprintf("%x", sha1.Sum(data)), z.SHA1)
+	assert.Equals(t, 10, len(z.rsums))
+	assert.Cond(t, z.matchesBlock(1, data[1024:2048]), "block checksums do not match")
+
+	_, err = ParseZsync(bytes.NewReader(control[:len(control)-1]))
+	assert.Cond(t, err != nil, "truncated block checksums should be rejected")
+
+	_, err = ParseZsync(strings.NewReader("zsync: 0.6.2\nLength: 10\n\n"))
+	assert.Cond(t, err != nil, "control files without block size should be rejected")
+}
+
+func TestFetchZsync(t *testing.T) {
+	destDir, err := ioutil.TempDir(os.TempDir(), "zsync")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	data, old := newVersions(1 << 20)
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	var served int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/releases/image.iso":
+			http.ServeContent(countingWriter{w, &served}, r, "", modTime, bytes.NewReader(data))
+		case "/releases/image.iso.zsync":
+			w.Write(zsyncmake(data, "image.iso", 2048, 2, 2, 5))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(destDir, "image.iso"), old, 0640))
+
+	gf := New(WithDestDir(destDir), WithConcurrency(4))
+	progressCh := make(chan ProgressReport)
+	last := make(chan ProgressReport)
+	go func() {
+		var report ProgressReport
+		for report = range progressCh {
+		}
+		last <- report
+	}()
+	result, err := gf.FetchZsync(context.Background(), ts.URL+"/releases/image.iso.zsync", progressCh)
+	assert.Ok(t, err)
+	defer result.File.Close()
+
+	// The blocks copied from the older version are reported as resumed.
+	report := <-last
+	assert.Equals(t, int64(len(data)), report.Downloaded)
+	assert.Cond(t, report.ResumedBytes > int64(len(data))-40000, "expected copied blocks to be reported, got %d bytes", report.ResumedBytes)
+
+	got, err := ioutil.ReadAll(result.File)
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(data, got), "updated file does not match")
+	assert.Equals(t, filepath.Join(destDir, "image.iso"), result.File.Name())
+	// Only the blocks that changed, and the bytes missing at the end, are downloaded.
+	assert.Cond(t, atomic.LoadInt64(&served) < 40000, "expected only changed blocks to be downloaded, got %d bytes", served)
+
+	// Without older version, the whole file is downloaded.
+	assert.Ok(t, os.Remove(result.File.Name()))
+	atomic.StoreInt64(&served, 0)
+	result, err = gf.FetchZsync(context.Background(), ts.URL+"/releases/image.iso.zsync", nil)
+	assert.Ok(t, err)
+	result.File.Close()
+	assert.Equals(t, int64(len(data)), atomic.LoadInt64(&served))
+}
+
+func TestDeltaUpdates(t *testing.T) {
+	destDir, err := ioutil.TempDir(os.TempDir(), "delta-updates")
+	assert.Ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	data, old := newVersions(1 << 20)
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	var served int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/image.iso", "/other.iso":
+			http.ServeContent(countingWriter{w, &served}, r, "", modTime, bytes.NewReader(data))
+		case "/image.iso.zsync":
+			w.Write(zsyncmake(data, "image.iso", 4096, 1, 4, 16))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	destFile := filepath.Join(destDir, "image.iso")
+	assert.Ok(t, ioutil.WriteFile(destFile, old, 0640))
+
+	gf := New(WithDestDir(destDir), WithConcurrency(2), WithDeltaUpdates())
+	file, err := gf.Fetch(ts.URL+"/image.iso", nil)
+	assert.Ok(t, err)
+	defer file.Close()
+
+	got, err := ioutil.ReadAll(file)
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Equal(data, got), "updated file does not match")
+	assert.Cond(t, atomic.LoadInt64(&served) < 50000, "expected only changed blocks to be downloaded, got %d bytes", served)
+
+	// Content without control file is downloaded as a whole.
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(destDir, "other.iso"), old, 0640))
+	atomic.StoreInt64(&served, 0)
+	file, err = gf.Fetch(ts.URL+"/other.iso", nil)
+	assert.Ok(t, err)
+	file.Close()
+	assert.Equals(t, int64(len(data)), atomic.LoadInt64(&served))
+}